@@ -0,0 +1,509 @@
+package config
+
+import (
+	"bifrost/maxim"
+	"bifrost/modal_proxy"
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of Bifrost. It is read from a YAML file on top of the defaults,
+// then overridden by the environment variables and the command line flags.
+type Config struct {
+	Server        ServerConfig           `yaml:"server"`
+	HTTPClient    HTTPClientConfig       `yaml:"httpClient"`
+	Providers     ProvidersConfig        `yaml:"providers"`
+	Accounts      AccountsConfig         `yaml:"accounts"`
+	Routes        []RouteConfig          `yaml:"routes"`
+	Models        map[string]ModelConfig `yaml:"models"`
+	ModelRoutes   []ModelRouteConfig     `yaml:"modelRoutes"`
+	Fallback      FallbackConfig         `yaml:"fallback"`
+	Retry         RetryConfig            `yaml:"retry"`
+	Keys          KeysConfig             `yaml:"keys"`
+	ResponseCache ResponseCacheConfig    `yaml:"responseCache"`
+	SemanticCache SemanticCacheConfig    `yaml:"semanticCache"`
+	Limits        LimitsConfig           `yaml:"limits"`
+	Budgets       BudgetsConfig          `yaml:"budgets"`
+	RequestLog    RequestLogConfig       `yaml:"requestLog"`
+	Reload        ReloadConfig           `yaml:"reload"`
+}
+
+// ServerConfig is the listener of the proxy.
+type ServerConfig struct {
+	Host        string        `yaml:"host"`
+	Port        int           `yaml:"port"`
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// ReadTimeout and WriteTimeout bound reading a request and writing its response, zero does not
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	// BodyLimit is the largest request body accepted, in bytes
+	BodyLimit int `yaml:"bodyLimit"`
+	// AdminApiKey is the bearer token of the /admin routes, they are disabled when it is empty
+	AdminApiKey string `yaml:"adminApiKey"`
+}
+
+// Address is the address the proxy listens on.
+func (sc ServerConfig) Address() string {
+	return fmt.Sprintf("%s:%d", sc.Host, sc.Port)
+}
+
+// HTTPClientConfig is the HTTP client of the requests to the providers and the Maxim API.
+type HTTPClientConfig struct {
+	Timeout             time.Duration `yaml:"timeout"`
+	IdleConnTimeout     time.Duration `yaml:"idleConnTimeout"`
+	MaxIdleConns        int           `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int           `yaml:"maxConnsPerHost"`
+}
+
+// Client creates the HTTP client.
+func (hc HTTPClientConfig) Client() *http.Client {
+	return &http.Client{
+		Timeout: hc.Timeout,
+		Transport: &http.Transport{
+			MaxIdleConns:        hc.MaxIdleConns,
+			IdleConnTimeout:     hc.IdleConnTimeout,
+			MaxConnsPerHost:     hc.MaxConnsPerHost,
+			MaxIdleConnsPerHost: hc.MaxIdleConnsPerHost,
+		},
+	}
+}
+
+// ProvidersConfig is where the requests to each provider are sent.
+type ProvidersConfig struct {
+	OpenAI    ProviderConfig `yaml:"openai"`
+	Anthropic ProviderConfig `yaml:"anthropic"`
+	Azure     ProviderConfig `yaml:"azure"`
+}
+
+// ProviderConfig configures a provider, the base URLs of Azure are those of the deployments of
+// the accounts and its ApiVersion is the only setting it takes.
+type ProviderConfig struct {
+	BaseUrl    string `yaml:"baseUrl,omitempty"`
+	ApiVersion string `yaml:"apiVersion,omitempty"`
+}
+
+// AccountsConfig is where the provider accounts of the Maxim API keys are read from: the
+// accounts file when File is set, the Maxim API otherwise.
+type AccountsConfig struct {
+	File string `yaml:"file"`
+	// FilePollInterval is how often the accounts file is checked for changes, 0 never
+	FilePollInterval time.Duration `yaml:"filePollInterval"`
+	MaximBaseUrl     string        `yaml:"maximBaseUrl"`
+	TTL              time.Duration `yaml:"ttl"`
+	StaleTTL         time.Duration `yaml:"staleTtl"`
+	NegativeTTL      time.Duration `yaml:"negativeTtl"`
+}
+
+// ResolverConfig is the configuration of the resolver of the accounts from the Maxim API.
+func (ac AccountsConfig) ResolverConfig() maxim.AccountResolverConfig {
+	return maxim.AccountResolverConfig{TTL: ac.TTL, StaleTTL: ac.StaleTTL, NegativeTTL: ac.NegativeTTL}
+}
+
+// RouteConfig proxies Path to ApiPath of Provider.
+type RouteConfig struct {
+	Path          string `yaml:"path"`
+	Provider      string `yaml:"provider"`
+	ApiPath       string `yaml:"apiPath"`
+	ResponseCache bool   `yaml:"responseCache,omitempty"`
+	SemanticCache bool   `yaml:"semanticCache,omitempty"`
+	// Retry overrides settings of the retry policy for the route
+	Retry *RetryOverride `yaml:"retry,omitempty"`
+}
+
+// ModelConfig configures the requests for a model.
+type ModelConfig struct {
+	// Fallbacks are the provider/model targets tried in order when the provider of the route fails
+	Fallbacks []string `yaml:"fallbacks,omitempty"`
+	// Price overrides the default price of the model
+	Price *PriceConfig `yaml:"price,omitempty"`
+	// Limits are the limits of each Maxim API key for the model
+	Limits *LimitsConfig `yaml:"limits,omitempty"`
+}
+
+// ModelRouteConfig resolves the requests matching Match to Target, the first route which matches
+// a request applies.
+type ModelRouteConfig struct {
+	Match ModelMatchConfig `yaml:"match"`
+	// Target is the provider/model serving the requests, or the provider alone to keep the
+	// requested model
+	Target string `yaml:"target,omitempty"`
+	// Split splits the requests between several targets instead of Target
+	Split *ModelSplitConfig `yaml:"split,omitempty"`
+}
+
+// ModelSplitConfig splits the requests of a model route between arms by weight. The requests with
+// the same StickyHeader, or else the same user, are assigned the same arm.
+type ModelSplitConfig struct {
+	// Experiment names the split in the request log
+	Experiment   string           `yaml:"experiment"`
+	StickyHeader string           `yaml:"stickyHeader,omitempty"`
+	Arms         []ModelArmConfig `yaml:"arms"`
+}
+
+// ModelArmConfig is an arm of a split, its Target is written as the Target of a model route.
+type ModelArmConfig struct {
+	// Name names the arm in the request log, its target when empty
+	Name   string  `yaml:"name,omitempty"`
+	Weight float64 `yaml:"weight"`
+	Target string  `yaml:"target"`
+}
+
+// ModelMatchConfig are the globs a request must match, where * matches any text and ? a single
+// character. Unset globs match every request.
+type ModelMatchConfig struct {
+	Model  string `yaml:"model,omitempty"`
+	Route  string `yaml:"route,omitempty"`
+	Tenant string `yaml:"tenant,omitempty"`
+	// Headers match request headers and Attributes top-level fields of the request body
+	Headers    map[string]string `yaml:"headers,omitempty"`
+	Attributes map[string]string `yaml:"attributes,omitempty"`
+}
+
+// PriceConfig is the price of a model in USD per million tokens.
+type PriceConfig struct {
+	Input       float64 `yaml:"input"`
+	CachedInput float64 `yaml:"cachedInput,omitempty"`
+	Output      float64 `yaml:"output"`
+}
+
+// FallbackConfig configures the fallback chains of the models.
+type FallbackConfig struct {
+	// Timeout bounds the wait for a provider before falling back, zero waits as long as the client
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// RetryConfig is the retry policy of the routes.
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"maxAttempts"`
+	BaseBackoff time.Duration `yaml:"baseBackoff"`
+	MaxBackoff  time.Duration `yaml:"maxBackoff"`
+	Jitter      float64       `yaml:"jitter"`
+	Deadline    time.Duration `yaml:"deadline"`
+}
+
+// Policy is the retry policy.
+func (rc RetryConfig) Policy() modal_proxy.RetryPolicy {
+	return modal_proxy.RetryPolicy{
+		MaxAttempts: rc.MaxAttempts,
+		BaseBackoff: rc.BaseBackoff,
+		MaxBackoff:  rc.MaxBackoff,
+		Jitter:      rc.Jitter,
+		Deadline:    rc.Deadline,
+	}
+}
+
+// RetryOverride overrides the settings of a retry policy which are set.
+type RetryOverride struct {
+	MaxAttempts *int           `yaml:"maxAttempts,omitempty"`
+	BaseBackoff *time.Duration `yaml:"baseBackoff,omitempty"`
+	MaxBackoff  *time.Duration `yaml:"maxBackoff,omitempty"`
+	Jitter      *float64       `yaml:"jitter,omitempty"`
+	Deadline    *time.Duration `yaml:"deadline,omitempty"`
+}
+
+// apply returns retry with the settings of the override.
+func (ro *RetryOverride) apply(retry RetryConfig) RetryConfig {
+	if ro == nil {
+		return retry
+	}
+	if ro.MaxAttempts != nil {
+		retry.MaxAttempts = *ro.MaxAttempts
+	}
+	if ro.BaseBackoff != nil {
+		retry.BaseBackoff = *ro.BaseBackoff
+	}
+	if ro.MaxBackoff != nil {
+		retry.MaxBackoff = *ro.MaxBackoff
+	}
+	if ro.Jitter != nil {
+		retry.Jitter = *ro.Jitter
+	}
+	if ro.Deadline != nil {
+		retry.Deadline = *ro.Deadline
+	}
+	return retry
+}
+
+// KeysConfig is how the providers pick their keys.
+type KeysConfig struct {
+	Strategy          string        `yaml:"strategy"`
+	RateLimitCooldown time.Duration `yaml:"rateLimitCooldown"`
+	AuthCooldown      time.Duration `yaml:"authCooldown"`
+	RateLimitReserve  float64       `yaml:"rateLimitReserve"`
+	MaxQueueWait      time.Duration `yaml:"maxQueueWait"`
+}
+
+// KeyPoolConfig is the configuration of the key pools.
+func (kc KeysConfig) KeyPoolConfig() modal_proxy.KeyPoolConfig {
+	return modal_proxy.KeyPoolConfig{
+		Strategy:          modal_proxy.KeyStrategy(kc.Strategy),
+		RateLimitCooldown: kc.RateLimitCooldown,
+		AuthCooldown:      kc.AuthCooldown,
+		RateLimitReserve:  kc.RateLimitReserve,
+		MaxQueueWait:      kc.MaxQueueWait,
+	}
+}
+
+// ResponseCacheConfig is the exact match response cache, enabled by route.
+type ResponseCacheConfig struct {
+	Size int `yaml:"size"`
+	// Policy is the eviction policy, lru or lfu
+	Policy string `yaml:"policy"`
+}
+
+// SemanticCacheConfig is the semantic cache, enabled by route. It is only available when
+// OpenAIApiKey is set to embed the prompts.
+type SemanticCacheConfig struct {
+	OpenAIApiKey   string `yaml:"openaiApiKey"`
+	EmbeddingModel string `yaml:"embeddingModel"`
+	// ChromaUrl is the Chroma server storing the prompts, they are kept in memory when empty
+	ChromaUrl string `yaml:"chromaUrl"`
+	// Index is the in-memory index of the prompts, exact or hnsw
+	Index      string  `yaml:"index"`
+	Threshold  float64 `yaml:"threshold"`
+	Size       int     `yaml:"size"`
+	FullPrompt bool    `yaml:"fullPrompt"`
+}
+
+// LimitsConfig caps the requests of each Maxim API key, zero leaves a limit unset.
+type LimitsConfig struct {
+	RequestsPerMinute  int `yaml:"requestsPerMinute,omitempty"`
+	TokensPerMinute    int `yaml:"tokensPerMinute,omitempty"`
+	ConcurrentRequests int `yaml:"concurrentRequests,omitempty"`
+}
+
+// BudgetsConfig caps the spend of each Maxim API key.
+type BudgetsConfig struct {
+	// Timezone is the timezone of the calendar days and months of the budgets
+	Timezone string `yaml:"timezone"`
+	// StateFile keeps the spend of the current periods across restarts
+	StateFile  string        `yaml:"stateFile"`
+	WebhookUrl string        `yaml:"webhookUrl"`
+	Limits     []BudgetLimit `yaml:"limits"`
+}
+
+// BudgetLimit is a budget of every Maxim API key over a period, daily or monthly.
+type BudgetLimit struct {
+	Period      string  `yaml:"period"`
+	ModelFamily string  `yaml:"modelFamily,omitempty"`
+	SoftLimit   float64 `yaml:"softLimit,omitempty"`
+	HardLimit   float64 `yaml:"hardLimit,omitempty"`
+}
+
+// RequestLogConfig is the request log, it is enabled when File is set.
+type RequestLogConfig struct {
+	File       string `yaml:"file"`
+	MaxSize    int64  `yaml:"maxSize"`
+	MaxBackups int    `yaml:"maxBackups"`
+	Bodies     bool   `yaml:"bodies"`
+}
+
+// ReloadConfig is how often the configuration file is checked for changes, zero only reloads it
+// on SIGHUP.
+type ReloadConfig struct {
+	PollInterval time.Duration `yaml:"pollInterval"`
+}
+
+// DefaultRoutes are the routes proxied when the configuration does not list any.
+var DefaultRoutes = []RouteConfig{
+	{Path: "/v1/chat/completions", Provider: modal_proxy.ProviderOpenAI, ApiPath: "/v1/chat/completions"},
+	// The Python client adds the v1 prefix itself
+	{Path: "/chat/completions", Provider: modal_proxy.ProviderOpenAI, ApiPath: "/v1/chat/completions"},
+	// llamaindex uses the completions API
+	{Path: "/completions", Provider: modal_proxy.ProviderOpenAI, ApiPath: "/v1/completions"},
+	{Path: "/azure/v1/chat/completions", Provider: modal_proxy.ProviderAzure, ApiPath: "/v1/chat/completions"},
+	{Path: "/azure/chat/completions", Provider: modal_proxy.ProviderAzure, ApiPath: "/v1/chat/completions"},
+	{Path: "/azure/v1/completions", Provider: modal_proxy.ProviderAzure, ApiPath: "/v1/completions"},
+	{Path: "/azure/completions", Provider: modal_proxy.ProviderAzure, ApiPath: "/v1/completions"},
+	{Path: "/v1/messages", Provider: modal_proxy.ProviderAnthropic, ApiPath: "/v1/messages"},
+}
+
+// Default returns the configuration Bifrost runs with when nothing is configured.
+func Default() *Config {
+	retry := modal_proxy.DefaultRetryPolicy
+	keys := modal_proxy.DefaultKeyPoolConfig
+	return &Config{
+		Server: ServerConfig{
+			Port:        3000,
+			IdleTimeout: 5 * time.Second,
+			BodyLimit:   4 * 1024 * 1024,
+		},
+		HTTPClient: HTTPClientConfig{
+			Timeout:             2 * time.Minute,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 10,
+			MaxConnsPerHost:     100,
+		},
+		Providers: ProvidersConfig{
+			OpenAI:    ProviderConfig{BaseUrl: "https://api.openai.com"},
+			Anthropic: ProviderConfig{BaseUrl: "https://api.anthropic.com"},
+			Azure:     ProviderConfig{ApiVersion: modal_proxy.AzureApiVersion},
+		},
+		Accounts: AccountsConfig{
+			FilePollInterval: 5 * time.Second,
+			TTL:              maxim.DefaultAccountResolverConfig.TTL,
+			StaleTTL:         maxim.DefaultAccountResolverConfig.StaleTTL,
+			NegativeTTL:      maxim.DefaultAccountResolverConfig.NegativeTTL,
+		},
+		Routes: append([]RouteConfig(nil), DefaultRoutes...),
+		Retry: RetryConfig{
+			MaxAttempts: retry.MaxAttempts,
+			BaseBackoff: retry.BaseBackoff,
+			MaxBackoff:  retry.MaxBackoff,
+			Jitter:      retry.Jitter,
+			Deadline:    retry.Deadline,
+		},
+		Keys: KeysConfig{
+			Strategy:          string(keys.Strategy),
+			RateLimitCooldown: keys.RateLimitCooldown,
+			AuthCooldown:      keys.AuthCooldown,
+			RateLimitReserve:  keys.RateLimitReserve,
+			MaxQueueWait:      keys.MaxQueueWait,
+		},
+		ResponseCache: ResponseCacheConfig{Size: 1000, Policy: "lru"},
+		SemanticCache: SemanticCacheConfig{
+			EmbeddingModel: "text-embedding-3-small",
+			Index:          "exact",
+			Threshold:      0.05,
+			Size:           1000,
+		},
+		Budgets: BudgetsConfig{
+			Timezone:  "UTC",
+			StateFile: "bifrost-budgets.json",
+		},
+		RequestLog: RequestLogConfig{MaxSize: 100 << 20, MaxBackups: 5},
+		Reload:     ReloadConfig{PollInterval: 5 * time.Second},
+	}
+}
+
+// Load reads the configuration file at path on top of the defaults, the defaults are returned
+// when path is empty. Unknown settings are rejected.
+func Load(path string) (*Config, error) {
+	config := Default()
+	if path == "" {
+		return config, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// RetryPolicy is the retry policy of route.
+func (c *Config) RetryPolicy(route RouteConfig) modal_proxy.RetryPolicy {
+	return route.Retry.apply(c.Retry).Policy()
+}
+
+// FallbackChains are the fallback chains of the models, Validate checks their targets.
+func (c *Config) FallbackChains() map[string][]modal_proxy.FallbackTarget {
+	chains := make(map[string][]modal_proxy.FallbackTarget)
+	for model, modelConfig := range c.Models {
+		for _, target := range modelConfig.Fallbacks {
+			provider, targetModel, _ := strings.Cut(target, "/")
+			chains[model] = append(chains[model], modal_proxy.FallbackTarget{Provider: provider, Model: targetModel})
+		}
+	}
+	return chains
+}
+
+// ModelRouteTable is the table of the model router, Validate checks the targets.
+func (c *Config) ModelRouteTable() []modal_proxy.ModelRoute {
+	routes := make([]modal_proxy.ModelRoute, len(c.ModelRoutes))
+	for i, route := range c.ModelRoutes {
+		routes[i] = modal_proxy.ModelRoute{
+			Model:      route.Match.Model,
+			Route:      route.Match.Route,
+			Tenant:     route.Match.Tenant,
+			Headers:    route.Match.Headers,
+			Attributes: route.Match.Attributes,
+			Target:     modelTarget(route.Target),
+		}
+		if split := route.Split; split != nil {
+			routes[i].Split = &modal_proxy.ModelSplit{Experiment: split.Experiment, StickyHeader: split.StickyHeader}
+			for _, arm := range split.Arms {
+				routes[i].Split.Arms = append(routes[i].Split.Arms, modal_proxy.ModelArm{Name: arm.Name, Weight: arm.Weight, Target: modelTarget(arm.Target)})
+			}
+		}
+	}
+	return routes
+}
+
+// modelTarget is the target of a model route written as provider/model or provider.
+func modelTarget(target string) modal_proxy.FallbackTarget {
+	provider, model, _ := strings.Cut(target, "/")
+	return modal_proxy.FallbackTarget{Provider: provider, Model: model}
+}
+
+// PriceTable is the default price table with the prices of the models.
+func (c *Config) PriceTable() modal_proxy.PriceTable {
+	prices := make(modal_proxy.PriceTable, len(modal_proxy.DefaultPriceTable)+len(c.Models))
+	for model, price := range modal_proxy.DefaultPriceTable {
+		prices[model] = price
+	}
+	for model, modelConfig := range c.Models {
+		if price := modelConfig.Price; price != nil {
+			prices[model] = modal_proxy.ModelPrice{Input: price.Input, CachedInput: price.CachedInput, Output: price.Output}
+		}
+	}
+	return prices
+}
+
+// TenantLimits are the limits of each Maxim API key, with the limits of the models.
+func (c *Config) TenantLimits() maxim.Limits {
+	limits := c.Limits.limits()
+	for model, modelConfig := range c.Models {
+		if modelConfig.Limits != nil {
+			if limits.Models == nil {
+				limits.Models = make(map[string]maxim.Limits)
+			}
+			limits.Models[model] = modelConfig.Limits.limits()
+		}
+	}
+	return limits
+}
+
+func (lc LimitsConfig) limits() maxim.Limits {
+	return maxim.Limits{
+		RequestsPerMinute:  lc.RequestsPerMinute,
+		TokensPerMinute:    lc.TokensPerMinute,
+		ConcurrentRequests: lc.ConcurrentRequests,
+	}
+}
+
+// BudgetConfig is the configuration of the budget tracker, Validate checks the timezone.
+func (bc BudgetsConfig) BudgetConfig() (modal_proxy.BudgetConfig, error) {
+	location, err := time.LoadLocation(bc.Timezone)
+	if err != nil {
+		return modal_proxy.BudgetConfig{}, err
+	}
+	budgets := make([]maxim.Budget, len(bc.Limits))
+	for i, limit := range bc.Limits {
+		budgets[i] = maxim.Budget{Period: limit.Period, ModelFamily: limit.ModelFamily, SoftLimit: limit.SoftLimit, HardLimit: limit.HardLimit}
+	}
+	return modal_proxy.BudgetConfig{
+		Budgets:    budgets,
+		Location:   location,
+		StateFile:  bc.StateFile,
+		WebhookUrl: bc.WebhookUrl,
+	}, nil
+}
+
+// RequestLogConfig is the configuration of the request logger.
+func (rc RequestLogConfig) RequestLogConfig() modal_proxy.RequestLogConfig {
+	return modal_proxy.RequestLogConfig{Path: rc.File, MaxSize: rc.MaxSize, MaxBackups: rc.MaxBackups, Bodies: rc.Bodies}
+}
@@ -0,0 +1,272 @@
+package config
+
+import (
+	"bifrost/modal_proxy"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes content to a configuration file of the test.
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "bifrost.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testMaximBaseUrl is the Maxim API of the tests, Bifrost has no default one.
+const testMaximBaseUrl = "https://maxim.example.com"
+
+// envLookup looks up the variables of env.
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestDefault(t *testing.T) {
+	config := Default()
+	// The accounts are either read from a file or from a Maxim API which must be configured
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "accounts.maximBaseUrl: is required") {
+		t.Errorf("expected the Maxim API to be required, got %v", err)
+	}
+	config.Accounts.MaximBaseUrl = testMaximBaseUrl
+	if err := config.Validate(); err != nil {
+		t.Fatalf("the default configuration is invalid: %v", err)
+	}
+	if config.Server.Address() != ":3000" {
+		t.Errorf("expected the proxy to listen on :3000, got %s", config.Server.Address())
+	}
+	if len(config.Routes) != len(DefaultRoutes) {
+		t.Errorf("expected %d routes, got %d", len(DefaultRoutes), len(config.Routes))
+	}
+	if config.RetryPolicy(config.Routes[0]) != modal_proxy.DefaultRetryPolicy {
+		t.Errorf("expected the default retry policy, got %+v", config.RetryPolicy(config.Routes[0]))
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+server:
+  port: 8080
+  idleTimeout: 30s
+providers:
+  openai:
+    baseUrl: http://localhost:9000
+accounts:
+  maximBaseUrl: https://maxim.example.com
+routes:
+  - path: /v1/chat/completions
+    provider: openai
+    apiPath: /v1/chat/completions
+    responseCache: true
+    retry:
+      maxAttempts: 5
+      deadline: 2m
+models:
+  gpt-4o:
+    fallbacks: [azure/gpt-4o, anthropic/claude-3-5-sonnet]
+    price: {input: 2, output: 8}
+    limits: {requestsPerMinute: 10}
+modelRoutes:
+  - match: {model: fast}
+    target: openai/gpt-4o-mini
+  - match:
+      model: claude-*
+      headers: {x-team: research}
+    target: anthropic
+  - match: {model: gpt-4o}
+    split:
+      experiment: mini-trial
+      stickyHeader: x-conversation-id
+      arms:
+        - {name: control, weight: 90, target: openai/gpt-4o}
+        - {weight: 10, target: openai/gpt-4o-mini}
+budgets:
+  limits:
+    - period: monthly
+      hardLimit: 100
+`)
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Server.Port != 8080 || config.Server.IdleTimeout != 30*time.Second {
+		t.Errorf("unexpected server %+v", config.Server)
+	}
+	// Settings the file leaves out keep their defaults
+	if config.Providers.Anthropic.BaseUrl != "https://api.anthropic.com" {
+		t.Errorf("expected the default Anthropic base URL, got %s", config.Providers.Anthropic.BaseUrl)
+	}
+	if len(config.Routes) != 1 || !config.Routes[0].ResponseCache {
+		t.Errorf("unexpected routes %+v", config.Routes)
+	}
+	retry := config.RetryPolicy(config.Routes[0])
+	if retry.MaxAttempts != 5 || retry.Deadline != 2*time.Minute || retry.BaseBackoff != modal_proxy.DefaultRetryPolicy.BaseBackoff {
+		t.Errorf("unexpected retry policy %+v", retry)
+	}
+	chain := config.FallbackChains()["gpt-4o"]
+	if len(chain) != 2 || chain[1] != (modal_proxy.FallbackTarget{Provider: "anthropic", Model: "claude-3-5-sonnet"}) {
+		t.Errorf("unexpected fallback chain %v", chain)
+	}
+	modelRoutes := config.ModelRouteTable()
+	if len(modelRoutes) != 3 || modelRoutes[0].Target != (modal_proxy.FallbackTarget{Provider: "openai", Model: "gpt-4o-mini"}) ||
+		modelRoutes[1].Headers["x-team"] != "research" || modelRoutes[1].Target != (modal_proxy.FallbackTarget{Provider: "anthropic"}) {
+		t.Errorf("unexpected model routes %+v", modelRoutes)
+	}
+	if split := modelRoutes[2].Split; split == nil || split.Experiment != "mini-trial" || len(split.Arms) != 2 ||
+		split.Arms[1] != (modal_proxy.ModelArm{Weight: 10, Target: modal_proxy.FallbackTarget{Provider: "openai", Model: "gpt-4o-mini"}}) {
+		t.Errorf("unexpected split %+v", modelRoutes[2].Split)
+	}
+	prices := config.PriceTable()
+	if prices["gpt-4o"].Output != 8 || prices["gpt-4o-mini"] != modal_proxy.DefaultPriceTable["gpt-4o-mini"] {
+		t.Errorf("unexpected prices %+v", prices)
+	}
+	if limits := config.TenantLimits(); limits.Models["gpt-4o"].RequestsPerMinute != 10 {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+	budgetConfig, err := config.Budgets.BudgetConfig()
+	if err != nil || len(budgetConfig.Budgets) != 1 || budgetConfig.Budgets[0].HardLimit != 100 {
+		t.Errorf("unexpected budgets %+v, %v", budgetConfig, err)
+	}
+}
+
+func TestLoadUnknownSetting(t *testing.T) {
+	_, err := Load(writeConfig(t, "server:\n  prot: 8080\n"))
+	if err == nil || !strings.Contains(err.Error(), "field prot not found") {
+		t.Errorf("expected the unknown setting to be rejected, got %v", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	config := Default()
+	err := config.ApplyEnv(envLookup(map[string]string{
+		"BIFROST_PORT":                  "4000",
+		"BIFROST_HTTP_TIMEOUT":          "30s",
+		"MAXIM_BASE_URL":                testMaximBaseUrl,
+		"BIFROST_RESPONSE_CACHE_ROUTES": "/v1/messages",
+		"BIFROST_RETRY_ROUTES":          "/v1/messages=max_attempts:1",
+		"BIFROST_FALLBACK_CHAINS":       "gpt-4o=azure/gpt-4o",
+		"BIFROST_MODEL_ROUTES":          "fast=openai/gpt-4o-mini;claude-*=anthropic",
+		"BIFROST_PRICES":                "my-finetune=input:3,output:12",
+		"BIFROST_TENANT_MODEL_LIMITS":   "gpt-4o=rpm:5",
+		"BIFROST_BUDGETS":               "daily=hard:50",
+		"BIFROST_REQUEST_LOG_FILE":      "",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Server.Port != 4000 || config.HTTPClient.Timeout != 30*time.Second {
+		t.Errorf("unexpected overrides %+v %+v", config.Server, config.HTTPClient)
+	}
+	messages := config.route("/v1/messages")
+	if !messages.ResponseCache || config.route("/v1/chat/completions").ResponseCache {
+		t.Error("expected the response cache on /v1/messages only")
+	}
+	if config.RetryPolicy(*messages).MaxAttempts != 1 {
+		t.Errorf("unexpected retry policy %+v", config.RetryPolicy(*messages))
+	}
+	model := config.Models["gpt-4o"]
+	if len(model.Fallbacks) != 1 || model.Fallbacks[0] != "azure/gpt-4o" || model.Limits.RequestsPerMinute != 5 {
+		t.Errorf("unexpected gpt-4o %+v", model)
+	}
+	if len(config.ModelRoutes) != 2 || config.ModelRoutes[0].Target != "openai/gpt-4o-mini" || config.ModelRoutes[1].Target != "anthropic" {
+		t.Errorf("unexpected model routes %+v", config.ModelRoutes)
+	}
+	if config.PriceTable()["my-finetune"].Output != 12 {
+		t.Errorf("unexpected prices %+v", config.PriceTable()["my-finetune"])
+	}
+	if len(config.Budgets.Limits) != 1 || config.Budgets.Limits[0].Period != "daily" {
+		t.Errorf("unexpected budgets %+v", config.Budgets.Limits)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	err := Default().ApplyEnv(envLookup(map[string]string{
+		"BIFROST_PORT":         "http",
+		"BIFROST_RETRY_JITTER": "lots",
+		"BIFROST_RETRY_ROUTES": "/unknown=max_attempts:1",
+	}))
+	if err == nil {
+		t.Fatal("expected the invalid variables to be rejected")
+	}
+	for _, key := range []string{"BIFROST_PORT", "BIFROST_RETRY_JITTER", `unknown route "/unknown"`} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("expected an error about %s, got %v", key, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	config := Default()
+	config.Server.Port = 0
+	config.Routes = append(config.Routes, RouteConfig{Path: "/v1/messages", Provider: "bedrock", ApiPath: "/v1/embeddings"})
+	config.Models = map[string]ModelConfig{"gpt-4o": {Fallbacks: []string{"gpt-4o-mini"}}}
+	config.ModelRoutes = []ModelRouteConfig{
+		{Match: ModelMatchConfig{Model: "fast"}, Target: "mistral/large"},
+		{Match: ModelMatchConfig{Model: "gpt-4o"}, Split: &ModelSplitConfig{Arms: []ModelArmConfig{
+			{Target: "openai/gpt-4o"},
+			{Target: "openai/gpt-4o"},
+		}}},
+	}
+	config.Keys.RateLimitReserve = 2
+	config.ResponseCache.Policy = "fifo"
+	config.Budgets.Timezone = "Mars/Olympus"
+	config.Budgets.Limits = []BudgetLimit{{Period: "daily", SoftLimit: 20, HardLimit: 10}}
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("expected the configuration to be invalid")
+	}
+	for _, problem := range []string{
+		"server.port: must be between 1 and 65535",
+		`routes[8].path: duplicate route "/v1/messages"`,
+		`routes[8].provider: unknown provider "bedrock"`,
+		`routes[8].apiPath: unknown API "/v1/embeddings"`,
+		`models[gpt-4o].fallbacks[0]: invalid target "gpt-4o-mini"`,
+		`modelRoutes[0].target: unknown provider "mistral"`,
+		"modelRoutes[1].split.experiment: is required",
+		`modelRoutes[1].split.arms[1].name: duplicate arm "openai/gpt-4o"`,
+		"modelRoutes[1].split.arms: at least one arm must have a weight",
+		"keys.rateLimitReserve: must be between 0 and 1",
+		`responseCache.policy: unknown policy "fifo"`,
+		"budgets.timezone:",
+		"budgets.limits[0].softLimit: must not exceed the hard limit 10",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q in %v", problem, err)
+		}
+	}
+}
+
+func TestFlags(t *testing.T) {
+	path := writeConfig(t, "server:\n  host: 127.0.0.1\n  port: 8080\n")
+	set := flag.NewFlagSet("bifrost", flag.ContinueOnError)
+	flags := NewFlags(set)
+	if err := set.Parse([]string{"-config", path, "-port", "9090"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := flags.LoadWithOverrides(envLookup(map[string]string{
+		"BIFROST_PORT":   "4000",
+		"BIFROST_HOST":   "0.0.0.0",
+		"MAXIM_BASE_URL": testMaximBaseUrl,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The flags override the environment, which overrides the file
+	if config.Server.Address() != "0.0.0.0:9090" {
+		t.Errorf("expected 0.0.0.0:9090, got %s", config.Server.Address())
+	}
+}
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"bifrost/modal_proxy"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApplyEnv overrides the configuration with the environment variables found by lookup, empty
+// variables are ignored. Invalid values are reported together.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	env := envReader{lookup: lookup}
+
+	env.string("BIFROST_HOST", &c.Server.Host)
+	env.int("BIFROST_PORT", &c.Server.Port)
+	env.duration("BIFROST_IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	env.int("BIFROST_BODY_LIMIT", &c.Server.BodyLimit)
+	env.string("BIFROST_ADMIN_API_KEY", &c.Server.AdminApiKey)
+
+	env.duration("BIFROST_HTTP_TIMEOUT", &c.HTTPClient.Timeout)
+
+	env.string("BIFROST_OPENAI_BASE_URL", &c.Providers.OpenAI.BaseUrl)
+	env.string("BIFROST_ANTHROPIC_BASE_URL", &c.Providers.Anthropic.BaseUrl)
+	env.string("BIFROST_AZURE_API_VERSION", &c.Providers.Azure.ApiVersion)
+
+	env.string("BIFROST_ACCOUNTS_FILE", &c.Accounts.File)
+	env.duration("BIFROST_ACCOUNTS_FILE_POLL_INTERVAL", &c.Accounts.FilePollInterval)
+	env.string("MAXIM_BASE_URL", &c.Accounts.MaximBaseUrl)
+	env.duration("MAXIM_ACCOUNT_TTL", &c.Accounts.TTL)
+	env.duration("MAXIM_ACCOUNT_STALE_TTL", &c.Accounts.StaleTTL)
+	env.duration("MAXIM_ACCOUNT_NEGATIVE_TTL", &c.Accounts.NegativeTTL)
+
+	env.duration("BIFROST_FALLBACK_TIMEOUT", &c.Fallback.Timeout)
+
+	env.int("BIFROST_RETRY_MAX_ATTEMPTS", &c.Retry.MaxAttempts)
+	env.duration("BIFROST_RETRY_BASE_BACKOFF", &c.Retry.BaseBackoff)
+	env.duration("BIFROST_RETRY_MAX_BACKOFF", &c.Retry.MaxBackoff)
+	env.float("BIFROST_RETRY_JITTER", &c.Retry.Jitter)
+	env.duration("BIFROST_RETRY_DEADLINE", &c.Retry.Deadline)
+
+	env.string("BIFROST_KEY_STRATEGY", &c.Keys.Strategy)
+	env.duration("BIFROST_KEY_RATE_LIMIT_COOLDOWN", &c.Keys.RateLimitCooldown)
+	env.duration("BIFROST_KEY_AUTH_COOLDOWN", &c.Keys.AuthCooldown)
+	env.float("BIFROST_KEY_RATE_LIMIT_RESERVE", &c.Keys.RateLimitReserve)
+	env.duration("BIFROST_KEY_MAX_QUEUE_WAIT", &c.Keys.MaxQueueWait)
+
+	env.int("BIFROST_RESPONSE_CACHE_SIZE", &c.ResponseCache.Size)
+	env.string("BIFROST_RESPONSE_CACHE_POLICY", &c.ResponseCache.Policy)
+
+	env.string("BIFROST_SEMANTIC_CACHE_OPENAI_API_KEY", &c.SemanticCache.OpenAIApiKey)
+	env.string("BIFROST_SEMANTIC_CACHE_EMBEDDING_MODEL", &c.SemanticCache.EmbeddingModel)
+	env.string("BIFROST_SEMANTIC_CACHE_CHROMA_URL", &c.SemanticCache.ChromaUrl)
+	env.string("BIFROST_SEMANTIC_CACHE_INDEX", &c.SemanticCache.Index)
+	env.float("BIFROST_SEMANTIC_CACHE_THRESHOLD", &c.SemanticCache.Threshold)
+	env.int("BIFROST_SEMANTIC_CACHE_SIZE", &c.SemanticCache.Size)
+	env.bool("BIFROST_SEMANTIC_CACHE_FULL_PROMPT", &c.SemanticCache.FullPrompt)
+
+	env.int("BIFROST_TENANT_RPM", &c.Limits.RequestsPerMinute)
+	env.int("BIFROST_TENANT_TPM", &c.Limits.TokensPerMinute)
+	env.int("BIFROST_TENANT_CONCURRENCY", &c.Limits.ConcurrentRequests)
+
+	env.string("BIFROST_BUDGET_TIMEZONE", &c.Budgets.Timezone)
+	env.string("BIFROST_BUDGET_STATE_FILE", &c.Budgets.StateFile)
+	env.string("BIFROST_BUDGET_WEBHOOK_URL", &c.Budgets.WebhookUrl)
+
+	env.string("BIFROST_REQUEST_LOG_FILE", &c.RequestLog.File)
+	env.int64("BIFROST_REQUEST_LOG_MAX_SIZE", &c.RequestLog.MaxSize)
+	env.int("BIFROST_REQUEST_LOG_MAX_BACKUPS", &c.RequestLog.MaxBackups)
+	env.bool("BIFROST_REQUEST_LOG_BODIES", &c.RequestLog.Bodies)
+
+	env.duration("BIFROST_CONFIG_POLL_INTERVAL", &c.Reload.PollInterval)
+
+	// The routes with a cache enabled and the settings of the models are written in the specs of
+	// their variables
+	if routes, ok := env.get("BIFROST_RESPONSE_CACHE_ROUTES"); ok {
+		c.enableRoutes(routes, func(route *RouteConfig, enabled bool) { route.ResponseCache = enabled })
+	}
+	if routes, ok := env.get("BIFROST_SEMANTIC_CACHE_ROUTES"); ok {
+		c.enableRoutes(routes, func(route *RouteConfig, enabled bool) { route.SemanticCache = enabled })
+	}
+	if spec, ok := env.get("BIFROST_RETRY_ROUTES"); ok {
+		policies, err := modal_proxy.ParseRetryPolicies(spec, c.Retry.Policy())
+		env.check("BIFROST_RETRY_ROUTES", err)
+		for path, policy := range policies {
+			route := c.route(path)
+			if route == nil {
+				env.check("BIFROST_RETRY_ROUTES", fmt.Errorf("unknown route %q", path))
+				continue
+			}
+			route.Retry = &RetryOverride{
+				MaxAttempts: &policy.MaxAttempts,
+				BaseBackoff: &policy.BaseBackoff,
+				MaxBackoff:  &policy.MaxBackoff,
+				Jitter:      &policy.Jitter,
+				Deadline:    &policy.Deadline,
+			}
+		}
+	}
+	if spec, ok := env.get("BIFROST_FALLBACK_CHAINS"); ok {
+		chains, err := modal_proxy.ParseFallbackChains(spec)
+		env.check("BIFROST_FALLBACK_CHAINS", err)
+		for model, targets := range chains {
+			c.updateModel(model, func(modelConfig *ModelConfig) {
+				modelConfig.Fallbacks = nil
+				for _, target := range targets {
+					modelConfig.Fallbacks = append(modelConfig.Fallbacks, target.String())
+				}
+			})
+		}
+	}
+	if spec, ok := env.get("BIFROST_MODEL_ROUTES"); ok {
+		routes, err := modal_proxy.ParseModelRoutes(spec)
+		env.check("BIFROST_MODEL_ROUTES", err)
+		c.ModelRoutes = nil
+		for _, route := range routes {
+			c.ModelRoutes = append(c.ModelRoutes, ModelRouteConfig{
+				Match:  ModelMatchConfig{Model: route.Model},
+				Target: strings.TrimSuffix(route.Target.String(), "/"),
+			})
+		}
+	}
+	if spec, ok := env.get("BIFROST_PRICES"); ok {
+		prices, err := modal_proxy.ParsePriceTable(spec, nil)
+		env.check("BIFROST_PRICES", err)
+		for model, price := range prices {
+			c.updateModel(model, func(modelConfig *ModelConfig) {
+				modelConfig.Price = &PriceConfig{Input: price.Input, CachedInput: price.CachedInput, Output: price.Output}
+			})
+		}
+	}
+	if spec, ok := env.get("BIFROST_TENANT_MODEL_LIMITS"); ok {
+		models, err := modal_proxy.ParseTenantModelLimits(spec)
+		env.check("BIFROST_TENANT_MODEL_LIMITS", err)
+		for model, limits := range models {
+			c.updateModel(model, func(modelConfig *ModelConfig) {
+				modelConfig.Limits = &LimitsConfig{
+					RequestsPerMinute:  limits.RequestsPerMinute,
+					TokensPerMinute:    limits.TokensPerMinute,
+					ConcurrentRequests: limits.ConcurrentRequests,
+				}
+			})
+		}
+	}
+	if spec, ok := env.get("BIFROST_BUDGETS"); ok {
+		budgets, err := modal_proxy.ParseBudgets(spec)
+		env.check("BIFROST_BUDGETS", err)
+		c.Budgets.Limits = nil
+		for _, budget := range budgets {
+			c.Budgets.Limits = append(c.Budgets.Limits, BudgetLimit{
+				Period:      budget.Period,
+				ModelFamily: budget.ModelFamily,
+				SoftLimit:   budget.SoftLimit,
+				HardLimit:   budget.HardLimit,
+			})
+		}
+	}
+	return errors.Join(env.errs...)
+}
+
+// route returns the route at path, nil when there is none.
+func (c *Config) route(path string) *RouteConfig {
+	for i := range c.Routes {
+		if c.Routes[i].Path == path {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+// enableRoutes sets the routes in the comma separated list routes, and unsets the others.
+func (c *Config) enableRoutes(routes string, set func(route *RouteConfig, enabled bool)) {
+	enabled := make(map[string]bool)
+	for _, path := range strings.Split(routes, ",") {
+		enabled[strings.TrimSpace(path)] = true
+	}
+	for i := range c.Routes {
+		set(&c.Routes[i], enabled[c.Routes[i].Path])
+	}
+}
+
+// updateModel updates the configuration of model.
+func (c *Config) updateModel(model string, update func(modelConfig *ModelConfig)) {
+	if c.Models == nil {
+		c.Models = make(map[string]ModelConfig)
+	}
+	modelConfig := c.Models[model]
+	update(&modelConfig)
+	c.Models[model] = modelConfig
+}
+
+// envReader reads the environment variables into the configuration, collecting the errors.
+type envReader struct {
+	lookup func(string) (string, bool)
+	errs   []error
+}
+
+func (er *envReader) get(key string) (string, bool) {
+	value, ok := er.lookup(key)
+	if !ok || value == "" {
+		return "", false
+	}
+	return value, true
+}
+
+func (er *envReader) check(key string, err error) {
+	if err != nil {
+		er.errs = append(er.errs, fmt.Errorf("invalid %s: %w", key, err))
+	}
+}
+
+func (er *envReader) string(key string, value *string) {
+	if env, ok := er.get(key); ok {
+		*value = env
+	}
+}
+
+func (er *envReader) int(key string, value *int) {
+	if env, ok := er.get(key); ok {
+		parsed, err := strconv.Atoi(env)
+		er.check(key, err)
+		if err == nil {
+			*value = parsed
+		}
+	}
+}
+
+func (er *envReader) int64(key string, value *int64) {
+	if env, ok := er.get(key); ok {
+		parsed, err := strconv.ParseInt(env, 10, 64)
+		er.check(key, err)
+		if err == nil {
+			*value = parsed
+		}
+	}
+}
+
+func (er *envReader) float(key string, value *float64) {
+	if env, ok := er.get(key); ok {
+		parsed, err := strconv.ParseFloat(env, 64)
+		er.check(key, err)
+		if err == nil {
+			*value = parsed
+		}
+	}
+}
+
+func (er *envReader) bool(key string, value *bool) {
+	if env, ok := er.get(key); ok {
+		parsed, err := strconv.ParseBool(env)
+		er.check(key, err)
+		if err == nil {
+			*value = parsed
+		}
+	}
+}
+
+func (er *envReader) duration(key string, value *time.Duration) {
+	if env, ok := er.get(key); ok {
+		parsed, err := time.ParseDuration(env)
+		er.check(key, err)
+		if err == nil {
+			*value = parsed
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"flag"
+	"time"
+)
+
+// Flags are the command line flags of Bifrost, they override the configuration file and the
+// environment variables.
+type Flags struct {
+	set *flag.FlagSet
+	// ConfigFile is the path of the configuration file
+	ConfigFile     string
+	host           string
+	port           int
+	idleTimeout    time.Duration
+	accountsFile   string
+	maximBaseUrl   string
+	requestLogFile string
+}
+
+// NewFlags defines the flags of Bifrost on set.
+func NewFlags(set *flag.FlagSet) *Flags {
+	f := &Flags{set: set}
+	set.StringVar(&f.ConfigFile, "config", "", "path of the YAML configuration file, BIFROST_CONFIG when unset")
+	set.StringVar(&f.host, "host", "", "host the proxy listens on")
+	set.IntVar(&f.port, "port", 0, "port the proxy listens on")
+	set.DurationVar(&f.idleTimeout, "idle-timeout", 0, "timeout of the idle client connections")
+	set.StringVar(&f.accountsFile, "accounts-file", "", "file the provider accounts are read from instead of the Maxim API")
+	set.StringVar(&f.maximBaseUrl, "maxim-base-url", "", "base URL of the Maxim API")
+	set.StringVar(&f.requestLogFile, "request-log-file", "", "file the proxied requests are logged to")
+	return f
+}
+
+// Apply overrides the configuration with the flags set on the command line.
+func (f *Flags) Apply(c *Config) {
+	f.set.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "host":
+			c.Server.Host = f.host
+		case "port":
+			c.Server.Port = f.port
+		case "idle-timeout":
+			c.Server.IdleTimeout = f.idleTimeout
+		case "accounts-file":
+			c.Accounts.File = f.accountsFile
+		case "maxim-base-url":
+			c.Accounts.MaximBaseUrl = f.maximBaseUrl
+		case "request-log-file":
+			c.RequestLog.File = f.requestLogFile
+		}
+	})
+}
+
+// Path returns the path of the configuration file set by the flags or BIFROST_CONFIG, empty when
+// there is none.
+func (f *Flags) Path(lookup func(string) (string, bool)) string {
+	if f.ConfigFile != "" {
+		return f.ConfigFile
+	}
+	path, _ := lookup("BIFROST_CONFIG")
+	return path
+}
+
+// LoadWithOverrides loads the configuration file set by the flags or BIFROST_CONFIG, applies the
+// environment variables found by lookup and the flags, and validates the result.
+func (f *Flags) LoadWithOverrides(lookup func(string) (string, bool)) (*Config, error) {
+	config, err := Load(f.Path(lookup))
+	if err != nil {
+		return nil, err
+	}
+	if err := config.ApplyEnv(lookup); err != nil {
+		return nil, err
+	}
+	f.Apply(config)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
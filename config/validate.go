@@ -0,0 +1,225 @@
+package config
+
+import (
+	"bifrost/modal_proxy"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiPaths are the provider APIs the routes can proxy to.
+var apiPaths = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/messages":         true,
+}
+
+// providers are the providers the routes and the fallback chains can send requests to.
+var providers = map[string]bool{
+	modal_proxy.ProviderOpenAI:    true,
+	modal_proxy.ProviderAzure:     true,
+	modal_proxy.ProviderAnthropic: true,
+}
+
+// Validate checks the configuration, the errors name the setting they are about.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.check(c.Server.Port >= 1 && c.Server.Port <= 65535, "server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	v.nonNegative("server.idleTimeout", c.Server.IdleTimeout)
+	v.nonNegative("server.readTimeout", c.Server.ReadTimeout)
+	v.nonNegative("server.writeTimeout", c.Server.WriteTimeout)
+	v.check(c.Server.BodyLimit >= 0, "server.bodyLimit", "must not be negative")
+
+	v.nonNegative("httpClient.timeout", c.HTTPClient.Timeout)
+	v.nonNegative("httpClient.idleConnTimeout", c.HTTPClient.IdleConnTimeout)
+	v.check(c.HTTPClient.MaxIdleConns >= 0, "httpClient.maxIdleConns", "must not be negative")
+	v.check(c.HTTPClient.MaxIdleConnsPerHost >= 0, "httpClient.maxIdleConnsPerHost", "must not be negative")
+	v.check(c.HTTPClient.MaxConnsPerHost >= 0, "httpClient.maxConnsPerHost", "must not be negative")
+
+	v.url("providers.openai.baseUrl", c.Providers.OpenAI.BaseUrl, true)
+	v.url("providers.anthropic.baseUrl", c.Providers.Anthropic.BaseUrl, true)
+	v.check(c.Providers.Azure.ApiVersion != "", "providers.azure.apiVersion", "is required")
+
+	if c.Accounts.File != "" {
+		if _, err := os.Stat(c.Accounts.File); err != nil {
+			v.add("accounts.file", "%v", err)
+		}
+		v.check(c.Accounts.FilePollInterval >= 0, "accounts.filePollInterval", "must not be negative")
+	} else {
+		v.check(c.Accounts.MaximBaseUrl != "", "accounts.maximBaseUrl", "is required when accounts.file is not set")
+		v.url("accounts.maximBaseUrl", c.Accounts.MaximBaseUrl, false)
+	}
+	v.nonNegative("accounts.ttl", c.Accounts.TTL)
+	v.nonNegative("accounts.staleTtl", c.Accounts.StaleTTL)
+	v.nonNegative("accounts.negativeTtl", c.Accounts.NegativeTTL)
+
+	v.check(len(c.Routes) > 0, "routes", "at least one route is required")
+	paths := make(map[string]bool)
+	for i, route := range c.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		if !strings.HasPrefix(route.Path, "/") {
+			v.add(field+".path", "must start with /, got %q", route.Path)
+		} else if paths[route.Path] {
+			v.add(field+".path", "duplicate route %q", route.Path)
+		}
+		paths[route.Path] = true
+		v.check(providers[route.Provider], field+".provider", "unknown provider %q, expected openai, azure or anthropic", route.Provider)
+		v.check(apiPaths[route.ApiPath], field+".apiPath", "unknown API %q, expected /v1/chat/completions, /v1/completions or /v1/messages", route.ApiPath)
+		if route.Retry != nil {
+			v.retry(field+".retry", route.Retry.apply(c.Retry))
+		}
+	}
+
+	models := make([]string, 0, len(c.Models))
+	for model := range c.Models {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	for _, model := range models {
+		modelConfig := c.Models[model]
+		field := fmt.Sprintf("models[%s]", model)
+		for i, target := range modelConfig.Fallbacks {
+			provider, targetModel, ok := strings.Cut(target, "/")
+			if !ok || targetModel == "" {
+				v.add(fmt.Sprintf("%s.fallbacks[%d]", field, i), "invalid target %q, expected provider/model", target)
+			} else if !providers[provider] {
+				v.add(fmt.Sprintf("%s.fallbacks[%d]", field, i), "unknown provider %q", provider)
+			}
+		}
+		if price := modelConfig.Price; price != nil {
+			v.check(price.Input >= 0 && price.CachedInput >= 0 && price.Output >= 0, field+".price", "must not be negative")
+		}
+		if limits := modelConfig.Limits; limits != nil {
+			v.limits(field+".limits", *limits)
+		}
+	}
+	for i, route := range c.ModelRoutes {
+		field := fmt.Sprintf("modelRoutes[%d]", i)
+		if route.Split == nil {
+			v.modelTarget(field+".target", route.Target)
+			continue
+		}
+		v.check(route.Target == "", field, "must set either target or split")
+		v.check(route.Split.Experiment != "", field+".split.experiment", "is required")
+		v.check(len(route.Split.Arms) > 0, field+".split.arms", "at least one arm is required")
+		var total float64
+		arms := make(map[string]bool)
+		for j, arm := range route.Split.Arms {
+			armField := fmt.Sprintf("%s.split.arms[%d]", field, j)
+			v.modelTarget(armField+".target", arm.Target)
+			v.check(arm.Weight >= 0, armField+".weight", "must not be negative")
+			total += arm.Weight
+			name := arm.Name
+			if name == "" {
+				name = modelTarget(arm.Target).String()
+			}
+			v.check(!arms[name], armField+".name", "duplicate arm %q", name)
+			arms[name] = true
+		}
+		v.check(len(route.Split.Arms) == 0 || total > 0, field+".split.arms", "at least one arm must have a weight")
+	}
+	v.nonNegative("fallback.timeout", c.Fallback.Timeout)
+	v.retry("retry", c.Retry)
+
+	switch modal_proxy.KeyStrategy(c.Keys.Strategy) {
+	case modal_proxy.WeightedRoundRobin, modal_proxy.LeastInFlight:
+	default:
+		v.add("keys.strategy", "unknown strategy %q, expected %s or %s", c.Keys.Strategy, modal_proxy.WeightedRoundRobin, modal_proxy.LeastInFlight)
+	}
+	v.nonNegative("keys.rateLimitCooldown", c.Keys.RateLimitCooldown)
+	v.nonNegative("keys.authCooldown", c.Keys.AuthCooldown)
+	v.fraction("keys.rateLimitReserve", c.Keys.RateLimitReserve)
+	v.nonNegative("keys.maxQueueWait", c.Keys.MaxQueueWait)
+
+	v.check(c.ResponseCache.Size > 0, "responseCache.size", "must be positive, got %d", c.ResponseCache.Size)
+	v.check(c.ResponseCache.Policy == "lru" || c.ResponseCache.Policy == "lfu", "responseCache.policy",
+		"unknown policy %q, expected lru or lfu", c.ResponseCache.Policy)
+
+	v.check(c.SemanticCache.Size > 0, "semanticCache.size", "must be positive, got %d", c.SemanticCache.Size)
+	v.check(c.SemanticCache.Index == "exact" || c.SemanticCache.Index == "hnsw", "semanticCache.index",
+		"unknown index %q, expected exact or hnsw", c.SemanticCache.Index)
+	v.check(c.SemanticCache.Threshold >= 0, "semanticCache.threshold", "must not be negative")
+	v.url("semanticCache.chromaUrl", c.SemanticCache.ChromaUrl, false)
+
+	v.limits("limits", c.Limits)
+
+	if _, err := time.LoadLocation(c.Budgets.Timezone); err != nil {
+		v.add("budgets.timezone", "%v", err)
+	}
+	v.url("budgets.webhookUrl", c.Budgets.WebhookUrl, false)
+	for i, limit := range c.Budgets.Limits {
+		field := fmt.Sprintf("budgets.limits[%d]", i)
+		v.check(limit.Period == "daily" || limit.Period == "monthly", field+".period",
+			"unknown period %q, expected daily or monthly", limit.Period)
+		v.check(limit.SoftLimit >= 0 && limit.HardLimit >= 0, field, "limits must not be negative")
+		v.check(limit.SoftLimit <= limit.HardLimit || limit.HardLimit == 0, field+".softLimit",
+			"must not exceed the hard limit %g", limit.HardLimit)
+	}
+
+	v.check(c.RequestLog.MaxSize >= 0, "requestLog.maxSize", "must not be negative")
+	v.check(c.RequestLog.MaxBackups >= 0, "requestLog.maxBackups", "must not be negative")
+
+	v.nonNegative("reload.pollInterval", c.Reload.PollInterval)
+
+	return errors.Join(v.errs...)
+}
+
+// validator collects the problems of a configuration.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) add(field string, format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) check(ok bool, field string, format string, args ...any) {
+	if !ok {
+		v.add(field, format, args...)
+	}
+}
+
+func (v *validator) nonNegative(field string, duration time.Duration) {
+	v.check(duration >= 0, field, "must not be negative, got %s", duration)
+}
+
+func (v *validator) fraction(field string, value float64) {
+	v.check(value >= 0 && value <= 1, field, "must be between 0 and 1, got %g", value)
+}
+
+// url checks that value is an absolute http or https URL, it may only be empty when not required.
+func (v *validator) url(field string, value string, required bool) {
+	if value == "" {
+		v.check(!required, field, "is required")
+		return
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		v.add(field, "must be an http or https URL, got %q", value)
+	}
+}
+
+// modelTarget checks the target of a model route, written as provider/model or provider.
+func (v *validator) modelTarget(field string, target string) {
+	provider := modelTarget(target).Provider
+	v.check(providers[provider], field, "unknown provider %q, expected openai, azure or anthropic", provider)
+}
+
+func (v *validator) retry(field string, retry RetryConfig) {
+	v.check(retry.MaxAttempts >= 0, field+".maxAttempts", "must not be negative, got %d", retry.MaxAttempts)
+	v.nonNegative(field+".baseBackoff", retry.BaseBackoff)
+	v.nonNegative(field+".maxBackoff", retry.MaxBackoff)
+	v.fraction(field+".jitter", retry.Jitter)
+	v.nonNegative(field+".deadline", retry.Deadline)
+}
+
+func (v *validator) limits(field string, limits LimitsConfig) {
+	v.check(limits.RequestsPerMinute >= 0, field+".requestsPerMinute", "must not be negative")
+	v.check(limits.TokensPerMinute >= 0, field+".tokensPerMinute", "must not be negative")
+	v.check(limits.ConcurrentRequests >= 0, field+".concurrentRequests", "must not be negative")
+}
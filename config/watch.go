@@ -0,0 +1,168 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watcher reloads the configuration when its file changes, or when Reload is called on SIGHUP.
+// The configuration is only applied once it is loaded and valid, otherwise the error is logged
+// and the previous configuration is kept, as it is when it can not be applied.
+type Watcher struct {
+	path  string
+	load  func() (*Config, error)
+	apply func(config *Config) error
+
+	mu       sync.Mutex
+	started  *Config
+	current  *Config
+	modTime  time.Time
+	size     int64
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewWatcher watches the configuration file at path, config being the configuration the process
+// started with. load loads the configuration again and apply switches to it, or returns why it
+// can not without changing anything.
+func NewWatcher(path string, config *Config, load func() (*Config, error), apply func(config *Config) error) *Watcher {
+	w := &Watcher{
+		path:    path,
+		load:    load,
+		apply:   apply,
+		started: config,
+		current: config,
+		stop:    make(chan struct{}),
+	}
+	w.modTime, w.size = w.stat()
+	return w
+}
+
+// Config returns the configuration applied last.
+func (w *Watcher) Config() *Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Reload loads the configuration and applies it, an invalid configuration is not applied and
+// the configuration applied last is kept when the new one can not be applied.
+func (w *Watcher) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// A broken file is reported once, not at every poll
+	w.modTime, w.size = w.stat()
+	config, err := w.load()
+	if err != nil {
+		return err
+	}
+	if sections := config.RestartRequired(w.started); len(sections) > 0 {
+		fmt.Printf("Restart bifrost to apply the changes to %s\n", strings.Join(sections, ", "))
+	}
+	if err := w.apply(config); err != nil {
+		return err
+	}
+	w.current = config
+	return nil
+}
+
+// Watch polls the configuration file every interval and reloads it when it changes, until Close
+// is called. Nothing is watched without a file or an interval.
+func (w *Watcher) Watch(interval time.Duration) {
+	if w.path == "" || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				if !w.changed() {
+					continue
+				}
+				w.reload(w.path + " changed")
+			}
+		}
+	}()
+}
+
+// ReloadOn reloads the configuration each time a value is sent on signals, until Close is called.
+func (w *Watcher) ReloadOn(signals <-chan os.Signal) {
+	go func() {
+		for {
+			select {
+			case <-w.stop:
+				return
+			case sig := <-signals:
+				w.reload(sig.String())
+			}
+		}
+	}()
+}
+
+// reload reloads the configuration and logs the outcome, cause being why it is reloaded.
+func (w *Watcher) reload(cause string) {
+	if err := w.Reload(); err != nil {
+		fmt.Printf("Error reloading the configuration on %s, keeping the previous one:\n%v\n", cause, err)
+		return
+	}
+	fmt.Printf("Reloaded the configuration on %s\n", cause)
+}
+
+// Close stops watching the configuration.
+func (w *Watcher) Close() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *Watcher) stat() (time.Time, int64) {
+	if w.path == "" {
+		return time.Time{}, 0
+	}
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return info.ModTime(), info.Size()
+}
+
+func (w *Watcher) changed() bool {
+	modTime, size := w.stat()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !modTime.Equal(w.modTime) || size != w.size
+}
+
+// RestartRequired returns the settings which differ from running, the configuration the process
+// started with, and are only read at startup.
+func (c *Config) RestartRequired(running *Config) []string {
+	var sections []string
+	for _, section := range []struct {
+		name             string
+		value, startedAs any
+	}{
+		{"server", c.Server, running.Server},
+		{"httpClient", c.HTTPClient, running.HTTPClient},
+		{"accounts", c.Accounts, running.Accounts},
+		{"responseCache", c.ResponseCache, running.ResponseCache},
+		{"semanticCache", c.SemanticCache, running.SemanticCache},
+		{"budgets.timezone", c.Budgets.Timezone, running.Budgets.Timezone},
+		{"budgets.stateFile", c.Budgets.StateFile, running.Budgets.StateFile},
+		{"budgets.webhookUrl", c.Budgets.WebhookUrl, running.Budgets.WebhookUrl},
+		{"requestLog", c.RequestLog, running.RequestLog},
+		{"reload", c.Reload, running.Reload},
+	} {
+		if !reflect.DeepEqual(section.value, section.startedAs) {
+			sections = append(sections, section.name)
+		}
+	}
+	return sections
+}
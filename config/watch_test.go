@@ -0,0 +1,140 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestWatcher watches the configuration file at path, the configurations it applies are
+// stored in applied.
+func newTestWatcher(t *testing.T, path string, applied *atomic.Pointer[Config]) *Watcher {
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied.Store(config)
+	load := func() (*Config, error) {
+		config, err := Load(path)
+		if err != nil {
+			return nil, err
+		}
+		config.Accounts.MaximBaseUrl = testMaximBaseUrl
+		return config, config.Validate()
+	}
+	return NewWatcher(path, config, load, func(config *Config) error {
+		applied.Store(config)
+		return nil
+	})
+}
+
+func TestWatcherReload(t *testing.T) {
+	path := writeConfig(t, "retry:\n  maxAttempts: 2\n")
+	var applied atomic.Pointer[Config]
+	watcher := newTestWatcher(t, path, &applied)
+
+	if err := os.WriteFile(path, []byte("retry:\n  maxAttempts: 5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if applied.Load().Retry.MaxAttempts != 5 || watcher.Config() != applied.Load() {
+		t.Errorf("expected the reloaded configuration, got %+v", applied.Load().Retry)
+	}
+
+	// An invalid configuration keeps the previous one
+	if err := os.WriteFile(path, []byte("retry:\n  maxAttempts: -1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.Reload(); err == nil {
+		t.Error("expected the invalid configuration to be rejected")
+	}
+	if applied.Load().Retry.MaxAttempts != 5 || watcher.Config().Retry.MaxAttempts != 5 {
+		t.Errorf("expected the previous configuration, got %+v", applied.Load().Retry)
+	}
+}
+
+func TestWatcherApplyError(t *testing.T) {
+	path := writeConfig(t, "retry:\n  maxAttempts: 2\n")
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := NewWatcher(path, config, func() (*Config, error) {
+		return Load(path)
+	}, func(config *Config) error {
+		if config.Retry.MaxAttempts == 3 {
+			return errors.New("can not apply 3 attempts")
+		}
+		return nil
+	})
+
+	if err := os.WriteFile(path, []byte("retry:\n  maxAttempts: 3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.Reload(); err == nil {
+		t.Error("expected the configuration which can not be applied to be rejected")
+	}
+	if watcher.Config() != config {
+		t.Errorf("expected the previous configuration, got %+v", watcher.Config().Retry)
+	}
+}
+
+func TestWatcherWatch(t *testing.T) {
+	path := writeConfig(t, "retry:\n  maxAttempts: 2\n")
+	var applied atomic.Pointer[Config]
+	watcher := newTestWatcher(t, path, &applied)
+	watcher.Watch(5 * time.Millisecond)
+	defer watcher.Close()
+
+	if err := os.WriteFile(path, []byte("retry:\n  maxAttempts: 10\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && applied.Load().Retry.MaxAttempts != 10 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if applied.Load().Retry.MaxAttempts != 10 {
+		t.Errorf("expected the changed file to be reloaded, got %+v", applied.Load().Retry)
+	}
+}
+
+func TestWatcherReloadOn(t *testing.T) {
+	path := writeConfig(t, "retry:\n  maxAttempts: 2\n")
+	var applied atomic.Pointer[Config]
+	watcher := newTestWatcher(t, path, &applied)
+	signals := make(chan os.Signal)
+	watcher.ReloadOn(signals)
+	defer watcher.Close()
+
+	if err := os.WriteFile(path, []byte("retry:\n  maxAttempts: 4\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	signals <- syscall.SIGHUP
+	// The second signal is only received once the first one was handled
+	signals <- syscall.SIGHUP
+	if applied.Load().Retry.MaxAttempts != 4 {
+		t.Errorf("expected the configuration to be reloaded on SIGHUP, got %+v", applied.Load().Retry)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	running := Default()
+	config := Default()
+	config.Routes = config.Routes[:1]
+	config.Retry.MaxAttempts = 1
+	config.Server.Port = 8080
+	config.ResponseCache.Size = 10
+	config.Budgets.Timezone = "Europe/Paris"
+	config.Budgets.Limits = []BudgetLimit{{Period: "daily", HardLimit: 10}}
+
+	expected := []string{"server", "responseCache", "budgets.timezone"}
+	if sections := config.RestartRequired(running); !reflect.DeepEqual(sections, expected) {
+		t.Errorf("expected %v, got %v", expected, sections)
+	}
+}
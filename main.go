@@ -1,43 +1,339 @@
 package main
 
 import (
+	"bifrost/cache_storage"
+	"bifrost/config"
+	"bifrost/embedding"
+	"bifrost/maxim"
 	"bifrost/modal_proxy"
+	"bifrost/vector_stores"
+	"context"
+	"crypto/subtle"
+	"flag"
 	"fmt"
 	"github.com/gofiber/fiber/v2"
+	"github.com/openai/openai-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
-const PORT = 3000
+// newAccountSource reads the accounts from the accounts file when it is set, otherwise from the
+// Maxim API.
+func newAccountSource(accounts config.AccountsConfig) (maxim.AccountSource, error) {
+	if accounts.File != "" {
+		fileAccountSource, err := maxim.NewFileAccountSource(accounts.File)
+		if err != nil {
+			return nil, err
+		}
+		fileAccountSource.Watch(accounts.FilePollInterval)
+		return fileAccountSource, nil
+	}
+	maximClient := maxim.NewMaximClient(accounts.MaximBaseUrl)
+	return maxim.NewAccountResolver(maximClient, accounts.ResolverConfig()), nil
+}
+
+// newResponseCache creates the exact match response cache, an lru or an lfu cache depending on
+// its policy.
+func newResponseCache(cacheConfig config.ResponseCacheConfig) *modal_proxy.ResponseCache {
+	if cacheConfig.Policy == "lfu" {
+		return modal_proxy.NewResponseCache(cache_storage.NewLFUCache(cacheConfig.Size))
+	}
+	return modal_proxy.NewResponseCache(cache_storage.NewLRUCache(cacheConfig.Size))
+}
+
+// newSemanticCache creates the semantic cache backed by Chroma when its URL is set, or an
+// in-memory vector store otherwise, searched exactly or with an HNSW index. It is only available
+// when an OpenAI API key is set to embed the prompts.
+func newSemanticCache(cacheConfig config.SemanticCacheConfig) *modal_proxy.SemanticCache {
+	if cacheConfig.OpenAIApiKey == "" {
+		return nil
+	}
+	var store vector_stores.DocumentStoreInterface = vector_stores.NewMemoryVectorStore(vector_stores.Cosine)
+	if cacheConfig.Index == "hnsw" {
+		store = vector_stores.NewHNSWVectorStore(vector_stores.HNSWConfig{Metric: vector_stores.Cosine})
+	}
+	if cacheConfig.ChromaUrl != "" {
+		chromaStore, err := vector_stores.NewChromaVectorStore(context.Background(), vector_stores.ChromaConfig{
+			BaseUrl: cacheConfig.ChromaUrl,
+			Metric:  vector_stores.Cosine,
+		})
+		if err != nil {
+			fmt.Println("Error connecting to Chroma, the semantic cache is disabled:", err)
+			return nil
+		}
+		store = chromaStore
+	}
+	embedder := embedding.NewOpenAIEmbeddings(cacheConfig.OpenAIApiKey, openai.EmbeddingNewParamsModel(cacheConfig.EmbeddingModel))
+	return modal_proxy.NewSemanticCache(embedder, store, modal_proxy.SemanticCacheConfig{
+		Threshold:  cacheConfig.Threshold,
+		FullPrompt: cacheConfig.FullPrompt,
+		Size:       cacheConfig.Size,
+	})
+}
+
+// newBudgetTracker creates the tracker of the spend budgets of the Maxim API keys, priced with pricing.
+func newBudgetTracker(budgets config.BudgetsConfig, pricing *modal_proxy.Pricing, accounts maxim.AccountSource) (*modal_proxy.BudgetTracker, error) {
+	budgetConfig, err := budgets.BudgetConfig()
+	if err != nil {
+		return nil, err
+	}
+	budgetTracker, err := modal_proxy.NewBudgetTracker(budgetConfig, pricing, accounts)
+	if err != nil {
+		return nil, err
+	}
+	budgetTracker.Persist(5 * time.Second)
+	return budgetTracker, nil
+}
+
+// newRequestLogger creates the request log when its file is set, nil otherwise.
+func newRequestLogger(requestLog config.RequestLogConfig) (*modal_proxy.RequestLogger, error) {
+	if requestLog.File == "" {
+		return nil, nil
+	}
+	return modal_proxy.NewRequestLogger(requestLog.RequestLogConfig())
+}
+
+// newTracerProvider exports the traces over OTLP/HTTP to the collector set by the standard
+// OTEL_EXPORTER_OTLP_* environment variables, it returns nil when no endpoint is set.
+func newTracerProvider() (*sdktrace.TracerProvider, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the service name
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", "bifrost")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// adminAuth requires the admin API key as a bearer token.
+func adminAuth(apiKey string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) != 1 {
+			return c.Status(fiber.StatusUnauthorized).SendString("Invalid admin API key")
+		}
+		return c.Next()
+	}
+}
+
+// proxy holds what outlives a configuration: the account source, the key pools, the caches, the
+// usage, the limits, the budgets, the metrics and the request log. The routes are built again from
+// each configuration and swapped in the route table.
+type proxy struct {
+	accounts        maxim.AccountSource
+	keyPools        map[string]*modal_proxy.KeyPool
+	pricing         *modal_proxy.Pricing
+	metrics         *modal_proxy.Metrics
+	usageAccountant *modal_proxy.UsageAccountant
+	tenantLimiter   *modal_proxy.TenantLimiter
+	budgetTracker   *modal_proxy.BudgetTracker
+	responseCache   *modal_proxy.ResponseCache
+	semanticCache   *modal_proxy.SemanticCache
+	requestLogger   *modal_proxy.RequestLogger
+	traced          bool
+	routes          *modal_proxy.RouteTable
+}
+
+// apply switches the proxy to cfg. The requests in flight finish with the routes and the prices
+// they started with. Nothing is changed when cfg can not be applied.
+func (p *proxy) apply(cfg *config.Config) error {
+	budgetConfig, err := cfg.Budgets.BudgetConfig()
+	if err != nil {
+		return err
+	}
+	for _, keyPool := range p.keyPools {
+		keyPool.SetConfig(cfg.Keys.KeyPoolConfig())
+	}
+	p.pricing.SetPrices(cfg.PriceTable())
+	p.budgetTracker.SetBudgets(budgetConfig.Budgets)
+	p.tenantLimiter.SetLimits(cfg.TenantLimits())
+
+	// The providers are created again with the key pools, which keep the health of the keys
+	openAiModalProvider := modal_proxy.NewOpenAIProvider(cfg.Providers.OpenAI.BaseUrl, p.accounts)
+	openAiModalProvider.SetKeyPool(p.keyPools[modal_proxy.ProviderOpenAI])
+	anthropicAiModalProvider := modal_proxy.NewAnthropicModalProvider(cfg.Providers.Anthropic.BaseUrl, p.accounts)
+	anthropicAiModalProvider.SetKeyPool(p.keyPools[modal_proxy.ProviderAnthropic])
+	azureModalProvider := modal_proxy.NewAzureModalProvider(cfg.Providers.Azure.ApiVersion, p.accounts)
+	azureModalProvider.SetKeyPool(p.keyPools[modal_proxy.ProviderAzure])
+	fallbackRouter := modal_proxy.NewFallbackRouter(map[string]modal_proxy.ModalProviderInterface{
+		modal_proxy.ProviderOpenAI:    openAiModalProvider,
+		modal_proxy.ProviderAzure:     azureModalProvider,
+		modal_proxy.ProviderAnthropic: anthropicAiModalProvider,
+	}, modal_proxy.FallbackConfig{
+		Chains:  cfg.FallbackChains(),
+		Timeout: cfg.Fallback.Timeout,
+	})
+	fallbackRouter.SetMetrics(p.metrics)
+	modelRouter := modal_proxy.NewModelRouter(cfg.ModelRouteTable())
+
+	// Each route proxies its path to the API of its provider, behind the budgets, the tenant limits,
+	// the usage accounting and the response and semantic caches, measured, traced and logged to the
+	// request log. The model router resolves the model of the requests before anything else
+	routes := make(map[string]fiber.Handler, len(cfg.Routes))
+	for _, route := range cfg.Routes {
+		handler := p.budgetTracker.Handler(route.Provider, p.tenantLimiter.Handler(route.Provider,
+			p.usageAccountant.Handler(route.Provider, fallbackRouter.Handler(route.Provider, route.ApiPath, cfg.RetryPolicy(route)))))
+		if p.semanticCache != nil {
+			handler = p.semanticCache.Handler(route.SemanticCache, handler)
+		}
+		handler = p.metrics.Handler(route.Path, route.Provider, p.responseCache.Handler(route.ResponseCache, handler))
+		if p.requestLogger != nil {
+			handler = p.requestLogger.Handler(route.Path, route.Provider, handler)
+		}
+		if p.traced {
+			handler = modal_proxy.TracingHandler(route.Path, route.Provider, handler)
+		}
+		routes[route.Path] = modelRouter.Handler(route.Path, handler)
+	}
+	p.routes.Set(routes)
+	return nil
+}
+
+// loadConfig loads the configuration with the flags in args, the errors are printed with the
+// settings they are about.
+func loadConfig(name string, args []string) (*config.Flags, *config.Config, error) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configFlags := config.NewFlags(flags)
+	_ = flags.Parse(args)
+	cfg, err := configFlags.LoadWithOverrides(os.LookupEnv)
+	return configFlags, cfg, err
+}
+
+// validateConfig checks the configuration and exits with 1 when it is invalid.
+func validateConfig(args []string) {
+	if _, _, err := loadConfig("validate-config", args); err != nil {
+		fmt.Println("Invalid configuration:")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Configuration is valid")
+}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		validateConfig(os.Args[2:])
+		return
+	}
+	configFlags, cfg, err := loadConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		fmt.Println("Invalid configuration:")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	// Initialize a new Fiber app
 	app := fiber.New(
 		fiber.Config{
-			Prefork:           false,           // Disable prefork mode (uses multiple Go processes)
-			IdleTimeout:       5 * time.Second, // Timeout for idle connections
-			ReduceMemoryUsage: true,            // Reduces memory usage by freeing up resources more aggressively
+			Prefork:           false,                  // Disable prefork mode (uses multiple Go processes)
+			IdleTimeout:       cfg.Server.IdleTimeout, // Timeout for idle connections
+			ReadTimeout:       cfg.Server.ReadTimeout,
+			WriteTimeout:      cfg.Server.WriteTimeout,
+			BodyLimit:         cfg.Server.BodyLimit,
+			ReduceMemoryUsage: true, // Reduces memory usage by freeing up resources more aggressively
 		})
 
-	openAiModalProvider := modal_proxy.NewOpenAIProvider("https://api.openai.com")
-	anthropicAiModalProvider := modal_proxy.NewAnthropicModalProvider("https://api.anthropic.com")
+	httpClient := cfg.HTTPClient.Client()
+	modal_proxy.SetHTTPClient(httpClient)
+	maxim.SetHTTPClient(httpClient)
 
-	//OpenAI proxy
-	app.Post("/v1/chat/completions", func(ctx *fiber.Ctx) error {
-		return openAiModalProvider.GetCompletion(ctx, "/v1/chat/completions")
-	})
-	//Python client adds the v1 prefix to the endpoint, thus need to not add it here.
-	app.Post("/chat/completions", func(ctx *fiber.Ctx) error {
-		return openAiModalProvider.GetCompletion(ctx, "/v1/chat/completions")
-	})
-	//llamaindex uses completions API
-	app.Post("/completions", func(ctx *fiber.Ctx) error {
-		return openAiModalProvider.GetCompletion(ctx, "/v1/completions")
-	})
-	app.Post("/v1/messages", func(ctx *fiber.Ctx) error {
-		return anthropicAiModalProvider.GetCompletion(ctx, "/v1/messages")
-	})
+	accountSource, err := newAccountSource(cfg.Accounts)
+	if err != nil {
+		fmt.Println("Error loading accounts:", err)
+		os.Exit(1)
+	}
+
+	keyPools := map[string]*modal_proxy.KeyPool{
+		modal_proxy.ProviderOpenAI:    modal_proxy.NewKeyPool(cfg.Keys.KeyPoolConfig()),
+		modal_proxy.ProviderAzure:     modal_proxy.NewKeyPool(cfg.Keys.KeyPoolConfig()),
+		modal_proxy.ProviderAnthropic: modal_proxy.NewKeyPool(cfg.Keys.KeyPoolConfig()),
+	}
+	pricing := modal_proxy.NewPricing(cfg.PriceTable())
+	metrics := modal_proxy.NewMetrics(pricing)
+	metrics.WatchKeyPools(keyPools)
+	usageAccountant := modal_proxy.NewUsageAccountant(pricing, accountSource)
+	budgetTracker, err := newBudgetTracker(cfg.Budgets, pricing, accountSource)
+	if err != nil {
+		fmt.Println("Error setting up the budgets:", err)
+		os.Exit(1)
+	}
+
+	requestLogger, err := newRequestLogger(cfg.RequestLog)
+	if err != nil {
+		fmt.Println("Error opening the request log:", err)
+		os.Exit(1)
+	}
+
+	tracerProvider, err := newTracerProvider()
+	if err != nil {
+		fmt.Println("Error setting up tracing:", err)
+		os.Exit(1)
+	}
+	if tracerProvider != nil {
+		otel.SetTracerProvider(tracerProvider)
+	}
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	bifrost := &proxy{
+		accounts:        accountSource,
+		keyPools:        keyPools,
+		pricing:         pricing,
+		metrics:         metrics,
+		usageAccountant: usageAccountant,
+		tenantLimiter:   modal_proxy.NewTenantLimiter(cfg.TenantLimits(), accountSource),
+		budgetTracker:   budgetTracker,
+		responseCache:   newResponseCache(cfg.ResponseCache),
+		semanticCache:   newSemanticCache(cfg.SemanticCache),
+		requestLogger:   requestLogger,
+		traced:          tracerProvider != nil,
+		routes:          modal_proxy.NewRouteTable(),
+	}
+	if err := bifrost.apply(cfg); err != nil {
+		fmt.Println("Invalid configuration:")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	app.Post("/*", bifrost.routes.Handler())
+
+	// The routes, the fallback chains, the keys, the prices, the limits and the budgets are
+	// reloaded on SIGHUP and when the configuration file changes
+	watcher := config.NewWatcher(configFlags.Path(os.LookupEnv), cfg, func() (*config.Config, error) {
+		return configFlags.LoadWithOverrides(os.LookupEnv)
+	}, bifrost.apply)
+	watcher.Watch(cfg.Reload.PollInterval)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	watcher.ReloadOn(hups)
+	defer watcher.Close()
+
+	app.Get("/metrics", metrics.MetricsHandler())
+
+	// The admin routes expose the usage of every tenant, they are only served behind a key
+	if cfg.Server.AdminApiKey != "" {
+		admin := app.Group("/admin", adminAuth(cfg.Server.AdminApiKey))
+		admin.Get("/keys", modal_proxy.KeyHealthHandler(keyPools))
+		admin.Get("/usage", modal_proxy.UsageHandler(usageAccountant))
+	} else {
+		fmt.Println("The admin routes are disabled, set an admin API key to enable them")
+	}
 
 	// Setup graceful shutdown
 	sigs := make(chan os.Signal, 1)
@@ -52,8 +348,23 @@ func main() {
 		}
 	}()
 
-	fmt.Printf("Starting proxy server on :%d\n", PORT)
-	if err := app.Listen(fmt.Sprintf(":%d", PORT)); err != nil {
+	fmt.Printf("Starting proxy server on %s\n", cfg.Server.Address())
+	if err := app.Listen(cfg.Server.Address()); err != nil {
 		fmt.Println("Error starting server:", err)
 	}
+	if err := budgetTracker.Close(); err != nil {
+		fmt.Println("Error saving the budget state:", err)
+	}
+	if requestLogger != nil {
+		if err := requestLogger.Close(); err != nil {
+			fmt.Println("Error closing the request log:", err)
+		}
+	}
+	if tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			fmt.Println("Error flushing the traces:", err)
+		}
+	}
 }
@@ -0,0 +1,153 @@
+package maxim
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AccountResolverConfig configures how long resolved accounts are cached.
+type AccountResolverConfig struct {
+	// TTL is how long an account is served without refreshing it
+	TTL time.Duration
+	// StaleTTL is how long after TTL an account is still served while it is refreshed in the background
+	StaleTTL time.Duration
+	// NegativeTTL is how long a rejected Maxim API key is remembered
+	NegativeTTL time.Duration
+}
+
+// DefaultAccountResolverConfig is used for the zero fields of the resolver config.
+var DefaultAccountResolverConfig = AccountResolverConfig{
+	TTL:         time.Minute,
+	StaleTTL:    5 * time.Minute,
+	NegativeTTL: 30 * time.Second,
+}
+
+// AccountResolver caches the accounts of each Maxim API key, collapsing concurrent lookups
+// of the same key into a single call to the underlying AccountSource.
+type AccountResolver struct {
+	source AccountSource
+	config AccountResolverConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*accountEntry
+	calls   map[string]*accountCall
+	// sweptAt is when the entries which expired were last dropped
+	sweptAt time.Time
+}
+
+type accountEntry struct {
+	account   AccountsResponse
+	err       error
+	fetchedAt time.Time
+}
+
+// accountCall is an in-flight lookup which concurrent callers wait on.
+type accountCall struct {
+	done    chan struct{}
+	account AccountsResponse
+	err     error
+}
+
+// NewAccountResolver creates a resolver caching the accounts returned by source.
+func NewAccountResolver(source AccountSource, config AccountResolverConfig) *AccountResolver {
+	if config.TTL <= 0 {
+		config.TTL = DefaultAccountResolverConfig.TTL
+	}
+	if config.StaleTTL < 0 {
+		config.StaleTTL = 0
+	}
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = DefaultAccountResolverConfig.NegativeTTL
+	}
+	return &AccountResolver{
+		source:  source,
+		config:  config,
+		now:     time.Now,
+		entries: make(map[string]*accountEntry),
+		calls:   make(map[string]*accountCall),
+	}
+}
+
+// GetAccount returns the accounts of maximApiKey, from the cache when possible.
+func (ar *AccountResolver) GetAccount(maximApiKey string) (AccountsResponse, error) {
+	ar.mu.Lock()
+	ar.sweep()
+	if entry, ok := ar.entries[maximApiKey]; ok {
+		age := ar.now().Sub(entry.fetchedAt)
+		switch {
+		case entry.err != nil && age < ar.config.NegativeTTL:
+			ar.mu.Unlock()
+			return AccountsResponse{}, entry.err
+		case entry.err == nil && age < ar.config.TTL:
+			ar.mu.Unlock()
+			return entry.account, nil
+		case entry.err == nil && age < ar.config.TTL+ar.config.StaleTTL:
+			// Serve the stale account and refresh it in the background
+			ar.startCall(maximApiKey)
+			ar.mu.Unlock()
+			return entry.account, nil
+		}
+	}
+	call := ar.startCall(maximApiKey)
+	ar.mu.Unlock()
+
+	<-call.done
+	return call.account, call.err
+}
+
+// Invalidate drops the cached accounts of maximApiKey.
+func (ar *AccountResolver) Invalidate(maximApiKey string) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	delete(ar.entries, maximApiKey)
+}
+
+// sweep drops the entries which can no longer be served, so the keys which are not used again,
+// invalid ones included, do not pile up. It runs at most once per NegativeTTL, ar.mu must be held
+// by the caller.
+func (ar *AccountResolver) sweep() {
+	now := ar.now()
+	if now.Sub(ar.sweptAt) < ar.config.NegativeTTL {
+		return
+	}
+	ar.sweptAt = now
+	for maximApiKey, entry := range ar.entries {
+		age := now.Sub(entry.fetchedAt)
+		if (entry.err != nil && age >= ar.config.NegativeTTL) || age >= ar.config.TTL+ar.config.StaleTTL {
+			delete(ar.entries, maximApiKey)
+		}
+	}
+}
+
+// startCall returns the in-flight lookup of maximApiKey, starting one if there is none.
+// ar.mu must be held by the caller.
+func (ar *AccountResolver) startCall(maximApiKey string) *accountCall {
+	if call, ok := ar.calls[maximApiKey]; ok {
+		return call
+	}
+	call := &accountCall{done: make(chan struct{})}
+	ar.calls[maximApiKey] = call
+	go ar.doCall(maximApiKey, call)
+	return call
+}
+
+func (ar *AccountResolver) doCall(maximApiKey string, call *accountCall) {
+	call.account, call.err = ar.source.GetAccount(maximApiKey)
+
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	delete(ar.calls, maximApiKey)
+	switch {
+	case call.err == nil:
+		ar.entries[maximApiKey] = &accountEntry{account: call.account, fetchedAt: ar.now()}
+	case errors.Is(call.err, ErrInvalidMaximApiKey):
+		ar.entries[maximApiKey] = &accountEntry{err: call.err, fetchedAt: ar.now()}
+	default:
+		// Keep serving what we have, the lookup is retried on the next request
+		fmt.Printf("Error refreshing Maxim account: %v\n", call.err)
+	}
+	close(call.done)
+}
@@ -0,0 +1,212 @@
+package maxim
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for the resolver.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+}
+
+func newTestResolver(fetch func(string) (AccountsResponse, error)) (*AccountResolver, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	resolver := NewAccountResolver(AccountSourceFunc(fetch), AccountResolverConfig{
+		TTL:         time.Minute,
+		StaleTTL:    time.Minute,
+		NegativeTTL: 10 * time.Second,
+	})
+	resolver.now = clock.Now
+	return resolver, clock
+}
+
+func accountWithName(name string) AccountsResponse {
+	return AccountsResponse{Data: Accounts{Anthropic: []Anthropic{{Name: name}}}}
+}
+
+func TestAccountResolverCachesAccount(t *testing.T) {
+	var calls atomic.Int32
+	resolver, clock := newTestResolver(func(string) (AccountsResponse, error) {
+		calls.Add(1)
+		return accountWithName("cached"), nil
+	})
+
+	for i := 0; i < 3; i++ {
+		account, err := resolver.GetAccount("key")
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if account.Data.Anthropic[0].Name != "cached" {
+			t.Errorf("expected cached account, got %+v", account)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 call to the Maxim API, got %d", calls.Load())
+	}
+
+	// An account older than TTL and StaleTTL is fetched again
+	clock.Advance(3 * time.Minute)
+	if _, err := resolver.GetAccount("key"); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls to the Maxim API, got %d", calls.Load())
+	}
+}
+
+func TestAccountResolverCollapsesConcurrentLookups(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	resolver, _ := newTestResolver(func(string) (AccountsResponse, error) {
+		calls.Add(1)
+		<-release
+		return accountWithName("shared"), nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := resolver.GetAccount("key"); err != nil {
+				t.Errorf("expected no error, but got %v", err)
+			}
+		}()
+	}
+	// Give the goroutines a chance to join the in-flight lookup
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 call to the Maxim API, got %d", calls.Load())
+	}
+}
+
+func TestAccountResolverServesStaleWhileRefreshing(t *testing.T) {
+	var calls atomic.Int32
+	refreshed := make(chan struct{})
+	resolver, clock := newTestResolver(func(string) (AccountsResponse, error) {
+		if calls.Add(1) == 1 {
+			return accountWithName("old"), nil
+		}
+		defer close(refreshed)
+		return accountWithName("new"), nil
+	})
+
+	if _, err := resolver.GetAccount("key"); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	clock.Advance(90 * time.Second)
+
+	account, err := resolver.GetAccount("key")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if account.Data.Anthropic[0].Name != "old" {
+		t.Errorf("expected the stale account, got %+v", account)
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the account to be refreshed in the background")
+	}
+	// Wait for the refreshed account to be stored
+	for i := 0; i < 100; i++ {
+		account, _ = resolver.GetAccount("key")
+		if account.Data.Anthropic[0].Name == "new" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if account.Data.Anthropic[0].Name != "new" {
+		t.Errorf("expected the refreshed account, got %+v", account)
+	}
+}
+
+func TestAccountResolverNegativeCaching(t *testing.T) {
+	var calls atomic.Int32
+	resolver, clock := newTestResolver(func(string) (AccountsResponse, error) {
+		calls.Add(1)
+		return AccountsResponse{}, ErrInvalidMaximApiKey
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := resolver.GetAccount("key"); !errors.Is(err, ErrInvalidMaximApiKey) {
+			t.Fatalf("expected ErrInvalidMaximApiKey, got %v", err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 call to the Maxim API, got %d", calls.Load())
+	}
+
+	clock.Advance(11 * time.Second)
+	resolver.GetAccount("key")
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls to the Maxim API, got %d", calls.Load())
+	}
+}
+
+func TestAccountResolverDoesNotCacheTransientErrors(t *testing.T) {
+	var calls atomic.Int32
+	resolver, _ := newTestResolver(func(string) (AccountsResponse, error) {
+		calls.Add(1)
+		return AccountsResponse{}, errors.New("connection refused")
+	})
+
+	resolver.GetAccount("key")
+	resolver.GetAccount("key")
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls to the Maxim API, got %d", calls.Load())
+	}
+}
+
+func TestAccountResolverDropsExpiredEntries(t *testing.T) {
+	resolver, clock := newTestResolver(func(maximApiKey string) (AccountsResponse, error) {
+		if maximApiKey == "valid" {
+			return accountWithName("valid"), nil
+		}
+		return AccountsResponse{}, ErrInvalidMaximApiKey
+	})
+
+	resolver.GetAccount("valid")
+	for i := 0; i < 100; i++ {
+		resolver.GetAccount(fmt.Sprintf("random-%d", i))
+	}
+	clock.Advance(11 * time.Second)
+	resolver.GetAccount("valid")
+	resolver.mu.Lock()
+	entries := len(resolver.entries)
+	resolver.mu.Unlock()
+	if entries != 1 {
+		t.Errorf("expected the invalid keys to be dropped, got %d entries", entries)
+	}
+
+	clock.Advance(2 * time.Minute)
+	resolver.GetAccount("random-0")
+	resolver.mu.Lock()
+	_, ok := resolver.entries["valid"]
+	resolver.mu.Unlock()
+	if ok {
+		t.Error("expected the expired account to be dropped")
+	}
+}
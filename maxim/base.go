@@ -3,8 +3,10 @@ package maxim
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -23,6 +25,8 @@ type OpenAI struct {
 	APIKey         string           `json:"apiKey"`
 	Name           string           `json:"name"`
 	ModelAvailable []ModelAvailable `json:"modelAvailable"`
+	// Weight is the share of the requests sent with the key, 1 when unset
+	Weight int `json:"weight,omitempty"`
 }
 
 // Struct to represent the 'deploymentIds' field in 'azure'
@@ -37,12 +41,35 @@ type Azure struct {
 	APIKey1       string         `json:"apiKey1"`
 	APIKey2       string         `json:"apiKey2"`
 	DeploymentIds []DeploymentID `json:"deploymentIds"`
+	// Weight is the share of the requests sent to the resource, 1 when unset
+	Weight int `json:"weight,omitempty"`
 }
 
 // Struct to represent an item in the 'anthropic' field
 type Anthropic struct {
 	Name   string `json:"name"`
 	APIKey string `json:"apiKey"`
+	// Weight is the share of the requests sent with the key, 1 when unset
+	Weight int `json:"weight,omitempty"`
+}
+
+// Limits caps the requests a Maxim API key can send through Bifrost, zero leaves a limit unset
+type Limits struct {
+	RequestsPerMinute  int `json:"requestsPerMinute,omitempty"`
+	TokensPerMinute    int `json:"tokensPerMinute,omitempty"`
+	ConcurrentRequests int `json:"concurrentRequests,omitempty"`
+	// Models has the limits of the requests for a model, on top of the limits of the key
+	Models map[string]Limits `json:"models,omitempty"`
+}
+
+// Budget caps the spend in USD of a Maxim API key over a calendar period, daily or monthly, zero
+// leaves a limit unset
+type Budget struct {
+	Period string `json:"period"`
+	// ModelFamily limits the budget to the models whose name starts with it, all models when empty
+	ModelFamily string  `json:"modelFamily,omitempty"`
+	SoftLimit   float64 `json:"softLimit,omitempty"`
+	HardLimit   float64 `json:"hardLimit,omitempty"`
 }
 
 // AccountsResponse struct to represent the entire JSON
@@ -50,6 +77,10 @@ type Accounts struct {
 	OpenAI    []OpenAI    `json:"openai"`
 	Azure     []Azure     `json:"azure"`
 	Anthropic []Anthropic `json:"anthropic"`
+	// Limits overrides the limits configured in Bifrost for the key
+	Limits *Limits `json:"limits,omitempty"`
+	// Budgets replace the budgets configured in Bifrost for the same period and model family
+	Budgets []Budget `json:"budgets,omitempty"`
 }
 
 // Struct to represent the accounts response
@@ -67,12 +98,50 @@ var client = &http.Client{
 	},
 }
 
-// GetMaximAccount gets the accounts from the Maxim API
-func GetMaximAccount(maximApiKey string) (AccountsResponse, error) {
+// SetHTTPClient sets the HTTP client of the requests to the Maxim API.
+func SetHTTPClient(httpClient *http.Client) {
+	client = httpClient
+}
+
+// AccountSource resolves the provider accounts available to a Maxim API key.
+type AccountSource interface {
+	GetAccount(maximApiKey string) (AccountsResponse, error)
+}
+
+// AccountSourceFunc adapts a function to an AccountSource.
+type AccountSourceFunc func(maximApiKey string) (AccountsResponse, error)
+
+func (f AccountSourceFunc) GetAccount(maximApiKey string) (AccountsResponse, error) {
+	return f(maximApiKey)
+}
+
+const accountsPath = "/api/bifrost/v1/accounts"
+
+// ErrInvalidMaximApiKey is returned when the Maxim API rejects the Maxim API key.
+var ErrInvalidMaximApiKey = errors.New("invalid Maxim API key")
+
+// ErrNoMaximBaseUrl is returned when the accounts are looked up without a Maxim API configured.
+var ErrNoMaximBaseUrl = errors.New("the base URL of the Maxim API is not configured")
+
+// MaximClient talks to the Maxim API at baseUrl.
+type MaximClient struct {
+	baseUrl string
+}
+
+func NewMaximClient(baseUrl string) *MaximClient {
+	return &MaximClient{
+		baseUrl: strings.TrimSuffix(baseUrl, "/"),
+	}
+}
+
+// GetAccount gets the accounts of maximApiKey from the Maxim API
+func (mc *MaximClient) GetAccount(maximApiKey string) (AccountsResponse, error) {
+	if mc.baseUrl == "" {
+		return AccountsResponse{}, ErrNoMaximBaseUrl
+	}
 	// Call the Maxim API to get the accounts
 	var result AccountsResponse
-	//FIXME: Fix the API path
-	req, err := http.NewRequest(http.MethodGet, "https://maxim.example.com/api/bifrost/v1/accounts", nil)
+	req, err := http.NewRequest(http.MethodGet, mc.baseUrl+accountsPath, nil)
 	if err != nil {
 		return AccountsResponse{}, err
 	}
@@ -84,6 +153,13 @@ func GetMaximAccount(maximApiKey string) (AccountsResponse, error) {
 	if resp.Body == nil {
 		return AccountsResponse{}, errors.New("response body is nil")
 	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return AccountsResponse{}, ErrInvalidMaximApiKey
+	case resp.StatusCode != http.StatusOK:
+		return AccountsResponse{}, fmt.Errorf("unexpected response from Maxim API: %s", resp.Status)
+	}
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return AccountsResponse{}, err
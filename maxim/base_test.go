@@ -2,6 +2,9 @@ package maxim
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 )
@@ -94,3 +97,38 @@ func TestAccountsResponse(t *testing.T) {
 	}
 
 }
+
+func TestMaximClientGetAccount(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != accountsPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Header.Get("x-maxim-api-key") {
+		case "valid-key":
+			w.Write([]byte(`{"data":{"anthropic":[{"name":"Anthropic","apiKey":"anthropic-api-key"}]}}`))
+		case "broken-key":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	maximClient := NewMaximClient(server.URL + "/")
+
+	account, err := maximClient.GetAccount("valid-key")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if len(account.Data.Anthropic) != 1 || account.Data.Anthropic[0].APIKey != "anthropic-api-key" {
+		t.Errorf("unexpected account %+v", account)
+	}
+
+	if _, err := maximClient.GetAccount("invalid-key"); !errors.Is(err, ErrInvalidMaximApiKey) {
+		t.Errorf("expected ErrInvalidMaximApiKey, got %v", err)
+	}
+
+	if _, err := maximClient.GetAccount("broken-key"); err == nil || errors.Is(err, ErrInvalidMaximApiKey) {
+		t.Errorf("expected an unexpected response error, got %v", err)
+	}
+}
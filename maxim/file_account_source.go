@@ -0,0 +1,167 @@
+package maxim
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileAccountSource serves the accounts described in a local YAML or JSON file, so bifrost can
+// run without a reachable Maxim API. The file maps each Maxim API key allowed to use bifrost to its
+// accounts, which have the same shape as Accounts. Other keys are rejected.
+//
+//	team-a-maxim-api-key:
+//	  openai:
+//	    - name: OpenAI
+//	      apiKey: sk-...
+//	      modelAvailable:
+//	        - id: gpt-4o
+//	  anthropic:
+//	    - name: Anthropic
+//	      apiKey: sk-ant-...
+type FileAccountSource struct {
+	path     string
+	accounts atomic.Pointer[map[string]Accounts]
+
+	mu       sync.Mutex
+	modTime  time.Time
+	size     int64
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewFileAccountSource loads the accounts in path.
+func NewFileAccountSource(path string) (*FileAccountSource, error) {
+	fs := &FileAccountSource{
+		path: path,
+		stop: make(chan struct{}),
+	}
+	if err := fs.Reload(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// GetAccount returns the accounts of maximApiKey in the file, ErrInvalidMaximApiKey when the file
+// does not list it.
+func (fs *FileAccountSource) GetAccount(maximApiKey string) (AccountsResponse, error) {
+	accounts, ok := (*fs.accounts.Load())[maximApiKey]
+	if !ok || maximApiKey == "" {
+		return AccountsResponse{}, ErrInvalidMaximApiKey
+	}
+	return AccountsResponse{Data: accounts}, nil
+}
+
+// Reload reads the file again. The accounts are swapped only once the whole file is parsed,
+// a broken file keeps the previous accounts.
+func (fs *FileAccountSource) Reload() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		return err
+	}
+	accounts, err := readAccountsFile(fs.path)
+	if err != nil {
+		return err
+	}
+	fs.accounts.Store(&accounts)
+	fs.modTime = info.ModTime()
+	fs.size = info.Size()
+	return nil
+}
+
+// Watch polls the file every interval and reloads it when it changes, until Close is called.
+// Nothing is watched without an interval.
+func (fs *FileAccountSource) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-fs.stop:
+				return
+			case <-ticker.C:
+				if !fs.changed() {
+					continue
+				}
+				if err := fs.Reload(); err != nil {
+					fmt.Printf("Error reloading accounts file %s: %v\n", fs.path, err)
+					continue
+				}
+				fmt.Printf("Reloaded accounts file %s\n", fs.path)
+			}
+		}
+	}()
+}
+
+// Close stops watching the file.
+func (fs *FileAccountSource) Close() {
+	fs.stopOnce.Do(func() {
+		close(fs.stop)
+	})
+}
+
+func (fs *FileAccountSource) changed() bool {
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		return false
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return !info.ModTime().Equal(fs.modTime) || info.Size() != fs.size
+}
+
+// readAccountsFile parses a JSON or YAML accounts file, picked by its extension, into the accounts
+// of each Maxim API key.
+func readAccountsFile(path string) (map[string]Accounts, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		content, err = yamlToJSON(content)
+	default:
+		return nil, fmt.Errorf("unsupported accounts file %s, expected .json, .yaml or .yml", path)
+	}
+	var keys map[string]json.RawMessage
+	if err == nil {
+		err = json.Unmarshal(content, &keys)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid accounts file %s: %w", path, err)
+	}
+	accounts := make(map[string]Accounts, len(keys))
+	for maximApiKey, content := range keys {
+		switch maximApiKey {
+		case "openai", "azure", "anthropic", "limits", "budgets":
+			return nil, fmt.Errorf("invalid accounts file %s: the accounts must be listed under the Maxim API keys they belong to, found %s at the top level", path, maximApiKey)
+		}
+		var keyAccounts Accounts
+		if err := json.Unmarshal(content, &keyAccounts); err != nil {
+			return nil, fmt.Errorf("invalid accounts file %s: accounts of a Maxim API key: %w", path, err)
+		}
+		accounts[maximApiKey] = keyAccounts
+	}
+	return accounts, nil
+}
+
+// yamlToJSON converts YAML to JSON so the json tags of the account structs apply.
+func yamlToJSON(content []byte) ([]byte, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	return json.Marshal(raw)
+}
@@ -0,0 +1,154 @@
+package maxim
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const yamlAccounts = `
+maxim-api-key:
+  openai:
+    - name: OpenAI
+      apiKey: openai-api-key
+      modelAvailable:
+        - name: gpt4o
+          id: gpt-4o
+  azure:
+    - baseUrl: https://azure.example.com
+      apiKey1: azure-api-key-1
+      apiKey2: azure-api-key-2
+      deploymentIds:
+        - id: gpt4o-prod
+          model: gpt-4o
+  anthropic: &anthropic
+    - name: Anthropic
+      apiKey: anthropic-api-key
+other-maxim-api-key:
+  anthropic: *anthropic
+`
+
+func writeAccountsFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write accounts file: %v", err)
+	}
+}
+
+func TestFileAccountSourceYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.yaml")
+	writeAccountsFile(t, path, yamlAccounts)
+
+	source, err := NewFileAccountSource(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	account, err := source.GetAccount("maxim-api-key")
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if len(account.Data.OpenAI) != 1 || account.Data.OpenAI[0].ModelAvailable[0].ID != "gpt-4o" {
+		t.Errorf("unexpected openai accounts %+v", account.Data.OpenAI)
+	}
+	if len(account.Data.Azure) != 1 || account.Data.Azure[0].DeploymentIds[0].ID != "gpt4o-prod" {
+		t.Errorf("unexpected azure accounts %+v", account.Data.Azure)
+	}
+	if len(account.Data.Anthropic) != 1 || account.Data.Anthropic[0].APIKey != "anthropic-api-key" {
+		t.Errorf("unexpected anthropic accounts %+v", account.Data.Anthropic)
+	}
+	account, err = source.GetAccount("other-maxim-api-key")
+	if err != nil || len(account.Data.OpenAI) != 0 || len(account.Data.Anthropic) != 1 {
+		t.Errorf("unexpected accounts %+v, %v", account.Data, err)
+	}
+
+	// Keys which are not listed get no accounts
+	for _, maximApiKey := range []string{"", "any-key"} {
+		if _, err := source.GetAccount(maximApiKey); !errors.Is(err, ErrInvalidMaximApiKey) {
+			t.Errorf("expected %q to be rejected, got %v", maximApiKey, err)
+		}
+	}
+}
+
+func TestFileAccountSourceJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	writeAccountsFile(t, path, `{"maxim-api-key":{"anthropic":[{"name":"Anthropic","apiKey":"anthropic-api-key"}]}}`)
+
+	source, err := NewFileAccountSource(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	account, _ := source.GetAccount("maxim-api-key")
+	if len(account.Data.Anthropic) != 1 || account.Data.Anthropic[0].APIKey != "anthropic-api-key" {
+		t.Errorf("unexpected anthropic accounts %+v", account.Data.Anthropic)
+	}
+}
+
+func TestFileAccountSourceInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.yaml")
+	writeAccountsFile(t, path, "openai: [")
+
+	if _, err := NewFileAccountSource(path); err == nil {
+		t.Fatal("expected an error but got none")
+	}
+	// The accounts are listed by Maxim API key
+	writeAccountsFile(t, path, "openai:\n  - name: OpenAI\n    apiKey: openai-api-key\n")
+	if _, err := NewFileAccountSource(path); err == nil || !strings.Contains(err.Error(), "found openai at the top level") {
+		t.Fatalf("expected the accounts without Maxim API key to be rejected, got %v", err)
+	}
+	if _, err := NewFileAccountSource(filepath.Join(t.TempDir(), "accounts.txt")); err == nil {
+		t.Fatal("expected an error but got none")
+	}
+}
+
+func TestFileAccountSourceWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	writeAccountsFile(t, path, `{"maxim-api-key":{"anthropic":[{"name":"old","apiKey":"old-key"}]}}`)
+
+	source, err := NewFileAccountSource(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	source.Watch(5 * time.Millisecond)
+	defer source.Close()
+
+	// A broken file keeps the previous accounts
+	writeAccountsFile(t, path, `{"maxim-api-key":`)
+	time.Sleep(30 * time.Millisecond)
+	account, _ := source.GetAccount("maxim-api-key")
+	if account.Data.Anthropic[0].Name != "old" {
+		t.Errorf("expected the previous accounts, got %+v", account)
+	}
+
+	writeAccountsFile(t, path, `{"maxim-api-key":{"anthropic":[{"name":"new","apiKey":"new-key"}]}}`)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		account, _ = source.GetAccount("maxim-api-key")
+		if account.Data.Anthropic[0].Name == "new" {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("expected the reloaded accounts, got %+v", account)
+}
+
+func TestFileAccountSourceWatchWithoutInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	writeAccountsFile(t, path, `{"maxim-api-key":{"anthropic":[{"name":"old","apiKey":"old-key"}]}}`)
+
+	source, err := NewFileAccountSource(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	source.Watch(0)
+	defer source.Close()
+
+	writeAccountsFile(t, path, `{"maxim-api-key":{"anthropic":[{"name":"new","apiKey":"new-key"}]}}`)
+	time.Sleep(30 * time.Millisecond)
+	account, _ := source.GetAccount("maxim-api-key")
+	if account.Data.Anthropic[0].Name != "old" {
+		t.Errorf("expected the file not to be reloaded, got %+v", account)
+	}
+}
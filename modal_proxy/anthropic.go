@@ -2,42 +2,70 @@ package modal_proxy
 
 import (
 	"bifrost/maxim"
-	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"fmt"
-	"github.com/andybalholm/brotli"
 	"github.com/gofiber/fiber/v2"
-	"io"
-	"math/rand"
 	"net/http"
-	"strings"
 )
 
+// anthropicVersion is sent when the client does not pin a version of the Anthropic API.
+const anthropicVersion = "2023-06-01"
+
 type AnthropicModalProvider struct {
-	apiUrl string
+	apiUrl   string
+	accounts maxim.AccountSource
+	keyPool  *KeyPool
 }
 
-func NewAnthropicModalProvider(apiUrl string) *AnthropicModalProvider {
+// NewAnthropicModalProvider creates the provider of the Anthropic API at apiUrl, sending the
+// requests with the keys of the accounts the Maxim API keys resolve to in accounts.
+func NewAnthropicModalProvider(apiUrl string, accounts maxim.AccountSource) *AnthropicModalProvider {
 	return &AnthropicModalProvider{
-		apiUrl: apiUrl,
+		apiUrl:   apiUrl,
+		accounts: accounts,
+		keyPool:  NewKeyPool(DefaultKeyPoolConfig),
 	}
 }
 
+// KeyPool returns the pool picking the keys of the provider.
+func (mp *AnthropicModalProvider) KeyPool() *KeyPool {
+	return mp.keyPool
+}
+
+// SetKeyPool makes the provider pick its keys from keyPool, so a provider created again with a
+// new configuration keeps the health of the keys. It must be called before the provider is used.
+func (mp *AnthropicModalProvider) SetKeyPool(keyPool *KeyPool) {
+	mp.keyPool = keyPool
+}
+
 func (mp *AnthropicModalProvider) GetApiKey(reqHeaders map[string][]string, modal string) (string, error) {
-	maximApiKey, err := GetMaximApiKey(reqHeaders)
+	candidates, err := mp.getKeys(reqHeaders)
 	if err != nil {
 		return "", err
 	}
-	account, err := maxim.GetMaximAccount(maximApiKey)
+	index, err := mp.keyPool.pick(candidates)
 	if err != nil {
 		return "", err
 	}
-	//FIXME: This is a temporary solution to get a random API key from the list of API keys,
-	// eventually we will need to implement a more sophisticated way to select the API key which
-	// looks at the response as well
-	index := rand.Int() % len(account.Data.Anthropic)
-	return account.Data.Anthropic[index].APIKey, nil
+	return candidates[index].apiKey, nil
+}
+
+// getKeys returns the Anthropic keys of the account.
+func (mp *AnthropicModalProvider) getKeys(reqHeaders map[string][]string) ([]poolKey, error) {
+	maximApiKey, err := GetMaximApiKey(reqHeaders)
+	if err != nil {
+		return nil, err
+	}
+	account, err := mp.accounts.GetAccount(maximApiKey)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]poolKey, len(account.Data.Anthropic))
+	for i, anthropic := range account.Data.Anthropic {
+		candidates[i] = poolKey{apiKey: anthropic.APIKey, weight: anthropic.Weight}
+	}
+	return candidates, nil
 }
 
 // GetCompletion Implement method.
@@ -45,46 +73,46 @@ func (mp *AnthropicModalProvider) GetCompletion(c *fiber.Ctx, apiPath string) er
 	if c.Method() != http.MethodPost {
 		return c.Status(fiber.StatusMethodNotAllowed).SendString("Only POST method is allowed")
 	}
-	fmt.Printf("Received request to OpenAI API %s\n", string(c.Body()))
-	req, err := http.NewRequest(http.MethodPost, mp.apiUrl+apiPath, bytes.NewBuffer(c.Body()))
-	if err != nil || req == nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error creating request")
+	fmt.Println("Received request to Anthropic API")
+	resp, err := mp.SendRequest(c.UserContext(), c, apiPath, c.Body())
+	if err != nil {
+		return sendProxyError(c, err)
 	}
-	copyHeadersFromIncomingRequest(c, req)
-	resp, err := client.Do(req)
-	if err != nil || resp == nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error making request to OpenAI API")
+	return relayResponse(c, resp, "Anthropic")
+}
+
+// SendRequest sends body to apiPath of Anthropic with a key of the account.
+func (mp *AnthropicModalProvider) SendRequest(ctx context.Context, c *fiber.Ctx, apiPath string, body []byte) (*http.Response, error) {
+	modal, err := getModalFromBody(body)
+	if err != nil {
+		return nil, &ProxyError{Status: fiber.StatusBadRequest, Message: err.Error(), Err: err}
 	}
-	copyReadersToOutgoingResponse(c, resp)
-	if resp.Body == nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error: response body is nil")
+	candidates, err := traced(ctx, "bifrost.account_lookup", func() ([]poolKey, error) {
+		return mp.getKeys(c.GetReqHeaders())
+	})
+	if err != nil {
+		return nil, apiKeyError(err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return c.Status(resp.StatusCode).SendString("Error response from Anthropic API: " + resp.Status)
+	index, err := mp.keyPool.acquire(ctx, candidates)
+	if err != nil {
+		return nil, apiKeyError(err)
 	}
-
-	// Detect Content-Encoding and handle Brotli, Gzip, or plain text
-	var reader io.Reader = resp.Body
-
-	switch resp.Header.Get("Content-Encoding") {
-	case "br":
-		reader = brotli.NewReader(resp.Body)
-	case "gzip":
-		gzipReader, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("Error reading gzip response")
-		}
-		reader = gzipReader
+	apiKey := candidates[index].apiKey
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, mp.apiUrl+apiPath, bytes.NewBuffer(body))
+	if err != nil || req == nil {
+		return nil, &ProxyError{Status: fiber.StatusInternalServerError, Message: "Error creating request", Err: err}
 	}
-
-	bufReader := bufio.NewReader(reader)
-
-	contentType := resp.Header.Get("Content-Type")
-	if strings.Contains(contentType, "text/event-stream") {
-		streamResponse(c, resp, bufReader)
-	} else {
-		// Handle non-streaming content (read all at once)
-		return blockingResponse(c, reader)
+	copyHeadersFromIncomingRequest(c, req)
+	req.Header.Set("x-api-key", apiKey)
+	if req.Header.Get("anthropic-version") == "" {
+		req.Header.Set("anthropic-version", anthropicVersion)
+	}
+	c.Locals(providerKeyLocal, apiKey)
+	req, span := startUpstreamSpan(req, ProviderAnthropic, modal)
+	resp, err := mp.keyPool.do(apiKey, req)
+	endUpstreamSpan(span, resp, err)
+	if err != nil || resp == nil {
+		return nil, &ProxyError{Status: fiber.StatusInternalServerError, Message: "Error making request to Anthropic API", Err: err}
 	}
-	return nil
+	return resp, nil
 }
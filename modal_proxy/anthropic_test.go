@@ -0,0 +1,47 @@
+package modal_proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupAnthropicApp(provider *AnthropicModalProvider) *fiber.App {
+	mockMaximAccount(testAccounts())
+	app := fiber.New()
+	app.Post("/completion", func(ctx *fiber.Ctx) error {
+		return provider.GetCompletion(ctx, "/v1/messages")
+	})
+	return app
+}
+
+// Test that the Anthropic key and version headers are set on the upstream request
+func TestAnthropicApiKeyInjection(t *testing.T) {
+	provider := NewAnthropicModalProvider("https://api.anthropic.com", testAccountSource)
+	app := setupAnthropicApp(provider)
+	transport := mockClient(http.StatusOK, "plain text response", nil)
+
+	req := newCompletionRequest(`{"model":"claude-3-5-sonnet-20240620","max_tokens":10}`)
+	req.Header.Set("x-api-key", "client-api-key")
+	resp, _ := app.Test(req)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "anthropic-api-key", transport.LastRequest.Header.Get("x-api-key"))
+	assert.Equal(t, anthropicVersion, transport.LastRequest.Header.Get("anthropic-version"))
+}
+
+// Test that a client pinned Anthropic version is preserved
+func TestAnthropicVersionPassthrough(t *testing.T) {
+	provider := NewAnthropicModalProvider("https://api.anthropic.com", testAccountSource)
+	app := setupAnthropicApp(provider)
+	transport := mockClient(http.StatusOK, "plain text response", nil)
+
+	req := newCompletionRequest(`{"model":"claude-3-5-sonnet-20240620","max_tokens":10}`)
+	req.Header.Set("anthropic-version", "2024-01-01")
+	resp, _ := app.Test(req)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2024-01-01", transport.LastRequest.Header.Get("anthropic-version"))
+}
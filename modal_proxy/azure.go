@@ -0,0 +1,186 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+	"bifrost/utils"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AzureApiVersion is the default api-version sent to Azure OpenAI.
+const AzureApiVersion = "2024-06-01"
+
+// azureApiPaths maps the OpenAI API paths to the Azure OpenAI deployment paths.
+var azureApiPaths = map[string]string{
+	"/v1/chat/completions": "/chat/completions",
+	"/v1/completions":      "/completions",
+}
+
+type AzureModalProvider struct {
+	apiVersion string
+	accounts   maxim.AccountSource
+	keyPool    *KeyPool
+}
+
+// azureDeployment is a deployment serving the requested modal with a key of its resource.
+type azureDeployment struct {
+	baseUrl      string
+	deploymentId string
+	apiKey       string
+	weight       int
+}
+
+// NewAzureModalProvider creates the provider of the Azure OpenAI deployments of the accounts the
+// Maxim API keys resolve to in accounts, sending apiVersion.
+func NewAzureModalProvider(apiVersion string, accounts maxim.AccountSource) *AzureModalProvider {
+	return &AzureModalProvider{
+		apiVersion: apiVersion,
+		accounts:   accounts,
+		keyPool:    NewKeyPool(DefaultKeyPoolConfig),
+	}
+}
+
+// KeyPool returns the pool picking the keys of the provider.
+func (mp *AzureModalProvider) KeyPool() *KeyPool {
+	return mp.keyPool
+}
+
+// SetKeyPool makes the provider pick its keys from keyPool, so a provider created again with a
+// new configuration keeps the health of the keys. It must be called before the provider is used.
+func (mp *AzureModalProvider) SetKeyPool(keyPool *KeyPool) {
+	mp.keyPool = keyPool
+}
+
+func (mp *AzureModalProvider) GetApiKey(reqHeaders map[string][]string, modal string) (string, error) {
+	deployments, err := mp.getDeployments(reqHeaders, modal)
+	if err != nil {
+		return "", err
+	}
+	index, err := mp.keyPool.pick(poolKeys(deployments))
+	if err != nil {
+		return "", err
+	}
+	return deployments[index].apiKey, nil
+}
+
+// getDeployments returns the Azure deployments of the account which serve modal, once for each
+// key of their resource. The modal can either be the OpenAI model name or the deployment id itself.
+func (mp *AzureModalProvider) getDeployments(reqHeaders map[string][]string, modal string) ([]azureDeployment, error) {
+	maximApiKey, err := GetMaximApiKey(reqHeaders)
+	if err != nil {
+		return nil, err
+	}
+	account, err := mp.accounts.GetAccount(maximApiKey)
+	if err != nil {
+		return nil, err
+	}
+	var deployments []azureDeployment
+	for _, azure := range account.Data.Azure {
+		apiKeys := utils.Filter([]string{azure.APIKey1, azure.APIKey2}, func(apiKey string) bool {
+			return apiKey != ""
+		})
+		for _, deploymentId := range utils.Filter(azure.DeploymentIds, func(deploymentId maxim.DeploymentID) bool {
+			return deploymentId.Model == modal || deploymentId.ID == modal
+		}) {
+			for _, apiKey := range apiKeys {
+				deployments = append(deployments, azureDeployment{
+					baseUrl:      strings.TrimSuffix(azure.BaseURL, "/"),
+					deploymentId: deploymentId.ID,
+					apiKey:       apiKey,
+					weight:       azure.Weight,
+				})
+			}
+		}
+	}
+	if len(deployments) == 0 {
+		return nil, ErrNoEligibleKey
+	}
+	return deployments, nil
+}
+
+// poolKeys returns the keys of deployments for the key pool.
+func poolKeys(deployments []azureDeployment) []poolKey {
+	candidates := make([]poolKey, len(deployments))
+	for i, deployment := range deployments {
+		candidates[i] = poolKey{apiKey: deployment.apiKey, weight: deployment.weight}
+	}
+	return candidates
+}
+
+// GetCompletion proxies an OpenAI shaped request to the Azure deployment serving the requested
+// modal, failing over to the other keys serving it on 401 and 429.
+func (mp *AzureModalProvider) GetCompletion(c *fiber.Ctx, apiPath string) error {
+	if c.Method() != http.MethodPost {
+		return c.Status(fiber.StatusMethodNotAllowed).SendString("Only POST method is allowed")
+	}
+	resp, err := mp.SendRequest(c.UserContext(), c, apiPath, c.Body())
+	if err != nil {
+		return sendProxyError(c, err)
+	}
+	return relayResponse(c, resp, "Azure OpenAI")
+}
+
+// SendRequest sends the OpenAI shaped body to an Azure deployment serving its modal, trying
+// the other deployments and keys serving it when a key is rejected or rate limited.
+func (mp *AzureModalProvider) SendRequest(ctx context.Context, c *fiber.Ctx, apiPath string, body []byte) (*http.Response, error) {
+	azurePath, ok := azureApiPaths[apiPath]
+	if !ok {
+		return nil, &ProxyError{Status: fiber.StatusNotFound, Message: "Unsupported Azure OpenAI API path " + apiPath}
+	}
+	modal, err := getModalFromBody(body)
+	if err != nil {
+		return nil, &ProxyError{Status: fiber.StatusBadRequest, Message: err.Error(), Err: err}
+	}
+	deployments, err := traced(ctx, "bifrost.account_lookup", func() ([]azureDeployment, error) {
+		return mp.getDeployments(c.GetReqHeaders(), modal)
+	})
+	if err != nil {
+		return nil, apiKeyError(err)
+	}
+
+	var resp *http.Response
+	for len(deployments) > 0 {
+		index, err := mp.keyPool.acquire(ctx, poolKeys(deployments))
+		if err != nil {
+			if resp != nil {
+				// The keys left are cooling down, relay the last rejection
+				return resp, nil
+			}
+			return nil, apiKeyError(err)
+		}
+		if resp != nil {
+			closeResponse(resp)
+		}
+		deployment := deployments[index]
+		apiUrl := fmt.Sprintf("%s/openai/deployments/%s%s?api-version=%s", deployment.baseUrl,
+			url.PathEscape(deployment.deploymentId), azurePath, url.QueryEscape(mp.apiVersion))
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiUrl, bytes.NewBuffer(body))
+		if err != nil || req == nil {
+			return nil, &ProxyError{Status: fiber.StatusInternalServerError, Message: "Error creating request", Err: err}
+		}
+		copyHeadersFromIncomingRequest(c, req)
+		req.Header.Set("api-key", deployment.apiKey)
+		c.Locals(providerKeyLocal, deployment.apiKey)
+		req, span := startUpstreamSpan(req, ProviderAzure, modal)
+		resp, err = mp.keyPool.do(deployment.apiKey, req)
+		endUpstreamSpan(span, resp, err)
+		if err != nil || resp == nil {
+			return nil, &ProxyError{Status: fiber.StatusInternalServerError, Message: "Error making request to Azure OpenAI API", Err: err}
+		}
+		if !isAzureFailoverStatus(resp.StatusCode) {
+			break
+		}
+		deployments = append(deployments[:index:index], deployments[index+1:]...)
+	}
+	return resp, nil
+}
+
+// isAzureFailoverStatus reports whether another key serving the deployment should be tried.
+func isAzureFailoverStatus(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,108 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// sequenceRoundTripper answers each request with the next status code of the sequence.
+type sequenceRoundTripper struct {
+	StatusCodes []int
+	Requests    []*http.Request
+}
+
+func (srt *sequenceRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	statusCode := srt.StatusCodes[len(srt.Requests)%len(srt.StatusCodes)]
+	srt.Requests = append(srt.Requests, req)
+	return &http.Response{
+		StatusCode: statusCode,
+		Body:       io.NopCloser(strings.NewReader("azure response")),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func setupAzureApp(provider *AzureModalProvider) *fiber.App {
+	mockMaximAccount(maxim.Accounts{
+		Azure: []maxim.Azure{
+			{
+				BaseURL: "https://bifrost.openai.azure.com/",
+				APIKey1: "azure-api-key-1",
+				APIKey2: "azure-api-key-2",
+				DeploymentIds: []maxim.DeploymentID{
+					{ID: "gpt4o-prod", Model: "gpt-4o"},
+				},
+			},
+		},
+	})
+	app := fiber.New()
+	app.Post("/completion", func(ctx *fiber.Ctx) error {
+		return provider.GetCompletion(ctx, "/v1/chat/completions")
+	})
+	return app
+}
+
+func mockSequenceClient(statusCodes ...int) *sequenceRoundTripper {
+	transport := &sequenceRoundTripper{StatusCodes: statusCodes}
+	client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Second,
+	}
+	return transport
+}
+
+// Test that the request is rewritten to the deployment of the requested model
+func TestAzureDeploymentUrl(t *testing.T) {
+	app := setupAzureApp(NewAzureModalProvider(AzureApiVersion, testAccountSource))
+	transport := mockSequenceClient(http.StatusOK)
+
+	req := newCompletionRequest(testRequestBody)
+	req.Header.Set("Authorization", "Bearer client-api-key")
+	resp, _ := app.Test(req)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, transport.Requests, 1)
+	upstream := transport.Requests[0]
+	assert.Equal(t, "https://bifrost.openai.azure.com/openai/deployments/gpt4o-prod/chat/completions?api-version="+AzureApiVersion, upstream.URL.String())
+	assert.Equal(t, "azure-api-key-1", upstream.Header.Get("api-key"))
+	assert.Empty(t, upstream.Header.Get("Authorization"))
+}
+
+// Test that the second key is used when the first one is rate limited
+func TestAzureKeyFailover(t *testing.T) {
+	app := setupAzureApp(NewAzureModalProvider(AzureApiVersion, testAccountSource))
+	transport := mockSequenceClient(http.StatusTooManyRequests, http.StatusOK)
+
+	resp, _ := app.Test(newCompletionRequest(testRequestBody))
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, transport.Requests, 2)
+	assert.Equal(t, "azure-api-key-2", transport.Requests[1].Header.Get("api-key"))
+}
+
+// Test that the last error is returned once both keys are rejected
+func TestAzureBothKeysRejected(t *testing.T) {
+	app := setupAzureApp(NewAzureModalProvider(AzureApiVersion, testAccountSource))
+	transport := mockSequenceClient(http.StatusUnauthorized)
+
+	resp, _ := app.Test(newCompletionRequest(testRequestBody))
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Len(t, transport.Requests, 2)
+}
+
+// Test for a model without an Azure deployment
+func TestAzureUnknownModel(t *testing.T) {
+	app := setupAzureApp(NewAzureModalProvider(AzureApiVersion, testAccountSource))
+	mockSequenceClient(http.StatusOK)
+
+	resp, _ := app.Test(newCompletionRequest(`{"model":"gpt-unknown"}`))
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
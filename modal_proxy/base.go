@@ -1,9 +1,14 @@
 package modal_proxy
 
 import (
+	"bifrost/maxim"
 	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/andybalholm/brotli"
 	"github.com/gofiber/fiber/v2"
 	"io"
 	"net/http"
@@ -21,12 +26,74 @@ var client = &http.Client{
 	},
 }
 
+// SetHTTPClient sets the HTTP client of the requests to the providers.
+func SetHTTPClient(httpClient *http.Client) {
+	client = httpClient
+}
+
+var (
+	errMaximApiKeyNotFound = errors.New("x-maxim-api-key not found")
+	errMaximApiKeyNoValue  = errors.New("x-maxim-api-key exists but no value associated with it")
+	// ErrNoEligibleKey is returned when the account has no provider key for the requested modal.
+	ErrNoEligibleKey = errors.New("no API key available for the requested modal")
+)
+
+// credentialHeaders are never forwarded upstream, the proxy sets the provider credentials itself.
+var credentialHeaders = []string{"Authorization", "X-Api-Key", "Api-Key", "X-Maxim-Api-Key"}
+
+// bifrostHeaderPrefix prefixes the headers which control bifrost itself, they are not forwarded upstream.
+const bifrostHeaderPrefix = "x-bifrost-"
+
 // ModalProviderInterface defines the interface for calling different modals.
 type ModalProviderInterface interface {
-	GetCompletion(c *fiber.Ctx) error
+	// GetCompletion proxies the incoming request to apiPath of the modal provider.
+	GetCompletion(c *fiber.Ctx, apiPath string) error
 
 	// GetApiKey returns the API key for the modal provider and the selected modal.
 	GetApiKey(reqHeaders map[string][]string, modal string) (string, error)
+
+	// SendRequest sends body to apiPath of the modal provider with the headers of the incoming
+	// request and returns the upstream response without relaying it. Failures are *ProxyError.
+	SendRequest(ctx context.Context, c *fiber.Ctx, apiPath string, body []byte) (*http.Response, error)
+}
+
+var (
+	_ ModalProviderInterface = (*OpenAIModalProvider)(nil)
+	_ ModalProviderInterface = (*AnthropicModalProvider)(nil)
+	_ ModalProviderInterface = (*AzureModalProvider)(nil)
+)
+
+// ProxyError is a failure of the proxy before it got a response from the modal provider, it is
+// sent to the caller with Status.
+type ProxyError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (pe *ProxyError) Error() string {
+	if pe.Err != nil {
+		return pe.Message + ": " + pe.Err.Error()
+	}
+	return pe.Message
+}
+
+func (pe *ProxyError) Unwrap() error {
+	return pe.Err
+}
+
+// sendProxyError sends err to the caller, with its status when it is a *ProxyError.
+func sendProxyError(c *fiber.Ctx, err error) error {
+	var proxyErr *ProxyError
+	if errors.As(err, &proxyErr) {
+		return c.Status(proxyErr.Status).SendString(proxyErr.Message)
+	}
+	return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+}
+
+// apiKeyError wraps an error returned by GetApiKey.
+func apiKeyError(err error) *ProxyError {
+	return &ProxyError{Status: apiKeyErrorStatus(err), Message: "Error resolving API key: " + err.Error(), Err: err}
 }
 
 func closeResponse(resp *http.Response) {
@@ -40,15 +107,56 @@ func closeResponse(resp *http.Response) {
 
 func GetMaximApiKey(reqHeaders map[string][]string) (string, error) {
 	const apiKey = "x-maxim-api-key"
-	// Check if the key exists in the map
-	if values, ok := reqHeaders[apiKey]; ok {
+	// Header names are case-insensitive, fiber hands them to us in canonical form
+	for key, values := range reqHeaders {
+		if !strings.EqualFold(key, apiKey) {
+			continue
+		}
 		// Check if there is at least one value associated with the key
 		if len(values) > 0 {
 			return values[0], nil
 		}
-		return "", errors.New("x-maxim-api-key exists but no value associated with it")
+		return "", errMaximApiKeyNoValue
 	}
-	return "", errors.New("x-maxim-api-key not found")
+	return "", errMaximApiKeyNotFound
+}
+
+// getModalFromBody extracts the requested modal from the JSON request body.
+func getModalFromBody(body []byte) (string, error) {
+	var payload struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", fmt.Errorf("invalid request body: %w", err)
+	}
+	if payload.Model == "" {
+		return "", errors.New("model is required")
+	}
+	return payload.Model, nil
+}
+
+// apiKeyErrorStatus maps an error returned by GetApiKey to the status code sent to the caller.
+func apiKeyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errMaximApiKeyNotFound), errors.Is(err, errMaximApiKeyNoValue),
+		errors.Is(err, maxim.ErrInvalidMaximApiKey):
+		return fiber.StatusUnauthorized
+	case errors.Is(err, ErrNoEligibleKey):
+		return fiber.StatusBadRequest
+	case errors.Is(err, ErrKeysCoolingDown):
+		return fiber.StatusServiceUnavailable
+	default:
+		return fiber.StatusBadGateway
+	}
+}
+
+func isCredentialHeader(key string) bool {
+	for _, header := range credentialHeaders {
+		if strings.EqualFold(key, header) {
+			return true
+		}
+	}
+	return false
 }
 
 func copyReadersToOutgoingResponse(c *fiber.Ctx, resp *http.Response) {
@@ -62,15 +170,64 @@ func copyReadersToOutgoingResponse(c *fiber.Ctx, resp *http.Response) {
 func copyHeadersFromIncomingRequest(c *fiber.Ctx, req *http.Request) {
 	reqHeaders := c.GetReqHeaders()
 	for key, values := range reqHeaders {
+		if isCredentialHeader(key) || strings.HasPrefix(strings.ToLower(key), bifrostHeaderPrefix) {
+			continue
+		}
 		for _, value := range values {
 			req.Header.Add(key, value)
 		}
 	}
 }
 
+// relayResponse copies the upstream response of providerName to the caller, decoding
+// Brotli and Gzip bodies and streaming event-stream responses as they arrive.
+func relayResponse(c *fiber.Ctx, resp *http.Response, providerName string) error {
+	copyReadersToOutgoingResponse(c, resp)
+	if resp.Body == nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Error: response body is nil")
+	}
+	if resp.StatusCode != http.StatusOK {
+		closeResponse(resp)
+		return c.Status(resp.StatusCode).SendString("Error response from " + providerName + " API: " + resp.Status)
+	}
+
+	reader, err := decodedBody(resp)
+	if err != nil {
+		closeResponse(resp)
+		return c.Status(fiber.StatusInternalServerError).SendString("Error reading gzip response")
+	}
+
+	bufReader := bufio.NewReader(reader)
+
+	contentType := resp.Header.Get("Content-Type")
+	if strings.Contains(contentType, "text/event-stream") {
+		streamResponse(c, resp, bufReader)
+		return nil
+	}
+	// Handle non-streaming content (read all at once)
+	defer closeResponse(resp)
+	return blockingResponse(c, reader)
+}
+
+// decodedBody returns the body of resp, decoding Brotli and Gzip content.
+func decodedBody(resp *http.Response) (io.Reader, error) {
+	switch resp.Header.Get("Content-Encoding") {
+	case "br":
+		return brotli.NewReader(resp.Body), nil
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	}
+	return resp.Body, nil
+}
+
 func streamResponse(c *fiber.Ctx, resp *http.Response, bufReader *bufio.Reader) {
+	observers := usageObservers(c)
+	usage := newStreamUsage(c)
+	span := startStreamSpan(c)
 	c.Status(fiber.StatusOK).Context().SetBodyStreamWriter(func(w *bufio.Writer) {
 		bufWriter := bufio.NewWriter(w)
+		defer usage.notify(observers)
+		defer endStreamSpan(span, usage)
 		defer closeResponse(resp)
 		for {
 			lineBytes, err := bufReader.ReadBytes('\n')
@@ -93,6 +250,7 @@ func streamResponse(c *fiber.Ctx, resp *http.Response, bufReader *bufio.Reader)
 			}
 
 			line := string(lineBytes)
+			usage.addLine(line)
 			_, err = bufWriter.WriteString(line)
 			if err != nil {
 				fmt.Printf("Error writing response: %v\n", err)
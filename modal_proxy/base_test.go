@@ -52,4 +52,19 @@ func TestGetMaximAPIKey(t *testing.T) {
 			t.Errorf("expected error message %v, but got %v", expectedErrMsg, err.Error())
 		}
 	})
+
+	// Test case where the header name is in canonical form
+	t.Run("API key in canonical form", func(t *testing.T) {
+		input := map[string][]string{
+			"X-Maxim-Api-Key": {"example-api-key"},
+		}
+
+		result, err := GetMaximApiKey(input)
+		if err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+		if result != "example-api-key" {
+			t.Errorf("expected %v, got %v", "example-api-key", result)
+		}
+	})
 }
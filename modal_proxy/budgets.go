@@ -0,0 +1,445 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BudgetWarningHeader warns the caller that a soft budget limit of its Maxim API key is reached.
+const BudgetWarningHeader = "x-bifrost-budget-warning"
+
+// BudgetPeriod is the calendar period of a budget.
+type BudgetPeriod string
+
+const (
+	Daily   BudgetPeriod = "daily"
+	Monthly BudgetPeriod = "monthly"
+)
+
+// BudgetConfig configures the spend budgets of the Maxim API keys.
+type BudgetConfig struct {
+	// Budgets apply to every Maxim API key, the budgets of an account replace them
+	Budgets []maxim.Budget
+	// Location is the timezone of the calendar the periods follow, UTC when nil
+	Location *time.Location
+	// StateFile persists the spend of the current periods, it is kept in memory only when empty
+	StateFile string
+	// WebhookUrl is posted an alert when a soft limit is reached, none is sent when empty
+	WebhookUrl string
+}
+
+// BudgetAlert is posted to the webhook when the spend of a Maxim API key reaches a soft limit.
+type BudgetAlert struct {
+	Event       string    `json:"event"`
+	Tenant      string    `json:"tenant"`
+	Period      string    `json:"period"`
+	ModelFamily string    `json:"modelFamily,omitempty"`
+	PeriodStart time.Time `json:"periodStart"`
+	SoftLimit   float64   `json:"softLimit"`
+	HardLimit   float64   `json:"hardLimit,omitempty"`
+	Spent       float64   `json:"spent"`
+}
+
+// budgetSpend is the spend of a Maxim API key, identified by its hash, against a budget over the
+// period starting at PeriodStart.
+type budgetSpend struct {
+	Tenant      string    `json:"tenant"`
+	Period      string    `json:"period"`
+	ModelFamily string    `json:"modelFamily,omitempty"`
+	PeriodStart time.Time `json:"periodStart"`
+	Spent       float64   `json:"spent"`
+	// Warned is set once the soft limit alert of the period was sent
+	Warned bool `json:"warned,omitempty"`
+}
+
+// BudgetTracker enforces the spend budgets of the Maxim API keys, priced from their usage.
+type BudgetTracker struct {
+	pricing  *Pricing
+	accounts maxim.AccountSource
+	mu       sync.Mutex
+	config   BudgetConfig
+	spend    map[string]*budgetSpend
+	dirty    bool
+	stop     chan struct{}
+	now      func() time.Time
+}
+
+// NewBudgetTracker creates a tracker of the budgets of config, or of the budgets of the accounts
+// in accounts, resuming the spend saved in its state file.
+func NewBudgetTracker(config BudgetConfig, pricing *Pricing, accounts maxim.AccountSource) (*BudgetTracker, error) {
+	if config.Location == nil {
+		config.Location = time.UTC
+	}
+	bt := &BudgetTracker{
+		pricing:  pricing,
+		accounts: accounts,
+		config:   config,
+		spend:    make(map[string]*budgetSpend),
+		stop:     make(chan struct{}),
+		now:      time.Now,
+	}
+	if config.StateFile == "" {
+		return bt, nil
+	}
+	data, err := os.ReadFile(config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return bt, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []*budgetSpend
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid budget state file %s: %w", config.StateFile, err)
+	}
+	for _, spend := range saved {
+		bt.spend[spendKey(spend.Tenant, spend.Period, spend.ModelFamily, spend.PeriodStart)] = spend
+	}
+	return bt, nil
+}
+
+// ParseBudgets parses budgets in USD, as in "monthly=soft:800,hard:1000;daily/claude=hard:50",
+// where the model family follows the period.
+func ParseBudgets(spec string) ([]maxim.Budget, error) {
+	var budgets []maxim.Budget
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		scope, settings, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid budget %q, expected period[/model family]=limit:value,...", entry)
+		}
+		period, family, _ := strings.Cut(strings.TrimSpace(scope), "/")
+		budget := maxim.Budget{Period: period, ModelFamily: family}
+		if !validPeriod(period) {
+			return nil, fmt.Errorf("invalid budget period %q, expected daily or monthly", period)
+		}
+		for _, setting := range strings.Split(settings, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(setting), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid budget limit %q of %s, expected limit:value", setting, scope)
+			}
+			amount, err := strconv.ParseFloat(value, 64)
+			if err != nil || amount < 0 {
+				return nil, fmt.Errorf("invalid %s limit of %s: %q", name, scope, value)
+			}
+			switch name {
+			case "soft":
+				budget.SoftLimit = amount
+			case "hard":
+				budget.HardLimit = amount
+			default:
+				return nil, fmt.Errorf("unknown budget limit %q of %s", name, scope)
+			}
+		}
+		budgets = append(budgets, budget)
+	}
+	return budgets, nil
+}
+
+func validPeriod(period string) bool {
+	return period == string(Daily) || period == string(Monthly)
+}
+
+// Handler enforces the budgets of the requests to next, a route of provider. Requests of a key
+// over a hard limit are answered with a 402 in the format of the provider, requests over a soft
+// limit are sent with a warning header. The cost of the responses is added to the spend.
+func (bt *BudgetTracker) Handler(provider string, next fiber.Handler) fiber.Handler {
+	format := providerFormats[provider]
+	return func(c *fiber.Ctx) error {
+		maximApiKey, err := GetMaximApiKey(c.GetReqHeaders())
+		if err != nil {
+			return next(c)
+		}
+		account, err := bt.accounts.GetAccount(maximApiKey)
+		if err != nil {
+			return next(c)
+		}
+		budgets := bt.budgets(account.Data.Budgets)
+		if len(budgets) == 0 {
+			return next(c)
+		}
+		tenant := hashTenant(maximApiKey)
+		model, _ := getModalFromBody(c.Body())
+
+		now := bt.now()
+		for _, budget := range budgets {
+			if !strings.HasPrefix(model, budget.ModelFamily) {
+				continue
+			}
+			spent := bt.spent(tenant, budget, now)
+			if budget.HardLimit > 0 && spent >= budget.HardLimit {
+				return sendBudgetExceeded(c, format, budget, bt.periodEnd(budget, now))
+			}
+			if budget.SoftLimit > 0 && spent >= budget.SoftLimit {
+				c.Append(BudgetWarningHeader, fmt.Sprintf("%.2f USD of the %s budget%s of %.2f USD spent",
+					spent, budget.Period, familySuffix(budget), budget.SoftLimit))
+			}
+		}
+
+		prices := bt.pricing.priceTable()
+		var once sync.Once
+		spend := func(report usageReport) {
+			once.Do(func() {
+				if !report.ok {
+					return
+				}
+				_, servedModel := report.served(provider, model)
+				bt.add(maximApiKey, budgets, servedModel, prices.cost(servedModel, report.usage))
+			})
+		}
+		observeUsage(c, spend)
+		err = next(c)
+		notifyUsage(c, spend)
+		return err
+	}
+}
+
+// SetBudgets changes the configured budgets, the spend of the current periods is kept.
+func (bt *BudgetTracker) SetBudgets(budgets []maxim.Budget) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.config.Budgets = budgets
+}
+
+// budgets returns the budgets of a key, those of its account replace the configured budgets for
+// the same period and model family.
+func (bt *BudgetTracker) budgets(account []maxim.Budget) []maxim.Budget {
+	bt.mu.Lock()
+	configured := bt.config.Budgets
+	bt.mu.Unlock()
+	budgets := make([]maxim.Budget, 0, len(configured)+len(account))
+	for _, budget := range configured {
+		replaced := false
+		for _, override := range account {
+			replaced = replaced || (override.Period == budget.Period && override.ModelFamily == budget.ModelFamily)
+		}
+		if !replaced {
+			budgets = append(budgets, budget)
+		}
+	}
+	for _, budget := range account {
+		if validPeriod(budget.Period) {
+			budgets = append(budgets, budget)
+		}
+	}
+	return budgets
+}
+
+// spent returns what tenant spent against budget in the period of now.
+func (bt *BudgetTracker) spent(tenant string, budget maxim.Budget, now time.Time) float64 {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if spend, ok := bt.spend[spendKey(tenant, budget.Period, budget.ModelFamily, bt.periodStart(budget, now))]; ok {
+		return spend.Spent
+	}
+	return 0
+}
+
+// add adds cost, spent on model by maximApiKey, to the budgets which apply to model and sends
+// the alerts of the soft limits it reaches.
+func (bt *BudgetTracker) add(maximApiKey string, budgets []maxim.Budget, model string, cost float64) {
+	if cost <= 0 {
+		return
+	}
+	tenant := hashTenant(maximApiKey)
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	now := bt.now()
+	for _, budget := range budgets {
+		if !strings.HasPrefix(model, budget.ModelFamily) {
+			continue
+		}
+		periodStart := bt.periodStart(budget, now)
+		key := spendKey(tenant, budget.Period, budget.ModelFamily, periodStart)
+		spend, ok := bt.spend[key]
+		if !ok {
+			spend = &budgetSpend{Tenant: tenant, Period: budget.Period, ModelFamily: budget.ModelFamily, PeriodStart: periodStart}
+			bt.spend[key] = spend
+		}
+		spend.Spent += cost
+		bt.dirty = true
+		if budget.SoftLimit > 0 && spend.Spent >= budget.SoftLimit && !spend.Warned {
+			spend.Warned = true
+			go bt.alert(BudgetAlert{
+				Event:       "budget.soft_limit_reached",
+				Tenant:      maskKey(maximApiKey),
+				Period:      budget.Period,
+				ModelFamily: budget.ModelFamily,
+				PeriodStart: periodStart,
+				SoftLimit:   budget.SoftLimit,
+				HardLimit:   budget.HardLimit,
+				Spent:       spend.Spent,
+			})
+		}
+	}
+}
+
+// alert posts alert to the webhook.
+func (bt *BudgetTracker) alert(alert BudgetAlert) {
+	fmt.Printf("%s of %s: %.2f USD of the %s budget of %.2f USD spent\n",
+		alert.Event, alert.Tenant, alert.Spent, alert.Period, alert.SoftLimit)
+	if bt.config.WebhookUrl == "" {
+		return
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		fmt.Printf("Error encoding budget alert: %v\n", err)
+		return
+	}
+	resp, err := client.Post(bt.config.WebhookUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Error sending budget alert: %v\n", err)
+		return
+	}
+	defer closeResponse(resp)
+	if resp.StatusCode >= http.StatusBadRequest {
+		fmt.Printf("Error sending budget alert: %s\n", resp.Status)
+	}
+}
+
+// periodStart returns the start of the period of budget which now is in.
+func (bt *BudgetTracker) periodStart(budget maxim.Budget, now time.Time) time.Time {
+	year, month, day := now.In(bt.config.Location).Date()
+	if budget.Period == string(Monthly) {
+		day = 1
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, bt.config.Location)
+}
+
+// periodEnd returns when the period of budget which now is in ends.
+func (bt *BudgetTracker) periodEnd(budget maxim.Budget, now time.Time) time.Time {
+	start := bt.periodStart(budget, now)
+	if budget.Period == string(Monthly) {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// Persist saves the spend to the state file every interval when it changed, until Close is called.
+func (bt *BudgetTracker) Persist(interval time.Duration) {
+	if bt.config.StateFile == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-bt.stop:
+				return
+			case <-ticker.C:
+				if err := bt.Save(); err != nil {
+					fmt.Printf("Error saving budget state file %s: %v\n", bt.config.StateFile, err)
+				}
+			}
+		}
+	}()
+}
+
+// Save writes the spend of the current periods to the state file, the spend of past periods is
+// forgotten.
+func (bt *BudgetTracker) Save() error {
+	bt.mu.Lock()
+	if !bt.dirty || bt.config.StateFile == "" {
+		bt.mu.Unlock()
+		return nil
+	}
+	now := bt.now()
+	saved := make([]budgetSpend, 0, len(bt.spend))
+	for key, spend := range bt.spend {
+		if !spend.PeriodStart.Equal(bt.periodStart(maxim.Budget{Period: spend.Period}, now)) {
+			delete(bt.spend, key)
+			continue
+		}
+		saved = append(saved, *spend)
+	}
+	bt.dirty = false
+	bt.mu.Unlock()
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = writeStateFile(bt.config.StateFile, data)
+	}
+	if err != nil {
+		bt.mu.Lock()
+		bt.dirty = true
+		bt.mu.Unlock()
+	}
+	return err
+}
+
+// writeStateFile replaces the content of path with data at once, a crash while writing leaves
+// the previous content.
+func writeStateFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Close stops persisting the spend and saves it a last time.
+func (bt *BudgetTracker) Close() error {
+	select {
+	case <-bt.stop:
+	default:
+		close(bt.stop)
+	}
+	return bt.Save()
+}
+
+// hashTenant identifies a Maxim API key without keeping it.
+func hashTenant(maximApiKey string) string {
+	sum := sha256.Sum256([]byte(maximApiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func spendKey(tenant string, period string, family string, periodStart time.Time) string {
+	return tenant + "\x00" + period + "\x00" + family + "\x00" + periodStart.Format(time.RFC3339)
+}
+
+func familySuffix(budget maxim.Budget) string {
+	if budget.ModelFamily == "" {
+		return ""
+	}
+	return " for " + budget.ModelFamily + " models"
+}
+
+// sendBudgetExceeded answers a request over the hard limit of budget with a 402 in format.
+func sendBudgetExceeded(c *fiber.Ctx, format ApiFormat, budget maxim.Budget, resetAt time.Time) error {
+	message := fmt.Sprintf("The %s budget%s of %.2f USD of this Maxim API key is spent, it resets at %s.",
+		budget.Period, familySuffix(budget), budget.HardLimit, resetAt.Format(time.RFC3339))
+	c.Status(fiber.StatusPaymentRequired)
+	if format == AnthropicFormat {
+		return c.JSON(fiber.Map{
+			"type":  "error",
+			"error": fiber.Map{"type": "billing_error", "message": message},
+		})
+	}
+	return c.JSON(fiber.Map{
+		"error": fiber.Map{"message": message, "type": "insufficient_quota", "param": nil, "code": "insufficient_quota"},
+	})
+}
@@ -0,0 +1,176 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const webhookHost = "hooks.example.com"
+
+// openAIResponseCost is the cost of openAIResponse at the default price of gpt-4o.
+const openAIResponseCost = (3*2.5 + 1*10) / 1e6
+
+// alertRoundTripper receives the budget alerts posted to webhookHost, other requests go to
+// RoundTripper.
+type alertRoundTripper struct {
+	http.RoundTripper
+	alerts chan BudgetAlert
+}
+
+func (art *alertRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != webhookHost {
+		return art.RoundTripper.RoundTrip(req)
+	}
+	var alert BudgetAlert
+	json.NewDecoder(req.Body).Decode(&alert)
+	art.alerts <- alert
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+// setupBudgetApp routes the chat and messages APIs behind tracker, its clock is stopped at the
+// returned time.
+func setupBudgetApp(tracker *BudgetTracker, accountBudgets []maxim.Budget) (*fiber.App, *time.Time) {
+	accounts := testAccounts()
+	accounts.Budgets = accountBudgets
+	mockMaximAccount(accounts)
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+	app, _ := setupWrappedApp(FallbackConfig{}, RetryPolicy{}, func(_ string, provider string, next fiber.Handler) fiber.Handler {
+		return tracker.Handler(provider, next)
+	})
+	return app, &now
+}
+
+func TestParseBudgets(t *testing.T) {
+	budgets, err := ParseBudgets(" monthly=soft:800,hard:1000 ; daily/claude=hard:50")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []maxim.Budget{
+		{Period: "monthly", SoftLimit: 800, HardLimit: 1000},
+		{Period: "daily", ModelFamily: "claude", HardLimit: 50},
+	}, budgets)
+
+	for _, spec := range []string{"monthly", "weekly=hard:10", "daily=hard", "daily=limit:10", "daily=hard:lots", "daily=soft:-1"} {
+		_, err := ParseBudgets(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestBudgetHardLimit(t *testing.T) {
+	newYork, _ := time.LoadLocation("America/New_York")
+	tracker, _ := NewBudgetTracker(BudgetConfig{
+		Budgets:  []maxim.Budget{{Period: "monthly", HardLimit: openAIResponseCost * 1.5}},
+		Location: newYork,
+	}, NewPricing(DefaultPriceTable), testAccountSource)
+	app, now := setupBudgetApp(tracker, nil)
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+
+	for i := 0; i < 2; i++ {
+		resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	// Midnight of July 1st in UTC is still June in New York
+	*now = time.Date(2024, 7, 1, 3, 0, 0, 0, time.UTC)
+	resp, body := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+	assert.JSONEq(t, `{"error":{"type":"insufficient_quota","code":"insufficient_quota","param":null,`+
+		`"message":"The monthly budget of 0.00 USD of this Maxim API key is spent, it resets at 2024-07-01T00:00:00-04:00."}}`, body)
+	assert.Len(t, transport.Requests[openAIHost], 2)
+
+	*now = time.Date(2024, 7, 1, 4, 0, 0, 0, time.UTC)
+	resp, _ = postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestBudgetOfModelFamilyFromAccount(t *testing.T) {
+	tracker, _ := NewBudgetTracker(BudgetConfig{
+		Budgets: []maxim.Budget{{Period: "daily", ModelFamily: "claude", HardLimit: 100}},
+	}, NewPricing(DefaultPriceTable), testAccountSource)
+	app, _ := setupBudgetApp(tracker, []maxim.Budget{{Period: "daily", ModelFamily: "claude", HardLimit: 0.00001}})
+	mockHostClient(map[string]hostResponse{
+		openAIHost:    {StatusCode: http.StatusOK, Body: openAIResponse},
+		anthropicHost: {StatusCode: http.StatusOK, Body: anthropicResponseBody},
+	})
+	messages := `{"model":"claude-3-5-sonnet","max_tokens":100,"messages":[]}`
+
+	resp, _ := postJSON(app, "/v1/messages", messages)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body := postJSON(app, "/v1/messages", messages)
+
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+	assert.Contains(t, body, `"type":"billing_error"`)
+	assert.Contains(t, body, "daily budget for claude models")
+	// The other models are not limited by the budget of the family
+	resp, _ = postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestBudgetSoftLimit(t *testing.T) {
+	tracker, _ := NewBudgetTracker(BudgetConfig{
+		Budgets:    []maxim.Budget{{Period: "daily", SoftLimit: openAIResponseCost, HardLimit: 1}},
+		WebhookUrl: "https://" + webhookHost + "/budgets",
+	}, NewPricing(DefaultPriceTable), testAccountSource)
+	app, _ := setupBudgetApp(tracker, nil)
+	mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+	alerts := make(chan BudgetAlert, 10)
+	client = &http.Client{Transport: &alertRoundTripper{RoundTripper: client.Transport, alerts: alerts}}
+
+	resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	assert.Empty(t, resp.Header.Get(BudgetWarningHeader))
+	select {
+	case alert := <-alerts:
+		assert.Equal(t, BudgetAlert{
+			Event: "budget.soft_limit_reached", Tenant: "max...-key", Period: "daily",
+			PeriodStart: time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC),
+			SoftLimit:   openAIResponseCost, HardLimit: 1, Spent: openAIResponseCost,
+		}, alert)
+	case <-time.After(time.Second):
+		t.Fatal("no budget alert was sent")
+	}
+
+	// The requests over the soft limit carry a warning, the alert is only sent once
+	resp, _ = postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0.00 USD of the daily budget of 0.00 USD spent", resp.Header.Get(BudgetWarningHeader))
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	select {
+	case <-alerts:
+		t.Fatal("the budget alert was sent again")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBudgetStatePersisted(t *testing.T) {
+	config := BudgetConfig{
+		Budgets:   []maxim.Budget{{Period: "monthly", SoftLimit: 10, HardLimit: 20}},
+		StateFile: filepath.Join(t.TempDir(), "budgets.json"),
+	}
+	tracker, err := NewBudgetTracker(config, NewPricing(DefaultPriceTable), testAccountSource)
+	assert.NoError(t, err)
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+	tracker.add("maxim-api-key", config.Budgets, "gpt-4o", 12.5)
+	tracker.add("other-maxim-api-key", config.Budgets, "gpt-4o", 1)
+	assert.NoError(t, tracker.Close())
+
+	restarted, err := NewBudgetTracker(config, NewPricing(DefaultPriceTable), testAccountSource)
+	assert.NoError(t, err)
+	assert.Equal(t, 12.5, restarted.spent(hashTenant("maxim-api-key"), config.Budgets[0], now))
+	assert.Equal(t, float64(1), restarted.spent(hashTenant("other-maxim-api-key"), config.Budgets[0], now))
+
+	// The spend of past periods is dropped when the state is saved
+	restarted.now = func() time.Time { return now.AddDate(0, 1, 0) }
+	restarted.add("maxim-api-key", config.Budgets, "gpt-4o", 2)
+	assert.NoError(t, restarted.Save())
+	restarted, _ = NewBudgetTracker(config, NewPricing(DefaultPriceTable), testAccountSource)
+	assert.Len(t, restarted.spend, 1)
+	assert.Equal(t, float64(2), restarted.spent(hashTenant("maxim-api-key"), config.Budgets[0], now.AddDate(0, 1, 0)))
+}
@@ -0,0 +1,407 @@
+package modal_proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ServedByHeader reports the provider and the model which served a request, as provider/model.
+const ServedByHeader = "x-bifrost-served-by"
+
+// Names of the providers fallback targets refer to.
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAzure     = "azure"
+	ProviderAnthropic = "anthropic"
+)
+
+// providerFormats is the API format each provider speaks.
+var providerFormats = map[string]ApiFormat{
+	ProviderOpenAI:    OpenAIFormat,
+	ProviderAzure:     OpenAIFormat,
+	ProviderAnthropic: AnthropicFormat,
+}
+
+// providerNames are used in the error responses of the providers.
+var providerNames = map[string]string{
+	ProviderOpenAI:    "OpenAI",
+	ProviderAzure:     "Azure OpenAI",
+	ProviderAnthropic: "Anthropic",
+}
+
+// errFallbackTimeout is returned when a target did not answer within the fallback timeout.
+var errFallbackTimeout = errors.New("timed out waiting for the response")
+
+// FallbackTarget is a provider and the model to ask it for.
+type FallbackTarget struct {
+	Provider string
+	Model    string
+}
+
+func (ft FallbackTarget) String() string {
+	return ft.Provider + "/" + ft.Model
+}
+
+// FallbackConfig configures the fallback router.
+type FallbackConfig struct {
+	// Chains are the targets tried in order, by requested model, when the provider of the route fails
+	Chains map[string][]FallbackTarget
+	// Timeout bounds the wait for the response headers of a target before moving to the next,
+	// zero waits as long as the HTTP client does
+	Timeout time.Duration
+}
+
+// FallbackRouter proxies chat requests to the provider of their route and, when it fails with
+// a retryable error, to the fallback chain of the requested model. Requests are translated
+// between the OpenAI and Anthropic formats when a target speaks the other one.
+type FallbackRouter struct {
+	providers map[string]ModalProviderInterface
+	config    FallbackConfig
+	// metrics counts the retries and fallbacks, nil when they are not measured
+	metrics *Metrics
+}
+
+// NewFallbackRouter creates a fallback router over providers, keyed by provider name.
+func NewFallbackRouter(providers map[string]ModalProviderInterface, config FallbackConfig) *FallbackRouter {
+	return &FallbackRouter{
+		providers: providers,
+		config:    config,
+	}
+}
+
+// SetMetrics counts the retries and the fallbacks of the router in metrics, which labels the
+// models of the chains of the router apart.
+func (fr *FallbackRouter) SetMetrics(metrics *Metrics) {
+	fr.metrics = metrics
+	metrics.setChains(fr.config.Chains)
+}
+
+// ParseFallbackChains parses fallback chains written as
+// model=provider/model,provider/model;model=provider/model
+func ParseFallbackChains(spec string) (map[string][]FallbackTarget, error) {
+	chains := make(map[string][]FallbackTarget)
+	for _, chain := range strings.Split(spec, ";") {
+		if chain = strings.TrimSpace(chain); chain == "" {
+			continue
+		}
+		model, targets, ok := strings.Cut(chain, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid fallback chain %q, expected model=provider/model,...", chain)
+		}
+		for _, target := range strings.Split(targets, ",") {
+			provider, targetModel, ok := strings.Cut(strings.TrimSpace(target), "/")
+			if !ok || targetModel == "" {
+				return nil, fmt.Errorf("invalid fallback target %q of %s, expected provider/model", target, model)
+			}
+			if _, ok := providerFormats[provider]; !ok {
+				return nil, fmt.Errorf("unknown provider %q in the fallback chain of %s", provider, model)
+			}
+			chains[model] = append(chains[model], FallbackTarget{Provider: provider, Model: targetModel})
+		}
+	}
+	return chains, nil
+}
+
+// Handler proxies the requests of a route to apiPath of provider, retrying transient failures
+// of each provider with retry. Chat requests for a model of another provider are translated to
+// its format, and requests whose model has a fallback chain move down the chain when the
+// provider fails.
+func (fr *FallbackRouter) Handler(provider string, apiPath string, retry RetryPolicy) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Method() != http.MethodPost {
+			return c.Status(fiber.StatusMethodNotAllowed).SendString("Only POST method is allowed")
+		}
+		format := providerFormats[provider]
+		model, err := getModalFromBody(c.Body())
+		if err != nil {
+			return fr.providers[provider].GetCompletion(c, apiPath)
+		}
+		routed := routedProvider(c, provider, model)
+		chain := fr.config.Chains[model]
+		if apiPaths[format] != apiPath || (len(chain) == 0 && routed == provider) {
+			return fr.forward(c, FallbackTarget{Provider: provider, Model: model}, apiPath, retry)
+		}
+		targets := []FallbackTarget{{Provider: routed, Model: model}}
+		for _, target := range chain {
+			if target != targets[0] {
+				targets = append(targets, target)
+			}
+		}
+		return fr.proxy(c, format, targets, retry)
+	}
+}
+
+// forward proxies the request as is to apiPath of the provider of target.
+func (fr *FallbackRouter) forward(c *fiber.Ctx, target FallbackTarget, apiPath string, retry RetryPolicy) error {
+	fmt.Printf("Received request to %s API\n", providerNames[target.Provider])
+	c.Set(ServedByHeader, target.String())
+	resp, err := fr.send(c, target, apiPath, c.Body(), retry, 0)
+	if err != nil {
+		return sendProxyError(c, err)
+	}
+	return relayResponse(c, resp, providerNames[target.Provider])
+}
+
+// modelProvider returns the provider serving model on a route of provider. Claude models asked
+// for on an OpenAI route are served by Anthropic, other models asked for on the Anthropic route
+// are served by OpenAI.
+func modelProvider(provider string, model string) string {
+	switch {
+	case providerFormats[provider] == OpenAIFormat && isClaudeModel(model):
+		return ProviderAnthropic
+	case providerFormats[provider] == AnthropicFormat && !isClaudeModel(model):
+		return ProviderOpenAI
+	}
+	return provider
+}
+
+func isClaudeModel(model string) bool {
+	return strings.HasPrefix(model, "claude")
+}
+
+// proxy tries targets in order until one of them answers with a non-retryable status, the last
+// failure is sent to the caller when all of them fail.
+func (fr *FallbackRouter) proxy(c *fiber.Ctx, format ApiFormat, targets []FallbackTarget, retry RetryPolicy) error {
+	stream := isStreamRequest(c.Body())
+	var lastErr error
+	for i, target := range targets {
+		if _, ok := fr.providers[target.Provider]; !ok {
+			continue
+		}
+		targetFormat := providerFormats[target.Provider]
+		if stream && targetFormat != format && !canTranslateStream(targetFormat, format) {
+			continue
+		}
+		body, err := translateRequest(c.Body(), format, targetFormat)
+		if err == nil {
+			body, err = withModel(body, target.Model)
+		}
+		if err != nil {
+			fmt.Printf("Error translating request for %s: %v\n", target, err)
+			if lastErr == nil {
+				lastErr = &ProxyError{Status: fiber.StatusBadRequest, Message: err.Error(), Err: err}
+			}
+			continue
+		}
+		resp, err := fr.send(c, target, apiPaths[targetFormat], body, retry, fr.config.Timeout)
+		last := i == len(targets)-1
+		if errors.Is(err, ErrNoEligibleKey) {
+			// The account has no key for the target, skip it without hiding an earlier failure
+			if lastErr == nil {
+				lastErr = err
+			}
+			continue
+		}
+		if err != nil {
+			if !last && isFallbackError(err) {
+				fmt.Printf("Falling back from %s: %v\n", target, err)
+				fr.metrics.fellBack(target, nil, err)
+				lastErr = err
+				continue
+			}
+			c.Set(ServedByHeader, target.String())
+			return sendProxyError(c, err)
+		}
+		if !last && isFallbackStatus(resp.StatusCode) {
+			fmt.Printf("Falling back from %s: %s\n", target, resp.Status)
+			fr.metrics.fellBack(target, resp, nil)
+			closeResponse(resp)
+			lastErr = &ProxyError{Status: resp.StatusCode, Message: "Error response from " + providerNames[target.Provider] + " API: " + resp.Status}
+			continue
+		}
+		c.Set(ServedByHeader, target.String())
+		if targetFormat == format {
+			return relayResponse(c, resp, providerNames[target.Provider])
+		}
+		return relayTranslatedResponse(c, resp, providerNames[target.Provider], targetFormat, format)
+	}
+	if lastErr == nil {
+		lastErr = &ProxyError{Status: fiber.StatusBadGateway, Message: "No provider available for the request"}
+	}
+	return sendProxyError(c, lastErr)
+}
+
+// send sends body to the provider of target, retrying connection failures and transient
+// statuses with retry. Nothing has been relayed to the caller yet, the response returned is
+// the first one which is not retried.
+func (fr *FallbackRouter) send(c *fiber.Ctx, target FallbackTarget, apiPath string, body []byte, retry RetryPolicy, timeout time.Duration) (*http.Response, error) {
+	provider := fr.providers[target.Provider]
+	ctx, cancel := requestContext(c)
+	var deadline time.Time
+	if retry.Deadline > 0 {
+		deadline = time.Now().Add(retry.Deadline)
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := sendWithTimeout(ctx, c, provider, apiPath, body, timeout)
+		retryable := (err == nil && isRetryStatus(resp.StatusCode)) || (err != nil && isRetryError(err))
+		if attempt >= retry.MaxAttempts || !retryable {
+			return cancelAfterBody(resp, cancel), err
+		}
+		wait := retry.backoff(attempt)
+		if err == nil {
+			if hint, ok := retryAfter(resp.Header, time.Now()); ok {
+				if retry.MaxBackoff > 0 && hint > retry.MaxBackoff {
+					// Waiting that long is left to the fallback chain or the caller
+					return cancelAfterBody(resp, cancel), nil
+				}
+				wait = max(wait, hint)
+			}
+		}
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			// The retry would end past the deadline of the request, the caller gets this answer
+			return cancelAfterBody(resp, cancel), err
+		}
+		fr.metrics.retried(target, resp, err)
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			closeResponse(resp)
+		}
+		fmt.Printf("Retrying %s in %s after %s\n", target, wait, reason)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			err := ctx.Err()
+			cancel()
+			return nil, &ProxyError{Status: fiber.StatusGatewayTimeout, Message: "Request cancelled while waiting to retry", Err: err}
+		}
+	}
+}
+
+// requestContext returns the context of the upstream requests of c, cancelled with the context
+// of the caller or when the server shuts down. fasthttp does not report connections closed by
+// the caller, the retries are bounded by their deadline instead. The context must be cancelled
+// once the upstream response is no longer read.
+func requestContext(c *fiber.Ctx) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.UserContext())
+	shutdown := c.Context().Done()
+	go func() {
+		select {
+		case <-shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// cancelAfterBody calls cancel once the body of resp is closed, or right away without a response.
+func cancelAfterBody(resp *http.Response, cancel context.CancelFunc) *http.Response {
+	if resp == nil {
+		cancel()
+		return nil
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: cancel}
+	return resp
+}
+
+// sendWithTimeout sends body to provider, giving up when the response headers take longer than
+// timeout, zero waits as long as the HTTP client does. The timeout no longer applies once the
+// body is being read.
+func sendWithTimeout(ctx context.Context, c *fiber.Ctx, provider ModalProviderInterface, apiPath string, body []byte, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return provider.SendRequest(ctx, c, apiPath, body)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := provider.SendRequest(ctx, c, apiPath, body)
+	if !timer.Stop() {
+		if resp != nil {
+			closeResponse(resp)
+		}
+		cancel()
+		return nil, &ProxyError{Status: fiber.StatusGatewayTimeout, Message: "Error making request: " + errFallbackTimeout.Error(), Err: errFallbackTimeout}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the context of a request once its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (coc *cancelOnClose) Close() error {
+	defer coc.cancel()
+	return coc.ReadCloser.Close()
+}
+
+// isFallbackStatus reports whether the next target should be tried after an upstream status.
+func isFallbackStatus(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// isFallbackError reports whether the next target should be tried after a failure to get a
+// response. Failures of the request itself, like a missing Maxim API key, are not retried.
+func isFallbackError(err error) bool {
+	if errors.Is(err, errFallbackTimeout) {
+		return true
+	}
+	var proxyErr *ProxyError
+	return errors.As(err, &proxyErr) && proxyErr.Status >= 500
+}
+
+// isStreamRequest reports whether a JSON request body asks for a streamed response.
+func isStreamRequest(body []byte) bool {
+	var request struct {
+		Stream bool `json:"stream"`
+	}
+	return json.Unmarshal(body, &request) == nil && request.Stream
+}
+
+// canTranslateStream reports whether streams of the from format can be relayed in the to format.
+func canTranslateStream(from, to ApiFormat) bool {
+	_, err := newStreamTranslator(from, to, nil)
+	return err == nil
+}
+
+// relayTranslatedResponse sends the response of providerName to the caller in the format it asked for.
+func relayTranslatedResponse(c *fiber.Ctx, resp *http.Response, providerName string, from, to ApiFormat) error {
+	if resp.StatusCode != http.StatusOK {
+		closeResponse(resp)
+		return c.Status(resp.StatusCode).SendString("Error response from " + providerName + " API: " + resp.Status)
+	}
+	reader, err := decodedBody(resp)
+	if err != nil {
+		closeResponse(resp)
+		return c.Status(fiber.StatusInternalServerError).SendString("Error reading gzip response")
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		translator, err := newStreamTranslator(from, to, c.Body())
+		if err != nil {
+			closeResponse(resp)
+			return c.Status(fiber.StatusBadGateway).SendString(err.Error())
+		}
+		// The body is closed once the stream has been relayed
+		relayTranslatedStream(c, resp, reader, translator)
+		return nil
+	}
+	defer closeResponse(resp)
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Error reading response body")
+	}
+	translated, err := translateResponse(body, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).SendString("Error translating response from " + providerName + " API: " + err.Error())
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(fiber.StatusOK).Send(translated)
+}
@@ -0,0 +1,375 @@
+package modal_proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// hostResponse is the answer of a host to the requests of the hostRoundTripper.
+type hostResponse struct {
+	StatusCode  int
+	Body        string
+	ContentType string
+	Header      http.Header
+	Delay       time.Duration
+	// Err fails the request as if the host could not be reached
+	Err error
+}
+
+// hostRoundTripper answers requests by host and records the requests sent to each host. The
+// Sequences of a host answer its first requests, in order, before its Responses.
+type hostRoundTripper struct {
+	Responses map[string]hostResponse
+	Sequences map[string][]hostResponse
+	Requests  map[string][]string
+	// Closed counts the response bodies of each host closed by the proxy
+	Closed map[string]int
+}
+
+// closeRecorder counts the close of a response body in the Closed of its host.
+type closeRecorder struct {
+	io.Reader
+	host      string
+	transport *hostRoundTripper
+}
+
+func (cr *closeRecorder) Close() error {
+	cr.transport.Closed[cr.host]++
+	return nil
+}
+
+func (hrt *hostRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	hrt.Requests[req.URL.Host] = append(hrt.Requests[req.URL.Host], string(body))
+	response := hrt.Responses[req.URL.Host]
+	if sequence := hrt.Sequences[req.URL.Host]; len(sequence) > 0 {
+		response, hrt.Sequences[req.URL.Host] = sequence[0], sequence[1:]
+	}
+	if response.Err != nil {
+		return nil, response.Err
+	}
+	if response.Delay > 0 {
+		select {
+		case <-time.After(response.Delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	contentType := response.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	header := http.Header{"Content-Type": []string{contentType}}
+	for key, values := range response.Header {
+		header[key] = values
+	}
+	return &http.Response{
+		StatusCode: response.StatusCode,
+		Status:     http.StatusText(response.StatusCode),
+		Body:       &closeRecorder{Reader: strings.NewReader(response.Body), host: req.URL.Host, transport: hrt},
+		Header:     header,
+	}, nil
+}
+
+func mockHostClient(responses map[string]hostResponse) *hostRoundTripper {
+	transport := &hostRoundTripper{
+		Responses: responses,
+		Sequences: make(map[string][]hostResponse),
+		Requests:  make(map[string][]string),
+		Closed:    make(map[string]int),
+	}
+	client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Second,
+	}
+	return transport
+}
+
+const (
+	openAIHost    = "api.openai.com"
+	azureHost     = "bifrost.openai.azure.com"
+	anthropicHost = "api.anthropic.com"
+)
+
+const openAIResponse = `{"id":"chatcmpl-1","object":"chat.completion","created":1,"model":"gpt-4o",` +
+	`"choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],` +
+	`"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`
+
+const anthropicResponseBody = `{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-sonnet",` +
+	`"content":[{"type":"text","text":"hello from claude"}],"stop_reason":"end_turn","stop_sequence":null,` +
+	`"usage":{"input_tokens":5,"output_tokens":4}}`
+
+func setupFallbackApp(config FallbackConfig) *fiber.App {
+	return setupRetryApp(config, RetryPolicy{})
+}
+
+// setupRetryApp routes the chat, completion and messages APIs with retry.
+func setupRetryApp(config FallbackConfig, retry RetryPolicy) *fiber.App {
+	mockMaximAccount(fallbackAccounts())
+	router := NewFallbackRouter(map[string]ModalProviderInterface{
+		ProviderOpenAI:    NewOpenAIProvider("https://"+openAIHost, testAccountSource),
+		ProviderAzure:     NewAzureModalProvider(AzureApiVersion, testAccountSource),
+		ProviderAnthropic: NewAnthropicModalProvider("https://"+anthropicHost, testAccountSource),
+	}, config)
+	app := fiber.New()
+	app.Post("/v1/chat/completions", router.Handler(ProviderOpenAI, "/v1/chat/completions", retry))
+	app.Post("/v1/completions", router.Handler(ProviderOpenAI, "/v1/completions", retry))
+	app.Post("/v1/messages", router.Handler(ProviderAnthropic, "/v1/messages", retry))
+	return app
+}
+
+func fallbackConfig() FallbackConfig {
+	return FallbackConfig{Chains: map[string][]FallbackTarget{
+		"gpt-4o": {{Provider: ProviderAzure, Model: "gpt-4o"}, {Provider: ProviderAnthropic, Model: "claude-3-5-sonnet"}},
+	}}
+}
+
+func postJSON(app *fiber.App, path string, body string) (*http.Response, string) {
+	req := newCompletionRequest(body)
+	req.URL.Path = path
+	req.RequestURI = path
+	resp, _ := app.Test(req, -1)
+	content, _ := io.ReadAll(resp.Body)
+	return resp, string(content)
+}
+
+func TestParseFallbackChains(t *testing.T) {
+	chains, err := ParseFallbackChains(" gpt-4o=azure/gpt-4o, anthropic/claude-3-5-sonnet ; claude-3-5-sonnet=openai/gpt-4o")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]FallbackTarget{
+		"gpt-4o":            {{Provider: ProviderAzure, Model: "gpt-4o"}, {Provider: ProviderAnthropic, Model: "claude-3-5-sonnet"}},
+		"claude-3-5-sonnet": {{Provider: ProviderOpenAI, Model: "gpt-4o"}},
+	}, chains)
+
+	for _, spec := range []string{"gpt-4o", "gpt-4o=azure", "gpt-4o=bedrock/claude", "=azure/gpt-4o"} {
+		_, err := ParseFallbackChains(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestFallbackServedByPrimary(t *testing.T) {
+	app := setupFallbackApp(fallbackConfig())
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+
+	resp, body := postJSON(app, "/v1/chat/completions", testRequestBody)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "openai/gpt-4o", resp.Header.Get(ServedByHeader))
+	assert.JSONEq(t, openAIResponse, body)
+	assert.Len(t, transport.Requests[azureHost], 0)
+}
+
+func TestFallbackToSameFormat(t *testing.T) {
+	app := setupFallbackApp(fallbackConfig())
+	transport := mockHostClient(map[string]hostResponse{
+		openAIHost: {StatusCode: http.StatusTooManyRequests},
+		azureHost:  {StatusCode: http.StatusOK, Body: openAIResponse},
+	})
+
+	resp, body := postJSON(app, "/v1/chat/completions", testRequestBody)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "azure/gpt-4o", resp.Header.Get(ServedByHeader))
+	assert.JSONEq(t, openAIResponse, body)
+	assert.Len(t, transport.Requests[openAIHost], 1)
+	assert.Len(t, transport.Requests[azureHost], 1)
+}
+
+func TestFallbackAcrossFormats(t *testing.T) {
+	app := setupFallbackApp(fallbackConfig())
+	transport := mockHostClient(map[string]hostResponse{
+		openAIHost:    {StatusCode: http.StatusInternalServerError},
+		azureHost:     {StatusCode: http.StatusServiceUnavailable},
+		anthropicHost: {StatusCode: http.StatusOK, Body: anthropicResponseBody},
+	})
+
+	resp, body := postJSON(app, "/v1/chat/completions",
+		`{"model":"gpt-4o","max_tokens":100,"messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "anthropic/claude-3-5-sonnet", resp.Header.Get(ServedByHeader))
+	assert.Len(t, transport.Requests[anthropicHost], 1)
+	assert.JSONEq(t, `{"model":"claude-3-5-sonnet","system":"be brief","max_tokens":100,`+
+		`"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}]}`, transport.Requests[anthropicHost][0])
+
+	var completion openAIChatResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &completion))
+	assert.Equal(t, "chat.completion", completion.Object)
+	assert.Equal(t, `"hello from claude"`, string(completion.Choices[0].Message.Content))
+	assert.Equal(t, "stop", completion.Choices[0].FinishReason)
+	assert.Equal(t, 9, completion.Usage.TotalTokens)
+}
+
+func TestFallbackFromAnthropicRoute(t *testing.T) {
+	config := FallbackConfig{Chains: map[string][]FallbackTarget{
+		"claude-3-5-sonnet": {{Provider: ProviderOpenAI, Model: "gpt-4o"}},
+	}}
+	app := setupFallbackApp(config)
+	mockHostClient(map[string]hostResponse{
+		anthropicHost: {StatusCode: 529},
+		openAIHost:    {StatusCode: http.StatusOK, Body: openAIResponse},
+	})
+
+	resp, body := postJSON(app, "/v1/messages",
+		`{"model":"claude-3-5-sonnet","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "openai/gpt-4o", resp.Header.Get(ServedByHeader))
+	var message anthropicResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &message))
+	assert.Equal(t, "message", message.Type)
+	assert.Equal(t, "hello", message.Content[0].Text)
+	assert.Equal(t, "end_turn", message.StopReason)
+	assert.Equal(t, anthropicUsage{InputTokens: 3, OutputTokens: 1}, message.Usage)
+}
+
+func TestFallbackDoesNotRetryClientErrors(t *testing.T) {
+	app := setupFallbackApp(fallbackConfig())
+	transport := mockHostClient(map[string]hostResponse{
+		openAIHost: {StatusCode: http.StatusBadRequest},
+		azureHost:  {StatusCode: http.StatusOK, Body: openAIResponse},
+	})
+
+	resp, _ := postJSON(app, "/v1/chat/completions", testRequestBody)
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "openai/gpt-4o", resp.Header.Get(ServedByHeader))
+	assert.Len(t, transport.Requests[azureHost], 0)
+}
+
+func TestFallbackAllTargetsFail(t *testing.T) {
+	app := setupFallbackApp(fallbackConfig())
+	mockHostClient(map[string]hostResponse{
+		openAIHost:    {StatusCode: http.StatusTooManyRequests},
+		azureHost:     {StatusCode: http.StatusTooManyRequests},
+		anthropicHost: {StatusCode: http.StatusServiceUnavailable},
+	})
+
+	resp, body := postJSON(app, "/v1/chat/completions", testRequestBody)
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "anthropic/claude-3-5-sonnet", resp.Header.Get(ServedByHeader))
+	assert.Contains(t, body, "Anthropic")
+}
+
+func TestFallbackTimeout(t *testing.T) {
+	config := fallbackConfig()
+	config.Timeout = 50 * time.Millisecond
+	app := setupFallbackApp(config)
+	mockHostClient(map[string]hostResponse{
+		openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse, Delay: 500 * time.Millisecond},
+		azureHost:  {StatusCode: http.StatusOK, Body: openAIResponse},
+	})
+
+	resp, _ := postJSON(app, "/v1/chat/completions", testRequestBody)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "azure/gpt-4o", resp.Header.Get(ServedByHeader))
+}
+
+func TestFallbackSkipsTargetsWithoutKeys(t *testing.T) {
+	app := setupFallbackApp(fallbackConfig())
+	mockMaximAccount(testAccounts())
+	transport := mockHostClient(map[string]hostResponse{
+		openAIHost:    {StatusCode: http.StatusBadGateway},
+		anthropicHost: {StatusCode: http.StatusOK, Body: anthropicResponseBody},
+	})
+
+	resp, _ := postJSON(app, "/v1/chat/completions", testRequestBody)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "anthropic/claude-3-5-sonnet", resp.Header.Get(ServedByHeader))
+	assert.Len(t, transport.Requests[azureHost], 0)
+}
+
+func TestFallbackTranslatesStreams(t *testing.T) {
+	app := setupFallbackApp(fallbackConfig())
+	transport := mockHostClient(map[string]hostResponse{
+		openAIHost:    {StatusCode: http.StatusInternalServerError},
+		azureHost:     {StatusCode: http.StatusInternalServerError},
+		anthropicHost: {StatusCode: http.StatusOK, Body: anthropicStream, ContentType: "text/event-stream"},
+	})
+
+	resp, body := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "anthropic/claude-3-5-sonnet", resp.Header.Get(ServedByHeader))
+	assert.Len(t, transport.Requests[anthropicHost], 1)
+	assert.Contains(t, body, `"object":"chat.completion.chunk"`)
+	assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+}
+
+func TestClaudeModelOnOpenAIRoute(t *testing.T) {
+	app := setupFallbackApp(FallbackConfig{})
+	transport := mockHostClient(map[string]hostResponse{anthropicHost: {StatusCode: http.StatusOK, Body: anthropicResponseBody}})
+
+	resp, body := postJSON(app, "/v1/chat/completions", `{"model":"claude-3-5-sonnet","messages":[{"role":"user","content":"hi"}]}`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "anthropic/claude-3-5-sonnet", resp.Header.Get(ServedByHeader))
+	assert.Len(t, transport.Requests[openAIHost], 0)
+	assert.JSONEq(t, `{"model":"claude-3-5-sonnet","max_tokens":4096,"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}]}`,
+		transport.Requests[anthropicHost][0])
+	assert.Contains(t, body, `"content":"hello from claude"`)
+}
+
+func TestOpenAIModelOnAnthropicRoute(t *testing.T) {
+	app := setupFallbackApp(FallbackConfig{})
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+
+	resp, body := postJSON(app, "/v1/messages", `{"model":"gpt-4o","max_tokens":100,"system":"be brief",`+
+		`"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}]}`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "openai/gpt-4o", resp.Header.Get(ServedByHeader))
+	assert.Len(t, transport.Requests[anthropicHost], 0)
+	assert.JSONEq(t, `{"model":"gpt-4o","max_tokens":100,"messages":[{"role":"system","content":"be brief"},`+
+		`{"role":"user","content":[{"type":"text","text":"hi"}]}]}`, transport.Requests[openAIHost][0])
+	var message anthropicResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &message))
+	assert.Equal(t, "hello", message.Content[0].Text)
+}
+
+func TestTranslatedResponseClosedOnDecodeError(t *testing.T) {
+	app := setupFallbackApp(FallbackConfig{})
+	transport := mockHostClient(map[string]hostResponse{
+		openAIHost: {StatusCode: http.StatusOK, Body: "not gzip", Header: http.Header{"Content-Encoding": []string{"gzip"}}},
+	})
+
+	resp, _ := postJSON(app, "/v1/messages", `{"model":"gpt-4o","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, 1, transport.Closed[openAIHost])
+}
+
+func TestOpenAIModelStreamOnAnthropicRoute(t *testing.T) {
+	app := setupFallbackApp(FallbackConfig{})
+	transport := mockHostClient(map[string]hostResponse{
+		openAIHost: {StatusCode: http.StatusOK, Body: openAIStream, ContentType: "text/event-stream"},
+	})
+
+	resp, body := postJSON(app, "/v1/messages", `{"model":"gpt-4o","max_tokens":100,"stream":true,`+
+		`"messages":[{"role":"user","content":"hi"}]}`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, transport.Requests[openAIHost][0], `"stream_options":{"include_usage":true}`)
+	assert.True(t, strings.HasPrefix(body, "event: message_start\n"))
+	assert.True(t, strings.HasSuffix(body, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"))
+}
+
+func TestFallbackOnlyForChatRoutes(t *testing.T) {
+	app := setupFallbackApp(fallbackConfig())
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusInternalServerError}})
+
+	resp, _ := postJSON(app, "/v1/completions", `{"model":"gpt-4o","prompt":"hi"}`)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Len(t, transport.Requests[azureHost], 0)
+}
@@ -0,0 +1,44 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// fallbackAccounts are the test accounts with an Azure deployment of gpt-4o to fall back to.
+func fallbackAccounts() maxim.Accounts {
+	accounts := testAccounts()
+	accounts.Azure = []maxim.Azure{
+		{
+			BaseURL:       "https://" + azureHost,
+			APIKey1:       "azure-api-key-1",
+			DeploymentIds: []maxim.DeploymentID{{ID: "gpt4o-prod", Model: "gpt-4o"}},
+		},
+	}
+	return accounts
+}
+
+// routeWrapper wraps the handler of the apiPath route of provider with the middlewares under test.
+type routeWrapper func(apiPath string, provider string, next fiber.Handler) fiber.Handler
+
+// setupWrappedApp routes the chat API to OpenAI and the messages API to Anthropic through a
+// fallback router with config and retry, each route wrapped by wrap. The Maxim account is left
+// to the caller to mock.
+func setupWrappedApp(config FallbackConfig, retry RetryPolicy, wrap routeWrapper) (*fiber.App, *FallbackRouter) {
+	router := NewFallbackRouter(map[string]ModalProviderInterface{
+		ProviderOpenAI:    NewOpenAIProvider("https://"+openAIHost, testAccountSource),
+		ProviderAzure:     NewAzureModalProvider(AzureApiVersion, testAccountSource),
+		ProviderAnthropic: NewAnthropicModalProvider("https://"+anthropicHost, testAccountSource),
+	}, config)
+	app := fiber.New()
+	for apiPath, provider := range map[string]string{"/v1/chat/completions": ProviderOpenAI, "/v1/messages": ProviderAnthropic} {
+		app.Post(apiPath, wrap(apiPath, provider, router.Handler(provider, apiPath, retry)))
+	}
+	return app, router
+}
+
+// shortAnthropicStream is a stream of a single frame, relayed before the handler which started
+// it returns.
+const shortAnthropicStream = "event: message_start\n" +
+	`data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-sonnet","content":[],"usage":{"input_tokens":10,"output_tokens":1}}}` + "\n\n"
@@ -0,0 +1,419 @@
+package modal_proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyStrategy is how a key pool picks among the keys eligible for a request.
+type KeyStrategy string
+
+const (
+	// WeightedRoundRobin spreads the requests over the keys by weight, scaled down by their error rate
+	WeightedRoundRobin KeyStrategy = "weighted_round_robin"
+	// LeastInFlight picks the key with the fewest requests in flight
+	LeastInFlight KeyStrategy = "least_in_flight"
+)
+
+// ErrKeysCoolingDown is returned when all the keys eligible for a request are cooling down
+// after rate limit or authentication errors, or have exhausted their rate limits.
+var ErrKeysCoolingDown = errors.New("all API keys for the requested modal are cooling down")
+
+// KeyPoolConfig configures a key pool.
+type KeyPoolConfig struct {
+	Strategy KeyStrategy
+	// RateLimitCooldown is how long a key rests after a 429 which does not say when to retry
+	RateLimitCooldown time.Duration
+	// AuthCooldown is how long a key rests after a 401 or a 403
+	AuthCooldown time.Duration
+	// RateLimitReserve is the fraction of the rate limits of a key below which other keys are
+	// preferred, the budgets are read from the rate limit headers of the responses
+	RateLimitReserve float64
+	// MaxQueueWait is how long a request waits for a key when they are all resting, the request
+	// fails right away when none is available sooner
+	MaxQueueWait time.Duration
+}
+
+// DefaultKeyPoolConfig is the configuration of the key pools of the providers.
+var DefaultKeyPoolConfig = KeyPoolConfig{
+	Strategy:          WeightedRoundRobin,
+	RateLimitCooldown: 30 * time.Second,
+	AuthCooldown:      5 * time.Minute,
+	RateLimitReserve:  0.05,
+	MaxQueueWait:      time.Second,
+}
+
+const (
+	// healthDecay is the weight of the latest request in the success rate and latency of a key
+	healthDecay = 0.2
+	// minSuccessRate keeps a share of the requests on failing keys, so their recovery is noticed
+	minSuccessRate = 0.1
+	// keyIdleTTL is how long the health of a key no request was eligible for is kept, so the keys
+	// removed from the accounts or rotated out are forgotten
+	keyIdleTTL = time.Hour
+)
+
+// KeyPool picks the provider key of each request and tracks the health of the keys from the
+// responses of the requests sent with them.
+type KeyPool struct {
+	mu     sync.Mutex
+	config KeyPoolConfig
+	keys   map[string]*keyState
+	next   int
+	swept  time.Time
+}
+
+// keyState is the health of a key.
+type keyState struct {
+	inFlight      int
+	requests      uint64
+	successes     uint64
+	errors        uint64
+	rateLimited   uint64
+	authErrors    uint64
+	successRate   float64
+	latency       time.Duration
+	cooldownUntil time.Time
+	requestLimit  rateLimit
+	tokenLimit    rateLimit
+	// currentWeight is the smooth weighted round-robin state of the key
+	currentWeight float64
+	// picked is when the key was last eligible for a request
+	picked time.Time
+}
+
+// poolKey is a key eligible for a request and its configured weight.
+type poolKey struct {
+	apiKey string
+	weight int
+}
+
+// KeyHealth is the health of a key, as reported by the admin endpoint.
+type KeyHealth struct {
+	Key              string           `json:"key"`
+	InFlight         int              `json:"inFlight"`
+	Requests         uint64           `json:"requests"`
+	Successes        uint64           `json:"successes"`
+	Errors           uint64           `json:"errors"`
+	RateLimited      uint64           `json:"rateLimited"`
+	AuthErrors       uint64           `json:"authErrors"`
+	SuccessRate      float64          `json:"successRate"`
+	LatencyMs        float64          `json:"latencyMs"`
+	CoolingDownUntil *time.Time       `json:"coolingDownUntil,omitempty"`
+	RequestLimit     *RateLimitHealth `json:"requestLimit,omitempty"`
+	TokenLimit       *RateLimitHealth `json:"tokenLimit,omitempty"`
+}
+
+func NewKeyPool(config KeyPoolConfig) *KeyPool {
+	return &KeyPool{
+		config: config,
+		keys:   make(map[string]*keyState),
+	}
+}
+
+// SetConfig changes the configuration of the pool, the health of the keys is kept.
+func (kp *KeyPool) SetConfig(config KeyPoolConfig) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	kp.config = config
+}
+
+// state returns the health of apiKey, kp.mu must be held.
+func (kp *KeyPool) state(apiKey string) *keyState {
+	state, ok := kp.keys[apiKey]
+	if !ok {
+		state = &keyState{successRate: 1, picked: time.Now()}
+		kp.keys[apiKey] = state
+	}
+	return state
+}
+
+// pick returns the index of the candidate the request is sent with. Keys which are cooling
+// down or have exhausted a rate limit are skipped, and keys low on their rate limits are only
+// picked when no other key is left.
+func (kp *KeyPool) pick(candidates []poolKey) (int, error) {
+	index, _, err := kp.pickAt(candidates, time.Now())
+	return index, err
+}
+
+// acquire picks the candidate the request is sent with like pick, waiting up to MaxQueueWait
+// for a key to become available when they are all resting.
+func (kp *KeyPool) acquire(ctx context.Context, candidates []poolKey) (index int, err error) {
+	_, span := tracer.Start(ctx, "bifrost.key_selection",
+		trace.WithAttributes(attribute.Int("bifrost.key.candidates", len(candidates))))
+	defer func() {
+		if err == nil {
+			span.SetAttributes(attribute.String("bifrost.key", maskKey(candidates[index].apiKey)))
+		}
+		endSpan(span, err)
+	}()
+	for {
+		index, availableAt, err := kp.pickAt(candidates, time.Now())
+		if !errors.Is(err, ErrKeysCoolingDown) {
+			return index, err
+		}
+		kp.mu.Lock()
+		maxQueueWait := kp.config.MaxQueueWait
+		kp.mu.Unlock()
+		wait := time.Until(availableAt)
+		if wait > maxQueueWait {
+			return 0, err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// pickAt picks the candidate the request is sent with at now. When all the keys are resting,
+// it returns ErrKeysCoolingDown and when the first of them is available again.
+func (kp *KeyPool) pickAt(candidates []poolKey, now time.Time) (int, time.Time, error) {
+	if len(candidates) == 0 {
+		return 0, time.Time{}, ErrNoEligibleKey
+	}
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	var eligible, low []int
+	var availableAt time.Time
+	for i, candidate := range candidates {
+		state := kp.state(candidate.apiKey)
+		state.picked = now
+		if restingUntil := state.restingUntil(now); !restingUntil.IsZero() {
+			if availableAt.IsZero() || restingUntil.Before(availableAt) {
+				availableAt = restingUntil
+			}
+			continue
+		}
+		if state.requestLimit.low(now, kp.config.RateLimitReserve) || state.tokenLimit.low(now, kp.config.RateLimitReserve) {
+			low = append(low, i)
+			continue
+		}
+		eligible = append(eligible, i)
+	}
+	kp.sweep(now)
+	if len(eligible) == 0 {
+		eligible = low
+	}
+	if len(eligible) == 0 {
+		return 0, availableAt, ErrKeysCoolingDown
+	}
+	if kp.config.Strategy == LeastInFlight {
+		return kp.leastInFlight(candidates, eligible), time.Time{}, nil
+	}
+	return kp.weightedRoundRobin(candidates, eligible), time.Time{}, nil
+}
+
+// sweep forgets the keys which were not eligible for a request for keyIdleTTL and are not in
+// flight or resting, at most once per keyIdleTTL. kp.mu must be held.
+func (kp *KeyPool) sweep(now time.Time) {
+	if now.Sub(kp.swept) < keyIdleTTL {
+		return
+	}
+	kp.swept = now
+	for apiKey, state := range kp.keys {
+		if state.inFlight == 0 && now.Sub(state.picked) >= keyIdleTTL && state.restingUntil(now).IsZero() {
+			delete(kp.keys, apiKey)
+		}
+	}
+}
+
+// restingUntil returns when a key cooling down or out of a rate limit at now is available
+// again, zero when it is available.
+func (ks *keyState) restingUntil(now time.Time) time.Time {
+	var until time.Time
+	if ks.cooldownUntil.After(now) {
+		until = ks.cooldownUntil
+	}
+	for _, budget := range []rateLimit{ks.requestLimit, ks.tokenLimit} {
+		if budget.exhausted(now) && budget.resetAt.After(until) {
+			until = budget.resetAt
+		}
+	}
+	return until
+}
+
+// weightedRoundRobin is the smooth weighted round-robin of nginx over the eligible candidates,
+// the weight of a key is scaled down by its success rate.
+func (kp *KeyPool) weightedRoundRobin(candidates []poolKey, eligible []int) int {
+	var total float64
+	var picked *keyState
+	pickedIndex := eligible[0]
+	for _, i := range eligible {
+		state := kp.state(candidates[i].apiKey)
+		weight := float64(max(candidates[i].weight, 1)) * max(state.successRate, minSuccessRate)
+		state.currentWeight += weight
+		total += weight
+		if picked == nil || state.currentWeight > picked.currentWeight {
+			picked, pickedIndex = state, i
+		}
+	}
+	picked.currentWeight -= total
+	return pickedIndex
+}
+
+// leastInFlight picks the eligible candidate with the fewest requests in flight, rotating
+// between the candidates which have as many.
+func (kp *KeyPool) leastInFlight(candidates []poolKey, eligible []int) int {
+	kp.next++
+	pickedIndex := -1
+	fewest := 0
+	for n := range eligible {
+		i := eligible[(kp.next+n)%len(eligible)]
+		if inFlight := kp.state(candidates[i].apiKey).inFlight; pickedIndex < 0 || inFlight < fewest {
+			pickedIndex, fewest = i, inFlight
+		}
+	}
+	return pickedIndex
+}
+
+// do sends req with apiKey and records the outcome in the health of the key. The request is
+// in flight until the body of its response is closed.
+func (kp *KeyPool) do(apiKey string, req *http.Request) (*http.Response, error) {
+	kp.mu.Lock()
+	state := kp.state(apiKey)
+	state.inFlight++
+	state.requestLimit.spend(time.Now())
+	kp.mu.Unlock()
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	kp.record(apiKey, resp, err, time.Since(start))
+	if err != nil || resp == nil {
+		kp.release(apiKey)
+		return resp, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { kp.release(apiKey) }}
+	return resp, nil
+}
+
+// record updates the health of apiKey with the outcome of a request.
+func (kp *KeyPool) record(apiKey string, resp *http.Response, err error, latency time.Duration) {
+	if errors.Is(err, context.Canceled) {
+		// The caller went away, this says nothing about the key
+		return
+	}
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	state := kp.state(apiKey)
+	state.requests++
+	if resp != nil {
+		now := time.Now()
+		if requestLimit := readRateLimit(resp.Header, "requests", now); requestLimit.known {
+			state.requestLimit = requestLimit
+		}
+		if tokenLimit := readRateLimit(resp.Header, "tokens", now); tokenLimit.known {
+			state.tokenLimit = tokenLimit
+		}
+	}
+	success := false
+	switch {
+	case err != nil || resp == nil || resp.StatusCode >= 500:
+		state.errors++
+	case resp.StatusCode == http.StatusTooManyRequests:
+		state.rateLimited++
+		cooldown := kp.config.RateLimitCooldown
+		if wait, ok := retryAfter(resp.Header, time.Now()); ok {
+			cooldown = wait
+		}
+		state.cooldownUntil = time.Now().Add(cooldown)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		state.authErrors++
+		state.cooldownUntil = time.Now().Add(kp.config.AuthCooldown)
+	default:
+		// Other client errors are about the request, not the key
+		state.successes++
+		success = true
+	}
+	if success {
+		state.successRate += healthDecay * (1 - state.successRate)
+	} else {
+		state.successRate -= healthDecay * state.successRate
+	}
+	if err == nil {
+		if state.latency == 0 {
+			state.latency = latency
+		} else {
+			state.latency += time.Duration(healthDecay * float64(latency-state.latency))
+		}
+	}
+}
+
+func (kp *KeyPool) release(apiKey string) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	kp.state(apiKey).inFlight--
+}
+
+// Health returns the health of the keys the pool has recently sent requests with, the keys are masked.
+func (kp *KeyPool) Health() []KeyHealth {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	now := time.Now()
+	health := make([]KeyHealth, 0, len(kp.keys))
+	for apiKey, state := range kp.keys {
+		keyHealth := KeyHealth{
+			Key:         maskKey(apiKey),
+			InFlight:    state.inFlight,
+			Requests:    state.requests,
+			Successes:   state.successes,
+			Errors:      state.errors,
+			RateLimited: state.rateLimited,
+			AuthErrors:  state.authErrors,
+			SuccessRate: state.successRate,
+			LatencyMs:   float64(state.latency) / float64(time.Millisecond),
+		}
+		if restingUntil := state.restingUntil(now); !restingUntil.IsZero() {
+			keyHealth.CoolingDownUntil = &restingUntil
+		}
+		keyHealth.RequestLimit = state.requestLimit.health(now)
+		keyHealth.TokenLimit = state.tokenLimit.health(now)
+		health = append(health, keyHealth)
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].Key < health[j].Key
+	})
+	return health
+}
+
+// KeyHealthHandler serves the health of the keys of pools, keyed by provider name.
+func KeyHealthHandler(pools map[string]*KeyPool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		health := make(map[string][]KeyHealth, len(pools))
+		for provider, pool := range pools {
+			health[provider] = pool.Health()
+		}
+		return c.JSON(health)
+	}
+}
+
+// maskKey hides all but the ends of an API key.
+func maskKey(apiKey string) string {
+	if len(apiKey) < 12 {
+		return "****"
+	}
+	return apiKey[:3] + "..." + apiKey[len(apiKey)-4:]
+}
+
+// releaseOnClose releases the key of a request once its response body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (roc *releaseOnClose) Close() error {
+	defer roc.once.Do(roc.release)
+	return roc.ReadCloser.Close()
+}
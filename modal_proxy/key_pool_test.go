@@ -0,0 +1,236 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// sendWithKey sends a request with apiKey through pool and closes its response.
+func sendWithKey(t *testing.T, pool *KeyPool, apiKey string) {
+	req, _ := http.NewRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", nil)
+	resp, err := pool.do(apiKey, req)
+	assert.NoError(t, err)
+	closeResponse(resp)
+}
+
+func TestKeyPoolWeightedRoundRobin(t *testing.T) {
+	pool := NewKeyPool(DefaultKeyPoolConfig)
+	candidates := []poolKey{{apiKey: "key-a", weight: 1}, {apiKey: "key-b", weight: 3}, {apiKey: "key-c"}}
+
+	var picks []string
+	counts := make(map[string]int)
+	for i := 0; i < 500; i++ {
+		index, err := pool.pick(candidates)
+		assert.NoError(t, err)
+		picks = append(picks, candidates[index].apiKey)
+		counts[candidates[index].apiKey]++
+	}
+
+	// Smooth weighted round-robin interleaves the keys instead of sending bursts to the heaviest
+	assert.Equal(t, []string{"key-b", "key-a", "key-b", "key-c", "key-b"}, picks[:5])
+	assert.Equal(t, map[string]int{"key-a": 100, "key-b": 300, "key-c": 100}, counts)
+}
+
+func TestKeyPoolPrefersHealthyKeys(t *testing.T) {
+	pool := NewKeyPool(DefaultKeyPoolConfig)
+	mockSequenceClient(http.StatusInternalServerError)
+	for i := 0; i < 20; i++ {
+		sendWithKey(t, pool, "key-a")
+	}
+
+	counts := make(map[string]int)
+	candidates := []poolKey{{apiKey: "key-a"}, {apiKey: "key-b"}}
+	for i := 0; i < 110; i++ {
+		index, _ := pool.pick(candidates)
+		counts[candidates[index].apiKey]++
+	}
+
+	// The failing key keeps a tenth of its weight
+	assert.Equal(t, 10, counts["key-a"])
+	assert.Equal(t, 100, counts["key-b"])
+}
+
+func TestKeyPoolLeastInFlight(t *testing.T) {
+	pool := NewKeyPool(KeyPoolConfig{Strategy: LeastInFlight})
+	client = &http.Client{Transport: &sequenceRoundTripper{StatusCodes: []int{http.StatusOK}}}
+	candidates := []poolKey{{apiKey: "key-a"}, {apiKey: "key-b"}, {apiKey: "key-c"}}
+
+	req, _ := http.NewRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", nil)
+	first, _ := pool.do("key-a", req)
+	second, _ := pool.do("key-b", req)
+	index, _ := pool.pick(candidates)
+	assert.Equal(t, "key-c", candidates[index].apiKey)
+
+	// Keys are in flight until their response body is closed
+	closeResponse(second)
+	closeResponse(second)
+	index, _ = pool.pick(candidates[:2])
+	assert.Equal(t, "key-b", candidates[index].apiKey)
+	closeResponse(first)
+	assert.Equal(t, 0, pool.state("key-a").inFlight)
+	assert.Equal(t, 0, pool.state("key-b").inFlight)
+}
+
+func TestKeyPoolCooldown(t *testing.T) {
+	pool := NewKeyPool(KeyPoolConfig{RateLimitCooldown: time.Hour, AuthCooldown: time.Hour})
+	candidates := []poolKey{{apiKey: "key-a"}, {apiKey: "key-b"}, {apiKey: "key-c"}}
+
+	mockClient(http.StatusTooManyRequests, "", map[string]string{"Retry-After-Ms": "50"})
+	sendWithKey(t, pool, "key-a")
+	mockSequenceClient(http.StatusTooManyRequests)
+	sendWithKey(t, pool, "key-b")
+	mockSequenceClient(http.StatusUnauthorized)
+	sendWithKey(t, pool, "key-c")
+
+	_, err := pool.pick(candidates)
+	assert.ErrorIs(t, err, ErrKeysCoolingDown)
+
+	// The first key asked to wait 50ms, the others rest for the configured cooldown
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		index, err := pool.pick(candidates)
+		assert.NoError(t, err)
+		assert.Equal(t, "key-a", candidates[index].apiKey)
+	}
+
+	_, err = pool.pick(nil)
+	assert.ErrorIs(t, err, ErrNoEligibleKey)
+}
+
+func TestKeyPoolForgetsIdleKeys(t *testing.T) {
+	pool := NewKeyPool(DefaultKeyPoolConfig)
+	now := time.Now()
+	_, _, err := pool.pickAt([]poolKey{{apiKey: "key-a"}, {apiKey: "key-b"}, {apiKey: "key-c"}}, now)
+	assert.NoError(t, err)
+	pool.state("key-c").inFlight++
+
+	// key-a was rotated out of the accounts, key-c is still in flight
+	_, _, err = pool.pickAt([]poolKey{{apiKey: "key-b"}}, now.Add(keyIdleTTL/2))
+	assert.NoError(t, err)
+	assert.Len(t, pool.keys, 3)
+	_, _, err = pool.pickAt([]poolKey{{apiKey: "key-b"}}, now.Add(keyIdleTTL))
+	assert.NoError(t, err)
+	assert.Contains(t, pool.keys, "key-b")
+	assert.Contains(t, pool.keys, "key-c")
+	assert.NotContains(t, pool.keys, "key-a")
+}
+
+func TestKeysCoolingDownResponse(t *testing.T) {
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
+	app := setupApp(provider)
+	transport := mockClient(http.StatusTooManyRequests, "", nil)
+
+	resp, _ := app.Test(newCompletionRequest(testRequestBody))
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	transport.LastRequest = nil
+	resp, _ = app.Test(newCompletionRequest(testRequestBody))
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Nil(t, transport.LastRequest)
+}
+
+func TestKeyPoolWeightsFromAccount(t *testing.T) {
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
+	accounts := testAccounts()
+	accounts.OpenAI = append(accounts.OpenAI, maxim.OpenAI{
+		APIKey:         "openai-api-key-2",
+		ModelAvailable: []maxim.ModelAvailable{{ID: "gpt-4o"}},
+		Weight:         2,
+	})
+	mockMaximAccount(accounts)
+	headers := map[string][]string{"X-Maxim-Api-Key": {"maxim-api-key"}}
+
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		apiKey, err := provider.GetApiKey(headers, "gpt-4o")
+		assert.NoError(t, err)
+		counts[apiKey]++
+	}
+
+	assert.Equal(t, map[string]int{"openai-api-key": 10, "openai-api-key-2": 20}, counts)
+}
+
+func TestKeyHealthHandler(t *testing.T) {
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
+	app := setupApp(provider)
+	app.Get("/admin/keys", KeyHealthHandler(map[string]*KeyPool{ProviderOpenAI: provider.KeyPool()}))
+	mockClient(http.StatusOK, "ok", nil)
+	app.Test(newCompletionRequest(testRequestBody))
+	mockClient(http.StatusTooManyRequests, "", map[string]string{"Retry-After": "60"})
+	app.Test(newCompletionRequest(testRequestBody))
+
+	resp, _ := app.Test(httptest.NewRequest(http.MethodGet, "/admin/keys", nil))
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	var health map[string][]KeyHealth
+	assert.NoError(t, json.Unmarshal(body, &health))
+	assert.Len(t, health[ProviderOpenAI], 1)
+	keyHealth := health[ProviderOpenAI][0]
+	assert.Equal(t, "ope...-key", keyHealth.Key)
+	assert.Equal(t, uint64(2), keyHealth.Requests)
+	assert.Equal(t, uint64(1), keyHealth.Successes)
+	assert.Equal(t, uint64(1), keyHealth.RateLimited)
+	assert.Equal(t, 0, keyHealth.InFlight)
+	assert.NotNil(t, keyHealth.CoolingDownUntil)
+	assert.NotContains(t, string(body), "openai-api-key")
+}
+
+func TestKeyPoolAvoidsKeysLowOnRateLimits(t *testing.T) {
+	pool := NewKeyPool(DefaultKeyPoolConfig)
+	candidates := []poolKey{{apiKey: "key-a"}, {apiKey: "key-b"}}
+	mockClient(http.StatusOK, "", map[string]string{
+		"x-ratelimit-limit-tokens": "10000", "x-ratelimit-remaining-tokens": "300", "x-ratelimit-reset-tokens": "1m",
+	})
+	sendWithKey(t, pool, "key-a")
+
+	for i := 0; i < 4; i++ {
+		index, err := pool.pick(candidates)
+		assert.NoError(t, err)
+		assert.Equal(t, "key-b", candidates[index].apiKey)
+	}
+
+	// A key low on its limits is still used when it is the only one left
+	index, err := pool.pick(candidates[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, 0, index)
+}
+
+func TestKeyPoolQueuesForExhaustedKeys(t *testing.T) {
+	pool := NewKeyPool(DefaultKeyPoolConfig)
+	candidates := []poolKey{{apiKey: "key-a"}}
+	mockClient(http.StatusOK, "", map[string]string{
+		"x-ratelimit-limit-requests": "100", "x-ratelimit-remaining-requests": "1", "x-ratelimit-reset-requests": "50ms",
+	})
+	sendWithKey(t, pool, "key-a")
+	// The request sent with the last request of the budget exhausts it
+	mockSequenceClient(http.StatusOK)
+	sendWithKey(t, pool, "key-a")
+
+	_, err := pool.pick(candidates)
+	assert.ErrorIs(t, err, ErrKeysCoolingDown)
+	start := time.Now()
+	index, err := pool.acquire(context.Background(), candidates)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, index)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	// Keys which are not available soon enough are not waited for
+	mockClient(http.StatusOK, "", map[string]string{"x-ratelimit-remaining-requests": "0", "x-ratelimit-reset-requests": "1m"})
+	sendWithKey(t, pool, "key-a")
+	start = time.Now()
+	_, err = pool.acquire(context.Background(), candidates)
+	assert.ErrorIs(t, err, ErrKeysCoolingDown)
+	assert.Less(t, time.Since(start), 10*time.Millisecond)
+	assert.NotNil(t, pool.Health()[0].CoolingDownUntil)
+	assert.Equal(t, int64(0), pool.Health()[0].RequestLimit.Remaining)
+}
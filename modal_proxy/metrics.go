@@ -0,0 +1,282 @@
+package modal_proxy
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics exports the Prometheus metrics of the proxied requests, of the upstream retries and
+// fallbacks, of the provider keys and of the tokens and cost of the responses.
+type Metrics struct {
+	registry *prometheus.Registry
+	pricing  *Pricing
+	mu       sync.Mutex
+	// chained are the models of the fallback chains
+	chained map[string]bool
+
+	requests          *prometheus.CounterVec
+	duration          *prometheus.HistogramVec
+	timeToFirstToken  *prometheus.HistogramVec
+	interTokenLatency *prometheus.HistogramVec
+	inFlight          *prometheus.GaugeVec
+	retries           *prometheus.CounterVec
+	fallbacks         *prometheus.CounterVec
+	tokens            *prometheus.CounterVec
+	cost              *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics, the cost of the responses is priced with pricing.
+func NewMetrics(pricing *Pricing) *Metrics {
+	requestLabels := []string{"route", "provider", "model", "status", "cache"}
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		pricing:  pricing,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bifrost_requests_total",
+			Help: "Proxied requests, by route, provider and model served, status class and cache result.",
+		}, requestLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bifrost_request_duration_seconds",
+			Help:    "Time until the response to a request was relayed, streams included.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+		}, requestLabels),
+		timeToFirstToken: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bifrost_time_to_first_token_seconds",
+			Help:    "Time until the first frame of a streamed response was received.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 0.75, 1, 2, 5, 10, 30},
+		}, []string{"route", "provider", "model"}),
+		interTokenLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bifrost_inter_token_latency_seconds",
+			Help:    "Mean time between the frames of a streamed response.",
+			Buckets: []float64{0.005, 0.01, 0.02, 0.03, 0.05, 0.075, 0.1, 0.25, 0.5, 1},
+		}, []string{"route", "provider", "model"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bifrost_requests_in_flight",
+			Help: "Requests being proxied, streams until they are over.",
+		}, []string{"route", "provider"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bifrost_upstream_retries_total",
+			Help: "Upstream requests retried, by target and the status, or error, retried.",
+		}, []string{"provider", "model", "reason"}),
+		fallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bifrost_upstream_fallbacks_total",
+			Help: "Requests which fell back from a target to the next of its chain.",
+		}, []string{"provider", "model", "reason"}),
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bifrost_tokens_total",
+			Help: "Tokens used by the responses of the providers, by type: prompt, completion or cached.",
+		}, []string{"provider", "model", "type"}),
+		cost: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bifrost_cost_usd_total",
+			Help: "Cost of the responses of the providers in USD.",
+		}, []string{"provider", "model"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.duration, m.timeToFirstToken, m.interTokenLatency, m.inFlight,
+		m.retries, m.fallbacks, m.tokens, m.cost,
+	)
+	return m
+}
+
+// Handler measures the requests to next, the route of provider at route.
+func (m *Metrics) Handler(route string, provider string, next fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		model, _ := getModalFromBody(c.Body())
+		inFlight := m.inFlight.WithLabelValues(route, provider)
+		inFlight.Inc()
+		labels := m.modelLabels()
+
+		var once sync.Once
+		observe := func(report usageReport) {
+			once.Do(func() {
+				inFlight.Dec()
+				m.observe(route, provider, model, labels, report, start)
+			})
+		}
+		observeUsage(c, observe)
+		err := next(c)
+		if err != nil {
+			setErrorStatus(c, err)
+		}
+		notifyUsage(c, observe)
+		return err
+	}
+}
+
+// setChains labels the models of chains apart, even those without a price.
+func (m *Metrics) setChains(chains map[string][]FallbackTarget) {
+	chained := make(map[string]bool)
+	for model, chain := range chains {
+		chained[model] = true
+		for _, target := range chain {
+			chained[target.Model] = true
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chained = chained
+}
+
+func (m *Metrics) modelLabels() modelLabels {
+	prices := m.pricing.priceTable()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return modelLabels{prices: prices, chained: m.chained}
+}
+
+// modelLabels are the models measured apart, those with a price and those of the fallback
+// chains, the others are labelled otherModel so that the series of the metrics are bounded.
+type modelLabels struct {
+	prices  PriceTable
+	chained map[string]bool
+}
+
+// label returns the label of model.
+func (ml modelLabels) label(model string) string {
+	if ml.chained[model] {
+		return model
+	}
+	return ml.prices.label(model)
+}
+
+// observe records the response to a request for model on route, started at start and labelled
+// and priced with labels.
+func (m *Metrics) observe(route, provider, model string, labels modelLabels, report usageReport, start time.Time) {
+	provider, model = report.served(provider, model)
+	cost := labels.prices.cost(model, report.usage)
+	model = labels.label(model)
+	cacheLabel := report.cache
+	if cacheLabel == "" {
+		cacheLabel = "none"
+	}
+	requestLabels := []string{route, provider, model, statusClass(report.status), cacheLabel}
+	m.requests.WithLabelValues(requestLabels...).Inc()
+	m.duration.WithLabelValues(requestLabels...).Observe(time.Since(start).Seconds())
+	if !report.firstByteAt.IsZero() {
+		m.timeToFirstToken.WithLabelValues(route, provider, model).Observe(report.firstByteAt.Sub(start).Seconds())
+		if report.frames > 1 {
+			interval := report.lastFrameAt.Sub(report.firstByteAt) / time.Duration(report.frames-1)
+			m.interTokenLatency.WithLabelValues(route, provider, model).Observe(interval.Seconds())
+		}
+	}
+	// Cached responses did not use the tokens they report again
+	if !report.ok || report.cache == "hit" || report.cache == "semantic_hit" {
+		return
+	}
+	m.tokens.WithLabelValues(provider, model, "prompt").Add(float64(report.usage.PromptTokens))
+	m.tokens.WithLabelValues(provider, model, "completion").Add(float64(report.usage.CompletionTokens))
+	m.tokens.WithLabelValues(provider, model, "cached").Add(float64(report.usage.CachedTokens))
+	m.cost.WithLabelValues(provider, model).Add(cost)
+}
+
+// retried counts a retry of target after resp or err, metrics may be nil.
+func (m *Metrics) retried(target FallbackTarget, resp *http.Response, err error) {
+	if m != nil {
+		m.retries.WithLabelValues(target.Provider, m.modelLabels().label(target.Model), upstreamReason(resp, err)).Inc()
+	}
+}
+
+// fellBack counts a fallback from target after resp or err, metrics may be nil.
+func (m *Metrics) fellBack(target FallbackTarget, resp *http.Response, err error) {
+	if m != nil {
+		m.fallbacks.WithLabelValues(target.Provider, m.modelLabels().label(target.Model), upstreamReason(resp, err)).Inc()
+	}
+}
+
+// upstreamReason is the status of resp, or error when the request failed.
+func upstreamReason(resp *http.Response, err error) string {
+	if err != nil || resp == nil {
+		return "error"
+	}
+	return strconv.Itoa(resp.StatusCode)
+}
+
+// statusClass returns the class of status, 2xx to 5xx.
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// WatchKeyPools exports the health of the keys of pools, keyed by provider name.
+func (m *Metrics) WatchKeyPools(pools map[string]*KeyPool) {
+	m.registry.MustRegister(&keyHealthCollector{pools: pools})
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format.
+func (m *Metrics) MetricsHandler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+var (
+	keyInFlightDesc = prometheus.NewDesc("bifrost_provider_key_in_flight",
+		"Requests in flight with a provider key.", []string{"provider", "key"}, nil)
+	keyRequestsDesc = prometheus.NewDesc("bifrost_provider_key_requests_total",
+		"Requests sent with a provider key, by outcome: success, error, rate_limited or auth_error.",
+		[]string{"provider", "key", "outcome"}, nil)
+	keySuccessRateDesc = prometheus.NewDesc("bifrost_provider_key_success_rate",
+		"Recent success rate of a provider key, between 0 and 1.", []string{"provider", "key"}, nil)
+	keyLatencyDesc = prometheus.NewDesc("bifrost_provider_key_latency_seconds",
+		"Recent latency of the responses to a provider key.", []string{"provider", "key"}, nil)
+	keyCoolingDownDesc = prometheus.NewDesc("bifrost_provider_key_cooling_down",
+		"1 when a provider key is cooling down after a rate limit or an auth error.", []string{"provider", "key"}, nil)
+	keyRateLimitRemainingDesc = prometheus.NewDesc("bifrost_provider_key_rate_limit_remaining",
+		"Remaining requests or tokens of the current rate limit window of a provider key.",
+		[]string{"provider", "key", "resource"}, nil)
+)
+
+// keyHealthCollector collects the health of the keys of the key pools when the metrics are scraped.
+type keyHealthCollector struct {
+	pools map[string]*KeyPool
+}
+
+func (khc *keyHealthCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{keyInFlightDesc, keyRequestsDesc, keySuccessRateDesc,
+		keyLatencyDesc, keyCoolingDownDesc, keyRateLimitRemainingDesc} {
+		ch <- desc
+	}
+}
+
+func (khc *keyHealthCollector) Collect(ch chan<- prometheus.Metric) {
+	for provider, pool := range khc.pools {
+		for _, health := range pool.Health() {
+			gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append([]string{provider, health.Key}, labels...)...)
+			}
+			gauge(keyInFlightDesc, float64(health.InFlight))
+			for outcome, count := range map[string]uint64{
+				"success":      health.Successes,
+				"error":        health.Errors,
+				"rate_limited": health.RateLimited,
+				"auth_error":   health.AuthErrors,
+			} {
+				ch <- prometheus.MustNewConstMetric(keyRequestsDesc, prometheus.CounterValue, float64(count), provider, health.Key, outcome)
+			}
+			gauge(keySuccessRateDesc, health.SuccessRate)
+			gauge(keyLatencyDesc, health.LatencyMs/1000)
+			coolingDown := 0.0
+			if health.CoolingDownUntil != nil {
+				coolingDown = 1
+			}
+			gauge(keyCoolingDownDesc, coolingDown)
+			if health.RequestLimit != nil {
+				gauge(keyRateLimitRemainingDesc, float64(health.RequestLimit.Remaining), "requests")
+			}
+			if health.TokenLimit != nil {
+				gauge(keyRateLimitRemainingDesc, float64(health.TokenLimit.Remaining), "tokens")
+			}
+		}
+	}
+}
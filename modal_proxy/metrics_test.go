@@ -0,0 +1,125 @@
+package modal_proxy
+
+import (
+	"bifrost/cache_storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupMeasuredApp routes the chat API, behind the response cache, and the messages API with
+// the fallback chains of fallbackConfig and fastRetry, measured and served at /metrics.
+func setupMeasuredApp() *fiber.App {
+	mockMaximAccount(fallbackAccounts())
+	metrics := NewMetrics(NewPricing(DefaultPriceTable))
+	responseCache := NewResponseCache(cache_storage.NewLRUCache(10))
+	app, router := setupWrappedApp(fallbackConfig(), fastRetry, func(apiPath string, provider string, next fiber.Handler) fiber.Handler {
+		if provider == ProviderOpenAI {
+			next = responseCache.Handler(true, next)
+		}
+		return metrics.Handler(apiPath, provider, next)
+	})
+	router.SetMetrics(metrics)
+	metrics.WatchKeyPools(map[string]*KeyPool{ProviderOpenAI: router.providers[ProviderOpenAI].(*OpenAIModalProvider).KeyPool()})
+	app.Get("/metrics", metrics.MetricsHandler())
+	return app
+}
+
+// scrape returns the metrics served by app.
+func scrape(app *fiber.App) string {
+	resp, _ := app.Test(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	app := setupMeasuredApp()
+	transport := mockHostClient(map[string]hostResponse{
+		azureHost:     {StatusCode: http.StatusOK, Body: openAIResponse},
+		anthropicHost: {StatusCode: http.StatusOK, Body: anthropicStream, ContentType: "text/event-stream"},
+	})
+	transport.Sequences[openAIHost] = []hostResponse{
+		{StatusCode: http.StatusServiceUnavailable},
+		{StatusCode: http.StatusOK, Body: openAIResponse},
+		{StatusCode: http.StatusServiceUnavailable},
+		{StatusCode: http.StatusServiceUnavailable},
+		{StatusCode: http.StatusServiceUnavailable},
+	}
+
+	// Retried once, then served from the cache
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	// Retried twice, then falls back to Azure
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)
+	postJSON(app, "/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":100,"stream":true,"messages":[]}`)
+
+	metrics := scrape(app)
+	for _, line := range []string{
+		`bifrost_requests_total{cache="miss",model="gpt-4o",provider="openai",route="/v1/chat/completions",status="2xx"} 1`,
+		`bifrost_requests_total{cache="hit",model="gpt-4o",provider="openai",route="/v1/chat/completions",status="2xx"} 1`,
+		`bifrost_requests_total{cache="miss",model="gpt-4o",provider="azure",route="/v1/chat/completions",status="2xx"} 1`,
+		`bifrost_requests_total{cache="none",model="claude-3-5-sonnet",provider="anthropic",route="/v1/messages",status="2xx"} 1`,
+		`bifrost_request_duration_seconds_count{cache="hit",model="gpt-4o",provider="openai",route="/v1/chat/completions",status="2xx"} 1`,
+		`bifrost_requests_in_flight{provider="openai",route="/v1/chat/completions"} 0`,
+		`bifrost_requests_in_flight{provider="anthropic",route="/v1/messages"} 0`,
+		`bifrost_time_to_first_token_seconds_count{model="claude-3-5-sonnet",provider="anthropic",route="/v1/messages"} 1`,
+		`bifrost_inter_token_latency_seconds_count{model="claude-3-5-sonnet",provider="anthropic",route="/v1/messages"} 1`,
+		`bifrost_upstream_retries_total{model="gpt-4o",provider="openai",reason="503"} 3`,
+		`bifrost_upstream_fallbacks_total{model="gpt-4o",provider="openai",reason="503"} 1`,
+		// The cached response did not use its tokens again
+		`bifrost_tokens_total{model="gpt-4o",provider="openai",type="prompt"} 3`,
+		`bifrost_tokens_total{model="gpt-4o",provider="azure",type="completion"} 1`,
+		`bifrost_tokens_total{model="claude-3-5-sonnet",provider="anthropic",type="completion"} 15`,
+		`bifrost_provider_key_requests_total{key="ope...-key",outcome="success",provider="openai"} 1`,
+		`bifrost_provider_key_requests_total{key="ope...-key",outcome="error",provider="openai"} 4`,
+		`bifrost_provider_key_in_flight{key="ope...-key",provider="openai"} 0`,
+	} {
+		assert.Contains(t, metrics, line)
+	}
+	assert.NotContains(t, metrics, `bifrost_time_to_first_token_seconds_count{model="gpt-4o"`)
+	assert.Contains(t, metrics, `bifrost_cost_usd_total{model="gpt-4o",provider="openai"}`)
+}
+
+func TestMetricsModelLabels(t *testing.T) {
+	metrics := NewMetrics(NewPricing(DefaultPriceTable))
+	metrics.setChains(map[string][]FallbackTarget{"my-finetune": {{Provider: ProviderAzure, Model: "my-finetune-eu"}}})
+	labels := metrics.modelLabels()
+	assert.Equal(t, "gpt-4o", labels.label("gpt-4o-2024-08-06"))
+	assert.Equal(t, "my-finetune", labels.label("my-finetune"))
+	assert.Equal(t, "my-finetune-eu", labels.label("my-finetune-eu"))
+	assert.Equal(t, otherModel, labels.label("llama-3"))
+
+	app := setupMeasuredApp()
+	mockHostClient(map[string]hostResponse{anthropicHost: {StatusCode: http.StatusOK, Body: anthropicResponseBody}})
+	postJSON(app, "/v1/messages", `{"model":"claude-3-5-sonnet-20241022","max_tokens":100,"messages":[]}`)
+	postJSON(app, "/v1/messages", `{"model":"claude-2.1","max_tokens":100,"messages":[]}`)
+
+	scraped := scrape(app)
+	assert.Contains(t, scraped, `bifrost_requests_total{cache="none",model="claude-3-5-sonnet",provider="anthropic",route="/v1/messages",status="2xx"} 1`)
+	assert.Contains(t, scraped, `bifrost_requests_total{cache="none",model="other",provider="anthropic",route="/v1/messages",status="2xx"} 1`)
+	assert.NotContains(t, scraped, `claude-2.1`)
+}
+
+func TestMetricsShortStream(t *testing.T) {
+	app := setupMeasuredApp()
+	mockHostClient(map[string]hostResponse{anthropicHost: {StatusCode: http.StatusOK, Body: shortAnthropicStream, ContentType: "text/event-stream"}})
+
+	postJSON(app, "/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":100,"stream":true,"messages":[]}`)
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(scrape(app), `bifrost_requests_total{cache="none",model="claude-3-5-sonnet",provider="anthropic",route="/v1/messages",status="2xx"} 1`)
+	}, time.Second, time.Millisecond)
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass(http.StatusOK))
+	assert.Equal(t, "4xx", statusClass(http.StatusTooManyRequests))
+	assert.Equal(t, "5xx", statusClass(http.StatusBadGateway))
+	assert.Equal(t, "unknown", statusClass(0))
+}
@@ -0,0 +1,283 @@
+package modal_proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"math/rand"
+	"strings"
+)
+
+// modelRouteLocal holds the *modelResolution of a request the model router resolved.
+const modelRouteLocal = "bifrost.modelRoute"
+
+// ModelRoute resolves the requests it matches to a provider and a model. The patterns are globs
+// where * matches any text and ? a single character, an empty pattern matches everything.
+type ModelRoute struct {
+	// Model matches the requested model, a virtual name such as fast or a pattern such as claude-*
+	Model string
+	// Route matches the path of the route of the request
+	Route string
+	// Tenant matches the Maxim API key of the request
+	Tenant string
+	// Headers match the values of request headers, by header name
+	Headers map[string]string
+	// Attributes match top-level fields of the request body, by field name. Fields which are not
+	// strings are matched in their JSON form, as true or 0.2
+	Attributes map[string]string
+	// Target is the provider and the model serving the requests, an empty provider keeps the one
+	// picked from the model and an empty model keeps the requested one
+	Target FallbackTarget
+	// Split splits the requests between several targets instead of Target
+	Split *ModelSplit
+}
+
+// ModelSplit splits the requests of a model route between arms by weight, for an experiment or a
+// canary. A request is assigned an arm from the hash of its StickyHeader, or else of the user of
+// its body, so the requests of a conversation stay on one arm. Requests with neither are assigned
+// at random.
+type ModelSplit struct {
+	// Experiment names the split in the request log
+	Experiment   string
+	StickyHeader string
+	Arms         []ModelArm
+}
+
+// ModelArm is a target of a split, Weight being its share of the requests relative to the other
+// arms. An arm with a zero weight gets no requests.
+type ModelArm struct {
+	// Name names the arm in the request log, its target when empty
+	Name   string
+	Weight float64
+	Target FallbackTarget
+}
+
+// modelResolution is the model a request asked for and the target the model router resolved it to,
+// with the experiment and the arm of the split which picked the target.
+type modelResolution struct {
+	requestedModel string
+	target         FallbackTarget
+	experiment     string
+	arm            string
+}
+
+// ModelRouter resolves the model of the requests with a table of routes, the first route which
+// matches a request applies.
+type ModelRouter struct {
+	routes []ModelRoute
+}
+
+func NewModelRouter(routes []ModelRoute) *ModelRouter {
+	return &ModelRouter{routes: routes}
+}
+
+// ParseModelRoutes parses routes which only match the model, written as
+// model=provider/model;model=provider, as in "fast=openai/gpt-4o-mini;claude-*=anthropic".
+func ParseModelRoutes(spec string) ([]ModelRoute, error) {
+	var routes []ModelRoute
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		model, target, ok := strings.Cut(entry, "=")
+		model, target = strings.TrimSpace(model), strings.TrimSpace(target)
+		if !ok || model == "" || target == "" {
+			return nil, fmt.Errorf("invalid model route %q, expected model=provider/model or model=provider", entry)
+		}
+		provider, targetModel, _ := strings.Cut(target, "/")
+		if _, ok := providerFormats[provider]; !ok {
+			return nil, fmt.Errorf("unknown provider %q in the model route of %s", provider, model)
+		}
+		routes = append(routes, ModelRoute{Model: model, Target: FallbackTarget{Provider: provider, Model: targetModel}})
+	}
+	return routes, nil
+}
+
+// Handler resolves the model of the requests to next, on the route at route. The model of the
+// request body is replaced with the model of the target, and the provider of the target serves
+// the request on the chat routes.
+func (mr *ModelRouter) Handler(route string, next fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if len(mr.routes) == 0 {
+			return next(c)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(c.Body(), &fields); err != nil {
+			return next(c)
+		}
+		var model string
+		_ = json.Unmarshal(fields["model"], &model)
+		for _, modelRoute := range mr.routes {
+			if !modelRoute.matches(c, route, model, fields) {
+				continue
+			}
+			resolution := &modelResolution{requestedModel: model, target: modelRoute.Target}
+			if split := modelRoute.Split; split != nil && len(split.Arms) > 0 {
+				arm := split.assign(c, fields)
+				resolution.target, resolution.experiment, resolution.arm = arm.Target, split.Experiment, arm.name()
+			}
+			target := &resolution.target
+			if target.Model == "" {
+				target.Model = model
+			}
+			if target.Model != model {
+				body, err := withModel(c.Body(), target.Model)
+				if err != nil {
+					return next(c)
+				}
+				c.Request().SetBody(body)
+			}
+			c.Locals(modelRouteLocal, resolution)
+			break
+		}
+		return next(c)
+	}
+}
+
+// matches reports whether the request c for model on route, whose body has fields, matches mr.
+func (mr ModelRoute) matches(c *fiber.Ctx, route string, model string, fields map[string]json.RawMessage) bool {
+	if !globMatch(mr.Model, model) || !globMatch(mr.Route, route) {
+		return false
+	}
+	if mr.Tenant != "" {
+		maximApiKey, err := GetMaximApiKey(c.GetReqHeaders())
+		if err != nil || !globMatch(mr.Tenant, maximApiKey) {
+			return false
+		}
+	}
+	for name, pattern := range mr.Headers {
+		if !globMatch(pattern, c.Get(name)) {
+			return false
+		}
+	}
+	for name, pattern := range mr.Attributes {
+		if !globMatch(pattern, attributeValue(fields[name])) {
+			return false
+		}
+	}
+	return true
+}
+
+// assign returns the arm of the request c whose body has fields.
+func (ms *ModelSplit) assign(c *fiber.Ctx, fields map[string]json.RawMessage) ModelArm {
+	var total float64
+	for _, arm := range ms.Arms {
+		total += arm.Weight
+	}
+	var point float64
+	if key := ms.stickyKey(c, fields); key != "" {
+		// The keys of a conversation are alike, their hash must spread them evenly
+		hash := sha256.Sum256([]byte(ms.Experiment + "\x00" + key))
+		point = float64(binary.BigEndian.Uint64(hash[:])>>11) / (1 << 53) * total
+	} else {
+		point = rand.Float64() * total
+	}
+	for _, arm := range ms.Arms {
+		if point < arm.Weight {
+			return arm
+		}
+		point -= arm.Weight
+	}
+	// Rounding can leave the point past the last arm with a weight
+	for i := len(ms.Arms) - 1; i >= 0; i-- {
+		if ms.Arms[i].Weight > 0 {
+			return ms.Arms[i]
+		}
+	}
+	return ms.Arms[len(ms.Arms)-1]
+}
+
+// stickyKey is the value the arm of the request c is assigned from: its sticky header, the user
+// of the OpenAI body or the user_id of the metadata of the Anthropic body, empty when there is none.
+func (ms *ModelSplit) stickyKey(c *fiber.Ctx, fields map[string]json.RawMessage) string {
+	if ms.StickyHeader != "" {
+		if value := c.Get(ms.StickyHeader); value != "" {
+			return value
+		}
+	}
+	var user string
+	if json.Unmarshal(fields["user"], &user) == nil && user != "" {
+		return user
+	}
+	var metadata struct {
+		UserId string `json:"user_id"`
+	}
+	_ = json.Unmarshal(fields["metadata"], &metadata)
+	return metadata.UserId
+}
+
+func (ma ModelArm) name() string {
+	if ma.Name != "" {
+		return ma.Name
+	}
+	return ma.Target.String()
+}
+
+// attributeValue is the text of a field of a request body, strings unquoted.
+func attributeValue(field json.RawMessage) string {
+	var value string
+	if err := json.Unmarshal(field, &value); err == nil {
+		return value
+	}
+	return string(field)
+}
+
+// routedProvider returns the provider serving the request c for model on a route of provider,
+// the one the model router resolved the request to or else the one picked from model.
+func routedProvider(c *fiber.Ctx, provider string, model string) string {
+	if resolution, ok := c.Locals(modelRouteLocal).(*modelResolution); ok && resolution.target.Provider != "" {
+		return resolution.target.Provider
+	}
+	return modelProvider(provider, model)
+}
+
+// requestedModel returns the model the request c asked for before the model router resolved
+// it, model when it was not resolved.
+func requestedModel(c *fiber.Ctx, model string) string {
+	if resolution, ok := c.Locals(modelRouteLocal).(*modelResolution); ok {
+		return resolution.requestedModel
+	}
+	return model
+}
+
+// modelExperiment returns the experiment and the arm the request c was assigned by a split of the
+// model router, empty when it was not.
+func modelExperiment(c *fiber.Ctx) (string, string) {
+	if resolution, ok := c.Locals(modelRouteLocal).(*modelResolution); ok {
+		return resolution.experiment, resolution.arm
+	}
+	return "", ""
+}
+
+// globMatch reports whether text matches pattern, where * matches any text and ? a single
+// character. An empty pattern matches everything.
+func globMatch(pattern string, text string) bool {
+	if pattern == "" {
+		return true
+	}
+	// Backtrack to the last * when a character does not match
+	p, t := 0, 0
+	star, starText := -1, 0
+	for t < len(text) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == text[t]):
+			p++
+			t++
+		case p < len(pattern) && pattern[p] == '*':
+			star, starText = p, t
+			p++
+		case star >= 0:
+			p = star + 1
+			starText++
+			t = starText
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,201 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupModelRoutedApp routes the chat API through a model router with routes, in front of a
+// request log at the returned path.
+func setupModelRoutedApp(t *testing.T, routes []ModelRoute) (*fiber.App, string) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	logger, err := NewRequestLogger(RequestLogConfig{Path: path})
+	assert.NoError(t, err)
+	t.Cleanup(func() { logger.Close() })
+	accounts := testAccounts()
+	accounts.OpenAI[0].ModelAvailable = append(accounts.OpenAI[0].ModelAvailable, maxim.ModelAvailable{Name: "gpt-4o-mini", ID: "gpt-4o-mini"})
+	mockMaximAccount(accounts)
+	router := NewFallbackRouter(map[string]ModalProviderInterface{
+		ProviderOpenAI:    NewOpenAIProvider("https://"+openAIHost, testAccountSource),
+		ProviderAnthropic: NewAnthropicModalProvider("https://"+anthropicHost, testAccountSource),
+	}, FallbackConfig{})
+	modelRouter := NewModelRouter(routes)
+	app := fiber.New()
+	app.Post("/v1/chat/completions", modelRouter.Handler("/v1/chat/completions",
+		logger.Handler("/v1/chat/completions", ProviderOpenAI, router.Handler(ProviderOpenAI, "/v1/chat/completions", RetryPolicy{}))))
+	return app, path
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, text string
+		match         bool
+	}{
+		{"", "gpt-4o", true},
+		{"gpt-4o", "gpt-4o", true},
+		{"gpt-4o", "gpt-4o-mini", false},
+		{"gpt-4*", "gpt-4o-mini", true},
+		{"gpt-4*", "gpt-3.5-turbo", false},
+		{"claude-*-sonnet", "claude-3-5-sonnet", true},
+		{"claude-*-sonnet", "claude-3-5-haiku", false},
+		{"gpt-4?", "gpt-4o", true},
+		{"gpt-4?", "gpt-4", false},
+		{"*", "", true},
+	} {
+		assert.Equal(t, test.match, globMatch(test.pattern, test.text), "%s on %s", test.pattern, test.text)
+	}
+}
+
+func TestParseModelRoutes(t *testing.T) {
+	routes, err := ParseModelRoutes(" fast=openai/gpt-4o-mini ; claude-*=anthropic")
+	assert.NoError(t, err)
+	assert.Equal(t, []ModelRoute{
+		{Model: "fast", Target: FallbackTarget{Provider: ProviderOpenAI, Model: "gpt-4o-mini"}},
+		{Model: "claude-*", Target: FallbackTarget{Provider: ProviderAnthropic}},
+	}, routes)
+
+	_, err = ParseModelRoutes("fast")
+	assert.Error(t, err)
+	_, err = ParseModelRoutes("fast=mistral/large")
+	assert.Error(t, err)
+}
+
+func TestModelRouter(t *testing.T) {
+	app, path := setupModelRoutedApp(t, []ModelRoute{
+		{Model: "fast", Target: FallbackTarget{Provider: ProviderOpenAI, Model: "gpt-4o-mini"}},
+		{Model: "smart", Headers: map[string]string{"x-team": "research"}, Target: FallbackTarget{Provider: ProviderAnthropic, Model: "claude-3-5-sonnet"}},
+		{Model: "smart", Attributes: map[string]string{"stream": "false"}, Target: FallbackTarget{Provider: ProviderOpenAI, Model: "gpt-4o"}},
+		{Model: "team-x-default", Tenant: "maxim-*", Target: FallbackTarget{Provider: ProviderOpenAI, Model: "gpt-4o"}},
+		{Model: "gpt-4o", Tenant: "other-*", Target: FallbackTarget{Provider: ProviderAnthropic, Model: "claude-3-5-sonnet"}},
+		{Model: "claude-*", Target: FallbackTarget{Provider: ProviderAnthropic}},
+	})
+	transport := mockHostClient(map[string]hostResponse{
+		openAIHost:    {StatusCode: http.StatusOK, Body: openAIResponse},
+		anthropicHost: {StatusCode: http.StatusOK, Body: anthropicResponseBody},
+	})
+
+	resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"fast","messages":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, transport.Requests[openAIHost], 1)
+	assert.Contains(t, transport.Requests[openAIHost][0], `"model":"gpt-4o-mini"`)
+
+	// The header rule applies before the attribute rule
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"smart","stream":false,"messages":[]}`))
+	req.Header.Set("x-maxim-api-key", "maxim-api-key")
+	req.Header.Set("x-team", "research")
+	resp, _ = app.Test(req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, transport.Requests[anthropicHost], 1)
+	assert.Contains(t, transport.Requests[anthropicHost][0], `"model":"claude-3-5-sonnet"`)
+
+	postJSON(app, "/v1/chat/completions", `{"model":"smart","stream":false,"messages":[]}`)
+	assert.Len(t, transport.Requests[openAIHost], 2)
+	assert.Contains(t, transport.Requests[openAIHost][1], `"model":"gpt-4o"`)
+
+	postJSON(app, "/v1/chat/completions", `{"model":"team-x-default","messages":[]}`)
+	assert.Len(t, transport.Requests[openAIHost], 3)
+	assert.Contains(t, transport.Requests[openAIHost][2], `"model":"gpt-4o"`)
+
+	// The tenant does not match, the model is sent as requested
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	assert.Len(t, transport.Requests[openAIHost], 4)
+	assert.Len(t, transport.Requests[anthropicHost], 1)
+
+	// The glob picks the provider and keeps the model
+	postJSON(app, "/v1/chat/completions", `{"model":"claude-3-5-haiku","messages":[]}`)
+	assert.Len(t, transport.Requests[anthropicHost], 2)
+	assert.Contains(t, transport.Requests[anthropicHost][1], `"model":"claude-3-5-haiku"`)
+
+	entries := readRequestLog(t, path)
+	assert.Len(t, entries, 6)
+	assert.Equal(t, "fast", entries[0].RequestedModel)
+	assert.Equal(t, ProviderOpenAI, entries[0].Provider)
+	assert.Equal(t, "gpt-4o-mini", entries[0].Model)
+	assert.Equal(t, "smart", entries[1].RequestedModel)
+	assert.Equal(t, ProviderAnthropic, entries[1].Provider)
+	assert.Equal(t, "claude-3-5-sonnet", entries[1].Model)
+	assert.Equal(t, "team-x-default", entries[3].RequestedModel)
+	assert.Equal(t, "gpt-4o", entries[3].Model)
+	assert.Equal(t, "gpt-4o", entries[4].RequestedModel)
+	assert.Equal(t, ProviderOpenAI, entries[4].Provider)
+}
+
+func TestModelSplit(t *testing.T) {
+	split := &ModelSplit{
+		Experiment:   "mini-trial",
+		StickyHeader: "x-conversation-id",
+		Arms: []ModelArm{
+			{Name: "control", Weight: 90, Target: FallbackTarget{Provider: ProviderOpenAI, Model: "gpt-4o"}},
+			{Weight: 10, Target: FallbackTarget{Provider: ProviderOpenAI, Model: "gpt-4o-mini"}},
+			{Name: "off", Target: FallbackTarget{Provider: ProviderAnthropic, Model: "claude-3-5-sonnet"}},
+		},
+	}
+	app := fiber.New()
+	app.Post("/v1/chat/completions", NewModelRouter([]ModelRoute{{Model: "gpt-4o", Split: split}}).Handler("/v1/chat/completions",
+		func(c *fiber.Ctx) error {
+			experiment, arm := modelExperiment(c)
+			return c.SendString(experiment + " " + arm)
+		}))
+	assign := func(header string, body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		if header != "" {
+			req.Header.Set("x-conversation-id", header)
+		}
+		resp, _ := app.Test(req)
+		content, _ := io.ReadAll(resp.Body)
+		return string(content)
+	}
+
+	// The arms are split by weight and the arms without weight get no requests
+	arms := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		arms[assign("", fmt.Sprintf(`{"model":"gpt-4o","user":"user-%d"}`, i))]++
+	}
+	assert.Len(t, arms, 2)
+	assert.InDelta(t, 900, arms["mini-trial control"], 50)
+	assert.InDelta(t, 100, arms["mini-trial openai/gpt-4o-mini"], 50)
+
+	// The requests of a conversation, or of a user, stay on one arm
+	for _, key := range []string{"conversation-1", "conversation-2", "conversation-3"} {
+		arm := assign(key, `{"model":"gpt-4o"}`)
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, arm, assign(key, fmt.Sprintf(`{"model":"gpt-4o","user":"user-%d"}`, i)))
+		}
+	}
+	arm := assign("", `{"model":"gpt-4o","max_tokens":10,"metadata":{"user_id":"user-1"}}`)
+	assert.Equal(t, arm, assign("", `{"model":"gpt-4o","metadata":{"user_id":"user-1"}}`))
+
+	// Requests for other models are not split
+	assert.Equal(t, " ", assign("", `{"model":"gpt-4o-mini"}`))
+}
+
+func TestModelSplitRequestLog(t *testing.T) {
+	app, path := setupModelRoutedApp(t, []ModelRoute{{Model: "smart", Split: &ModelSplit{
+		Experiment: "mini-trial",
+		Arms:       []ModelArm{{Name: "mini", Weight: 1, Target: FallbackTarget{Provider: ProviderOpenAI, Model: "gpt-4o-mini"}}},
+	}}})
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+
+	resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"smart","messages":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, transport.Requests[openAIHost][0], `"model":"gpt-4o-mini"`)
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	entries := readRequestLog(t, path)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "smart", entries[0].RequestedModel)
+	assert.Equal(t, "gpt-4o-mini", entries[0].Model)
+	assert.Equal(t, "mini-trial", entries[0].Experiment)
+	assert.Equal(t, "mini", entries[0].Arm)
+	assert.Empty(t, entries[1].Experiment)
+	assert.Empty(t, entries[1].Arm)
+}
@@ -1,8 +1,10 @@
 package modal_proxy
 
 import (
+	"bifrost/maxim"
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"github.com/andybalholm/brotli"
 	"io"
 	"net/http"
@@ -15,8 +17,54 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+const testRequestBody = `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`
+
+// mockedAccount is the Maxim account lookup behind testAccountSource.
+var mockedAccount = func(string) (maxim.AccountsResponse, error) {
+	return maxim.AccountsResponse{}, errors.New("no mocked accounts")
+}
+
+// testAccountSource is the account source of the providers and middlewares under test. It
+// looks the Maxim API keys up with mockedAccount.
+var testAccountSource = maxim.AccountSourceFunc(func(maximApiKey string) (maxim.AccountsResponse, error) {
+	return mockedAccount(maximApiKey)
+})
+
+// mockMaximAccount stubs the Maxim account lookup with the given accounts.
+func mockMaximAccount(accounts maxim.Accounts) {
+	mockedAccount = func(string) (maxim.AccountsResponse, error) {
+		return maxim.AccountsResponse{Data: accounts}, nil
+	}
+}
+
+func testAccounts() maxim.Accounts {
+	return maxim.Accounts{
+		OpenAI: []maxim.OpenAI{
+			{
+				APIKey:         "openai-api-key",
+				Name:           "OpenAI",
+				ModelAvailable: []maxim.ModelAvailable{{Name: "gpt-4o", ID: "gpt-4o"}},
+			},
+		},
+		Anthropic: []maxim.Anthropic{
+			{
+				Name:   "Anthropic",
+				APIKey: "anthropic-api-key",
+			},
+		},
+	}
+}
+
+// newCompletionRequest creates a proxied request carrying a Maxim API key.
+func newCompletionRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/completion", strings.NewReader(body))
+	req.Header.Set("x-maxim-api-key", "maxim-api-key")
+	return req
+}
+
 // Helper function to create Fiber App
 func setupApp(provider *OpenAIModalProvider) *fiber.App {
+	mockMaximAccount(testAccounts())
 	app := fiber.New()
 	app.Post("/completion", func(ctx *fiber.Ctx) error {
 		return provider.GetCompletion(ctx, "/v1/chat/completions")
@@ -29,9 +77,12 @@ type MockRoundTripper struct {
 	StatusCode int
 	Body       string
 	Headers    map[string]string
+	// LastRequest is the last request sent upstream
+	LastRequest *http.Request
 }
 
-func (mrt *MockRoundTripper) RoundTrip(_ *http.Request) (*http.Response, error) {
+func (mrt *MockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	mrt.LastRequest = req
 	// Create a mock response
 	response := &http.Response{
 		StatusCode: mrt.StatusCode,
@@ -47,20 +98,22 @@ func (mrt *MockRoundTripper) RoundTrip(_ *http.Request) (*http.Response, error)
 	return response, nil
 }
 
-func mockClient(statusCode int, body string, headers map[string]string) {
+func mockClient(statusCode int, body string, headers map[string]string) *MockRoundTripper {
+	transport := &MockRoundTripper{
+		StatusCode: statusCode,
+		Body:       body,
+		Headers:    headers,
+	}
 	client = &http.Client{
-		Transport: &MockRoundTripper{
-			StatusCode: statusCode,
-			Body:       body,
-			Headers:    headers,
-		},
-		Timeout: time.Second,
+		Transport: transport,
+		Timeout:   time.Second,
 	}
+	return transport
 }
 
 // Test for Invalid HTTP Method
 func TestInvalidMethod(t *testing.T) {
-	provider := NewOpenAIProvider("https://api.openai.com")
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
 	app := setupApp(provider)
 
 	req := httptest.NewRequest(http.MethodGet, "/completion", nil) // Invalid method (GET)
@@ -72,10 +125,15 @@ func TestInvalidMethod(t *testing.T) {
 
 // Test for Request Creation Failure
 func TestRequestCreationFailure(t *testing.T) {
-	provider := NewOpenAIProvider("https://invalid-url") // Simulate a bad URL
+	provider := NewOpenAIProvider("https://invalid-url", testAccountSource) // Simulate a bad URL
 	app := setupApp(provider)
 
-	req := httptest.NewRequest(http.MethodPost, "/completion", strings.NewReader("test body"))
+	// Use a real client, other tests may have mocked it
+	client = &http.Client{
+		Timeout: time.Second,
+	}
+
+	req := newCompletionRequest(testRequestBody)
 	resp, _ := app.Test(req)
 
 	assert.Equal(t, fiber.StatusInternalServerError, resp.StatusCode)
@@ -83,7 +141,7 @@ func TestRequestCreationFailure(t *testing.T) {
 
 // Test for HTTP Client Failure
 func TestHttpClientFailure(t *testing.T) {
-	provider := NewOpenAIProvider("https://api.openai.com")
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
 	app := setupApp(provider)
 
 	// Mock the client to simulate a timeout
@@ -91,7 +149,7 @@ func TestHttpClientFailure(t *testing.T) {
 		Timeout: 1 * time.Millisecond, // Timeout to force client failure
 	}
 
-	req := httptest.NewRequest(http.MethodPost, "/completion", strings.NewReader("test body"))
+	req := newCompletionRequest(testRequestBody)
 	resp, _ := app.Test(req)
 
 	assert.Equal(t, fiber.StatusInternalServerError, resp.StatusCode)
@@ -100,13 +158,13 @@ func TestHttpClientFailure(t *testing.T) {
 
 // Test for Non-200 Status from OpenAI API
 func TestNonOKResponse(t *testing.T) {
-	provider := NewOpenAIProvider("https://api.openai.com")
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
 	app := setupApp(provider)
 
 	// Mock response with 404 status code
 	mockClient(http.StatusNotFound, "Not Found", nil)
 
-	req := httptest.NewRequest(http.MethodPost, "/completion", strings.NewReader("test body"))
+	req := newCompletionRequest(testRequestBody)
 	resp, _ := app.Test(req)
 
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
@@ -115,7 +173,7 @@ func TestNonOKResponse(t *testing.T) {
 
 // Test for Brotli Encoding Response
 func TestBrotliEncodingResponse(t *testing.T) {
-	provider := NewOpenAIProvider("https://api.openai.com")
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
 	app := setupApp(provider)
 
 	// Compress the body using Brotli
@@ -132,7 +190,7 @@ func TestBrotliEncodingResponse(t *testing.T) {
 	// Mock response with Brotli encoding
 	mockClient(http.StatusOK, compressedBody.String(), headers)
 
-	req := httptest.NewRequest(http.MethodPost, "/completion", strings.NewReader("test body"))
+	req := newCompletionRequest(testRequestBody)
 	resp, _ := app.Test(req)
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
@@ -144,7 +202,7 @@ func TestBrotliEncodingResponse(t *testing.T) {
 
 // Test for Gzip Encoding Response
 func TestGzipEncodingResponse(t *testing.T) {
-	provider := NewOpenAIProvider("https://api.openai.com")
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
 	app := setupApp(provider)
 
 	// Simulate a Gzip-encoded response body
@@ -159,7 +217,7 @@ func TestGzipEncodingResponse(t *testing.T) {
 	// Mock response with Gzip encoding
 	mockClient(http.StatusOK, buf.String(), headers)
 
-	req := httptest.NewRequest(http.MethodPost, "/completion", strings.NewReader("test body"))
+	req := newCompletionRequest(testRequestBody)
 	resp, _ := app.Test(req)
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
@@ -167,13 +225,13 @@ func TestGzipEncodingResponse(t *testing.T) {
 
 // Test for Non-Stream (Regular) Response
 func TestNonStreamResponse(t *testing.T) {
-	provider := NewOpenAIProvider("https://api.openai.com")
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
 	app := setupApp(provider)
 
 	// Mock regular response with plain text
 	mockClient(http.StatusOK, "plain text response", nil)
 
-	req := httptest.NewRequest(http.MethodPost, "/completion", strings.NewReader("test body"))
+	req := newCompletionRequest(testRequestBody)
 	resp, _ := app.Test(req)
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
@@ -183,7 +241,7 @@ func TestNonStreamResponse(t *testing.T) {
 
 // Test for Error During Event-Stream Handling
 func TestErrorDuringEventStream(t *testing.T) {
-	provider := NewOpenAIProvider("https://api.openai.com")
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
 	app := setupApp(provider)
 
 	// Simulate a streaming response that causes an error mid-stream
@@ -193,9 +251,57 @@ func TestErrorDuringEventStream(t *testing.T) {
 	// Mock event-stream response
 	mockClient(http.StatusOK, stream, headers)
 
-	req := httptest.NewRequest(http.MethodPost, "/completion", strings.NewReader("test body"))
+	req := newCompletionRequest(testRequestBody)
 	resp, _ := app.Test(req)
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	// You would test for proper handling of event-stream response here
 }
+
+// Test that the client credentials are replaced with the Maxim managed key
+func TestApiKeyInjection(t *testing.T) {
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
+	app := setupApp(provider)
+	transport := mockClient(http.StatusOK, "plain text response", nil)
+
+	req := newCompletionRequest(testRequestBody)
+	req.Header.Set("Authorization", "Bearer client-api-key")
+	resp, _ := app.Test(req)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Bearer openai-api-key", transport.LastRequest.Header.Get("Authorization"))
+	assert.Empty(t, transport.LastRequest.Header.Get("x-maxim-api-key"))
+}
+
+// Test for a request without a Maxim API key
+func TestMissingMaximApiKey(t *testing.T) {
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
+	app := setupApp(provider)
+	mockClient(http.StatusOK, "plain text response", nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/completion", strings.NewReader(testRequestBody))
+	resp, _ := app.Test(req)
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+// Test for a modal which is not available on any key of the account
+func TestNoEligibleKey(t *testing.T) {
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
+	app := setupApp(provider)
+	mockClient(http.StatusOK, "plain text response", nil)
+
+	resp, _ := app.Test(newCompletionRequest(`{"model":"gpt-unknown"}`))
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// Test for a request body without a model
+func TestMissingModel(t *testing.T) {
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
+	app := setupApp(provider)
+
+	resp, _ := app.Test(newCompletionRequest("test body"))
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
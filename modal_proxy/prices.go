@@ -0,0 +1,159 @@
+package modal_proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ModelPrice is the price of a model in USD per million tokens.
+type ModelPrice struct {
+	Input float64 `json:"input"`
+	// CachedInput is the price of the prompt tokens read from the prompt cache, Input when unset
+	CachedInput float64 `json:"cachedInput,omitempty"`
+	Output      float64 `json:"output"`
+}
+
+// PriceTable has the prices of models. The dated snapshots of a model without a price of their
+// own take its price, as gpt-4o-2024-08-06 and claude-3-5-sonnet-20241022 take the prices of
+// gpt-4o and claude-3-5-sonnet.
+type PriceTable map[string]ModelPrice
+
+// snapshotSuffix is the date suffix of the snapshots of a model, as OpenAI and Anthropic write it.
+var snapshotSuffix = regexp.MustCompile(`-(\d{4}-\d{2}-\d{2}|\d{8})$`)
+
+// Pricing holds the prices shared by the usage accounting, the metrics and the budgets.
+type Pricing struct {
+	mu     sync.Mutex
+	prices PriceTable
+}
+
+func NewPricing(prices PriceTable) *Pricing {
+	return &Pricing{prices: prices}
+}
+
+// SetPrices changes the prices of the requests, those in flight keep the prices they started with.
+func (p *Pricing) SetPrices(prices PriceTable) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prices = prices
+}
+
+func (p *Pricing) priceTable() PriceTable {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.prices
+}
+
+// DefaultPriceTable has the list prices of the common OpenAI and Anthropic models.
+var DefaultPriceTable = PriceTable{
+	"gpt-4o":            {Input: 2.5, CachedInput: 1.25, Output: 10},
+	"gpt-4o-mini":       {Input: 0.15, CachedInput: 0.075, Output: 0.6},
+	"gpt-4-turbo":       {Input: 10, Output: 30},
+	"gpt-4":             {Input: 30, Output: 60},
+	"gpt-3.5-turbo":     {Input: 0.5, Output: 1.5},
+	"o1":                {Input: 15, CachedInput: 7.5, Output: 60},
+	"o1-mini":           {Input: 3, CachedInput: 1.5, Output: 12},
+	"claude-3-5-sonnet": {Input: 3, CachedInput: 0.3, Output: 15},
+	"claude-3-5-haiku":  {Input: 0.8, CachedInput: 0.08, Output: 4},
+	"claude-3-opus":     {Input: 15, CachedInput: 1.5, Output: 75},
+	"claude-3-sonnet":   {Input: 3, CachedInput: 0.3, Output: 15},
+	"claude-3-haiku":    {Input: 0.25, CachedInput: 0.03, Output: 1.25},
+}
+
+// ParsePriceTable parses prices in USD per million tokens, as in
+// "gpt-4o=input:2.5,cached_input:1.25,output:10;my-finetune=input:3,output:12", on top of defaults.
+func ParsePriceTable(spec string, defaults PriceTable) (PriceTable, error) {
+	prices := make(PriceTable, len(defaults))
+	for model, price := range defaults {
+		prices[model] = price
+	}
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		model, settings, ok := strings.Cut(entry, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid price %q, expected model=price:value,...", entry)
+		}
+		var price ModelPrice
+		for _, setting := range strings.Split(settings, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(setting), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid price %q of %s, expected price:value", setting, model)
+			}
+			amount, err := strconv.ParseFloat(value, 64)
+			if err != nil || amount < 0 {
+				return nil, fmt.Errorf("invalid %s price of %s: %q", name, model, value)
+			}
+			switch name {
+			case "input":
+				price.Input = amount
+			case "cached_input":
+				price.CachedInput = amount
+			case "output":
+				price.Output = amount
+			default:
+				return nil, fmt.Errorf("unknown price %q of %s", name, model)
+			}
+		}
+		prices[model] = price
+	}
+	return prices, nil
+}
+
+// otherModel stands for the models without a price in the usage and the metrics.
+const otherModel = "other"
+
+// pricedModel returns the model of pt whose price model takes, the model itself or the model
+// it is a snapshot of.
+func (pt PriceTable) pricedModel(model string) (string, bool) {
+	if _, ok := pt[model]; ok {
+		return model, true
+	}
+	if suffix := snapshotSuffix.FindString(model); suffix != "" {
+		name := strings.TrimSuffix(model, suffix)
+		if _, ok := pt[name]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// price returns the price of model.
+func (pt PriceTable) price(model string) (ModelPrice, bool) {
+	name, ok := pt.pricedModel(model)
+	return pt[name], ok
+}
+
+// label returns the model of pt whose price model takes, otherModel when model has no price, so
+// that the models told apart are bounded by the price table.
+func (pt PriceTable) label(model string) string {
+	if name, ok := pt.pricedModel(model); ok {
+		return name
+	}
+	return otherModel
+}
+
+// cost returns the cost in USD of usage of model, zero when model has no price.
+func (pt PriceTable) cost(model string, usage tokenUsage) float64 {
+	price, ok := pt.price(model)
+	if !ok {
+		return 0
+	}
+	return price.cost(usage)
+}
+
+// cost returns the cost of usage in USD.
+func (mp ModelPrice) cost(usage tokenUsage) float64 {
+	cachedInput := mp.CachedInput
+	if cachedInput == 0 {
+		cachedInput = mp.Input
+	}
+	return (float64(usage.PromptTokens-usage.CachedTokens)*mp.Input +
+		float64(usage.CachedTokens)*cachedInput +
+		float64(usage.CompletionTokens)*mp.Output) / 1e6
+}
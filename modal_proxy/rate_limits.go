@@ -0,0 +1,88 @@
+package modal_proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rateLimitWindow is how long a budget reported without a reset time applies, the limits of
+// the providers are per minute.
+const rateLimitWindow = time.Minute
+
+// rateLimit is the budget of a key for requests or tokens, as last reported by the provider and
+// spent since then.
+type rateLimit struct {
+	known     bool
+	limit     int64
+	remaining int64
+	// resetAt is when the budget is replenished
+	resetAt time.Time
+}
+
+// RateLimitHealth is a rate limit budget of a key, as reported by the admin endpoint.
+type RateLimitHealth struct {
+	Limit     int64     `json:"limit,omitempty"`
+	Remaining int64     `json:"remaining"`
+	ResetAt   time.Time `json:"resetAt"`
+}
+
+// readRateLimit reads the budget of resource, requests or tokens, from the rate limit headers of
+// OpenAI and Azure (x-ratelimit-*) or Anthropic (anthropic-ratelimit-*).
+func readRateLimit(header http.Header, resource string, now time.Time) rateLimit {
+	remaining, ok := headerInt(header, "x-ratelimit-remaining-"+resource, "anthropic-ratelimit-"+resource+"-remaining")
+	if !ok {
+		return rateLimit{}
+	}
+	budget := rateLimit{known: true, remaining: remaining}
+	budget.limit, _ = headerInt(header, "x-ratelimit-limit-"+resource, "anthropic-ratelimit-"+resource+"-limit")
+	if reset, err := time.ParseDuration(header.Get("x-ratelimit-reset-" + resource)); err == nil {
+		budget.resetAt = now.Add(reset)
+	} else if resetAt, err := time.Parse(time.RFC3339, header.Get("anthropic-ratelimit-"+resource+"-reset")); err == nil {
+		budget.resetAt = resetAt
+	} else {
+		budget.resetAt = now.Add(rateLimitWindow)
+	}
+	return budget
+}
+
+// headerInt returns the integer value of the first of names which is in header.
+func headerInt(header http.Header, names ...string) (int64, bool) {
+	for _, name := range names {
+		if value := header.Get(name); value != "" {
+			number, err := strconv.ParseInt(value, 10, 64)
+			return number, err == nil
+		}
+	}
+	return 0, false
+}
+
+// current reports whether the budget still applies at now, it no longer does once it was reset.
+func (rl rateLimit) current(now time.Time) bool {
+	return rl.known && now.Before(rl.resetAt)
+}
+
+// exhausted reports whether the budget is spent at now.
+func (rl rateLimit) exhausted(now time.Time) bool {
+	return rl.current(now) && rl.remaining <= 0
+}
+
+// low reports whether less than reserve, a fraction of the limit, is left of the budget at now.
+func (rl rateLimit) low(now time.Time, reserve float64) bool {
+	return rl.current(now) && rl.limit > 0 && float64(rl.remaining) < reserve*float64(rl.limit)
+}
+
+// spend takes a request from the budget, until the provider reports it again.
+func (rl *rateLimit) spend(now time.Time) {
+	if rl.current(now) && rl.remaining > 0 {
+		rl.remaining--
+	}
+}
+
+// health returns the budget for the admin endpoint, nil when it is not known at now.
+func (rl rateLimit) health(now time.Time) *RateLimitHealth {
+	if !rl.current(now) {
+		return nil
+	}
+	return &RateLimitHealth{Limit: rl.limit, Remaining: rl.remaining, ResetAt: rl.resetAt}
+}
@@ -0,0 +1,59 @@
+package modal_proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadRateLimit(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	openAI := http.Header{}
+	openAI.Set("x-ratelimit-limit-requests", "500")
+	openAI.Set("x-ratelimit-remaining-requests", "499")
+	openAI.Set("x-ratelimit-reset-requests", "120ms")
+	openAI.Set("x-ratelimit-limit-tokens", "30000")
+	openAI.Set("x-ratelimit-remaining-tokens", "29000")
+	openAI.Set("x-ratelimit-reset-tokens", "2s")
+	assert.Equal(t, rateLimit{known: true, limit: 500, remaining: 499, resetAt: now.Add(120 * time.Millisecond)},
+		readRateLimit(openAI, "requests", now))
+	assert.Equal(t, rateLimit{known: true, limit: 30000, remaining: 29000, resetAt: now.Add(2 * time.Second)},
+		readRateLimit(openAI, "tokens", now))
+
+	anthropic := http.Header{}
+	anthropic.Set("anthropic-ratelimit-requests-limit", "50")
+	anthropic.Set("anthropic-ratelimit-requests-remaining", "0")
+	anthropic.Set("anthropic-ratelimit-requests-reset", "2024-06-01T12:00:30Z")
+	assert.Equal(t, rateLimit{known: true, limit: 50, remaining: 0, resetAt: now.Add(30 * time.Second)},
+		readRateLimit(anthropic, "requests", now))
+	assert.False(t, readRateLimit(anthropic, "tokens", now).known)
+
+	// Azure does not say when its limits reset
+	azure := http.Header{}
+	azure.Set("x-ratelimit-remaining-requests", "10")
+	assert.Equal(t, rateLimit{known: true, remaining: 10, resetAt: now.Add(rateLimitWindow)},
+		readRateLimit(azure, "requests", now))
+}
+
+func TestRateLimitBudget(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	budget := rateLimit{known: true, limit: 100, remaining: 5, resetAt: now.Add(time.Second)}
+
+	assert.False(t, budget.low(now, 0.05))
+	budget.spend(now)
+	assert.True(t, budget.low(now, 0.05))
+	for i := 0; i < 10; i++ {
+		budget.spend(now)
+	}
+	assert.Equal(t, int64(0), budget.remaining)
+	assert.True(t, budget.exhausted(now))
+
+	// Budgets no longer apply once they were reset
+	later := now.Add(time.Second)
+	assert.False(t, budget.exhausted(later))
+	assert.False(t, budget.low(later, 0.05))
+	assert.Nil(t, budget.health(later))
+}
@@ -0,0 +1,258 @@
+package modal_proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"os"
+	"sync"
+	"time"
+)
+
+// RequestIdHeader identifies a request in the request log, it is taken from the request when
+// the caller sets it.
+const RequestIdHeader = "x-request-id"
+
+// RequestLogConfig configures the request log.
+type RequestLogConfig struct {
+	// Path is the file the requests are logged to
+	Path string
+	// MaxSize is the size in bytes past which the file is rotated, it is never rotated when zero
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept, as Path.1 to Path.MaxBackups
+	MaxBackups int
+	// Bodies logs the request and response bodies, streams reassembled
+	Bodies bool
+}
+
+// RequestLogEntry is a line of the request log.
+type RequestLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"requestId"`
+	// Tenant is the masked Maxim API key of the request
+	Tenant string `json:"tenant,omitempty"`
+	Route  string `json:"route"`
+	// Provider and Model served the request, RequestedModel is the model of the request, which may
+	// be a virtual name the model router resolved
+	Provider       string `json:"provider"`
+	Model          string `json:"model,omitempty"`
+	RequestedModel string `json:"requestedModel,omitempty"`
+	// Experiment and Arm are the split of the model router which picked the model, and its arm
+	Experiment       string          `json:"experiment,omitempty"`
+	Arm              string          `json:"arm,omitempty"`
+	Status           int             `json:"status"`
+	Stream           bool            `json:"stream"`
+	LatencyMs        float64         `json:"latencyMs"`
+	TtftMs           *float64        `json:"ttftMs,omitempty"`
+	PromptTokens     int             `json:"promptTokens"`
+	CompletionTokens int             `json:"completionTokens"`
+	CachedTokens     int             `json:"cachedTokens"`
+	Cache            string          `json:"cache,omitempty"`
+	Error            string          `json:"error,omitempty"`
+	Request          json.RawMessage `json:"request,omitempty"`
+	Response         json.RawMessage `json:"response,omitempty"`
+}
+
+// RequestLogger writes a RequestLogEntry per proxied request, as a JSON line, to a rotating file.
+type RequestLogger struct {
+	mu     sync.Mutex
+	config RequestLogConfig
+	file   *rotatingFile
+}
+
+func NewRequestLogger(config RequestLogConfig) (*RequestLogger, error) {
+	file, err := openRotatingFile(config.Path, config.MaxSize, config.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestLogger{config: config, file: file}, nil
+}
+
+// Handler logs the requests to next, the route of provider at route, once their response is
+// relayed.
+func (rl *RequestLogger) Handler(route string, provider string, next fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		requestId := c.Get(RequestIdHeader)
+		if requestId == "" {
+			requestId = uuid.NewString()
+		}
+		c.Set(RequestIdHeader, requestId)
+
+		entry := RequestLogEntry{Time: start, RequestId: requestId, Route: route}
+		if maximApiKey, err := GetMaximApiKey(c.GetReqHeaders()); err == nil {
+			entry.Tenant = maskKey(maximApiKey)
+		}
+		var request struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		_ = json.Unmarshal(c.Body(), &request)
+		entry.RequestedModel = requestedModel(c, request.Model)
+		entry.Experiment, entry.Arm = modelExperiment(c)
+		if rl.config.Bodies {
+			c.Locals(captureBodyLocal, true)
+			entry.Request = rawJSON(c.Body())
+		}
+
+		// Streams log their entry from the goroutine relaying them, entry is not changed once
+		// the request is proxied
+		var once sync.Once
+		log := func(report usageReport, errMessage string) {
+			once.Do(func() { rl.log(entry, provider, request.Model, report, errMessage, start) })
+		}
+		observeUsage(c, func(report usageReport) { log(report, "") })
+		err := next(c)
+		var errMessage string
+		if err != nil {
+			errMessage = err.Error()
+			setErrorStatus(c, err)
+		}
+		notifyUsage(c, func(report usageReport) { log(report, errMessage) })
+		return err
+	}
+}
+
+// log completes entry, a request for model on a route of provider, with the report of its
+// response and the error of the handler, and writes it.
+func (rl *RequestLogger) log(entry RequestLogEntry, provider string, model string, report usageReport, errMessage string, start time.Time) {
+	end := time.Now()
+	entry.Provider, entry.Model = report.served(provider, model)
+	entry.Cache = report.cache
+	entry.Error = errMessage
+	entry.Status = report.status
+	entry.Stream = report.stream
+	entry.LatencyMs = milliseconds(end.Sub(start))
+	if !report.firstByteAt.IsZero() {
+		ttft := milliseconds(report.firstByteAt.Sub(start))
+		entry.TtftMs = &ttft
+	}
+	entry.PromptTokens = report.usage.PromptTokens
+	entry.CompletionTokens = report.usage.CompletionTokens
+	entry.CachedTokens = report.usage.CachedTokens
+	if rl.config.Bodies {
+		entry.Response = rawJSON(report.body)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("Error encoding request log entry: %v\n", err)
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, err := rl.file.Write(append(line, '\n')); err != nil {
+		fmt.Printf("Error writing request log: %v\n", err)
+	}
+}
+
+// Close closes the log file.
+func (rl *RequestLogger) Close() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.file.Close()
+}
+
+// cacheStatus reports whether the response to c was served by the response cache, hit, by the
+// semantic cache, semantic_hit, or missed them, miss. It is empty when the caches are not used.
+func cacheStatus(c *fiber.Ctx) string {
+	switch {
+	case c.GetRespHeader(CacheHeader) == "hit":
+		return "hit"
+	case c.GetRespHeader(SemanticCacheHeader) == "hit":
+		return "semantic_hit"
+	case c.GetRespHeader(CacheHeader) == "miss", c.GetRespHeader(SemanticCacheHeader) == "miss":
+		return "miss"
+	}
+	return ""
+}
+
+// rawJSON returns body as is when it is JSON, as a JSON string otherwise.
+func rawJSON(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return append(json.RawMessage(nil), body...)
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// rotatingFile appends to the file at path, which is renamed path.1 once it is larger than
+// maxSize, path.1 becoming path.2 and so on up to maxBackups.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first when p does not fit.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	if rf.maxBackups <= 0 {
+		if err := os.Remove(rf.path); err != nil {
+			return err
+		}
+		return rf.open()
+	}
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(rf.backup(i), rf.backup(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(rf.path, rf.backup(1)); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", rf.path, i)
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.file.Close()
+}
@@ -0,0 +1,166 @@
+package modal_proxy
+
+import (
+	"bifrost/cache_storage"
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupLoggedApp routes the chat API, behind the response cache, and the messages API to a
+// request log at the returned path.
+func setupLoggedApp(t *testing.T, bodies bool) (*fiber.App, string) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	logger, err := NewRequestLogger(RequestLogConfig{Path: path, Bodies: bodies})
+	assert.NoError(t, err)
+	t.Cleanup(func() { logger.Close() })
+	mockMaximAccount(testAccounts())
+	responseCache := NewResponseCache(cache_storage.NewLRUCache(10))
+	app, _ := setupWrappedApp(FallbackConfig{}, RetryPolicy{}, func(apiPath string, provider string, next fiber.Handler) fiber.Handler {
+		if provider == ProviderOpenAI {
+			next = responseCache.Handler(false, next)
+		}
+		return logger.Handler(apiPath, provider, next)
+	})
+	return app, path
+}
+
+// readRequestLog returns the entries of the request log at path.
+func readRequestLog(t *testing.T, path string) []RequestLogEntry {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	var entries []RequestLogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry RequestLogEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRequestLog(t *testing.T) {
+	app, path := setupLoggedApp(t, false)
+	mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+
+	newChatRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","messages":[]}`))
+		req.Header.Set("x-maxim-api-key", "maxim-api-key")
+		req.Header.Set(CacheHeader, "true")
+		return req
+	}
+	req := newChatRequest()
+	req.Header.Set(RequestIdHeader, "req-1")
+	app.Test(req)
+	resp, _ := app.Test(newChatRequest())
+	mockHostClient(map[string]hostResponse{anthropicHost: {StatusCode: http.StatusUnauthorized}})
+	postJSON(app, "/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":100,"messages":[]}`)
+
+	entries := readRequestLog(t, path)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "req-1", entries[0].RequestId)
+	assert.Equal(t, "max...-key", entries[0].Tenant)
+	assert.Equal(t, "/v1/chat/completions", entries[0].Route)
+	assert.Equal(t, ProviderOpenAI, entries[0].Provider)
+	assert.Equal(t, "gpt-4o", entries[0].Model)
+	assert.Equal(t, http.StatusOK, entries[0].Status)
+	assert.Equal(t, "miss", entries[0].Cache)
+	assert.Equal(t, 3, entries[0].PromptTokens)
+	assert.Equal(t, 1, entries[0].CompletionTokens)
+	assert.Nil(t, entries[0].TtftMs)
+	assert.Nil(t, entries[0].Request)
+	assert.Nil(t, entries[0].Response)
+
+	// Requests without an ID get one
+	assert.Equal(t, resp.Header.Get(RequestIdHeader), entries[1].RequestId)
+	assert.Len(t, entries[1].RequestId, 36)
+	assert.Equal(t, "hit", entries[1].Cache)
+	assert.Equal(t, 3, entries[1].PromptTokens)
+
+	assert.Equal(t, ProviderAnthropic, entries[2].Provider)
+	assert.Equal(t, "claude-3-5-sonnet", entries[2].Model)
+	assert.Equal(t, http.StatusUnauthorized, entries[2].Status)
+	assert.Empty(t, entries[2].Cache)
+}
+
+func TestRequestLogBodies(t *testing.T) {
+	app, path := setupLoggedApp(t, true)
+	mockHostClient(map[string]hostResponse{
+		openAIHost:    {StatusCode: http.StatusOK, Body: openAIResponse},
+		anthropicHost: {StatusCode: http.StatusOK, Body: anthropicStream, ContentType: "text/event-stream"},
+	})
+	messages := `{"model":"claude-3-5-sonnet","max_tokens":100,"stream":true,"messages":[]}`
+
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	postJSON(app, "/v1/messages", messages)
+
+	entries := readRequestLog(t, path)
+	assert.Len(t, entries, 2)
+	assert.JSONEq(t, `{"model":"gpt-4o","messages":[]}`, string(entries[0].Request))
+	assert.JSONEq(t, openAIResponse, string(entries[0].Response))
+	assert.False(t, entries[0].Stream)
+
+	// Streams are logged reassembled, once they are over
+	assert.JSONEq(t, messages, string(entries[1].Request))
+	assert.True(t, entries[1].Stream)
+	assert.Equal(t, 10, entries[1].PromptTokens)
+	assert.Equal(t, 15, entries[1].CompletionTokens)
+	assert.NotNil(t, entries[1].TtftMs)
+	assert.LessOrEqual(t, *entries[1].TtftMs, entries[1].LatencyMs)
+	assert.JSONEq(t, assembleStream(anthropicStream), string(entries[1].Response))
+}
+
+func TestRequestLogShortStream(t *testing.T) {
+	app, path := setupLoggedApp(t, false)
+	mockHostClient(map[string]hostResponse{anthropicHost: {StatusCode: http.StatusOK, Body: shortAnthropicStream, ContentType: "text/event-stream"}})
+
+	postJSON(app, "/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":100,"stream":true,"messages":[]}`)
+
+	var entries []RequestLogEntry
+	assert.Eventually(t, func() bool {
+		entries = readRequestLog(t, path)
+		return len(entries) == 1
+	}, time.Second, time.Millisecond)
+	assert.True(t, entries[0].Stream)
+	assert.Equal(t, 10, entries[0].PromptTokens)
+	assert.Empty(t, entries[0].Cache)
+	assert.Empty(t, entries[0].Error)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	file, err := openRotatingFile(path, 10, 2)
+	assert.NoError(t, err)
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := file.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, file.Close())
+
+	read := func(path string) string {
+		content, _ := os.ReadFile(path)
+		return string(content)
+	}
+	assert.Equal(t, "fourth\n", read(path))
+	assert.Equal(t, "third\n", read(path+".1"))
+	assert.Equal(t, "second\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Reopened files keep growing until they are too large
+	file, _ = openRotatingFile(path, 10, 2)
+	file.Write([]byte("x\n"))
+	file.Close()
+	assert.Equal(t, "fourth\nx\n", read(path))
+	assert.False(t, strings.Contains(read(path+".1"), "fourth"))
+}
@@ -0,0 +1,170 @@
+package modal_proxy
+
+import (
+	"bifrost/cache_storage"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// CacheHeader opts a request in or out of the response cache, and reports hit or miss on the response.
+const CacheHeader = "x-bifrost-cache"
+
+// ResponseCache serves identical non-streaming completion requests of a tenant from a cache.
+type ResponseCache struct {
+	store *responseStore
+}
+
+// responseStore keeps cached responses in a cache storage, which is not safe for concurrent use.
+type responseStore struct {
+	mu      sync.Mutex
+	storage cache_storage.CacheStorageInterface
+}
+
+// cachedResponse is what is stored in the cache storage for a request.
+type cachedResponse struct {
+	// Key identifies the cached request, the storage is only indexed by a hash of it
+	Key         string `json:"key"`
+	ContentType string `json:"contentType"`
+	Body        string `json:"body"`
+}
+
+// NewResponseCache creates a response cache backed by storage.
+func NewResponseCache(storage cache_storage.CacheStorageInterface) *ResponseCache {
+	return &ResponseCache{
+		store: &responseStore{storage: storage},
+	}
+}
+
+// Handler wraps next with the response cache. Caching is enabled for the route when
+// defaultEnabled is set, the CacheHeader of a request overrides it.
+func (rc *ResponseCache) Handler(defaultEnabled bool, next fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !headerEnabled(c, CacheHeader, defaultEnabled) {
+			return next(c)
+		}
+		key, ok := rc.requestKey(c)
+		if !ok {
+			return next(c)
+		}
+		_, span := tracer.Start(c.UserContext(), "bifrost.cache_lookup")
+		cached := rc.store.get(key)
+		span.SetAttributes(attribute.Bool("bifrost.cache.hit", cached != nil))
+		span.End()
+		if cached != nil {
+			c.Set(CacheHeader, "hit")
+			return sendCachedResponse(c, cached)
+		}
+		// The miss is reported before proxying, for the streams which start relaying meanwhile
+		c.Set(CacheHeader, "miss")
+		if err := next(c); err != nil {
+			return err
+		}
+		if cached, ok := cacheableResponse(c, key); ok {
+			rc.store.set(key, cached)
+		}
+		return nil
+	}
+}
+
+// headerEnabled reads the boolean header of the request, falling back to defaultEnabled.
+func headerEnabled(c *fiber.Ctx, header string, defaultEnabled bool) bool {
+	value := c.Get(header)
+	if value == "" {
+		return defaultEnabled
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return defaultEnabled
+	}
+	return enabled
+}
+
+// requestKey derives the cache key of a request from the tenant, the route and the canonical
+// JSON request body. Streaming requests and invalid bodies are not cached.
+func (rc *ResponseCache) requestKey(c *fiber.Ctx) (string, bool) {
+	maximApiKey, err := GetMaximApiKey(c.GetReqHeaders())
+	if err != nil {
+		return "", false
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(c.Body(), &body); err != nil {
+		return "", false
+	}
+	if stream, _ := body["stream"].(bool); stream {
+		return "", false
+	}
+	// Marshalling sorts the object keys, so the same request always has the same key
+	canonicalBody, err := json.Marshal(body)
+	if err != nil {
+		return "", false
+	}
+	hash := sha256.New()
+	hash.Write([]byte(maximApiKey))
+	hash.Write([]byte{0})
+	hash.Write([]byte(c.Path()))
+	hash.Write([]byte{0})
+	hash.Write(canonicalBody)
+	return hex.EncodeToString(hash.Sum(nil)), true
+}
+
+// cacheableResponse returns the response sent by the proxy when it can be cached, only
+// complete successful responses are.
+func cacheableResponse(c *fiber.Ctx, key string) (cachedResponse, bool) {
+	resp := c.Response()
+	if resp.StatusCode() != http.StatusOK || resp.IsBodyStream() {
+		return cachedResponse{}, false
+	}
+	return cachedResponse{
+		Key:         key,
+		ContentType: string(resp.Header.ContentType()),
+		Body:        string(resp.Body()),
+	}, true
+}
+
+func sendCachedResponse(c *fiber.Ctx, cached *cachedResponse) error {
+	if cached.ContentType != "" {
+		c.Set(fiber.HeaderContentType, cached.ContentType)
+	}
+	return c.Status(fiber.StatusOK).SendString(cached.Body)
+}
+
+// queryIndex maps a key to the index of the cache storage.
+func queryIndex(key string) int {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return int(hash.Sum64() >> 1)
+}
+
+func (rs *responseStore) get(key string) *cachedResponse {
+	rs.mu.Lock()
+	var stored []byte
+	if response := rs.storage.GetResponse(queryIndex(key)); response != nil {
+		stored = []byte(*response)
+	}
+	rs.mu.Unlock()
+	if stored == nil {
+		return nil
+	}
+	var cached cachedResponse
+	if err := json.Unmarshal(stored, &cached); err != nil || cached.Key != key {
+		return nil
+	}
+	return &cached
+}
+
+func (rs *responseStore) set(key string, cached cachedResponse) {
+	stored, err := json.Marshal(cached)
+	if err != nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.storage.SetResponse(queryIndex(key), string(stored))
+}
@@ -0,0 +1,121 @@
+package modal_proxy
+
+import (
+	"bifrost/cache_storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupCachedApp(provider *OpenAIModalProvider, defaultEnabled bool) *fiber.App {
+	mockMaximAccount(testAccounts())
+	responseCache := NewResponseCache(cache_storage.NewLRUCache(10))
+	app := fiber.New()
+	app.Post("/completion", responseCache.Handler(defaultEnabled, func(ctx *fiber.Ctx) error {
+		return provider.GetCompletion(ctx, "/v1/chat/completions")
+	}))
+	return app
+}
+
+func sendRequest(t *testing.T, app *fiber.App, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+// Test that an identical request is served from the cache
+func TestResponseCacheHit(t *testing.T) {
+	app := setupCachedApp(NewOpenAIProvider("https://api.openai.com", testAccountSource), false)
+	transport := mockClient(http.StatusOK, `{"id":"chatcmpl-1"}`, map[string]string{"Content-Type": "application/json"})
+
+	req := newCompletionRequest(`{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`)
+	req.Header.Set(CacheHeader, "true")
+	resp, _ := sendRequest(t, app, req)
+	assert.Equal(t, "miss", resp.Header.Get(CacheHeader))
+
+	// Same request with the keys in a different order
+	req = newCompletionRequest(`{"messages":[{"role":"user","content":"hi"}],"temperature":0,"model":"gpt-4o"}`)
+	req.Header.Set(CacheHeader, "true")
+	transport.LastRequest = nil
+	resp, body := sendRequest(t, app, req)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hit", resp.Header.Get(CacheHeader))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"id":"chatcmpl-1"}`, body)
+	assert.Nil(t, transport.LastRequest)
+}
+
+// Test that requests of different tenants or parameters do not share entries
+func TestResponseCacheKey(t *testing.T) {
+	app := setupCachedApp(NewOpenAIProvider("https://api.openai.com", testAccountSource), true)
+	mockClient(http.StatusOK, `{"id":"chatcmpl-1"}`, nil)
+
+	sendRequest(t, app, newCompletionRequest(testRequestBody))
+
+	resp, _ := sendRequest(t, app, newCompletionRequest(`{"model":"gpt-4o","temperature":1,"messages":[{"role":"user","content":"hi"}]}`))
+	assert.Equal(t, "miss", resp.Header.Get(CacheHeader))
+
+	req := newCompletionRequest(testRequestBody)
+	req.Header.Set("x-maxim-api-key", "another-maxim-api-key")
+	resp, _ = sendRequest(t, app, req)
+	assert.Equal(t, "miss", resp.Header.Get(CacheHeader))
+
+	resp, _ = sendRequest(t, app, newCompletionRequest(testRequestBody))
+	assert.Equal(t, "hit", resp.Header.Get(CacheHeader))
+}
+
+// Test that the cache is only used when enabled for the route or the request
+func TestResponseCacheOptIn(t *testing.T) {
+	app := setupCachedApp(NewOpenAIProvider("https://api.openai.com", testAccountSource), false)
+	mockClient(http.StatusOK, `{"id":"chatcmpl-1"}`, nil)
+
+	sendRequest(t, app, newCompletionRequest(testRequestBody))
+	resp, _ := sendRequest(t, app, newCompletionRequest(testRequestBody))
+	assert.Empty(t, resp.Header.Get(CacheHeader))
+
+	// A route enabled by default can be opted out per request
+	app = setupCachedApp(NewOpenAIProvider("https://api.openai.com", testAccountSource), true)
+	sendRequest(t, app, newCompletionRequest(testRequestBody))
+	req := newCompletionRequest(testRequestBody)
+	req.Header.Set(CacheHeader, "false")
+	resp, _ = sendRequest(t, app, req)
+	assert.Empty(t, resp.Header.Get(CacheHeader))
+}
+
+// Test that errors and streaming responses are not cached
+func TestResponseCacheSkipsErrorsAndStreams(t *testing.T) {
+	app := setupCachedApp(NewOpenAIProvider("https://api.openai.com", testAccountSource), true)
+
+	mockClient(http.StatusTooManyRequests, "rate limited", nil)
+	sendRequest(t, app, newCompletionRequest(testRequestBody))
+	mockClient(http.StatusOK, `{"id":"chatcmpl-1"}`, nil)
+	resp, _ := sendRequest(t, app, newCompletionRequest(testRequestBody))
+	assert.Equal(t, "miss", resp.Header.Get(CacheHeader))
+
+	streamBody := `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	mockClient(http.StatusOK, "data: [DONE]\n\n", map[string]string{"Content-Type": "text/event-stream"})
+	sendRequest(t, app, newCompletionRequest(streamBody))
+	resp, _ = sendRequest(t, app, newCompletionRequest(streamBody))
+	assert.Empty(t, resp.Header.Get(CacheHeader))
+}
+
+// Test that bifrost headers are not forwarded upstream
+func TestResponseCacheHeaderNotForwarded(t *testing.T) {
+	app := setupCachedApp(NewOpenAIProvider("https://api.openai.com", testAccountSource), false)
+	transport := mockClient(http.StatusOK, `{"id":"chatcmpl-1"}`, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/completion", strings.NewReader(testRequestBody))
+	req.Header.Set("x-maxim-api-key", "maxim-api-key")
+	req.Header.Set(CacheHeader, "true")
+	sendRequest(t, app, req)
+
+	assert.Empty(t, transport.LastRequest.Header.Get(CacheHeader))
+}
@@ -0,0 +1,146 @@
+package modal_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusOverloaded is the status Anthropic answers with when its API is overloaded.
+const statusOverloaded = 529
+
+// RetryPolicy configures how a request is retried on the same provider before its response is
+// relayed or the request moves down its fallback chain.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one, zero or one disables retries
+	MaxAttempts int
+	// BaseBackoff is the wait before the first retry, it doubles with each attempt
+	BaseBackoff time.Duration
+	// MaxBackoff caps the wait between attempts, a provider asking to wait longer with Retry-After
+	// or x-ratelimit-reset-* is not retried. Zero does not cap the wait
+	MaxBackoff time.Duration
+	// Jitter is the fraction of the backoff, between 0 and 1, which is randomized
+	Jitter float64
+	// Deadline bounds the time spent on the attempts of a request, no retry is made which would
+	// end past it. Zero does not bound the retries
+	Deadline time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of the routes which do not configure one.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseBackoff: 250 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+	Jitter:      0.5,
+	Deadline:    time.Minute,
+}
+
+// ParseRetryPolicies parses the retry policies of routes written as
+// path=max_attempts:5,base_backoff:1s,max_backoff:30s,jitter:0.2,deadline:2m;path=max_attempts:1
+// Settings a route leaves out are taken from defaults.
+func ParseRetryPolicies(spec string, defaults RetryPolicy) (map[string]RetryPolicy, error) {
+	policies := make(map[string]RetryPolicy)
+	for _, route := range strings.Split(spec, ";") {
+		if route = strings.TrimSpace(route); route == "" {
+			continue
+		}
+		path, settings, ok := strings.Cut(route, "=")
+		path = strings.TrimSpace(path)
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid retry policy %q, expected path=setting:value,...", route)
+		}
+		policy := defaults
+		for _, setting := range strings.Split(settings, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(setting), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid retry setting %q of %s, expected setting:value", setting, path)
+			}
+			var err error
+			switch name {
+			case "max_attempts":
+				policy.MaxAttempts, err = strconv.Atoi(value)
+			case "base_backoff":
+				policy.BaseBackoff, err = time.ParseDuration(value)
+			case "max_backoff":
+				policy.MaxBackoff, err = time.ParseDuration(value)
+			case "jitter":
+				policy.Jitter, err = strconv.ParseFloat(value, 64)
+				if err == nil && (policy.Jitter < 0 || policy.Jitter > 1) {
+					err = errors.New("must be between 0 and 1")
+				}
+			case "deadline":
+				policy.Deadline, err = time.ParseDuration(value)
+			default:
+				return nil, fmt.Errorf("unknown retry setting %q of %s", name, path)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s of %s: %w", name, path, err)
+			}
+		}
+		policies[path] = policy
+	}
+	return policies, nil
+}
+
+// backoff returns the wait before the retry following attempt, attempts counting from 1.
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := rp.BaseBackoff << min(attempt-1, 30)
+	if rp.MaxBackoff > 0 && (backoff > rp.MaxBackoff || backoff < 0) {
+		backoff = rp.MaxBackoff
+	}
+	if rp.Jitter > 0 {
+		backoff -= time.Duration(rand.Float64() * rp.Jitter * float64(backoff))
+	}
+	return backoff
+}
+
+// isRetryStatus reports whether a request answered with statusCode is retried.
+func isRetryStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, statusOverloaded:
+		return true
+	}
+	return false
+}
+
+// isRetryError reports whether a request which failed with err is retried, which is the case
+// when the provider could not be reached.
+func isRetryError(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && !errors.Is(err, context.Canceled)
+}
+
+// retryAfter returns how long a provider asked to wait before retrying with the Retry-After,
+// retry-after-ms or, for exhausted rate limits, x-ratelimit-reset-* headers of its response.
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	if ms, err := strconv.ParseFloat(header.Get("retry-after-ms"), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return max(date.Sub(now), 0), true
+		}
+	}
+	var wait time.Duration
+	found := false
+	for _, limit := range []string{"requests", "tokens"} {
+		if header.Get("x-ratelimit-remaining-"+limit) != "0" {
+			continue
+		}
+		if reset, err := time.ParseDuration(header.Get("x-ratelimit-reset-" + limit)); err == nil {
+			wait = max(wait, reset)
+			found = true
+		}
+	}
+	return wait, found
+}
@@ -0,0 +1,207 @@
+package modal_proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// fastRetry retries without waiting long, to keep the tests quick.
+var fastRetry = RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Second}
+
+func TestParseRetryPolicies(t *testing.T) {
+	policies, err := ParseRetryPolicies(" /v1/messages=max_attempts:5,base_backoff:1s,max_backoff:30s,jitter:0.2,deadline:2m ; /completions=max_attempts:1",
+		DefaultRetryPolicy)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]RetryPolicy{
+		"/v1/messages": {MaxAttempts: 5, BaseBackoff: time.Second, MaxBackoff: 30 * time.Second, Jitter: 0.2, Deadline: 2 * time.Minute},
+		"/completions": {MaxAttempts: 1, BaseBackoff: DefaultRetryPolicy.BaseBackoff, MaxBackoff: DefaultRetryPolicy.MaxBackoff,
+			Jitter: DefaultRetryPolicy.Jitter, Deadline: DefaultRetryPolicy.Deadline},
+	}, policies)
+
+	for _, spec := range []string{"max_attempts:5", "/v1/messages=max_attempts", "/v1/messages=attempts:5",
+		"/v1/messages=max_attempts:many", "/v1/messages=base_backoff:1", "/v1/messages=jitter:2", "/v1/messages=deadline:soon"} {
+		_, err := ParseRetryPolicies(spec, DefaultRetryPolicy)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	var backoffs []time.Duration
+	for attempt := 1; attempt <= 6; attempt++ {
+		backoffs = append(backoffs, policy.backoff(attempt))
+	}
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second}, backoffs)
+	assert.Equal(t, time.Second, policy.backoff(100))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.backoff(2)
+		assert.True(t, backoff > 100*time.Millisecond && backoff <= 200*time.Millisecond, backoff)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		wait   time.Duration
+		ok     bool
+	}{
+		{"seconds", http.Header{"Retry-After": {"3"}}, 3 * time.Second, true},
+		{"date", http.Header{"Retry-After": {"Sat, 01 Jun 2024 12:00:05 GMT"}}, 5 * time.Second, true},
+		{"past date", http.Header{"Retry-After": {"Sat, 01 Jun 2024 11:00:00 GMT"}}, 0, true},
+		{"milliseconds", http.Header{"Retry-After-Ms": {"1500"}, "Retry-After": {"2"}}, 1500 * time.Millisecond, true},
+		{"exhausted limits", http.Header{
+			"X-Ratelimit-Remaining-Requests": {"0"}, "X-Ratelimit-Reset-Requests": {"1s"},
+			"X-Ratelimit-Remaining-Tokens": {"0"}, "X-Ratelimit-Reset-Tokens": {"6m0s"},
+		}, 6 * time.Minute, true},
+		{"limit left", http.Header{
+			"X-Ratelimit-Remaining-Requests": {"0"}, "X-Ratelimit-Reset-Requests": {"20ms"},
+			"X-Ratelimit-Remaining-Tokens": {"100"}, "X-Ratelimit-Reset-Tokens": {"6m0s"},
+		}, 20 * time.Millisecond, true},
+		{"none", http.Header{"X-Ratelimit-Reset-Requests": {"1s"}, "Retry-After": {"soon"}}, 0, false},
+	}
+	for _, test := range tests {
+		wait, ok := retryAfter(test.header, now)
+		assert.Equal(t, test.ok, ok, test.name)
+		assert.Equal(t, test.wait, wait, test.name)
+	}
+}
+
+func TestRetryTransientStatuses(t *testing.T) {
+	app := setupRetryApp(FallbackConfig{}, fastRetry)
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+	transport.Sequences[openAIHost] = []hostResponse{{StatusCode: http.StatusServiceUnavailable}, {StatusCode: statusOverloaded}}
+
+	resp, body := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, openAIResponse, body)
+	assert.Len(t, transport.Requests[openAIHost], 3)
+}
+
+func TestRetryConnectionErrors(t *testing.T) {
+	app := setupRetryApp(FallbackConfig{}, fastRetry)
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+	transport.Sequences[openAIHost] = []hostResponse{{Err: errors.New("connection refused")}}
+
+	resp, _ := postJSON(app, "/v1/completions", `{"model":"gpt-4o","prompt":"hi"}`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, transport.Requests[openAIHost], 2)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	app := setupRetryApp(FallbackConfig{}, fastRetry)
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusBadGateway}})
+
+	resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Len(t, transport.Requests[openAIHost], 3)
+}
+
+func TestRetryOnlyTransientStatuses(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotImplemented} {
+		app := setupRetryApp(FallbackConfig{}, fastRetry)
+		transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: status}})
+
+		resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+		assert.Equal(t, status, resp.StatusCode)
+		assert.Len(t, transport.Requests[openAIHost], 1)
+	}
+}
+
+func TestRetryWaitsForRetryAfter(t *testing.T) {
+	app := setupRetryApp(FallbackConfig{}, fastRetry)
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+	transport.Sequences[openAIHost] = []hostResponse{
+		{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After-Ms": {"50"}}},
+	}
+
+	start := time.Now()
+	resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Len(t, transport.Requests[openAIHost], 2)
+}
+
+func TestRetryAfterBeyondMaxBackoff(t *testing.T) {
+	app := setupRetryApp(fallbackConfig(), fastRetry)
+	transport := mockHostClient(map[string]hostResponse{
+		openAIHost: {StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"60"}}},
+		azureHost:  {StatusCode: http.StatusOK, Body: openAIResponse},
+	})
+
+	resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	// The provider is not retried, the request falls back right away
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "azure/gpt-4o", resp.Header.Get(ServedByHeader))
+	assert.Len(t, transport.Requests[openAIHost], 1)
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	accounts := testAccounts()
+	mockMaximAccount(accounts)
+	router := NewFallbackRouter(map[string]ModalProviderInterface{ProviderOpenAI: NewOpenAIProvider("https://"+openAIHost, testAccountSource)}, FallbackConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	app := fiber.New()
+	app.Post("/v1/chat/completions", func(c *fiber.Ctx) error {
+		c.SetUserContext(ctx)
+		// The caller goes away while the first retry is waiting
+		time.AfterFunc(20*time.Millisecond, cancel)
+		return c.Next()
+	}, router.Handler(ProviderOpenAI, "/v1/chat/completions", RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Minute}))
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusServiceUnavailable}})
+
+	start := time.Now()
+	resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Len(t, transport.Requests[openAIHost], 1)
+}
+
+func TestRetryDeadline(t *testing.T) {
+	app := setupRetryApp(FallbackConfig{}, RetryPolicy{MaxAttempts: 5, BaseBackoff: 30 * time.Millisecond, Deadline: 100 * time.Millisecond})
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusServiceUnavailable}})
+
+	start := time.Now()
+	resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	// After waiting 30ms and 60ms the next retry would wait 120ms, past the deadline, the last
+	// answer is sent instead
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+	assert.Len(t, transport.Requests[openAIHost], 3)
+	assert.Equal(t, 3, transport.Closed[openAIHost])
+}
+
+func TestRetryBeforeFallingBack(t *testing.T) {
+	app := setupRetryApp(fallbackConfig(), fastRetry)
+	transport := mockHostClient(map[string]hostResponse{
+		openAIHost: {StatusCode: http.StatusServiceUnavailable},
+		azureHost:  {StatusCode: http.StatusOK, Body: openAIResponse},
+	})
+	transport.Sequences[azureHost] = []hostResponse{{StatusCode: http.StatusInternalServerError}}
+
+	resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "azure/gpt-4o", resp.Header.Get(ServedByHeader))
+	assert.Len(t, transport.Requests[openAIHost], 3)
+	assert.Len(t, transport.Requests[azureHost], 2)
+}
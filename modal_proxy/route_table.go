@@ -0,0 +1,46 @@
+package modal_proxy
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"strings"
+	"sync/atomic"
+)
+
+// RouteTable routes the requests to the handler of their path. The routes can be replaced at any
+// time, the requests in flight, streams included, finish with the handler they started with.
+type RouteTable struct {
+	routes atomic.Pointer[map[string]fiber.Handler]
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{}
+}
+
+// Set replaces the routes with routes, by path.
+func (rt *RouteTable) Set(routes map[string]fiber.Handler) {
+	table := make(map[string]fiber.Handler, len(routes))
+	for path, handler := range routes {
+		table[routeKey(path)] = handler
+	}
+	rt.routes.Store(&table)
+}
+
+// Handler serves the requests to the paths of the table, the others go to the next handler.
+func (rt *RouteTable) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if routes := rt.routes.Load(); routes != nil {
+			if handler, ok := (*routes)[routeKey(c.Path())]; ok {
+				return handler(c)
+			}
+		}
+		return c.Next()
+	}
+}
+
+// routeKey matches paths the way fiber does by default, ignoring case and a trailing slash.
+func routeKey(path string) string {
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return strings.ToLower(path)
+}
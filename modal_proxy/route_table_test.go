@@ -0,0 +1,72 @@
+package modal_proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// respondWith answers the requests with body.
+func respondWith(body string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.SendString(body)
+	}
+}
+
+func routeResponse(app *fiber.App, path string) (int, string) {
+	resp, _ := app.Test(httptest.NewRequest(http.MethodPost, path, nil))
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestRouteTable(t *testing.T) {
+	routes := NewRouteTable()
+	app := fiber.New()
+	app.Post("/*", routes.Handler())
+
+	status, _ := routeResponse(app, "/v1/messages")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	routes.Set(map[string]fiber.Handler{"/v1/messages": respondWith("old")})
+	_, body := routeResponse(app, "/v1/messages")
+	assert.Equal(t, "old", body)
+	_, body = routeResponse(app, "/V1/Messages/")
+	assert.Equal(t, "old", body)
+
+	routes.Set(map[string]fiber.Handler{"/v1/chat/completions": respondWith("new")})
+	_, body = routeResponse(app, "/v1/chat/completions")
+	assert.Equal(t, "new", body)
+	status, _ = routeResponse(app, "/v1/messages")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestRouteTableInFlight(t *testing.T) {
+	routes := NewRouteTable()
+	app := fiber.New()
+	app.Post("/*", routes.Handler())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	routes.Set(map[string]fiber.Handler{"/v1/messages": func(c *fiber.Ctx) error {
+		close(started)
+		<-release
+		return c.SendString("old")
+	}})
+	done := make(chan string)
+	go func() {
+		_, body := routeResponse(app, "/v1/messages")
+		done <- body
+	}()
+	<-started
+
+	// The request in flight finishes with the handler it started with
+	routes.Set(map[string]fiber.Handler{"/v1/messages": respondWith("new")})
+	_, body := routeResponse(app, "/v1/messages")
+	assert.Equal(t, "new", body)
+	close(release)
+	assert.Equal(t, "old", <-done)
+}
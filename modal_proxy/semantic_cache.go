@@ -0,0 +1,288 @@
+package modal_proxy
+
+import (
+	"bifrost/embedding"
+	"bifrost/vector_stores"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// SemanticCacheHeader opts a request in or out of the semantic cache, and reports hit or miss on the response.
+	SemanticCacheHeader = "x-bifrost-semantic-cache"
+	// SemanticCacheScoreHeader is the distance between the request and the matched entry, lower is closer.
+	SemanticCacheScoreHeader = "x-bifrost-semantic-cache-score"
+	// SemanticCacheEntryHeader is the vector store ID of the matched entry.
+	SemanticCacheEntryHeader = "x-bifrost-semantic-cache-entry"
+)
+
+// semanticCandidates is the number of entries looked at for a request, so entries without a
+// completion do not hide the ones behind them.
+const semanticCandidates = 5
+
+// SemanticCacheConfig configures when a cached completion is close enough to be served.
+type SemanticCacheConfig struct {
+	// Threshold is the maximum distance to a cached prompt for its completion to be served
+	Threshold float64
+	// FullPrompt embeds the whole prompt instead of only the last user message
+	FullPrompt bool
+	// Size is the number of entries kept, the least recently used ones are deleted from the
+	// vector store beyond it. The entries are not bounded when it is not positive.
+	Size int
+}
+
+// SemanticCache serves completions of similar prompts, it embeds the prompt of a request and
+// looks for a cached prompt of the same tenant, route, model and context close enough to it. The
+// completions are stored as the documents of the vector store, so a store shared between
+// replicas shares the cache.
+type SemanticCache struct {
+	embedder embedding.BaseEmbedding
+	store    vector_stores.DocumentStoreInterface
+	config   SemanticCacheConfig
+
+	mu sync.Mutex
+	// entries are the semanticEntry of the entries used by this process, least recently used first
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+// semanticEntry is an entry of the vector store, with the scope it was added with.
+type semanticEntry struct {
+	id    string
+	scope map[string]interface{}
+}
+
+// promptRequest is the part of OpenAI and Anthropic requests the semantic cache looks at.
+type promptRequest struct {
+	Model    string          `json:"model"`
+	Stream   bool            `json:"stream"`
+	System   json.RawMessage `json:"system"`
+	Prompt   json.RawMessage `json:"prompt"`
+	Messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+// NewSemanticCache creates a semantic cache embedding prompts with embedder and keeping them
+// in store along with their completions.
+func NewSemanticCache(embedder embedding.BaseEmbedding, store vector_stores.DocumentStoreInterface, config SemanticCacheConfig) *SemanticCache {
+	return &SemanticCache{
+		embedder: embedder,
+		store:    store,
+		config:   config,
+		entries:  list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+// Handler wraps next with the semantic cache. Caching is enabled for the route when
+// defaultEnabled is set, the SemanticCacheHeader of a request overrides it.
+func (sc *SemanticCache) Handler(defaultEnabled bool, next fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !headerEnabled(c, SemanticCacheHeader, defaultEnabled) {
+			return next(c)
+		}
+		scope, text, ok := sc.requestPrompt(c)
+		if !ok {
+			return next(c)
+		}
+		ctx, span := tracer.Start(c.UserContext(), "bifrost.semantic_cache_lookup")
+		vector, err := sc.embedder.GetEmbeddings(ctx, text)
+		if err != nil {
+			fmt.Printf("Error embedding prompt for the semantic cache: %v\n", err)
+			endSpan(span, err)
+			return next(c)
+		}
+		cached, entry := sc.lookup(vector, scope)
+		span.SetAttributes(attribute.Bool("bifrost.cache.hit", cached != nil))
+		span.End()
+		if cached != nil {
+			sc.remember(entry.ID, scope)
+			c.Set(SemanticCacheHeader, "hit")
+			c.Set(SemanticCacheScoreHeader, strconv.FormatFloat(entry.Distance, 'f', -1, 64))
+			c.Set(SemanticCacheEntryHeader, entry.ID)
+			return sendCachedResponse(c, cached)
+		}
+		// The miss is reported before proxying, for the streams which start relaying meanwhile
+		c.Set(SemanticCacheHeader, "miss")
+		if err := next(c); err != nil {
+			return err
+		}
+		if cached, ok := cacheableResponse(c, ""); ok {
+			if document, err := json.Marshal(cached); err == nil {
+				// An empty ID means the vector store could not add the prompt
+				if id := sc.store.AddDocument(vector, string(document), scope); id != "" {
+					sc.remember(id, scope)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// lookup returns the completion of the closest entry within the threshold, entries without a
+// valid completion are skipped.
+func (sc *SemanticCache) lookup(vector []float64, scope map[string]interface{}) (*cachedResponse, vector_stores.SearchResult) {
+	for _, result := range sc.store.SearchDocuments(vector, semanticCandidates, scope) {
+		if result.Distance > sc.config.Threshold {
+			break
+		}
+		var cached cachedResponse
+		if result.Document == "" || json.Unmarshal([]byte(result.Document), &cached) != nil {
+			continue
+		}
+		return &cached, result
+	}
+	return nil, vector_stores.SearchResult{}
+}
+
+// remember marks the entry id as the most recently used, and deletes the least recently used
+// entries from the vector store beyond the size of the cache. Entries added by other replicas
+// are bounded as well once they are served.
+func (sc *SemanticCache) remember(id string, scope map[string]interface{}) {
+	sc.mu.Lock()
+	if element, ok := sc.index[id]; ok {
+		sc.entries.MoveToBack(element)
+	} else {
+		sc.index[id] = sc.entries.PushBack(&semanticEntry{id: id, scope: scope})
+	}
+	var evicted []*semanticEntry
+	for sc.config.Size > 0 && sc.entries.Len() > sc.config.Size {
+		entry := sc.entries.Remove(sc.entries.Front()).(*semanticEntry)
+		delete(sc.index, entry.id)
+		evicted = append(evicted, entry)
+	}
+	sc.mu.Unlock()
+	for _, entry := range evicted {
+		sc.store.DeleteDocument(entry.id, entry.scope)
+	}
+}
+
+// requestPrompt returns the scope the request is cached in and the text to embed for it.
+// Streaming requests and requests without a prompt are not cached.
+func (sc *SemanticCache) requestPrompt(c *fiber.Ctx) (map[string]interface{}, string, bool) {
+	maximApiKey, err := GetMaximApiKey(c.GetReqHeaders())
+	if err != nil {
+		return nil, "", false
+	}
+	var request promptRequest
+	if err := json.Unmarshal(c.Body(), &request); err != nil || request.Stream || request.Model == "" {
+		return nil, "", false
+	}
+	text := promptText(request, sc.config.FullPrompt)
+	if text == "" {
+		return nil, "", false
+	}
+	// The Maxim API key is hashed so it never ends up in the vector store
+	tenant := sha256.Sum256([]byte(maximApiKey))
+	scope := map[string]interface{}{
+		"tenant":  hex.EncodeToString(tenant[:]),
+		"route":   c.Path(),
+		"model":   request.Model,
+		"context": promptContext(c.Body(), request),
+	}
+	return scope, text, true
+}
+
+// promptFields are the fields of a request which are not part of the context of its prompt.
+var promptFields = []string{"model", "messages", "prompt", "stream", "user", "metadata"}
+
+// promptContext hashes what shapes the completion besides the embedded prompt: the messages
+// before the last user message, system prompt and earlier turns included, the tools and the
+// sampling parameters. Prompts only match within the same context, so a short follow-up is not
+// answered as in another conversation.
+func promptContext(body []byte, request promptRequest) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return ""
+	}
+	var history []interface{}
+	if err := json.Unmarshal(fields["messages"], &history); err != nil {
+		history = nil
+	}
+	if last := lastUserMessage(request); last >= 0 && last < len(history) {
+		history = append(history[:last:last], history[last+1:]...)
+	}
+	for _, field := range promptFields {
+		delete(fields, field)
+	}
+	// The fields are marshalled with sorted keys and compacted, so formatting does not matter
+	content, err := json.Marshal(struct {
+		Fields  map[string]json.RawMessage `json:"fields"`
+		History []interface{}              `json:"history"`
+	}{fields, history})
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// promptText returns the last user message of the request, or the whole prompt when fullPrompt is set.
+func promptText(request promptRequest, fullPrompt bool) string {
+	if request.Prompt != nil {
+		return contentText(request.Prompt)
+	}
+	if !fullPrompt {
+		if last := lastUserMessage(request); last >= 0 {
+			return contentText(request.Messages[last].Content)
+		}
+		return ""
+	}
+	var lines []string
+	if system := contentText(request.System); system != "" {
+		lines = append(lines, "system: "+system)
+	}
+	for _, message := range request.Messages {
+		lines = append(lines, message.Role+": "+contentText(message.Content))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lastUserMessage returns the index of the last user message of the request, -1 without one.
+func lastUserMessage(request promptRequest) int {
+	for i := len(request.Messages) - 1; i >= 0; i-- {
+		if request.Messages[i].Role == "user" {
+			return i
+		}
+	}
+	return -1
+}
+
+// contentText flattens a string, a list of strings or a list of text blocks into text.
+func contentText(content json.RawMessage) string {
+	if len(content) == 0 {
+		return ""
+	}
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text
+	}
+	var texts []string
+	if err := json.Unmarshal(content, &texts); err == nil {
+		return strings.Join(texts, "\n")
+	}
+	var blocks []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(content, &blocks); err == nil {
+		var blockTexts []string
+		for _, block := range blocks {
+			if block.Type == "text" {
+				blockTexts = append(blockTexts, block.Text)
+			}
+		}
+		return strings.Join(blockTexts, "\n")
+	}
+	return ""
+}
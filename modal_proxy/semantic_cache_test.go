@@ -0,0 +1,244 @@
+package modal_proxy
+
+import (
+	"bifrost/vector_stores"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEmbedding embeds a text as the counts of a few known words.
+type fakeEmbedding struct{}
+
+var fakeVocabulary = []string{"weather", "paris", "london", "today"}
+
+func (fe *fakeEmbedding) GetEmbeddings(_ context.Context, text interface{}, _ ...interface{}) ([]float64, error) {
+	words := strings.Fields(strings.ToLower(text.(string)))
+	vector := make([]float64, len(fakeVocabulary))
+	for _, word := range words {
+		for i, known := range fakeVocabulary {
+			if strings.Trim(word, "?!.,") == known {
+				vector[i]++
+			}
+		}
+	}
+	return vector, nil
+}
+
+func (fe *fakeEmbedding) Dimension(_ context.Context) int {
+	return len(fakeVocabulary)
+}
+
+// fakeVectorStore is a brute force L2 store filtering on equal metadata.
+type fakeVectorStore struct {
+	vectors   [][]float64
+	metadata  []map[string]interface{}
+	documents []string
+	deleted   []bool
+}
+
+func (fvs *fakeVectorStore) Add(embedding []float64, options map[string]interface{}) string {
+	return fvs.AddDocument(embedding, "", options)
+}
+
+func (fvs *fakeVectorStore) AddDocument(embedding []float64, document string, options map[string]interface{}) string {
+	fvs.vectors = append(fvs.vectors, embedding)
+	fvs.metadata = append(fvs.metadata, options)
+	fvs.documents = append(fvs.documents, document)
+	fvs.deleted = append(fvs.deleted, false)
+	return fmt.Sprintf("entry-%d", len(fvs.vectors)-1)
+}
+
+func (fvs *fakeVectorStore) Search(embedding []float64, topN int, _ bool, options map[string]interface{}) ([]string, []float64) {
+	var ids []string
+	var distances []float64
+	for _, result := range fvs.SearchDocuments(embedding, topN, options) {
+		ids = append(ids, result.ID)
+		distances = append(distances, result.Distance)
+	}
+	return ids, distances
+}
+
+func (fvs *fakeVectorStore) SearchDocuments(embedding []float64, topN int, options map[string]interface{}) []vector_stores.SearchResult {
+	var results []vector_stores.SearchResult
+	for i, vector := range fvs.vectors {
+		matches := !fvs.deleted[i]
+		for key, value := range options {
+			if fvs.metadata[i][key] != value {
+				matches = false
+			}
+		}
+		if !matches {
+			continue
+		}
+		distance := 0.0
+		for j := range vector {
+			distance += (vector[j] - embedding[j]) * (vector[j] - embedding[j])
+		}
+		results = append(results, vector_stores.SearchResult{ID: fmt.Sprintf("entry-%d", i), Distance: math.Sqrt(distance), Document: fvs.documents[i]})
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Distance < results[j].Distance })
+	if len(results) > topN {
+		results = results[:topN]
+	}
+	return results
+}
+
+func (fvs *fakeVectorStore) DeleteDocument(id string, _ map[string]interface{}) bool {
+	var index int
+	if _, err := fmt.Sscanf(id, "entry-%d", &index); err != nil || index >= len(fvs.deleted) || fvs.deleted[index] {
+		return false
+	}
+	fvs.deleted[index] = true
+	return true
+}
+
+func setupSemanticCachedApp(config SemanticCacheConfig) *fiber.App {
+	app, _ := setupSemanticCachedAppWithStore(config, &fakeVectorStore{})
+	return app
+}
+
+// setupSemanticCachedAppWithStore creates a semantic cached app keeping its entries in store.
+func setupSemanticCachedAppWithStore(config SemanticCacheConfig, store *fakeVectorStore) (*fiber.App, *fakeVectorStore) {
+	mockMaximAccount(testAccounts())
+	provider := NewOpenAIProvider("https://api.openai.com", testAccountSource)
+	semanticCache := NewSemanticCache(&fakeEmbedding{}, store, config)
+	app := fiber.New()
+	app.Post("/completion", semanticCache.Handler(true, func(ctx *fiber.Ctx) error {
+		return provider.GetCompletion(ctx, "/v1/chat/completions")
+	}))
+	return app, store
+}
+
+func chatBody(model, content string) string {
+	return fmt.Sprintf(`{"model":%q,"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":%q}]}`, model, content)
+}
+
+// Test that a similar prompt is served from the cache
+func TestSemanticCacheHit(t *testing.T) {
+	app := setupSemanticCachedApp(SemanticCacheConfig{Threshold: 0.5})
+	transport := mockClient(http.StatusOK, `{"id":"chatcmpl-1"}`, nil)
+
+	resp, _ := sendRequest(t, app, newCompletionRequest(chatBody("gpt-4o", "What is the weather in Paris today?")))
+	assert.Equal(t, "miss", resp.Header.Get(SemanticCacheHeader))
+
+	transport.LastRequest = nil
+	resp, body := sendRequest(t, app, newCompletionRequest(chatBody("gpt-4o", "Paris weather today")))
+	assert.Equal(t, "hit", resp.Header.Get(SemanticCacheHeader))
+	assert.Equal(t, "0", resp.Header.Get(SemanticCacheScoreHeader))
+	assert.Equal(t, "entry-0", resp.Header.Get(SemanticCacheEntryHeader))
+	assert.Equal(t, `{"id":"chatcmpl-1"}`, body)
+	assert.Nil(t, transport.LastRequest)
+}
+
+// Test that prompts too far away, or of another model or tenant, are not served
+func TestSemanticCacheMiss(t *testing.T) {
+	app := setupSemanticCachedApp(SemanticCacheConfig{Threshold: 0.5})
+	mockClient(http.StatusOK, `{"id":"chatcmpl-1"}`, nil)
+
+	sendRequest(t, app, newCompletionRequest(chatBody("gpt-4o", "What is the weather in Paris today?")))
+
+	resp, _ := sendRequest(t, app, newCompletionRequest(chatBody("gpt-4o", "What is the weather in London today?")))
+	assert.Equal(t, "miss", resp.Header.Get(SemanticCacheHeader))
+
+	resp, _ = sendRequest(t, app, newCompletionRequest(chatBody("gpt-4o-mini", "What is the weather in Paris today?")))
+	assert.Equal(t, "miss", resp.Header.Get(SemanticCacheHeader))
+
+	req := newCompletionRequest(chatBody("gpt-4o", "What is the weather in Paris today?"))
+	req.Header.Set("x-maxim-api-key", "another-maxim-api-key")
+	resp, _ = sendRequest(t, app, req)
+	assert.Equal(t, "miss", resp.Header.Get(SemanticCacheHeader))
+
+	// Another system prompt or other sampling parameters are another context
+	resp, _ = sendRequest(t, app, newCompletionRequest(strings.Replace(chatBody("gpt-4o", "What is the weather in Paris today?"), "Be brief.", "Be verbose.", 1)))
+	assert.Equal(t, "miss", resp.Header.Get(SemanticCacheHeader))
+	resp, _ = sendRequest(t, app, newCompletionRequest(strings.Replace(chatBody("gpt-4o", "What is the weather in Paris today?"), `{`, `{"temperature":1.5,`, 1)))
+	assert.Equal(t, "miss", resp.Header.Get(SemanticCacheHeader))
+}
+
+func TestPromptContext(t *testing.T) {
+	contextHash := func(body string) string {
+		var request promptRequest
+		assert.NoError(t, json.Unmarshal([]byte(body), &request))
+		return promptContext([]byte(body), request)
+	}
+	base := contextHash(`{"model":"gpt-4o","temperature":0,"tools":[{"type":"function"}],"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hi"}]}`)
+	assert.NotEmpty(t, base)
+	// The prompt, the streaming, the user and the formatting are not part of the context
+	assert.Equal(t, base, contextHash(`{"user":"user-1", "stream":false, "tools": [ {"type": "function"} ], "temperature": 0,
+		"model":"gpt-4o-mini","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hello"}]}`))
+	assert.NotEqual(t, base, contextHash(`{"model":"gpt-4o","temperature":0,"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hi"}]}`))
+	assert.NotEqual(t, base, contextHash(`{"model":"gpt-4o","temperature":0,"tools":[{"type":"function"}],"messages":[{"role":"user","content":"Hi"}]}`))
+
+	// The earlier turns of the conversation are part of the context of a follow-up
+	followUp := func(question, answer string) string {
+		return contextHash(`{"model":"gpt-4o","messages":[{"role":"user","content":"` + question + `"},` +
+			`{"role":"assistant","content":"` + answer + `"},{"role":"user","content":"yes"}]}`)
+	}
+	assert.Equal(t, followUp("Delete my account?", "Are you sure?"), followUp("Delete my account?", "Are you sure?"))
+	assert.NotEqual(t, followUp("Delete my account?", "Are you sure?"), followUp("Book a flight?", "To Paris?"))
+}
+
+// Test that the completions live in the vector store, another replica sharing it is served
+// from it and entries without a completion are skipped
+func TestSemanticCacheSharedStore(t *testing.T) {
+	app, store := setupSemanticCachedAppWithStore(SemanticCacheConfig{Threshold: 0.5}, &fakeVectorStore{})
+	mockClient(http.StatusOK, `{"id":"chatcmpl-1"}`, nil)
+	sendRequest(t, app, newCompletionRequest(chatBody("gpt-4o", "What is the weather in Paris today?")))
+	shared := &fakeVectorStore{}
+	shared.Add(store.vectors[0], store.metadata[0])
+	shared.AddDocument(store.vectors[0], store.documents[0], store.metadata[0])
+
+	replica, _ := setupSemanticCachedAppWithStore(SemanticCacheConfig{Threshold: 0.5}, shared)
+	transport := mockClient(http.StatusOK, `{"id":"chatcmpl-2"}`, nil)
+	resp, body := sendRequest(t, replica, newCompletionRequest(chatBody("gpt-4o", "Paris weather today")))
+	assert.Equal(t, "hit", resp.Header.Get(SemanticCacheHeader))
+	assert.Equal(t, "entry-1", resp.Header.Get(SemanticCacheEntryHeader))
+	assert.Equal(t, `{"id":"chatcmpl-1"}`, body)
+	assert.Nil(t, transport.LastRequest)
+}
+
+// Test that the entries used least recently are deleted from the vector store beyond the size
+func TestSemanticCacheEviction(t *testing.T) {
+	app, store := setupSemanticCachedAppWithStore(SemanticCacheConfig{Threshold: 0.5, Size: 1}, &fakeVectorStore{})
+	mockClient(http.StatusOK, `{"id":"chatcmpl-1"}`, nil)
+
+	sendRequest(t, app, newCompletionRequest(chatBody("gpt-4o", "What is the weather in Paris today?")))
+	sendRequest(t, app, newCompletionRequest(chatBody("gpt-4o", "What is the weather in London today?")))
+	assert.Equal(t, []bool{true, false}, store.deleted)
+
+	resp, _ := sendRequest(t, app, newCompletionRequest(chatBody("gpt-4o", "What is the weather in Paris today?")))
+	assert.Equal(t, "miss", resp.Header.Get(SemanticCacheHeader))
+	resp, _ = sendRequest(t, app, newCompletionRequest(chatBody("gpt-4o", "What is the weather in Paris today?")))
+	assert.Equal(t, "hit", resp.Header.Get(SemanticCacheHeader))
+	assert.Equal(t, []bool{true, true, false}, store.deleted)
+}
+
+func TestPromptText(t *testing.T) {
+	var request promptRequest
+	err := json.Unmarshal([]byte(`{
+		"model": "claude-3-5-sonnet-20240620",
+		"system": "Be brief.",
+		"messages": [
+			{"role": "user", "content": "Hello"},
+			{"role": "assistant", "content": "Hi!"},
+			{"role": "user", "content": [{"type": "text", "text": "Weather in"}, {"type": "image"}, {"type": "text", "text": "Paris?"}]}
+		]
+	}`), &request)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Weather in\nParis?", promptText(request, false))
+	assert.Equal(t, "system: Be brief.\nuser: Hello\nassistant: Hi!\nuser: Weather in\nParis?", promptText(request, true))
+
+	err = json.Unmarshal([]byte(`{"model": "gpt-3.5-turbo-instruct", "prompt": ["Say", "hi"]}`), &request)
+	assert.NoError(t, err)
+	assert.Equal(t, "Say\nhi", promptText(request, false))
+}
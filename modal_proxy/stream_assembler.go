@@ -0,0 +1,235 @@
+package modal_proxy
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// streamAssembler reassembles the frames of an OpenAI or Anthropic stream into the response the
+// request would have got without streaming.
+type streamAssembler struct {
+	anthropic bool
+	// chunk is the first OpenAI chunk, message the message of the Anthropic message_start event
+	chunk   map[string]json.RawMessage
+	message map[string]json.RawMessage
+	choices map[int]*assembledChoice
+	blocks  map[int]*assembledBlock
+	delta   map[string]json.RawMessage
+	usage   json.RawMessage
+}
+
+type assembledChoice struct {
+	role         string
+	content      strings.Builder
+	text         strings.Builder
+	toolCalls    map[int]*openAIToolCall
+	finishReason json.RawMessage
+}
+
+type assembledBlock struct {
+	block map[string]json.RawMessage
+	text  strings.Builder
+	input strings.Builder
+	// field is where the deltas of the block go, text or thinking
+	field string
+}
+
+func newStreamAssembler() *streamAssembler {
+	return &streamAssembler{choices: make(map[int]*assembledChoice), blocks: make(map[int]*assembledBlock)}
+}
+
+// add adds the data of a stream frame to the response.
+func (sa *streamAssembler) add(data string) {
+	var frame struct {
+		Type    string          `json:"type"`
+		Index   int             `json:"index"`
+		Message json.RawMessage `json:"message"`
+		Block   json.RawMessage `json:"content_block"`
+		Delta   json.RawMessage `json:"delta"`
+		Usage   json.RawMessage `json:"usage"`
+		Choices []struct {
+			Index int    `json:"index"`
+			Text  string `json:"text"`
+			Delta struct {
+				Role      string           `json:"role"`
+				Content   string           `json:"content"`
+				ToolCalls []openAIToolCall `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason json.RawMessage `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(data), &frame); err != nil {
+		return
+	}
+	switch frame.Type {
+	case "message_start":
+		sa.anthropic = true
+		json.Unmarshal(frame.Message, &sa.message)
+	case "content_block_start":
+		block := &assembledBlock{}
+		json.Unmarshal(frame.Block, &block.block)
+		sa.blocks[frame.Index] = block
+	case "content_block_delta":
+		var delta struct {
+			Type        string `json:"type"`
+			Text        string `json:"text"`
+			Thinking    string `json:"thinking"`
+			PartialJSON string `json:"partial_json"`
+		}
+		json.Unmarshal(frame.Delta, &delta)
+		if block, ok := sa.blocks[frame.Index]; ok {
+			switch delta.Type {
+			case "text_delta":
+				block.field = "text"
+				block.text.WriteString(delta.Text)
+			case "thinking_delta":
+				block.field = "thinking"
+				block.text.WriteString(delta.Thinking)
+			case "input_json_delta":
+				block.input.WriteString(delta.PartialJSON)
+			}
+		}
+	case "message_delta":
+		json.Unmarshal(frame.Delta, &sa.delta)
+		sa.usage = frame.Usage
+	case "":
+		if sa.chunk == nil {
+			json.Unmarshal([]byte(data), &sa.chunk)
+		}
+		if len(frame.Usage) > 0 && string(frame.Usage) != "null" {
+			sa.usage = frame.Usage
+		}
+		for _, chunkChoice := range frame.Choices {
+			choice, ok := sa.choices[chunkChoice.Index]
+			if !ok {
+				choice = &assembledChoice{toolCalls: make(map[int]*openAIToolCall)}
+				sa.choices[chunkChoice.Index] = choice
+			}
+			if chunkChoice.Delta.Role != "" {
+				choice.role = chunkChoice.Delta.Role
+			}
+			choice.content.WriteString(chunkChoice.Delta.Content)
+			choice.text.WriteString(chunkChoice.Text)
+			for _, toolCallDelta := range chunkChoice.Delta.ToolCalls {
+				index := 0
+				if toolCallDelta.Index != nil {
+					index = *toolCallDelta.Index
+				}
+				toolCall, ok := choice.toolCalls[index]
+				if !ok {
+					toolCall = &openAIToolCall{ID: toolCallDelta.ID, Type: toolCallDelta.Type}
+					toolCall.Function.Name = toolCallDelta.Function.Name
+					choice.toolCalls[index] = toolCall
+				}
+				toolCall.Function.Arguments += toolCallDelta.Function.Arguments
+			}
+			if len(chunkChoice.FinishReason) > 0 && string(chunkChoice.FinishReason) != "null" {
+				choice.finishReason = chunkChoice.FinishReason
+			}
+		}
+	}
+}
+
+// response returns the reassembled response, nil when no frame was understood.
+func (sa *streamAssembler) response() []byte {
+	var response interface{}
+	switch {
+	case sa.anthropic:
+		response = sa.anthropicResponse()
+	case sa.chunk != nil:
+		response = sa.openAIResponse()
+	default:
+		return nil
+	}
+	body, _ := json.Marshal(response)
+	return body
+}
+
+func (sa *streamAssembler) anthropicResponse() map[string]interface{} {
+	response := make(map[string]interface{}, len(sa.message))
+	for key, value := range sa.message {
+		response[key] = value
+	}
+	content := make([]interface{}, 0, len(sa.blocks))
+	for _, index := range sortedKeys(sa.blocks) {
+		block := sa.blocks[index]
+		assembled := make(map[string]interface{}, len(block.block))
+		for key, value := range block.block {
+			assembled[key] = value
+		}
+		if block.field != "" {
+			assembled[block.field] = block.text.String()
+		}
+		if input := block.input.String(); input != "" && json.Valid([]byte(input)) {
+			assembled["input"] = json.RawMessage(input)
+		}
+		content = append(content, assembled)
+	}
+	response["content"] = content
+	for key, value := range sa.delta {
+		response[key] = value
+	}
+	if sa.usage != nil {
+		// The usage of message_delta has the output tokens, the one of message_start the input tokens
+		var usage map[string]json.RawMessage
+		if startUsage, ok := sa.message["usage"]; ok {
+			json.Unmarshal(startUsage, &usage)
+		}
+		if usage == nil {
+			usage = make(map[string]json.RawMessage)
+		}
+		var deltaUsage map[string]json.RawMessage
+		json.Unmarshal(sa.usage, &deltaUsage)
+		for key, value := range deltaUsage {
+			usage[key] = value
+		}
+		response["usage"] = usage
+	}
+	return response
+}
+
+func (sa *streamAssembler) openAIResponse() map[string]interface{} {
+	response := map[string]interface{}{"object": "chat.completion"}
+	for _, key := range []string{"id", "created", "model", "system_fingerprint"} {
+		if value, ok := sa.chunk[key]; ok {
+			response[key] = value
+		}
+	}
+	choices := make([]interface{}, 0, len(sa.choices))
+	for _, index := range sortedKeys(sa.choices) {
+		choice := sa.choices[index]
+		assembled := map[string]interface{}{"index": index, "finish_reason": choice.finishReason}
+		if text := choice.text.String(); text != "" {
+			// Streams of the completions API carry text instead of messages
+			response["object"] = "text_completion"
+			assembled["text"] = text
+		} else {
+			message := map[string]interface{}{"role": choice.role, "content": choice.content.String()}
+			if len(choice.toolCalls) > 0 {
+				toolCalls := make([]*openAIToolCall, 0, len(choice.toolCalls))
+				for _, toolCallIndex := range sortedKeys(choice.toolCalls) {
+					toolCall := choice.toolCalls[toolCallIndex]
+					toolCalls = append(toolCalls, toolCall)
+				}
+				message["tool_calls"] = toolCalls
+			}
+			assembled["message"] = message
+		}
+		choices = append(choices, assembled)
+	}
+	response["choices"] = choices
+	if sa.usage != nil {
+		response["usage"] = sa.usage
+	}
+	return response
+}
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,40 @@
+package modal_proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assembleStream runs the data lines of stream through a streamAssembler.
+func assembleStream(stream string) string {
+	assembler := newStreamAssembler()
+	for _, line := range strings.Split(stream, "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			assembler.add(data)
+		}
+	}
+	return string(assembler.response())
+}
+
+func TestAssembleOpenAIStream(t *testing.T) {
+	assert.JSONEq(t, `{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o",
+		"choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","content":"Hello",
+			"tool_calls":[{"id":"call_1","type":"function","function":{"name":"weather","arguments":"{\"city\":\"Paris\"}"}}]}}],
+		"usage":{"prompt_tokens":10,"completion_tokens":15,"total_tokens":25}}`, assembleStream(openAIStream))
+
+	completions := `data: {"id":"cmpl-1","object":"text_completion","created":1,"model":"gpt-3.5-turbo-instruct","choices":[{"index":0,"text":"Hel","finish_reason":null}]}` + "\n\n" +
+		`data: {"id":"cmpl-1","object":"text_completion","created":1,"model":"gpt-3.5-turbo-instruct","choices":[{"index":0,"text":"lo","finish_reason":"stop"}]}` + "\n\n" +
+		"data: [DONE]\n\n"
+	assert.JSONEq(t, `{"id":"cmpl-1","object":"text_completion","created":1,"model":"gpt-3.5-turbo-instruct",
+		"choices":[{"index":0,"text":"Hello","finish_reason":"stop"}]}`, assembleStream(completions))
+}
+
+func TestAssembleAnthropicStream(t *testing.T) {
+	assert.JSONEq(t, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-sonnet",
+		"content":[{"type":"text","text":"Hello"},{"type":"tool_use","id":"toolu_1","name":"weather","input":{"city":"Paris"}}],
+		"stop_reason":"tool_use","stop_sequence":null,"usage":{"input_tokens":10,"output_tokens":15}}`, assembleStream(anthropicStream))
+
+	assert.Empty(t, assembleStream("data: [DONE]\n\n"))
+}
@@ -0,0 +1,406 @@
+package modal_proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sseEvent is an event of a server-sent events stream.
+type sseEvent struct {
+	Event string
+	Data  string
+}
+
+// readSSEEvent reads the next event of a server-sent events stream, comments are skipped.
+func readSSEEvent(reader *bufio.Reader) (sseEvent, error) {
+	var event sseEvent
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event.Event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// An empty line, or the end of the stream, dispatches the event
+		if (line == "" || err != nil) && (len(data) > 0 || event.Event != "") {
+			event.Data = strings.Join(data, "\n")
+			return event, nil
+		}
+		if err != nil {
+			return event, err
+		}
+	}
+}
+
+// streamTranslator turns the events of an upstream stream into the frames sent to the caller.
+type streamTranslator interface {
+	// translate returns the frames to send for an upstream event, done reports the end of the stream
+	translate(event sseEvent) (frames []byte, done bool)
+	// finish returns the frames closing a stream which ended without its final event
+	finish() []byte
+}
+
+// newStreamTranslator creates the translator of a stream, request is the body sent by the caller.
+func newStreamTranslator(from, to ApiFormat, request []byte) (streamTranslator, error) {
+	if from == AnthropicFormat && to == OpenAIFormat {
+		var openAiRequest openAIChatRequest
+		_ = json.Unmarshal(request, &openAiRequest)
+		includeUsage := openAiRequest.StreamOptions != nil && openAiRequest.StreamOptions.IncludeUsage
+		return &anthropicToOpenAIStream{includeUsage: includeUsage, toolCalls: make(map[int]int)}, nil
+	}
+	if from == OpenAIFormat && to == AnthropicFormat {
+		return &openAIToAnthropicStream{toolBlocks: make(map[int]int)}, nil
+	}
+	return nil, fmt.Errorf("can not translate streams from %s to %s", from, to)
+}
+
+// relayTranslatedStream streams the events of resp to the caller, translated by translator.
+func relayTranslatedStream(c *fiber.Ctx, resp *http.Response, reader io.Reader, translator streamTranslator) {
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	observers := usageObservers(c)
+	usage := newStreamUsage(c)
+	span := startStreamSpan(c)
+	c.Status(fiber.StatusOK).Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer usage.notify(observers)
+		defer endStreamSpan(span, usage)
+		defer closeResponse(resp)
+		bufReader := bufio.NewReader(reader)
+		for {
+			event, err := readSSEEvent(bufReader)
+			if err != nil {
+				if err != io.EOF {
+					fmt.Printf("Error reading response stream: %v\n", err)
+				}
+				w.Write(translator.finish())
+				w.Flush()
+				return
+			}
+			usage.add(event.Data)
+			frames, done := translator.translate(event)
+			if len(frames) > 0 {
+				if _, err := w.Write(frames); err != nil {
+					fmt.Printf("Error writing response: %v\n", err)
+					return
+				}
+				if err := w.Flush(); err != nil {
+					fmt.Printf("Error flushing buffer: %v\n", err)
+					return
+				}
+			}
+			if done {
+				return
+			}
+		}
+	})
+}
+
+// openAIChunk is a chat.completion.chunk frame of an OpenAI stream.
+type openAIChunk struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []openAIChunkChoice `json:"choices"`
+	Usage   *openAIUsage        `json:"usage,omitempty"`
+}
+
+type openAIChunkChoice struct {
+	Index        int         `json:"index"`
+	Delta        openAIDelta `json:"delta"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type openAIDelta struct {
+	Role      string           `json:"role,omitempty"`
+	Content   *string          `json:"content,omitempty"`
+	ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+// anthropicStreamEvent is the union of the events of an Anthropic stream.
+type anthropicStreamEvent struct {
+	Type         string            `json:"type"`
+	Index        int               `json:"index"`
+	Message      anthropicResponse `json:"message"`
+	ContentBlock anthropicBlock    `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage  `json:"usage"`
+	Error json.RawMessage `json:"error"`
+}
+
+// anthropicToOpenAIStream translates an Anthropic messages stream to chat.completion.chunk frames.
+type anthropicToOpenAIStream struct {
+	includeUsage bool
+	id           string
+	model        string
+	created      int64
+	usage        anthropicUsage
+	// toolCalls maps the index of a tool_use block to the index of its OpenAI tool call
+	toolCalls map[int]int
+	done      bool
+}
+
+func (as *anthropicToOpenAIStream) translate(event sseEvent) ([]byte, bool) {
+	var streamEvent anthropicStreamEvent
+	if err := json.Unmarshal([]byte(event.Data), &streamEvent); err != nil {
+		return nil, false
+	}
+	switch streamEvent.Type {
+	case "message_start":
+		as.id = streamEvent.Message.ID
+		as.model = streamEvent.Message.Model
+		as.created = time.Now().Unix()
+		as.usage = streamEvent.Message.Usage
+		empty := ""
+		return as.chunk(openAIDelta{Role: "assistant", Content: &empty}, nil), false
+	case "content_block_start":
+		if streamEvent.ContentBlock.Type != "tool_use" {
+			return nil, false
+		}
+		index := len(as.toolCalls)
+		as.toolCalls[streamEvent.Index] = index
+		toolCall := openAIToolCall{Index: &index, ID: streamEvent.ContentBlock.ID, Type: "function"}
+		toolCall.Function.Name = streamEvent.ContentBlock.Name
+		return as.chunk(openAIDelta{ToolCalls: []openAIToolCall{toolCall}}, nil), false
+	case "content_block_delta":
+		switch streamEvent.Delta.Type {
+		case "text_delta":
+			return as.chunk(openAIDelta{Content: &streamEvent.Delta.Text}, nil), false
+		case "input_json_delta":
+			index, ok := as.toolCalls[streamEvent.Index]
+			if !ok {
+				return nil, false
+			}
+			toolCall := openAIToolCall{Index: &index}
+			toolCall.Function.Arguments = streamEvent.Delta.PartialJSON
+			return as.chunk(openAIDelta{ToolCalls: []openAIToolCall{toolCall}}, nil), false
+		}
+	case "message_delta":
+		as.usage.OutputTokens = streamEvent.Usage.OutputTokens
+		finishReason := openAIFinishReason(streamEvent.Delta.StopReason)
+		return as.chunk(openAIDelta{}, &finishReason), false
+	case "message_stop":
+		return as.finish(), true
+	case "error":
+		as.done = true
+		return sseData(map[string]json.RawMessage{"error": streamEvent.Error}), true
+	}
+	return nil, false
+}
+
+func (as *anthropicToOpenAIStream) finish() []byte {
+	if as.done {
+		return nil
+	}
+	as.done = true
+	var frames []byte
+	if as.includeUsage {
+		// The usage comes in a last chunk without choices, as OpenAI sends it
+		frames = sseData(openAIChunk{
+			ID:      as.id,
+			Object:  "chat.completion.chunk",
+			Created: as.created,
+			Model:   as.model,
+			Choices: []openAIChunkChoice{},
+			Usage: &openAIUsage{
+				PromptTokens:     as.usage.InputTokens,
+				CompletionTokens: as.usage.OutputTokens,
+				TotalTokens:      as.usage.InputTokens + as.usage.OutputTokens,
+			},
+		})
+	}
+	return append(frames, "data: [DONE]\n\n"...)
+}
+
+func (as *anthropicToOpenAIStream) chunk(delta openAIDelta, finishReason *string) []byte {
+	return sseData(openAIChunk{
+		ID:      as.id,
+		Object:  "chat.completion.chunk",
+		Created: as.created,
+		Model:   as.model,
+		Choices: []openAIChunkChoice{{Delta: delta, FinishReason: finishReason}},
+	})
+}
+
+// openAIToAnthropicStream translates chat.completion.chunk frames to the events of an Anthropic
+// messages stream. Text and tool calls each get a content block of their own.
+type openAIToAnthropicStream struct {
+	started bool
+	// block is the index of the open content block, -1 when none is open
+	block      int
+	blockType  string
+	nextBlock  int
+	stopReason string
+	usage      anthropicUsage
+	// toolBlocks maps the index of an OpenAI tool call to the index of its tool_use block
+	toolBlocks map[int]int
+	done       bool
+}
+
+func (oas *openAIToAnthropicStream) translate(event sseEvent) ([]byte, bool) {
+	if strings.TrimSpace(event.Data) == "[DONE]" {
+		return oas.finish(), true
+	}
+	var chunk struct {
+		openAIChunk
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(event.Data), &chunk); err != nil {
+		return nil, false
+	}
+	if chunk.Error != nil {
+		oas.done = true
+		var openAiError struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(chunk.Error, &openAiError)
+		return sseEventFrame("error", map[string]interface{}{
+			"type":  "error",
+			"error": map[string]string{"type": "api_error", "message": openAiError.Message},
+		}), true
+	}
+	var frames []byte
+	if !oas.started {
+		frames = append(frames, oas.start(chunk.ID, chunk.Model)...)
+	}
+	if chunk.Usage != nil {
+		oas.usage = anthropicUsage{InputTokens: chunk.Usage.PromptTokens, OutputTokens: chunk.Usage.CompletionTokens}
+	}
+	if len(chunk.Choices) == 0 {
+		return frames, false
+	}
+	choice := chunk.Choices[0]
+	if choice.Delta.Content != nil && *choice.Delta.Content != "" {
+		if oas.blockType != "text" {
+			// The text of anthropicBlock is omitted when empty, Anthropic clients expect it
+			frames = append(frames, oas.startBlock(map[string]string{"type": "text", "text": ""}, "text")...)
+		}
+		frames = append(frames, sseEventFrame("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": oas.block,
+			"delta": map[string]string{"type": "text_delta", "text": *choice.Delta.Content},
+		})...)
+	}
+	for _, toolCall := range choice.Delta.ToolCalls {
+		index := 0
+		if toolCall.Index != nil {
+			index = *toolCall.Index
+		}
+		if toolCall.ID != "" {
+			frames = append(frames, oas.startBlock(anthropicBlock{
+				Type:  "tool_use",
+				ID:    toolCall.ID,
+				Name:  toolCall.Function.Name,
+				Input: json.RawMessage("{}"),
+			}, "tool_use")...)
+			oas.toolBlocks[index] = oas.block
+		}
+		block, ok := oas.toolBlocks[index]
+		if !ok || toolCall.Function.Arguments == "" {
+			continue
+		}
+		frames = append(frames, sseEventFrame("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": block,
+			"delta": map[string]string{"type": "input_json_delta", "partial_json": toolCall.Function.Arguments},
+		})...)
+	}
+	if choice.FinishReason != nil {
+		oas.stopReason = anthropicStopReason(*choice.FinishReason)
+	}
+	return frames, false
+}
+
+func (oas *openAIToAnthropicStream) finish() []byte {
+	if oas.done {
+		return nil
+	}
+	oas.done = true
+	var frames []byte
+	if !oas.started {
+		frames = append(frames, oas.start("", "")...)
+	}
+	frames = append(frames, oas.stopBlock()...)
+	stopReason := oas.stopReason
+	if stopReason == "" {
+		stopReason = "end_turn"
+	}
+	frames = append(frames, sseEventFrame("message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": stopReason, "stop_sequence": nil},
+		// OpenAI only reports the usage at the end of the stream, so the input tokens come here as well
+		"usage": map[string]int{"input_tokens": oas.usage.InputTokens, "output_tokens": oas.usage.OutputTokens},
+	})...)
+	return append(frames, sseEventFrame("message_stop", map[string]string{"type": "message_stop"})...)
+}
+
+func (oas *openAIToAnthropicStream) start(id string, model string) []byte {
+	oas.started = true
+	oas.block = -1
+	return sseEventFrame("message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":            id,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         model,
+			"content":       []anthropicBlock{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         anthropicUsage{},
+		},
+	})
+}
+
+// startBlock closes the open content block and starts block.
+func (oas *openAIToAnthropicStream) startBlock(block interface{}, blockType string) []byte {
+	frames := oas.stopBlock()
+	oas.block, oas.blockType = oas.nextBlock, blockType
+	oas.nextBlock++
+	return append(frames, sseEventFrame("content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         oas.block,
+		"content_block": block,
+	})...)
+}
+
+func (oas *openAIToAnthropicStream) stopBlock() []byte {
+	if oas.block < 0 {
+		return nil
+	}
+	frame := sseEventFrame("content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": oas.block})
+	oas.block, oas.blockType = -1, ""
+	return frame
+}
+
+// sseEventFrame encodes v as the data of a server-sent event named event.
+func sseEventFrame(event string, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return []byte("event: " + event + "\ndata: " + string(data) + "\n\n")
+}
+
+// sseData encodes v as the data of an unnamed server-sent event.
+func sseData(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return []byte("data: " + string(data) + "\n\n")
+}
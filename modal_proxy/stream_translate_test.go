@@ -0,0 +1,186 @@
+package modal_proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const anthropicStream = "event: message_start\n" +
+	`data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-sonnet","content":[],"usage":{"input_tokens":10,"output_tokens":1}}}` + "\n\n" +
+	"event: ping\ndata: {\"type\":\"ping\"}\n\n" +
+	"event: content_block_start\n" +
+	`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}` + "\n\n" +
+	"event: content_block_stop\n" +
+	`data: {"type":"content_block_stop","index":0}` + "\n\n" +
+	"event: content_block_start\n" +
+	`data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"weather","input":{}}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}` + "\n\n" +
+	"event: content_block_delta\n" +
+	`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}` + "\n\n" +
+	"event: content_block_stop\n" +
+	`data: {"type":"content_block_stop","index":1}` + "\n\n" +
+	"event: message_delta\n" +
+	`data: {"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":15}}` + "\n\n" +
+	"event: message_stop\n" +
+	`data: {"type":"message_stop"}` + "\n\n"
+
+// translateStream runs all the events of stream through translator.
+func translateStream(t *testing.T, translator streamTranslator, stream string) string {
+	reader := bufio.NewReader(strings.NewReader(stream))
+	var output strings.Builder
+	for {
+		event, err := readSSEEvent(reader)
+		if err != nil {
+			output.Write(translator.finish())
+			return output.String()
+		}
+		frames, done := translator.translate(event)
+		output.Write(frames)
+		if done {
+			return output.String()
+		}
+	}
+}
+
+// openAIChunks decodes the data frames of an OpenAI stream, up to [DONE].
+func openAIChunks(t *testing.T, stream string) []openAIChunk {
+	var chunks []openAIChunk
+	reader := bufio.NewReader(strings.NewReader(stream))
+	for {
+		event, err := readSSEEvent(reader)
+		if err != nil || event.Data == "[DONE]" {
+			return chunks
+		}
+		var chunk openAIChunk
+		assert.NoError(t, json.Unmarshal([]byte(event.Data), &chunk))
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestReadSSEEvent(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader(": comment\nevent: a\ndata: 1\ndata: 2\n\n\ndata: last"))
+
+	event, err := readSSEEvent(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, sseEvent{Event: "a", Data: "1\n2"}, event)
+	event, err = readSSEEvent(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, sseEvent{Data: "last"}, event)
+	_, err = readSSEEvent(reader)
+	assert.Error(t, err)
+}
+
+func TestAnthropicToOpenAIStream(t *testing.T) {
+	translator, err := newStreamTranslator(AnthropicFormat, OpenAIFormat,
+		[]byte(`{"model":"claude-3-5-sonnet","stream":true,"stream_options":{"include_usage":true}}`))
+	assert.NoError(t, err)
+
+	output := translateStream(t, translator, anthropicStream)
+	assert.True(t, strings.HasSuffix(output, "data: [DONE]\n\n"))
+	chunks := openAIChunks(t, output)
+	assert.Len(t, chunks, 7)
+	for _, chunk := range chunks {
+		assert.Equal(t, "msg_1", chunk.ID)
+		assert.Equal(t, "chat.completion.chunk", chunk.Object)
+		assert.Equal(t, "claude-3-5-sonnet", chunk.Model)
+	}
+
+	assert.Equal(t, "assistant", chunks[0].Choices[0].Delta.Role)
+	assert.Equal(t, "Hello", *chunks[1].Choices[0].Delta.Content)
+	toolCall := chunks[2].Choices[0].Delta.ToolCalls[0]
+	assert.Equal(t, 0, *toolCall.Index)
+	assert.Equal(t, "toolu_1", toolCall.ID)
+	assert.Equal(t, "weather", toolCall.Function.Name)
+	assert.Equal(t, `{"city":`, chunks[3].Choices[0].Delta.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, `"Paris"}`, chunks[4].Choices[0].Delta.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, "tool_calls", *chunks[5].Choices[0].FinishReason)
+	assert.Empty(t, chunks[6].Choices)
+	assert.Equal(t, &openAIUsage{PromptTokens: 10, CompletionTokens: 15, TotalTokens: 25}, chunks[6].Usage)
+}
+
+func TestAnthropicToOpenAIStreamWithoutUsage(t *testing.T) {
+	translator, err := newStreamTranslator(AnthropicFormat, OpenAIFormat, []byte(`{"stream":true}`))
+	assert.NoError(t, err)
+
+	// A stream cut before message_stop is still terminated
+	cut := anthropicStream[:strings.Index(anthropicStream, "event: message_stop")]
+	output := translateStream(t, translator, cut)
+	assert.True(t, strings.HasSuffix(output, "data: [DONE]\n\n"))
+	chunks := openAIChunks(t, output)
+	assert.Len(t, chunks, 6)
+	assert.Nil(t, chunks[5].Usage)
+}
+
+func TestAnthropicToOpenAIStreamError(t *testing.T) {
+	translator, _ := newStreamTranslator(AnthropicFormat, OpenAIFormat, nil)
+
+	output := translateStream(t, translator, "event: error\n"+
+		`data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`+"\n\n")
+
+	assert.Equal(t, `data: {"error":{"type":"overloaded_error","message":"Overloaded"}}`+"\n\n", output)
+}
+
+const openAIStream = `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}` + "\n\n" +
+	`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hello"},"finish_reason":null}]}` + "\n\n" +
+	`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"weather","arguments":""}}]},"finish_reason":null}]}` + "\n\n" +
+	`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":\"Paris\"}"}}]},"finish_reason":null}]}` + "\n\n" +
+	`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}` + "\n\n" +
+	`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":15,"total_tokens":25}}` + "\n\n" +
+	"data: [DONE]\n\n"
+
+// anthropicEvents decodes the events of an Anthropic stream.
+func anthropicEvents(t *testing.T, stream string) ([]string, []map[string]interface{}) {
+	var names []string
+	var events []map[string]interface{}
+	reader := bufio.NewReader(strings.NewReader(stream))
+	for {
+		event, err := readSSEEvent(reader)
+		if err != nil {
+			return names, events
+		}
+		var data map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(event.Data), &data))
+		assert.Equal(t, event.Event, data["type"])
+		names = append(names, event.Event)
+		events = append(events, data)
+	}
+}
+
+func TestOpenAIToAnthropicStream(t *testing.T) {
+	translator, err := newStreamTranslator(OpenAIFormat, AnthropicFormat, nil)
+	assert.NoError(t, err)
+
+	stream := translateStream(t, translator, openAIStream)
+	names, events := anthropicEvents(t, stream)
+
+	assert.Equal(t, []string{"message_start", "content_block_start", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}, names)
+	message := events[0]["message"].(map[string]interface{})
+	assert.Equal(t, "chatcmpl-1", message["id"])
+	assert.Equal(t, "gpt-4o", message["model"])
+	assert.Contains(t, stream, "event: content_block_start\n"+
+		`data: {"content_block":{"text":"","type":"text"},"index":0,"type":"content_block_start"}`+"\n\n")
+	assert.Equal(t, map[string]interface{}{"type": "text_delta", "text": "Hello"}, events[2]["delta"])
+	assert.Equal(t, float64(1), events[4]["index"])
+	assert.Equal(t, map[string]interface{}{"type": "tool_use", "id": "call_1", "name": "weather", "input": map[string]interface{}{}},
+		events[4]["content_block"])
+	assert.Equal(t, map[string]interface{}{"type": "input_json_delta", "partial_json": `{"city":"Paris"}`}, events[5]["delta"])
+	assert.Equal(t, "tool_use", events[7]["delta"].(map[string]interface{})["stop_reason"])
+	assert.Equal(t, map[string]interface{}{"input_tokens": float64(10), "output_tokens": float64(15)}, events[7]["usage"])
+}
+
+func TestOpenAIToAnthropicStreamError(t *testing.T) {
+	translator, _ := newStreamTranslator(OpenAIFormat, AnthropicFormat, nil)
+
+	names, events := anthropicEvents(t, translateStream(t, translator, `data: {"error":{"message":"boom"}}`+"\n\n"))
+
+	assert.Equal(t, []string{"error"}, names)
+	assert.Equal(t, map[string]interface{}{"type": "api_error", "message": "boom"}, events[0]["error"])
+}
@@ -0,0 +1,323 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tenantLimitWindow is the window of the per minute limits, the buckets refill over it.
+const tenantLimitWindow = time.Minute
+
+// concurrencyRetryAfter is the wait suggested to callers over their concurrent requests limit,
+// there is no telling when a request in flight ends.
+const concurrencyRetryAfter = time.Second
+
+// TenantLimiter limits the requests, tokens and concurrent requests of each Maxim API key, and
+// optionally of each model of a key. Limits set on the account of a key override the configured ones.
+type TenantLimiter struct {
+	accounts maxim.AccountSource
+	mu       sync.Mutex
+	limits   maxim.Limits
+	scopes   map[string]*tenantScope
+	swept    time.Time
+	now      func() time.Time
+}
+
+// tenantScope is the usage of a Maxim API key, or of a model of a key.
+type tenantScope struct {
+	requests tokenBucket
+	tokens   tokenBucket
+	inFlight int
+}
+
+// tokenBucket holds level of capacity, refilled over tenantLimitWindow. The level goes below
+// zero when the tokens of a request turn out to be more than estimated.
+type tokenBucket struct {
+	level    float64
+	capacity float64
+	updated  time.Time
+}
+
+// tenantReservation is what a request took from the scopes it is limited by.
+type tenantReservation struct {
+	scopes []*tenantScope
+	tokens []float64
+}
+
+// scopeLimits are the limits of a scope.
+type scopeLimits struct {
+	key    string
+	limits maxim.Limits
+}
+
+// NewTenantLimiter creates a limiter of the requests of each Maxim API key to limits, or to the
+// limits of its account in accounts.
+func NewTenantLimiter(limits maxim.Limits, accounts maxim.AccountSource) *TenantLimiter {
+	return &TenantLimiter{
+		accounts: accounts,
+		limits:   limits,
+		scopes:   make(map[string]*tenantScope),
+		now:      time.Now,
+	}
+}
+
+// ParseTenantModelLimits parses the limits of models, as in
+// "gpt-4o=rpm:100,tpm:50000,concurrency:5;claude-3-5-sonnet-20240620=rpm:20".
+func ParseTenantModelLimits(spec string) (map[string]maxim.Limits, error) {
+	models := make(map[string]maxim.Limits)
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		model, settings, ok := strings.Cut(entry, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid model limits %q, expected model=limit:value,...", entry)
+		}
+		var limits maxim.Limits
+		for _, setting := range strings.Split(settings, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(setting), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid limit %q of %s, expected limit:value", setting, model)
+			}
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				return nil, fmt.Errorf("invalid %s of %s: %q", name, model, value)
+			}
+			switch name {
+			case "rpm":
+				limits.RequestsPerMinute = limit
+			case "tpm":
+				limits.TokensPerMinute = limit
+			case "concurrency":
+				limits.ConcurrentRequests = limit
+			default:
+				return nil, fmt.Errorf("unknown limit %q of %s", name, model)
+			}
+		}
+		models[model] = limits
+	}
+	return models, nil
+}
+
+// Handler limits the requests to next, a route of provider. Requests over a limit are answered
+// with a 429 in the format of the provider, the others are charged the tokens they are estimated
+// to use until their response reports the actual usage.
+func (tl *TenantLimiter) Handler(provider string, next fiber.Handler) fiber.Handler {
+	format := providerFormats[provider]
+	return func(c *fiber.Ctx) error {
+		maximApiKey, err := GetMaximApiKey(c.GetReqHeaders())
+		if err != nil {
+			return next(c)
+		}
+		// Requests of keys without an account are turned down by the providers
+		account, err := tl.accounts.GetAccount(maximApiKey)
+		if err != nil {
+			return next(c)
+		}
+		model, _ := getModalFromBody(c.Body())
+		scopes := tl.scopeLimits(maximApiKey, model, account.Data.Limits)
+		if len(scopes) == 0 {
+			return next(c)
+		}
+
+		reservation, limit, wait := tl.reserve(scopes, estimateTokens(c.Body()))
+		if reservation == nil {
+			return sendRateLimited(c, format, limit, wait)
+		}
+		var once sync.Once
+		release := func(report usageReport) {
+			once.Do(func() { tl.release(reservation, report.usage, report.ok) })
+		}
+		observeUsage(c, release)
+		err = next(c)
+		notifyUsage(c, release)
+		return err
+	}
+}
+
+// SetLimits changes the configured limits, the usage of the keys is kept.
+func (tl *TenantLimiter) SetLimits(limits maxim.Limits) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.limits = limits
+}
+
+// scopeLimits returns the limits of the requests of maximApiKey for model, the limits of
+// account override the configured ones.
+func (tl *TenantLimiter) scopeLimits(maximApiKey string, model string, account *maxim.Limits) []scopeLimits {
+	tl.mu.Lock()
+	limits := tl.limits
+	tl.mu.Unlock()
+	modelLimits := limits.Models[model]
+	if account != nil {
+		limits = mergeLimits(limits, *account)
+		modelLimits = mergeLimits(modelLimits, account.Models[model])
+	}
+
+	var scopes []scopeLimits
+	if limited(limits) {
+		scopes = append(scopes, scopeLimits{key: maximApiKey, limits: limits})
+	}
+	if model != "" && limited(modelLimits) {
+		scopes = append(scopes, scopeLimits{key: maximApiKey + "\x00" + model, limits: modelLimits})
+	}
+	return scopes
+}
+
+// mergeLimits returns limits with the limits set in override.
+func mergeLimits(limits maxim.Limits, override maxim.Limits) maxim.Limits {
+	if override.RequestsPerMinute > 0 {
+		limits.RequestsPerMinute = override.RequestsPerMinute
+	}
+	if override.TokensPerMinute > 0 {
+		limits.TokensPerMinute = override.TokensPerMinute
+	}
+	if override.ConcurrentRequests > 0 {
+		limits.ConcurrentRequests = override.ConcurrentRequests
+	}
+	return limits
+}
+
+func limited(limits maxim.Limits) bool {
+	return limits.RequestsPerMinute > 0 || limits.TokensPerMinute > 0 || limits.ConcurrentRequests > 0
+}
+
+// reserve takes a request estimated to use tokens from the scopes. When a limit is reached
+// nothing is taken, the name of the limit and how long to wait for it are returned instead.
+func (tl *TenantLimiter) reserve(scopes []scopeLimits, tokens int) (*tenantReservation, string, time.Duration) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	now := tl.now()
+	tl.sweep(now)
+
+	reservation := &tenantReservation{}
+	var limit string
+	var wait time.Duration
+	for _, scope := range scopes {
+		state, ok := tl.scopes[scope.key]
+		if !ok {
+			state = &tenantScope{}
+			tl.scopes[scope.key] = state
+		}
+		state.requests.refill(now, scope.limits.RequestsPerMinute)
+		state.tokens.refill(now, scope.limits.TokensPerMinute)
+		// A request larger than the limit is let through once the bucket is full
+		charge := min(float64(tokens), state.tokens.capacity)
+		switch {
+		case scope.limits.ConcurrentRequests > 0 && state.inFlight >= scope.limits.ConcurrentRequests:
+			limit, wait = "concurrent requests", max(wait, concurrencyRetryAfter)
+		case scope.limits.RequestsPerMinute > 0 && state.requests.level < 1:
+			limit, wait = "requests", max(wait, state.requests.wait(1))
+		case scope.limits.TokensPerMinute > 0 && state.tokens.level < charge:
+			limit, wait = "tokens", max(wait, state.tokens.wait(charge))
+		}
+		reservation.scopes = append(reservation.scopes, state)
+		reservation.tokens = append(reservation.tokens, charge)
+	}
+	if limit != "" {
+		return nil, limit, wait
+	}
+
+	for i, state := range reservation.scopes {
+		state.inFlight++
+		if state.requests.capacity > 0 {
+			state.requests.level--
+		}
+		if state.tokens.capacity > 0 {
+			state.tokens.level -= reservation.tokens[i]
+		}
+	}
+	return reservation, "", 0
+}
+
+// release ends a request, the tokens charged for it are reconciled with usage when it is known.
+func (tl *TenantLimiter) release(reservation *tenantReservation, usage tokenUsage, ok bool) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	for i, state := range reservation.scopes {
+		state.inFlight--
+		if ok && state.tokens.capacity > 0 {
+			state.tokens.level = min(state.tokens.level+reservation.tokens[i]-float64(usage.total()), state.tokens.capacity)
+		}
+	}
+}
+
+// sweep forgets the scopes which are back to their initial state, at most once per window.
+func (tl *TenantLimiter) sweep(now time.Time) {
+	if now.Sub(tl.swept) < tenantLimitWindow {
+		return
+	}
+	tl.swept = now
+	for key, state := range tl.scopes {
+		if state.inFlight == 0 && state.requests.full(now) && state.tokens.full(now) {
+			delete(tl.scopes, key)
+		}
+	}
+}
+
+// refill sets the capacity of the bucket to limit and refills it for the time elapsed since it
+// was last updated. A new bucket starts full.
+func (tb *tokenBucket) refill(now time.Time, limit int) {
+	capacity := float64(limit)
+	if tb.updated.IsZero() || capacity <= 0 {
+		tb.level = capacity
+	} else {
+		tb.level = min(tb.level+now.Sub(tb.updated).Seconds()*tb.rate(), capacity)
+	}
+	tb.capacity = capacity
+	tb.updated = now
+}
+
+// rate is how many units the bucket refills per second.
+func (tb *tokenBucket) rate() float64 {
+	return tb.capacity / tenantLimitWindow.Seconds()
+}
+
+// wait returns how long the bucket takes to refill up to level.
+func (tb *tokenBucket) wait(level float64) time.Duration {
+	if tb.capacity <= 0 {
+		return 0
+	}
+	return time.Duration((level - tb.level) / tb.rate() * float64(time.Second))
+}
+
+// full reports whether the bucket is refilled at now.
+func (tb *tokenBucket) full(now time.Time) bool {
+	return tb.capacity <= 0 || tb.level+now.Sub(tb.updated).Seconds()*tb.rate() >= tb.capacity
+}
+
+// estimateTokens estimates the tokens used by a request: about four bytes of the body per
+// prompt token, and the most tokens the completion is allowed.
+func estimateTokens(body []byte) int {
+	var request struct {
+		MaxTokens           int `json:"max_tokens"`
+		MaxCompletionTokens int `json:"max_completion_tokens"`
+	}
+	_ = json.Unmarshal(body, &request)
+	return len(body)/4 + max(request.MaxTokens, request.MaxCompletionTokens)
+}
+
+// sendRateLimited answers a request over limit with a 429 in format, asking to retry after wait.
+func sendRateLimited(c *fiber.Ctx, format ApiFormat, limit string, wait time.Duration) error {
+	seconds := max(int(math.Ceil(wait.Seconds())), 1)
+	message := fmt.Sprintf("Rate limit reached for %s on this Maxim API key, please try again in %ds.", limit, seconds)
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	c.Status(fiber.StatusTooManyRequests)
+	if format == AnthropicFormat {
+		return c.JSON(fiber.Map{
+			"type":  "error",
+			"error": fiber.Map{"type": "rate_limit_error", "message": message},
+		})
+	}
+	return c.JSON(fiber.Map{
+		"error": fiber.Map{"message": message, "type": limit, "param": nil, "code": "rate_limit_exceeded"},
+	})
+}
@@ -0,0 +1,138 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupLimitedApp routes the chat and messages APIs behind limiter, its clock is stopped at the
+// returned time.
+func setupLimitedApp(limiter *TenantLimiter, accountLimits *maxim.Limits) (*fiber.App, *time.Time) {
+	accounts := testAccounts()
+	accounts.Limits = accountLimits
+	mockMaximAccount(accounts)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	app, _ := setupWrappedApp(FallbackConfig{}, RetryPolicy{}, func(_ string, provider string, next fiber.Handler) fiber.Handler {
+		return limiter.Handler(provider, next)
+	})
+	return app, &now
+}
+
+func TestParseTenantModelLimits(t *testing.T) {
+	models, err := ParseTenantModelLimits(" gpt-4o=rpm:100,tpm:50000,concurrency:5 ; claude-3-5-sonnet=rpm:20")
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]maxim.Limits{
+		"gpt-4o":            {RequestsPerMinute: 100, TokensPerMinute: 50000, ConcurrentRequests: 5},
+		"claude-3-5-sonnet": {RequestsPerMinute: 20},
+	}, models)
+
+	for _, spec := range []string{"rpm:100", "gpt-4o=rpm", "gpt-4o=rpd:100", "gpt-4o=rpm:many", "gpt-4o=tpm:-1"} {
+		_, err := ParseTenantModelLimits(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestTenantRequestsPerMinute(t *testing.T) {
+	app, now := setupLimitedApp(NewTenantLimiter(maxim.Limits{RequestsPerMinute: 2}, testAccountSource), nil)
+	transport := mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+
+	for i := 0; i < 2; i++ {
+		resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	resp, body := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "30", resp.Header.Get("Retry-After"))
+	var rateLimited struct {
+		Error struct {
+			Type string `json:"type"`
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &rateLimited))
+	assert.Equal(t, "requests", rateLimited.Error.Type)
+	assert.Equal(t, "rate_limit_exceeded", rateLimited.Error.Code)
+	assert.Len(t, transport.Requests[openAIHost], 2)
+
+	// The bucket refills over the minute
+	*now = now.Add(30 * time.Second)
+	resp, _ = postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestTenantModelLimitsFromAccount(t *testing.T) {
+	limiter := NewTenantLimiter(maxim.Limits{RequestsPerMinute: 100}, testAccountSource)
+	app, _ := setupLimitedApp(limiter, &maxim.Limits{
+		Models: map[string]maxim.Limits{"claude-3-5-sonnet": {RequestsPerMinute: 1}},
+	})
+	mockHostClient(map[string]hostResponse{
+		openAIHost:    {StatusCode: http.StatusOK, Body: openAIResponse},
+		anthropicHost: {StatusCode: http.StatusOK, Body: anthropicResponseBody},
+	})
+	messages := `{"model":"claude-3-5-sonnet","max_tokens":100,"messages":[]}`
+
+	resp, _ := postJSON(app, "/v1/messages", messages)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body := postJSON(app, "/v1/messages", messages)
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	assert.JSONEq(t, `{"type":"error","error":{"type":"rate_limit_error",`+
+		`"message":"Rate limit reached for requests on this Maxim API key, please try again in 60s."}}`, body)
+	// The other models only have the limits of the key
+	resp, _ = postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestTenantTokensReconciledWithUsage(t *testing.T) {
+	limiter := NewTenantLimiter(maxim.Limits{TokensPerMinute: 1000}, testAccountSource)
+	app, _ := setupLimitedApp(limiter, nil)
+	mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+
+	// The request is estimated to use 500 tokens, its response reports 4
+	resp, _ := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","max_tokens":490,"messages":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(996), limiter.scopes["maxim-api-key"].tokens.level)
+
+	mockHostClient(map[string]hostResponse{openAIHost: {
+		StatusCode: http.StatusOK, Body: openAIStream, ContentType: "text/event-stream",
+	}})
+	resp, _ = postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","stream":true,"max_tokens":900,"messages":[]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(971), limiter.scopes["maxim-api-key"].tokens.level)
+
+	// Requests estimated above what is left wait for the bucket to refill
+	resp, body := postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","max_tokens":990,"messages":[]}`)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Contains(t, body, `"type":"tokens"`)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+}
+
+func TestTenantConcurrentRequests(t *testing.T) {
+	limiter := NewTenantLimiter(maxim.Limits{ConcurrentRequests: 2, TokensPerMinute: 100}, testAccountSource)
+	scopes := limiter.scopeLimits("maxim-api-key", "gpt-4o", nil)
+
+	first, _, _ := limiter.reserve(scopes, 10)
+	second, _, _ := limiter.reserve(scopes, 10)
+	assert.NotNil(t, first)
+	assert.NotNil(t, second)
+	rejected, limit, wait := limiter.reserve(scopes, 10)
+	assert.Nil(t, rejected)
+	assert.Equal(t, "concurrent requests", limit)
+	assert.Equal(t, concurrencyRetryAfter, wait)
+
+	// Requests without usage keep the tokens they were estimated to use
+	limiter.release(first, tokenUsage{}, false)
+	third, _, _ := limiter.reserve(scopes, 10)
+	assert.NotNil(t, third)
+	assert.InDelta(t, 70, limiter.scopes["maxim-api-key"].tokens.level, 0.01)
+}
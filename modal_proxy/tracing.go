@@ -0,0 +1,189 @@
+package modal_proxy
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// tracer creates the spans of the proxy with the global tracer provider, they are dropped
+// unless main sets up an exporter.
+var tracer = otel.Tracer("bifrost/modal_proxy")
+
+// Attributes of the GenAI semantic conventions.
+const (
+	genAISystemKey        = "gen_ai.system"
+	genAIOperationKey     = "gen_ai.operation.name"
+	genAIRequestModelKey  = "gen_ai.request.model"
+	genAIResponseModelKey = "gen_ai.response.model"
+	genAIInputTokensKey   = "gen_ai.usage.input_tokens"
+	genAIOutputTokensKey  = "gen_ai.usage.output_tokens"
+	genAIFinishReasonsKey = "gen_ai.response.finish_reasons"
+)
+
+// genAISystems is the gen_ai.system of each provider.
+var genAISystems = map[string]string{
+	ProviderOpenAI:    "openai",
+	ProviderAzure:     "az.ai.openai",
+	ProviderAnthropic: "anthropic",
+}
+
+// genAIOperation returns the gen_ai.operation.name of the requests to an API path.
+func genAIOperation(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"), strings.HasSuffix(path, "/messages"):
+		return "chat"
+	case strings.HasSuffix(path, "/completions"):
+		return "text_completion"
+	}
+	return ""
+}
+
+// TracingHandler traces the requests to next, the route of provider at route, continuing the
+// trace of their traceparent header. The span ends once the response is relayed, streams
+// included, and the spans of the upstream requests are its children.
+func TracingHandler(route string, provider string, next fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), requestCarrier{c})
+		model, _ := getModalFromBody(c.Body())
+		ctx, span := tracer.Start(ctx, c.Method()+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Method()),
+				attribute.String("http.route", route),
+				attribute.String(genAIOperationKey, genAIOperation(route)),
+				attribute.String(genAISystemKey, genAISystems[provider]),
+				attribute.String(genAIRequestModelKey, model),
+			))
+		c.SetUserContext(ctx)
+
+		var once sync.Once
+		end := func(report usageReport) {
+			once.Do(func() { endRequestSpan(span, provider, model, report) })
+		}
+		observeUsage(c, end)
+		err := next(c)
+		if err != nil {
+			span.RecordError(err)
+			setErrorStatus(c, err)
+		}
+		notifyUsage(c, end)
+		return err
+	}
+}
+
+// endRequestSpan records the response to a request for model on a route of provider and ends its span.
+func endRequestSpan(span trace.Span, provider, model string, report usageReport) {
+	servedProvider, servedModel := report.served(provider, model)
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", report.status),
+		attribute.String(genAISystemKey, genAISystems[servedProvider]),
+		attribute.String(genAIResponseModelKey, servedModel),
+		attribute.Bool("bifrost.stream", report.stream),
+	)
+	if report.ok {
+		span.SetAttributes(
+			attribute.Int(genAIInputTokensKey, report.usage.PromptTokens),
+			attribute.Int(genAIOutputTokensKey, report.usage.CompletionTokens),
+		)
+	}
+	if len(report.finishReasons) > 0 {
+		span.SetAttributes(attribute.StringSlice(genAIFinishReasonsKey, report.finishReasons))
+	}
+	if report.cache != "" {
+		span.SetAttributes(attribute.String("bifrost.cache", report.cache))
+	}
+	if report.status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(report.status))
+	}
+	span.End()
+}
+
+// startUpstreamSpan starts the span of req, an upstream request to provider for model, and
+// injects its trace context in the headers of req.
+func startUpstreamSpan(req *http.Request, provider string, model string) (*http.Request, trace.Span) {
+	operation := genAIOperation(req.URL.Path)
+	ctx, span := tracer.Start(req.Context(), strings.TrimSpace(operation+" "+model),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String(genAISystemKey, genAISystems[provider]),
+			attribute.String(genAIOperationKey, operation),
+			attribute.String(genAIRequestModelKey, model),
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Hostname()),
+			attribute.String("url.full", req.URL.String()),
+		))
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
+
+// endUpstreamSpan records the response to an upstream request, or its error, and ends its span.
+// The span covers the wait for the response headers, the stream relay has its own span.
+func endUpstreamSpan(span trace.Span, resp *http.Response, err error) {
+	if err == nil && resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	endSpan(span, err)
+}
+
+// startStreamSpan starts the span of the relay of the stream of the response to c, which runs
+// once the handler returned.
+func startStreamSpan(c *fiber.Ctx) trace.Span {
+	_, span := tracer.Start(c.UserContext(), "bifrost.stream_relay")
+	return span
+}
+
+// endStreamSpan records the frames of the relayed stream and ends its span.
+func endStreamSpan(span trace.Span, usage *streamUsage) {
+	span.SetAttributes(attribute.Int("bifrost.stream.frames", usage.report.frames))
+	span.End()
+}
+
+// traced runs f in a span named name.
+func traced[T any](ctx context.Context, name string, f func() (T, error)) (T, error) {
+	_, span := tracer.Start(ctx, name)
+	result, err := f()
+	endSpan(span, err)
+	return result, err
+}
+
+// endSpan marks span as failed when err is set and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// requestCarrier reads the trace context from the headers of a request.
+type requestCarrier struct {
+	c *fiber.Ctx
+}
+
+func (rc requestCarrier) Get(key string) string {
+	return rc.c.Get(key)
+}
+
+func (rc requestCarrier) Set(key string, value string) {
+	rc.c.Request().Header.Set(key, value)
+}
+
+func (rc requestCarrier) Keys() []string {
+	keys := make([]string, 0)
+	for key := range rc.c.GetReqHeaders() {
+		keys = append(keys, key)
+	}
+	return keys
+}
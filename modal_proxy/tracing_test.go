@@ -0,0 +1,178 @@
+package modal_proxy
+
+import (
+	"bifrost/cache_storage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanExporter    = tracetest.NewInMemoryExporter()
+	setupTracerOnce sync.Once
+)
+
+// setupTracing exports the spans of the tests to spanExporter. The global tracer provider can
+// only be set once for the tracers already created, so the tests share it.
+func setupTracing() *tracetest.InMemoryExporter {
+	setupTracerOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	spanExporter.Reset()
+	return spanExporter
+}
+
+// headerRoundTripper records the headers of the requests it passes on.
+type headerRoundTripper struct {
+	next    http.RoundTripper
+	headers []http.Header
+}
+
+func (hrt *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	hrt.headers = append(hrt.headers, req.Header.Clone())
+	return hrt.next.RoundTrip(req)
+}
+
+func setupTracedApp() *fiber.App {
+	mockMaximAccount(testAccounts())
+	responseCache := NewResponseCache(cache_storage.NewLRUCache(10))
+	app, _ := setupWrappedApp(FallbackConfig{}, RetryPolicy{}, func(apiPath string, provider string, next fiber.Handler) fiber.Handler {
+		if provider == ProviderOpenAI {
+			next = responseCache.Handler(true, next)
+		}
+		return TracingHandler(apiPath, provider, next)
+	})
+	return app
+}
+
+// spanNamed returns the span of spans named name.
+func spanNamed(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no span named %s", name)
+	return tracetest.SpanStub{}
+}
+
+// spanAttributes returns the attributes of span by key.
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func TestTracing(t *testing.T) {
+	exporter := setupTracing()
+	app := setupTracedApp()
+	transport := &headerRoundTripper{next: mockHostClient(map[string]hostResponse{
+		openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse},
+	})}
+	client.Transport = transport
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","messages":[]}`))
+	req.Header.Set("x-maxim-api-key", "maxim-api-key")
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	resp, _ := app.Test(req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	spans := exporter.GetSpans()
+	server := spanNamed(t, spans, "POST /v1/chat/completions")
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", server.SpanContext.TraceID().String())
+	assert.Equal(t, "b7ad6b7169203331", server.Parent.SpanID().String())
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind)
+	attributes := spanAttributes(server)
+	assert.Equal(t, "openai", attributes[genAISystemKey].AsString())
+	assert.Equal(t, "chat", attributes[genAIOperationKey].AsString())
+	assert.Equal(t, "gpt-4o", attributes[genAIRequestModelKey].AsString())
+	assert.Equal(t, "gpt-4o", attributes[genAIResponseModelKey].AsString())
+	assert.Equal(t, int64(3), attributes[genAIInputTokensKey].AsInt64())
+	assert.Equal(t, int64(1), attributes[genAIOutputTokensKey].AsInt64())
+	assert.Equal(t, []string{"stop"}, attributes[genAIFinishReasonsKey].AsStringSlice())
+	assert.Equal(t, int64(http.StatusOK), attributes["http.response.status_code"].AsInt64())
+	assert.Equal(t, "miss", attributes["bifrost.cache"].AsString())
+
+	for _, name := range []string{"bifrost.cache_lookup", "bifrost.account_lookup", "bifrost.key_selection", "chat gpt-4o"} {
+		span := spanNamed(t, spans, name)
+		assert.Equal(t, server.SpanContext.TraceID(), span.SpanContext.TraceID(), name)
+		assert.Equal(t, server.SpanContext.SpanID(), span.Parent.SpanID(), name)
+	}
+	upstream := spanNamed(t, spans, "chat gpt-4o")
+	assert.Equal(t, trace.SpanKindClient, upstream.SpanKind)
+	assert.Equal(t, int64(http.StatusOK), spanAttributes(upstream)["http.response.status_code"].AsInt64())
+	assert.Equal(t, "ope...-key", spanAttributes(spanNamed(t, spans, "bifrost.key_selection"))["bifrost.key"].AsString())
+
+	// The upstream request continues the trace from the upstream span
+	assert.Len(t, transport.headers, 1)
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-"+upstream.SpanContext.SpanID().String()+"-01",
+		transport.headers[0].Get("traceparent"))
+}
+
+func TestTracingStream(t *testing.T) {
+	exporter := setupTracing()
+	app := setupTracedApp()
+	mockHostClient(map[string]hostResponse{
+		anthropicHost: {StatusCode: http.StatusOK, Body: anthropicStream, ContentType: "text/event-stream"},
+	})
+
+	postJSON(app, "/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":100,"stream":true,"messages":[]}`)
+
+	spans := exporter.GetSpans()
+	server := spanNamed(t, spans, "POST /v1/messages")
+	// Requests without a traceparent start a trace
+	assert.False(t, server.Parent.IsValid())
+	attributes := spanAttributes(server)
+	assert.Equal(t, "anthropic", attributes[genAISystemKey].AsString())
+	assert.True(t, attributes["bifrost.stream"].AsBool())
+	assert.Equal(t, int64(10), attributes[genAIInputTokensKey].AsInt64())
+	assert.Equal(t, int64(15), attributes[genAIOutputTokensKey].AsInt64())
+	assert.Equal(t, []string{"tool_use"}, attributes[genAIFinishReasonsKey].AsStringSlice())
+
+	relay := spanNamed(t, spans, "bifrost.stream_relay")
+	assert.Equal(t, server.SpanContext.SpanID(), relay.Parent.SpanID())
+	assert.Positive(t, spanAttributes(relay)["bifrost.stream.frames"].AsInt64())
+	assert.False(t, relay.EndTime.After(server.EndTime))
+}
+
+func TestTracingShortStream(t *testing.T) {
+	exporter := setupTracing()
+	app := setupTracedApp()
+	mockHostClient(map[string]hostResponse{
+		anthropicHost: {StatusCode: http.StatusOK, Body: shortAnthropicStream, ContentType: "text/event-stream"},
+	})
+
+	postJSON(app, "/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":100,"stream":true,"messages":[]}`)
+
+	var spans tracetest.SpanStubs
+	assert.Eventually(t, func() bool {
+		spans = exporter.GetSpans()
+		return len(spans) > 0 && spans[len(spans)-1].Name == "POST /v1/messages"
+	}, time.Second, time.Millisecond)
+	attributes := spanAttributes(spanNamed(t, spans, "POST /v1/messages"))
+	assert.True(t, attributes["bifrost.stream"].AsBool())
+	assert.Equal(t, int64(10), attributes[genAIInputTokensKey].AsInt64())
+	assert.NotContains(t, attributes, attribute.Key("bifrost.cache"))
+}
+
+func TestReadFinishReasons(t *testing.T) {
+	assert.Equal(t, []string{"stop"}, readFinishReasons([]byte(openAIResponse)))
+	assert.Equal(t, []string{"end_turn"}, readFinishReasons([]byte(anthropicResponseBody)))
+	assert.Equal(t, []string{"max_tokens"}, readFinishReasons([]byte(`{"type":"message_delta","delta":{"stop_reason":"max_tokens"}}`)))
+	assert.Nil(t, readFinishReasons([]byte(`{"choices":[{"index":0,"delta":{"content":"Hel"},"finish_reason":null}]}`)))
+}
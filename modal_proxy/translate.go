@@ -0,0 +1,688 @@
+package modal_proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ApiFormat is the request and response format of a completion API.
+type ApiFormat string
+
+const (
+	// OpenAIFormat is the format of the OpenAI chat completions API, used by OpenAI and Azure
+	OpenAIFormat ApiFormat = "openai"
+	// AnthropicFormat is the format of the Anthropic messages API
+	AnthropicFormat ApiFormat = "anthropic"
+)
+
+// apiPaths are the paths of the chat API of each format.
+var apiPaths = map[ApiFormat]string{
+	OpenAIFormat:    "/v1/chat/completions",
+	AnthropicFormat: "/v1/messages",
+}
+
+// defaultAnthropicMaxTokens is sent to Anthropic, which requires max_tokens, when an OpenAI
+// request does not set it.
+const defaultAnthropicMaxTokens = 4096
+
+type openAIChatRequest struct {
+	Model               string          `json:"model"`
+	Messages            []openAIMessage `json:"messages"`
+	MaxTokens           *int            `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64        `json:"temperature,omitempty"`
+	TopP                *float64        `json:"top_p,omitempty"`
+	Stop                json.RawMessage `json:"stop,omitempty"`
+	Stream              bool            `json:"stream,omitempty"`
+	StreamOptions       *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options,omitempty"`
+	Tools          []openAITool          `json:"tools,omitempty"`
+	ToolChoice     json.RawMessage       `json:"tool_choice,omitempty"`
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+	User           string                `json:"user,omitempty"`
+}
+
+type openAIResponseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema *struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+	} `json:"json_schema,omitempty"`
+}
+
+type openAIMessage struct {
+	Role string `json:"role"`
+	// Content is a string or a list of content parts
+	Content    json.RawMessage  `json:"content,omitempty"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAIChatResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+type openAIChoice struct {
+	Index        int           `json:"index"`
+	Message      openAIMessage `json:"message"`
+	FinishReason string        `json:"finish_reason"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type anthropicRequest struct {
+	Model string `json:"model"`
+	// System is a string or a list of text blocks
+	System        json.RawMessage      `json:"system,omitempty"`
+	Messages      []anthropicMessage   `json:"messages"`
+	MaxTokens     int                  `json:"max_tokens"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Tools         []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Metadata      *anthropicMetadata   `json:"metadata,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role string `json:"role"`
+	// Content is a string or a list of content blocks
+	Content json.RawMessage `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type      string                `json:"type"`
+	Text      string                `json:"text,omitempty"`
+	Source    *anthropicImageSource `json:"source,omitempty"`
+	ID        string                `json:"id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Input     json.RawMessage       `json:"input,omitempty"`
+	ToolUseID string                `json:"tool_use_id,omitempty"`
+	// Content is the result of a tool, a string or a list of content blocks
+	Content json.RawMessage `json:"content,omitempty"`
+	IsError bool            `json:"is_error,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type anthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+type anthropicResponse struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []anthropicBlock `json:"content"`
+	StopReason   string           `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        anthropicUsage   `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// translateRequest translates a chat request body from one format to the other.
+func translateRequest(body []byte, from, to ApiFormat) ([]byte, error) {
+	switch {
+	case from == to:
+		return body, nil
+	case from == OpenAIFormat && to == AnthropicFormat:
+		return openAIToAnthropicRequest(body)
+	case from == AnthropicFormat && to == OpenAIFormat:
+		return anthropicToOpenAIRequest(body)
+	}
+	return nil, fmt.Errorf("can not translate requests from %s to %s", from, to)
+}
+
+// translateResponse translates a chat response body from one format to the other.
+func translateResponse(body []byte, from, to ApiFormat) ([]byte, error) {
+	switch {
+	case from == to:
+		return body, nil
+	case from == AnthropicFormat && to == OpenAIFormat:
+		return anthropicToOpenAIResponse(body)
+	case from == OpenAIFormat && to == AnthropicFormat:
+		return openAIToAnthropicResponse(body)
+	}
+	return nil, fmt.Errorf("can not translate responses from %s to %s", from, to)
+}
+
+// withModel replaces the model of a JSON request body, keeping the other fields untouched.
+func withModel(body []byte, model string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+	encodedModel, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	fields["model"] = encodedModel
+	return json.Marshal(fields)
+}
+
+func openAIToAnthropicRequest(body []byte) ([]byte, error) {
+	var request openAIChatRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, fmt.Errorf("invalid OpenAI request: %w", err)
+	}
+	translated := anthropicRequest{
+		Model:       request.Model,
+		MaxTokens:   defaultAnthropicMaxTokens,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		Stream:      request.Stream,
+	}
+	if request.MaxCompletionTokens != nil {
+		translated.MaxTokens = *request.MaxCompletionTokens
+	} else if request.MaxTokens != nil {
+		translated.MaxTokens = *request.MaxTokens
+	}
+	if request.Stop != nil {
+		var stop string
+		if err := json.Unmarshal(request.Stop, &stop); err == nil {
+			translated.StopSequences = []string{stop}
+		} else if err := json.Unmarshal(request.Stop, &translated.StopSequences); err != nil {
+			return nil, errors.New("invalid OpenAI request: stop must be a string or a list of strings")
+		}
+	}
+	if request.User != "" {
+		translated.Metadata = &anthropicMetadata{UserID: request.User}
+	}
+	for _, tool := range request.Tools {
+		inputSchema := tool.Function.Parameters
+		if inputSchema == nil {
+			inputSchema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		translated.Tools = append(translated.Tools, anthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: inputSchema,
+		})
+	}
+	if request.ToolChoice != nil {
+		toolChoice, err := anthropicToolChoiceOf(request.ToolChoice)
+		if err != nil {
+			return nil, err
+		}
+		translated.ToolChoice = toolChoice
+	}
+
+	var system []string
+	var messages []anthropicMessage
+	var blocks []anthropicBlock
+	role := ""
+	// Anthropic wants alternating turns, consecutive messages of a role are merged into one
+	flush := func() error {
+		if len(blocks) == 0 {
+			return nil
+		}
+		content, err := json.Marshal(blocks)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, anthropicMessage{Role: role, Content: content})
+		blocks = nil
+		return nil
+	}
+	for _, message := range request.Messages {
+		var messageRole string
+		var messageBlocks []anthropicBlock
+		switch message.Role {
+		case "system", "developer":
+			system = append(system, contentText(message.Content))
+			continue
+		case "user":
+			messageRole = "user"
+			parts, err := openAIContentBlocks(message.Content)
+			if err != nil {
+				return nil, err
+			}
+			messageBlocks = parts
+		case "assistant":
+			messageRole = "assistant"
+			if text := contentText(message.Content); text != "" {
+				messageBlocks = append(messageBlocks, anthropicBlock{Type: "text", Text: text})
+			}
+			for _, toolCall := range message.ToolCalls {
+				input := json.RawMessage(toolCall.Function.Arguments)
+				if strings.TrimSpace(toolCall.Function.Arguments) == "" {
+					input = json.RawMessage("{}")
+				} else if !json.Valid(input) {
+					return nil, fmt.Errorf("invalid OpenAI request: arguments of tool call %s are not JSON", toolCall.ID)
+				}
+				messageBlocks = append(messageBlocks, anthropicBlock{
+					Type:  "tool_use",
+					ID:    toolCall.ID,
+					Name:  toolCall.Function.Name,
+					Input: input,
+				})
+			}
+		case "tool":
+			messageRole = "user"
+			result, err := json.Marshal(contentText(message.Content))
+			if err != nil {
+				return nil, err
+			}
+			messageBlocks = []anthropicBlock{{Type: "tool_result", ToolUseID: message.ToolCallID, Content: result}}
+		default:
+			return nil, fmt.Errorf("invalid OpenAI request: unsupported message role %q", message.Role)
+		}
+		if messageRole != role {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			role = messageRole
+		}
+		blocks = append(blocks, messageBlocks...)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	translated.Messages = messages
+	if instruction := responseFormatInstruction(request.ResponseFormat); instruction != "" {
+		system = append(system, instruction)
+	}
+	if len(system) > 0 {
+		encodedSystem, err := json.Marshal(strings.Join(system, "\n"))
+		if err != nil {
+			return nil, err
+		}
+		translated.System = encodedSystem
+	}
+	return json.Marshal(translated)
+}
+
+// responseFormatInstruction asks for the OpenAI response format in the system prompt, Anthropic
+// has no structured output mode.
+func responseFormatInstruction(responseFormat *openAIResponseFormat) string {
+	if responseFormat == nil {
+		return ""
+	}
+	switch responseFormat.Type {
+	case "json_object":
+		return "Respond only with a valid JSON object, without any other text."
+	case "json_schema":
+		if responseFormat.JSONSchema != nil && len(responseFormat.JSONSchema.Schema) > 0 {
+			return "Respond only with a valid JSON object matching this JSON schema, without any other text:\n" +
+				string(responseFormat.JSONSchema.Schema)
+		}
+		return "Respond only with a valid JSON object, without any other text."
+	}
+	return ""
+}
+
+// openAIContentBlocks translates the content of an OpenAI user message to Anthropic blocks.
+func openAIContentBlocks(content json.RawMessage) ([]anthropicBlock, error) {
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return []anthropicBlock{{Type: "text", Text: text}}, nil
+	}
+	var parts []openAIContentPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return nil, errors.New("invalid OpenAI request: content must be a string or a list of content parts")
+	}
+	var blocks []anthropicBlock
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			blocks = append(blocks, anthropicBlock{Type: "text", Text: part.Text})
+		case "image_url":
+			if part.ImageURL == nil {
+				return nil, errors.New("invalid OpenAI request: image_url part without an image_url")
+			}
+			source, err := anthropicImageSourceOf(part.ImageURL.URL)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, anthropicBlock{Type: "image", Source: source})
+		default:
+			return nil, fmt.Errorf("invalid OpenAI request: unsupported content part %q", part.Type)
+		}
+	}
+	return blocks, nil
+}
+
+// anthropicImageSourceOf translates an OpenAI image URL, which may be a base64 data URL.
+func anthropicImageSourceOf(imageUrl string) (*anthropicImageSource, error) {
+	if !strings.HasPrefix(imageUrl, "data:") {
+		return &anthropicImageSource{Type: "url", URL: imageUrl}, nil
+	}
+	mediaType, data, ok := strings.Cut(strings.TrimPrefix(imageUrl, "data:"), ";base64,")
+	if !ok {
+		return nil, errors.New("invalid OpenAI request: image data URLs must be base64 encoded")
+	}
+	return &anthropicImageSource{Type: "base64", MediaType: mediaType, Data: data}, nil
+}
+
+func anthropicToolChoiceOf(toolChoice json.RawMessage) (*anthropicToolChoice, error) {
+	var mode string
+	if err := json.Unmarshal(toolChoice, &mode); err == nil {
+		switch mode {
+		case "auto":
+			return &anthropicToolChoice{Type: "auto"}, nil
+		case "required":
+			return &anthropicToolChoice{Type: "any"}, nil
+		case "none":
+			return &anthropicToolChoice{Type: "none"}, nil
+		}
+		return nil, fmt.Errorf("invalid OpenAI request: unsupported tool_choice %q", mode)
+	}
+	var function struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(toolChoice, &function); err != nil || function.Function.Name == "" {
+		return nil, errors.New("invalid OpenAI request: unsupported tool_choice")
+	}
+	return &anthropicToolChoice{Type: "tool", Name: function.Function.Name}, nil
+}
+
+func anthropicToOpenAIRequest(body []byte) ([]byte, error) {
+	var request anthropicRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, fmt.Errorf("invalid Anthropic request: %w", err)
+	}
+	translated := openAIChatRequest{
+		Model:       request.Model,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		Stream:      request.Stream,
+	}
+	if request.MaxTokens > 0 {
+		translated.MaxTokens = &request.MaxTokens
+	}
+	if request.Stream {
+		// Anthropic always reports the usage of a stream, OpenAI only when asked to
+		translated.StreamOptions = &struct {
+			IncludeUsage bool `json:"include_usage"`
+		}{IncludeUsage: true}
+	}
+	if len(request.StopSequences) > 0 {
+		stop, err := json.Marshal(request.StopSequences)
+		if err != nil {
+			return nil, err
+		}
+		translated.Stop = stop
+	}
+	if request.Metadata != nil {
+		translated.User = request.Metadata.UserID
+	}
+	for _, tool := range request.Tools {
+		var openAiTool openAITool
+		openAiTool.Type = "function"
+		openAiTool.Function.Name = tool.Name
+		openAiTool.Function.Description = tool.Description
+		openAiTool.Function.Parameters = tool.InputSchema
+		translated.Tools = append(translated.Tools, openAiTool)
+	}
+	if request.ToolChoice != nil {
+		var toolChoice interface{}
+		switch request.ToolChoice.Type {
+		case "auto":
+			toolChoice = "auto"
+		case "any":
+			toolChoice = "required"
+		case "none":
+			toolChoice = "none"
+		case "tool":
+			toolChoice = map[string]interface{}{"type": "function", "function": map[string]string{"name": request.ToolChoice.Name}}
+		default:
+			return nil, fmt.Errorf("invalid Anthropic request: unsupported tool_choice %q", request.ToolChoice.Type)
+		}
+		encodedToolChoice, err := json.Marshal(toolChoice)
+		if err != nil {
+			return nil, err
+		}
+		translated.ToolChoice = encodedToolChoice
+	}
+
+	if system := contentText(request.System); system != "" {
+		translated.Messages = append(translated.Messages, openAIMessage{Role: "system", Content: jsonString(system)})
+	}
+	for _, message := range request.Messages {
+		messages, err := openAIMessagesOf(message)
+		if err != nil {
+			return nil, err
+		}
+		translated.Messages = append(translated.Messages, messages...)
+	}
+	return json.Marshal(translated)
+}
+
+// openAIMessagesOf translates an Anthropic message to OpenAI messages, the tool results of a
+// user message become tool messages of their own.
+func openAIMessagesOf(message anthropicMessage) ([]openAIMessage, error) {
+	var text string
+	if err := json.Unmarshal(message.Content, &text); err == nil {
+		return []openAIMessage{{Role: message.Role, Content: jsonString(text)}}, nil
+	}
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(message.Content, &blocks); err != nil {
+		return nil, errors.New("invalid Anthropic request: content must be a string or a list of content blocks")
+	}
+	var messages []openAIMessage
+	var parts []map[string]interface{}
+	var toolCalls []openAIToolCall
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			parts = append(parts, map[string]interface{}{"type": "text", "text": block.Text})
+		case "image":
+			if block.Source == nil {
+				return nil, errors.New("invalid Anthropic request: image block without a source")
+			}
+			imageUrl := block.Source.URL
+			if block.Source.Type == "base64" {
+				imageUrl = "data:" + block.Source.MediaType + ";base64," + block.Source.Data
+			}
+			parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]string{"url": imageUrl}})
+		case "tool_use":
+			var toolCall openAIToolCall
+			toolCall.ID = block.ID
+			toolCall.Type = "function"
+			toolCall.Function.Name = block.Name
+			toolCall.Function.Arguments = toolArguments(block.Input)
+			toolCalls = append(toolCalls, toolCall)
+		case "tool_result":
+			messages = append(messages, openAIMessage{Role: "tool", ToolCallID: block.ToolUseID, Content: jsonString(contentText(block.Content))})
+		default:
+			return nil, fmt.Errorf("invalid Anthropic request: unsupported content block %q", block.Type)
+		}
+	}
+	if len(parts) == 0 && len(toolCalls) == 0 {
+		return messages, nil
+	}
+	translated := openAIMessage{Role: message.Role, ToolCalls: toolCalls}
+	if message.Role == "assistant" {
+		// Assistant messages only take text content
+		var texts []string
+		for _, part := range parts {
+			if text, ok := part["text"].(string); ok {
+				texts = append(texts, text)
+			}
+		}
+		if len(texts) > 0 {
+			translated.Content = jsonString(strings.Join(texts, "\n"))
+		}
+	} else if len(parts) > 0 {
+		content, err := json.Marshal(parts)
+		if err != nil {
+			return nil, err
+		}
+		translated.Content = content
+	}
+	return append(messages, translated), nil
+}
+
+func anthropicToOpenAIResponse(body []byte) ([]byte, error) {
+	var response anthropicResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("invalid Anthropic response: %w", err)
+	}
+	message := openAIMessage{Role: "assistant"}
+	var texts []string
+	for _, block := range response.Content {
+		switch block.Type {
+		case "text":
+			texts = append(texts, block.Text)
+		case "tool_use":
+			var toolCall openAIToolCall
+			toolCall.ID = block.ID
+			toolCall.Type = "function"
+			toolCall.Function.Name = block.Name
+			toolCall.Function.Arguments = toolArguments(block.Input)
+			message.ToolCalls = append(message.ToolCalls, toolCall)
+		}
+	}
+	if len(texts) > 0 || len(message.ToolCalls) == 0 {
+		message.Content = jsonString(strings.Join(texts, ""))
+	} else {
+		message.Content = json.RawMessage("null")
+	}
+	return json.Marshal(openAIChatResponse{
+		ID:      response.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   response.Model,
+		Choices: []openAIChoice{{Message: message, FinishReason: openAIFinishReason(response.StopReason)}},
+		Usage: &openAIUsage{
+			PromptTokens:     response.Usage.InputTokens,
+			CompletionTokens: response.Usage.OutputTokens,
+			TotalTokens:      response.Usage.InputTokens + response.Usage.OutputTokens,
+		},
+	})
+}
+
+func openAIToAnthropicResponse(body []byte) ([]byte, error) {
+	var response openAIChatResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("invalid OpenAI response: %w", err)
+	}
+	if len(response.Choices) == 0 {
+		return nil, errors.New("invalid OpenAI response: no choices")
+	}
+	choice := response.Choices[0]
+	content := []anthropicBlock{}
+	if text := contentText(choice.Message.Content); text != "" {
+		content = append(content, anthropicBlock{Type: "text", Text: text})
+	}
+	for _, toolCall := range choice.Message.ToolCalls {
+		input := json.RawMessage(toolCall.Function.Arguments)
+		if !json.Valid(input) {
+			input = json.RawMessage("{}")
+		}
+		content = append(content, anthropicBlock{Type: "tool_use", ID: toolCall.ID, Name: toolCall.Function.Name, Input: input})
+	}
+	translated := anthropicResponse{
+		ID:         response.ID,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      response.Model,
+		Content:    content,
+		StopReason: anthropicStopReason(choice.FinishReason),
+	}
+	if response.Usage != nil {
+		translated.Usage = anthropicUsage{InputTokens: response.Usage.PromptTokens, OutputTokens: response.Usage.CompletionTokens}
+	}
+	return json.Marshal(translated)
+}
+
+func openAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return "stop"
+	}
+}
+
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+// toolArguments turns the input of an Anthropic tool use into the arguments of an OpenAI tool call.
+func toolArguments(input json.RawMessage) string {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, input); err != nil || compact.Len() == 0 {
+		return "{}"
+	}
+	return compact.String()
+}
+
+func jsonString(text string) json.RawMessage {
+	encoded, _ := json.Marshal(text)
+	return encoded
+}
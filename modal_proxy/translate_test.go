@@ -0,0 +1,145 @@
+package modal_proxy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAIToAnthropicRequest(t *testing.T) {
+	translated, err := translateRequest([]byte(`{
+		"model": "gpt-4o",
+		"max_completion_tokens": 200,
+		"temperature": 0.5,
+		"stop": "END",
+		"user": "user-1",
+		"tools": [{"type": "function", "function": {"name": "weather", "description": "Get the weather",
+			"parameters": {"type": "object", "properties": {"city": {"type": "string"}}}}}],
+		"tool_choice": "required",
+		"messages": [
+			{"role": "system", "content": "be brief"},
+			{"role": "user", "content": [{"type": "text", "text": "weather here?"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,aGk="}}]},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function",
+				"function": {"name": "weather", "arguments": "{\"city\":\"Paris\"}"}}]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "sunny"},
+			{"role": "user", "content": "thanks"}
+		]
+	}`), OpenAIFormat, AnthropicFormat)
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"model": "gpt-4o",
+		"system": "be brief",
+		"max_tokens": 200,
+		"temperature": 0.5,
+		"stop_sequences": ["END"],
+		"metadata": {"user_id": "user-1"},
+		"tools": [{"name": "weather", "description": "Get the weather",
+			"input_schema": {"type": "object", "properties": {"city": {"type": "string"}}}}],
+		"tool_choice": {"type": "any"},
+		"messages": [
+			{"role": "user", "content": [{"type": "text", "text": "weather here?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "aGk="}}]},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "call_1", "name": "weather", "input": {"city": "Paris"}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "call_1", "content": "sunny"},
+				{"type": "text", "text": "thanks"}]}
+		]
+	}`, string(translated))
+}
+
+func TestOpenAIToAnthropicRequestDefaults(t *testing.T) {
+	translated, err := translateRequest([]byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`),
+		OpenAIFormat, AnthropicFormat)
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"model":"gpt-4o","max_tokens":4096,"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}]}`,
+		string(translated))
+
+	_, err = translateRequest([]byte(`{"model":"gpt-4o","messages":[{"role":"user","content":[{"type":"input_audio"}]}]}`),
+		OpenAIFormat, AnthropicFormat)
+	assert.Error(t, err)
+}
+
+func TestAnthropicToOpenAIRequest(t *testing.T) {
+	translated, err := translateRequest([]byte(`{
+		"model": "claude-3-5-sonnet",
+		"max_tokens": 100,
+		"system": [{"type": "text", "text": "be brief"}],
+		"stop_sequences": ["END"],
+		"stream": true,
+		"tools": [{"name": "weather", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "tool", "name": "weather"},
+		"messages": [
+			{"role": "user", "content": [{"type": "text", "text": "weather here?"},
+				{"type": "image", "source": {"type": "url", "url": "https://example.com/sky.png"}}]},
+			{"role": "assistant", "content": [{"type": "text", "text": "checking"},
+				{"type": "tool_use", "id": "toolu_1", "name": "weather", "input": {"city": "Paris"}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_1", "content": [{"type": "text", "text": "sunny"}]}]}
+		]
+	}`), AnthropicFormat, OpenAIFormat)
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"model": "claude-3-5-sonnet",
+		"max_tokens": 100,
+		"stop": ["END"],
+		"stream": true,
+		"stream_options": {"include_usage": true},
+		"tools": [{"type": "function", "function": {"name": "weather", "parameters": {"type": "object"}}}],
+		"tool_choice": {"type": "function", "function": {"name": "weather"}},
+		"messages": [
+			{"role": "system", "content": "be brief"},
+			{"role": "user", "content": [{"type": "text", "text": "weather here?"},
+				{"type": "image_url", "image_url": {"url": "https://example.com/sky.png"}}]},
+			{"role": "assistant", "content": "checking", "tool_calls": [{"id": "toolu_1", "type": "function",
+				"function": {"name": "weather", "arguments": "{\"city\":\"Paris\"}"}}]},
+			{"role": "tool", "tool_call_id": "toolu_1", "content": "sunny"}
+		]
+	}`, string(translated))
+}
+
+func TestResponseFormatInstruction(t *testing.T) {
+	translated, err := translateRequest([]byte(`{"model":"claude-3-5-sonnet","messages":[{"role":"system","content":"be brief"},
+		{"role":"user","content":"hi"}],"response_format":{"type":"json_schema","json_schema":{"name":"greeting","schema":{"type":"object"}}}}`),
+		OpenAIFormat, AnthropicFormat)
+
+	assert.NoError(t, err)
+	var request anthropicRequest
+	assert.NoError(t, json.Unmarshal(translated, &request))
+	assert.Equal(t, "be brief\nRespond only with a valid JSON object matching this JSON schema, without any other text:\n{\"type\":\"object\"}",
+		contentText(request.System))
+}
+
+func TestAnthropicToOpenAIResponseWithToolUse(t *testing.T) {
+	translated, err := translateResponse([]byte(`{"id":"msg_1","type":"message","role":"assistant","model":"claude",
+		"content":[{"type":"tool_use","id":"toolu_1","name":"weather","input":{"city":"Paris"}}],
+		"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5}}`), AnthropicFormat, OpenAIFormat)
+
+	assert.NoError(t, err)
+	assert.Contains(t, string(translated), `"content":null`)
+	assert.Contains(t, string(translated), `"tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"weather","arguments":"{\"city\":\"Paris\"}"}}]`)
+	assert.Contains(t, string(translated), `"finish_reason":"tool_calls"`)
+}
+
+func TestOpenAIToAnthropicResponse(t *testing.T) {
+	translated, err := translateResponse([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o",
+		"choices":[{"index":0,"message":{"role":"assistant","content":"it is sunny","tool_calls":[{"id":"call_1",
+		"type":"function","function":{"name":"weather","arguments":"{\"city\":\"Paris\"}"}}]},"finish_reason":"length"}],
+		"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`), OpenAIFormat, AnthropicFormat)
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"chatcmpl-1","type":"message","role":"assistant","model":"gpt-4o",
+		"content":[{"type":"text","text":"it is sunny"},{"type":"tool_use","id":"call_1","name":"weather","input":{"city":"Paris"}}],
+		"stop_reason":"max_tokens","stop_sequence":null,"usage":{"input_tokens":10,"output_tokens":5}}`, string(translated))
+
+	_, err = translateResponse([]byte(`{"choices":[]}`), OpenAIFormat, AnthropicFormat)
+	assert.Error(t, err)
+}
+
+func TestWithModel(t *testing.T) {
+	body, err := withModel([]byte(`{"model":"gpt-4o","messages":[],"x":{"y":1}}`), "gpt-4o-mini")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"model":"gpt-4o-mini","messages":[],"x":{"y":1}}`, string(body))
+}
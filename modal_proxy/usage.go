@@ -0,0 +1,273 @@
+package modal_proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"strings"
+	"time"
+)
+
+// usageObserversKey is the Locals key of the functions called with the token usage of the
+// response to a request once it has been relayed.
+const usageObserversKey = "bifrost.usageObservers"
+
+// captureBodyLocal is the Locals key set when the report of the response to a request includes
+// its body, streams are then reassembled.
+const captureBodyLocal = "bifrost.captureBody"
+
+// providerKeyLocal is the Locals key of the provider key the last upstream request of a request
+// was sent with.
+const providerKeyLocal = "bifrost.providerKey"
+
+// tokenUsage is the token usage reported by an OpenAI or Anthropic response. PromptTokens
+// include the CachedTokens read from the prompt cache.
+type tokenUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+	CachedTokens     int
+}
+
+func (tu tokenUsage) total() int {
+	return tu.PromptTokens + tu.CompletionTokens
+}
+
+// usageReport is the usage of the response to a request and what served it.
+type usageReport struct {
+	usage tokenUsage
+	// ok is false when the response did not report its usage
+	ok     bool
+	status int
+	// servedBy is the provider/model which served the request, empty when no provider did
+	servedBy    string
+	providerKey string
+	// cache is the cache status of the response, see cacheStatus
+	cache  string
+	stream bool
+	// firstByteAt and lastFrameAt are when the first and the last of the frames of a stream
+	// were received
+	firstByteAt time.Time
+	lastFrameAt time.Time
+	frames      int
+	// finishReasons are why the choices, or the message, of the response ended
+	finishReasons []string
+	// body is the response, streams reassembled, when the body was asked for
+	body []byte
+}
+
+// usageObserver is called with the usage of a response once it has been relayed.
+type usageObserver func(report usageReport)
+
+// newUsageReport returns the report of the response to c, before its usage is known. Streams
+// take it before they start, the observers they notify only read what it captured.
+func newUsageReport(c *fiber.Ctx) usageReport {
+	providerKey, _ := c.Locals(providerKeyLocal).(string)
+	return usageReport{
+		status:      c.Response().StatusCode(),
+		servedBy:    string(c.Response().Header.Peek(ServedByHeader)),
+		providerKey: providerKey,
+		cache:       cacheStatus(c),
+	}
+}
+
+// served returns the provider and the model which served the request, provider and model of
+// the route and the request when no provider did.
+func (ur usageReport) served(provider string, model string) (string, string) {
+	if servedProvider, servedModel, ok := strings.Cut(ur.servedBy, "/"); ok {
+		return servedProvider, servedModel
+	}
+	return provider, model
+}
+
+// observeUsage registers observer to be called with the usage of the response to c. Observers
+// must be registered before the request is proxied.
+//
+// Streamed responses call the observers once the stream has been relayed, the handler which
+// registered them calls them for the other responses, see notifyUsage.
+func observeUsage(c *fiber.Ctx, observer usageObserver) {
+	observers, _ := c.Locals(usageObserversKey).([]usageObserver)
+	c.Locals(usageObserversKey, append(observers, observer))
+}
+
+// usageObservers returns the observers registered for the response to c.
+func usageObservers(c *fiber.Ctx) []usageObserver {
+	observers, _ := c.Locals(usageObserversKey).([]usageObserver)
+	return observers
+}
+
+// notifyUsage calls observer with the usage of the response to c unless the response is a
+// stream, whose relay calls the observers once it is over.
+func notifyUsage(c *fiber.Ctx, observer usageObserver) {
+	if c.Response().IsBodyStream() {
+		return
+	}
+	report := newUsageReport(c)
+	if report.status == fiber.StatusOK {
+		report.usage, report.ok = readUsage(c.Response().Body())
+		report.finishReasons = readFinishReasons([]byte(c.Response().Body()))
+	}
+	if captured, _ := c.Locals(captureBodyLocal).(bool); captured {
+		report.body = append([]byte(nil), c.Response().Body()...)
+	}
+	observer(report)
+}
+
+// setErrorStatus sets the status the error handler sends for err once the handler returns, for
+// the observers notified before it does.
+func setErrorStatus(c *fiber.Ctx, err error) {
+	c.Status(fiber.StatusInternalServerError)
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		c.Status(fiberErr.Code)
+	}
+}
+
+// apiUsage is the usage object of OpenAI and Anthropic responses and stream frames.
+type apiUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// tokenUsage normalizes the usage, the input tokens of Anthropic do not include the tokens
+// written to and read from the prompt cache.
+func (au apiUsage) tokenUsage() tokenUsage {
+	usage := tokenUsage{
+		PromptTokens:     au.PromptTokens + au.InputTokens + au.CacheCreationInputTokens + au.CacheReadInputTokens,
+		CompletionTokens: au.CompletionTokens + au.OutputTokens,
+		CachedTokens:     au.CacheReadInputTokens,
+	}
+	if au.PromptTokensDetails != nil {
+		usage.CachedTokens += au.PromptTokensDetails.CachedTokens
+	}
+	return usage
+}
+
+// readUsage reads the usage of an OpenAI or Anthropic response body.
+func readUsage(body []byte) (tokenUsage, bool) {
+	var response struct {
+		Usage *apiUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Usage == nil {
+		return tokenUsage{}, false
+	}
+	return response.Usage.tokenUsage(), true
+}
+
+// readFinishReasons reads the finish reasons of the choices of an OpenAI response or chunk, or
+// the stop reason of an Anthropic response or message_delta event.
+func readFinishReasons(body []byte) []string {
+	var response struct {
+		Choices []struct {
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		StopReason string `json:"stop_reason"`
+		Delta      *struct {
+			StopReason string `json:"stop_reason"`
+		} `json:"delta"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil
+	}
+	var reasons []string
+	for _, choice := range response.Choices {
+		if choice.FinishReason != "" {
+			reasons = append(reasons, choice.FinishReason)
+		}
+	}
+	if response.StopReason != "" {
+		reasons = append(reasons, response.StopReason)
+	}
+	if response.Delta != nil && response.Delta.StopReason != "" {
+		reasons = append(reasons, response.Delta.StopReason)
+	}
+	return reasons
+}
+
+// streamUsage collects the usage reported by the frames of an OpenAI or Anthropic stream: the
+// last chunk of OpenAI streams with stream_options.include_usage, the message_start and
+// message_delta events of Anthropic streams.
+type streamUsage struct {
+	report usageReport
+	// assembler reassembles the response when its body was asked for
+	assembler *streamAssembler
+}
+
+// newStreamUsage starts collecting the usage of the stream relayed to c.
+func newStreamUsage(c *fiber.Ctx) *streamUsage {
+	su := &streamUsage{report: newUsageReport(c)}
+	su.report.stream = true
+	if captured, _ := c.Locals(captureBodyLocal).(bool); captured {
+		su.assembler = newStreamAssembler()
+	}
+	return su
+}
+
+// add reads the usage of the data of a stream frame.
+func (su *streamUsage) add(data string) {
+	now := time.Now()
+	if su.report.firstByteAt.IsZero() {
+		su.report.firstByteAt = now
+	}
+	su.report.lastFrameAt = now
+	su.report.frames++
+	if su.assembler != nil {
+		su.assembler.add(data)
+	}
+	if strings.Contains(data, `"finish_reason"`) || strings.Contains(data, `"stop_reason"`) {
+		su.report.finishReasons = append(su.report.finishReasons, readFinishReasons([]byte(data))...)
+	}
+	if !strings.Contains(data, `"usage"`) {
+		return
+	}
+	var frame struct {
+		Usage   *apiUsage `json:"usage"`
+		Message *struct {
+			Usage *apiUsage `json:"usage"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal([]byte(data), &frame); err != nil {
+		return
+	}
+	usage := frame.Usage
+	if usage == nil && frame.Message != nil {
+		usage = frame.Message.Usage
+	}
+	if usage == nil {
+		return
+	}
+	// Anthropic reports the input tokens when the message starts and the output tokens, which
+	// add up, as it goes
+	reported := usage.tokenUsage()
+	if reported.PromptTokens > 0 {
+		su.report.usage.PromptTokens = reported.PromptTokens
+		su.report.usage.CachedTokens = reported.CachedTokens
+	}
+	if reported.CompletionTokens > 0 {
+		su.report.usage.CompletionTokens = reported.CompletionTokens
+	}
+	su.report.ok = true
+}
+
+// addLine reads the usage of a line of a stream, data lines carry the frames.
+func (su *streamUsage) addLine(line string) {
+	if data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:"); ok {
+		su.add(strings.TrimSpace(data))
+	}
+}
+
+// notify calls observers with the usage collected from the stream.
+func (su *streamUsage) notify(observers []usageObserver) {
+	if su.assembler != nil {
+		su.report.body = su.assembler.response()
+	}
+	for _, observer := range observers {
+		observer(su.report)
+	}
+}
@@ -0,0 +1,204 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsageTotals are the requests, tokens and cost of a group of requests, the cost in USD.
+type UsageTotals struct {
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+	// RequestsWithoutUsage succeeded without reporting their usage, like OpenAI streams without
+	// stream_options.include_usage
+	RequestsWithoutUsage uint64  `json:"requestsWithoutUsage"`
+	PromptTokens         uint64  `json:"promptTokens"`
+	CompletionTokens     uint64  `json:"completionTokens"`
+	CachedTokens         uint64  `json:"cachedTokens"`
+	Cost                 float64 `json:"cost"`
+}
+
+// UsageEntry is the usage of the requests of a tenant sent with a provider key for a model, the
+// fields the entries are not grouped by are empty. Keys are masked.
+type UsageEntry struct {
+	Tenant      string `json:"tenant,omitempty"`
+	Provider    string `json:"provider,omitempty"`
+	ProviderKey string `json:"providerKey,omitempty"`
+	Model       string `json:"model,omitempty"`
+	UsageTotals
+}
+
+// UsageReport is the usage accounted since Since, as served by the admin endpoint.
+type UsageReport struct {
+	Since time.Time    `json:"since"`
+	Total UsageTotals  `json:"total"`
+	Usage []UsageEntry `json:"usage"`
+}
+
+// usageGroups are the fields the usage can be grouped by.
+var usageGroups = []string{"tenant", "provider", "providerKey", "model"}
+
+// usageKey identifies the requests of a tenant, a Maxim API key, sent with a provider key for a model.
+type usageKey struct {
+	tenant      string
+	provider    string
+	providerKey string
+	model       string
+}
+
+// UsageAccountant adds up the token usage and the cost of the proxied requests.
+type UsageAccountant struct {
+	pricing  *Pricing
+	accounts maxim.AccountSource
+	mu       sync.Mutex
+	since    time.Time
+	totals   map[usageKey]*UsageTotals
+}
+
+// NewUsageAccountant creates an accountant pricing the usage with pricing, the usage of the Maxim
+// API keys without an account in accounts is not accounted.
+func NewUsageAccountant(pricing *Pricing, accounts maxim.AccountSource) *UsageAccountant {
+	return &UsageAccountant{
+		pricing:  pricing,
+		accounts: accounts,
+		since:    time.Now(),
+		totals:   make(map[usageKey]*UsageTotals),
+	}
+}
+
+// Handler accounts the usage of the requests to next, a route of provider.
+func (ua *UsageAccountant) Handler(provider string, next fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenant, err := GetMaximApiKey(c.GetReqHeaders())
+		if err != nil {
+			return next(c)
+		}
+		// Keys without an account are turned down by the providers, they are not accounted so
+		// that the tenants are bounded by the accounts
+		if _, err := ua.accounts.GetAccount(tenant); err != nil {
+			return next(c)
+		}
+		model, _ := getModalFromBody(c.Body())
+		prices := ua.pricing.priceTable()
+		var once sync.Once
+		account := func(report usageReport) {
+			once.Do(func() { ua.record(tenant, provider, model, prices, report) })
+		}
+		observeUsage(c, account)
+		err = next(c)
+		notifyUsage(c, account)
+		return err
+	}
+}
+
+// record accounts the response to a request of tenant for model on a route of provider, priced
+// with prices, to the provider and the model which served it, the models without a price to
+// otherModel.
+func (ua *UsageAccountant) record(tenant string, provider string, model string, prices PriceTable, report usageReport) {
+	provider, model = report.served(provider, model)
+	key := usageKey{tenant: tenant, provider: provider, providerKey: report.providerKey, model: prices.label(model)}
+
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	totals, ok := ua.totals[key]
+	if !ok {
+		totals = &UsageTotals{}
+		ua.totals[key] = totals
+	}
+	totals.Requests++
+	switch {
+	case report.status != fiber.StatusOK:
+		totals.Errors++
+	case !report.ok:
+		totals.RequestsWithoutUsage++
+	default:
+		totals.PromptTokens += uint64(report.usage.PromptTokens)
+		totals.CompletionTokens += uint64(report.usage.CompletionTokens)
+		totals.CachedTokens += uint64(report.usage.CachedTokens)
+		totals.Cost += prices.cost(model, report.usage)
+	}
+}
+
+// Usage returns the usage accounted so far, grouped by the fields of groupBy, all of them when
+// it is empty.
+func (ua *UsageAccountant) Usage(groupBy []string) (UsageReport, error) {
+	grouped := make(map[string]bool, len(groupBy))
+	for _, group := range groupBy {
+		if !slices.Contains(usageGroups, group) {
+			return UsageReport{}, fmt.Errorf("can not group usage by %q, expected %s", group, strings.Join(usageGroups, ", "))
+		}
+		grouped[group] = true
+	}
+	if len(grouped) == 0 {
+		for _, group := range usageGroups {
+			grouped[group] = true
+		}
+	}
+
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	report := UsageReport{Since: ua.since, Usage: []UsageEntry{}}
+	entries := make(map[UsageEntry]UsageTotals)
+	for key, totals := range ua.totals {
+		var entry UsageEntry
+		if grouped["tenant"] {
+			entry.Tenant = maskKey(key.tenant)
+		}
+		if grouped["provider"] {
+			entry.Provider = key.provider
+		}
+		if grouped["providerKey"] && key.providerKey != "" {
+			entry.ProviderKey = maskKey(key.providerKey)
+		}
+		if grouped["model"] {
+			entry.Model = key.model
+		}
+		entries[entry] = entries[entry].add(*totals)
+		report.Total = report.Total.add(*totals)
+	}
+	for entry, totals := range entries {
+		entry.UsageTotals = totals
+		report.Usage = append(report.Usage, entry)
+	}
+	sort.Slice(report.Usage, func(i, j int) bool {
+		a, b := report.Usage[i], report.Usage[j]
+		return a.Tenant+"\x00"+a.Provider+"\x00"+a.ProviderKey+"\x00"+a.Model <
+			b.Tenant+"\x00"+b.Provider+"\x00"+b.ProviderKey+"\x00"+b.Model
+	})
+	return report, nil
+}
+
+func (ut UsageTotals) add(other UsageTotals) UsageTotals {
+	ut.Requests += other.Requests
+	ut.Errors += other.Errors
+	ut.RequestsWithoutUsage += other.RequestsWithoutUsage
+	ut.PromptTokens += other.PromptTokens
+	ut.CompletionTokens += other.CompletionTokens
+	ut.CachedTokens += other.CachedTokens
+	ut.Cost += other.Cost
+	return ut
+}
+
+// UsageHandler serves the usage accounted by accountant, grouped by the comma separated fields
+// of the groupBy query parameter.
+func UsageHandler(accountant *UsageAccountant) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var groupBy []string
+		for _, group := range strings.Split(c.Query("groupBy"), ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groupBy = append(groupBy, group)
+			}
+		}
+		report, err := accountant.Usage(groupBy)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		return c.JSON(report)
+	}
+}
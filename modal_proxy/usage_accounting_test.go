@@ -0,0 +1,174 @@
+package modal_proxy
+
+import (
+	"bifrost/maxim"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupAccountedApp routes the chat and messages APIs behind accountant.
+func setupAccountedApp(accountant *UsageAccountant, config FallbackConfig) *fiber.App {
+	mockMaximAccount(fallbackAccounts())
+	app, _ := setupWrappedApp(config, RetryPolicy{}, func(_ string, provider string, next fiber.Handler) fiber.Handler {
+		return accountant.Handler(provider, next)
+	})
+	app.Get("/admin/usage", UsageHandler(accountant))
+	return app
+}
+
+func getUsage(t *testing.T, app *fiber.App, query string) UsageReport {
+	resp, _ := app.Test(httptest.NewRequest(http.MethodGet, "/admin/usage"+query, nil))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	var report UsageReport
+	assert.NoError(t, json.Unmarshal(body, &report))
+	return report
+}
+
+func TestParsePriceTable(t *testing.T) {
+	prices, err := ParsePriceTable("gpt-4o=input:5,output:15 ; my-finetune=input:3,cached_input:1,output:12", DefaultPriceTable)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ModelPrice{Input: 5, Output: 15}, prices["gpt-4o"])
+	assert.Equal(t, ModelPrice{Input: 3, CachedInput: 1, Output: 12}, prices["my-finetune"])
+	assert.Equal(t, DefaultPriceTable["claude-3-5-sonnet"], prices["claude-3-5-sonnet"])
+	assert.Equal(t, ModelPrice{Input: 2.5, CachedInput: 1.25, Output: 10}, DefaultPriceTable["gpt-4o"])
+
+	for _, spec := range []string{"input:5", "gpt-4o=input", "gpt-4o=prompt:5", "gpt-4o=input:free", "gpt-4o=output:-1"} {
+		_, err := ParsePriceTable(spec, nil)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestModelPrice(t *testing.T) {
+	price, ok := DefaultPriceTable.price("gpt-4o-mini-2024-07-18")
+	assert.True(t, ok)
+	assert.Equal(t, DefaultPriceTable["gpt-4o-mini"], price)
+	price, ok = DefaultPriceTable.price("claude-3-5-sonnet-20241022")
+	assert.True(t, ok)
+	assert.Equal(t, DefaultPriceTable["claude-3-5-sonnet"], price)
+	// Models are not priced as the models their name starts with
+	for _, model := range []string{"llama-3", "gpt-4.1", "gpt-4.1-mini", "gpt-4.5-preview", "o1-pro", "gpt-4o-audio-preview"} {
+		_, ok = DefaultPriceTable.price(model)
+		assert.False(t, ok, model)
+		assert.Equal(t, otherModel, DefaultPriceTable.label(model), model)
+	}
+
+	// Cached tokens are charged at the cached input price, or the input price when it is not set
+	usage := tokenUsage{PromptTokens: 1_000_000, CompletionTokens: 100_000, CachedTokens: 400_000}
+	assert.InDelta(t, 0.6*2.5+0.4*1.25+0.1*10, ModelPrice{Input: 2.5, CachedInput: 1.25, Output: 10}.cost(usage), 1e-9)
+	assert.InDelta(t, 1*2.5+0.1*10, ModelPrice{Input: 2.5, Output: 10}.cost(usage), 1e-9)
+}
+
+func TestUsageAccounting(t *testing.T) {
+	accountant := NewUsageAccountant(NewPricing(DefaultPriceTable), testAccountSource)
+	app := setupAccountedApp(accountant, FallbackConfig{})
+	mockHostClient(map[string]hostResponse{
+		openAIHost:    {StatusCode: http.StatusOK, Body: openAIResponse},
+		anthropicHost: {StatusCode: http.StatusOK, Body: anthropicResponseBody},
+	})
+
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	postJSON(app, "/v1/messages", `{"model":"claude-3-5-sonnet","max_tokens":100,"messages":[]}`)
+	mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIStream, ContentType: "text/event-stream"}})
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[]}`)
+	mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusBadRequest}})
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	report := getUsage(t, app, "")
+	assert.Equal(t, []UsageEntry{
+		{Tenant: "max...-key", Provider: ProviderAnthropic, ProviderKey: "ant...-key", Model: "claude-3-5-sonnet",
+			UsageTotals: UsageTotals{Requests: 1, PromptTokens: 5, CompletionTokens: 4, Cost: (5*3 + 4*15) / 1e6}},
+		{Tenant: "max...-key", Provider: ProviderOpenAI, ProviderKey: "ope...-key", Model: "gpt-4o",
+			UsageTotals: UsageTotals{Requests: 4, Errors: 1, PromptTokens: 16, CompletionTokens: 17, Cost: (16*2.5 + 17*10) / 1e6}},
+	}, report.Usage)
+	assert.Equal(t, uint64(5), report.Total.Requests)
+	assert.InDelta(t, (5*3+4*15+16*2.5+17*10)/1e6, report.Total.Cost, 1e-12)
+
+	report = getUsage(t, app, "?groupBy=tenant")
+	assert.Len(t, report.Usage, 1)
+	assert.Equal(t, "max...-key", report.Usage[0].Tenant)
+	assert.Empty(t, report.Usage[0].Model)
+	assert.Equal(t, report.Total, report.Usage[0].UsageTotals)
+
+	resp, _ := app.Test(httptest.NewRequest(http.MethodGet, "/admin/usage?groupBy=team", nil))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestUsageAccountedToFallback(t *testing.T) {
+	accountant := NewUsageAccountant(NewPricing(DefaultPriceTable), testAccountSource)
+	app := setupAccountedApp(accountant, fallbackConfig())
+	mockHostClient(map[string]hostResponse{
+		openAIHost: {StatusCode: http.StatusServiceUnavailable},
+		azureHost:  {StatusCode: http.StatusOK, Body: openAIResponse},
+	})
+
+	postJSON(app, "/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+
+	report := getUsage(t, app, "?groupBy=provider,providerKey,model")
+	assert.Len(t, report.Usage, 1)
+	assert.Equal(t, UsageEntry{Provider: ProviderAzure, ProviderKey: "azu...ey-1", Model: "gpt-4o",
+		UsageTotals: UsageTotals{Requests: 1, PromptTokens: 3, CompletionTokens: 1, Cost: (3*2.5 + 1*10) / 1e6}}, report.Usage[0])
+}
+
+func TestUsageOfUnknownKeysAndModels(t *testing.T) {
+	accountant := NewUsageAccountant(NewPricing(DefaultPriceTable), testAccountSource)
+	app := setupAccountedApp(accountant, FallbackConfig{})
+	accounts := fallbackAccounts()
+	mockedAccount = func(maximApiKey string) (maxim.AccountsResponse, error) {
+		if maximApiKey != "maxim-api-key" {
+			return maxim.AccountsResponse{}, errors.New("account not found")
+		}
+		return maxim.AccountsResponse{Data: accounts}, nil
+	}
+	mockHostClient(map[string]hostResponse{anthropicHost: {StatusCode: http.StatusOK, Body: anthropicResponseBody}})
+
+	for _, maximApiKey := range []string{"unknown-key-1", "unknown-key-2"} {
+		req := newCompletionRequest(`{"model":"claude-3-5-sonnet","max_tokens":100,"messages":[]}`)
+		req.URL.Path, req.RequestURI = "/v1/messages", "/v1/messages"
+		req.Header.Set("x-maxim-api-key", maximApiKey)
+		app.Test(req, -1)
+	}
+	postJSON(app, "/v1/messages", `{"model":"claude-3-5-sonnet-20241022","max_tokens":100,"messages":[]}`)
+	postJSON(app, "/v1/messages", `{"model":"claude-2.1","max_tokens":100,"messages":[]}`)
+	postJSON(app, "/v1/messages", `{"model":"claude-instant-1.2","max_tokens":100,"messages":[]}`)
+
+	report := getUsage(t, app, "?groupBy=tenant,model")
+	assert.Equal(t, []UsageEntry{
+		{Tenant: "max...-key", Model: "claude-3-5-sonnet",
+			UsageTotals: UsageTotals{Requests: 1, PromptTokens: 5, CompletionTokens: 4, Cost: (5*3 + 4*15) / 1e6}},
+		{Tenant: "max...-key", Model: otherModel,
+			UsageTotals: UsageTotals{Requests: 2, PromptTokens: 10, CompletionTokens: 8}},
+	}, report.Usage)
+}
+
+func TestPricingSetPrices(t *testing.T) {
+	pricing := NewPricing(PriceTable{"gpt-4o": {Input: 1, Output: 1}})
+	accountant := NewUsageAccountant(pricing, testAccountSource)
+	router := NewFallbackRouter(map[string]ModalProviderInterface{
+		ProviderOpenAI: NewOpenAIProvider("https://"+openAIHost, testAccountSource),
+	}, FallbackConfig{})
+	proxy := router.Handler(ProviderOpenAI, "/v1/chat/completions", RetryPolicy{})
+	app := setupRetryApp(FallbackConfig{}, RetryPolicy{})
+	// The prices change while the first request is in flight
+	app.Post("/repriced/v1/chat/completions", accountant.Handler(ProviderOpenAI, func(c *fiber.Ctx) error {
+		pricing.SetPrices(PriceTable{"gpt-4o": {Input: 2, Output: 2}})
+		return proxy(c)
+	}))
+	app.Post("/accounted/v1/chat/completions", accountant.Handler(ProviderOpenAI, proxy))
+	app.Get("/admin/usage", UsageHandler(accountant))
+	mockHostClient(map[string]hostResponse{openAIHost: {StatusCode: http.StatusOK, Body: openAIResponse}})
+
+	postJSON(app, "/repriced/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	assert.InDelta(t, (3+1)/1e6, getUsage(t, app, "").Total.Cost, 1e-12)
+	postJSON(app, "/accounted/v1/chat/completions", `{"model":"gpt-4o","messages":[]}`)
+	assert.InDelta(t, (3+1)/1e6+(3+1)*2/1e6, getUsage(t, app, "").Total.Cost, 1e-12)
+}
@@ -0,0 +1,43 @@
+package modal_proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadUsage(t *testing.T) {
+	usage, ok := readUsage([]byte(openAIResponse))
+	assert.True(t, ok)
+	assert.Equal(t, tokenUsage{PromptTokens: 3, CompletionTokens: 1}, usage)
+
+	usage, ok = readUsage([]byte(anthropicResponseBody))
+	assert.True(t, ok)
+	assert.Equal(t, tokenUsage{PromptTokens: 5, CompletionTokens: 4}, usage)
+
+	// Cached tokens are part of the prompt tokens of OpenAI, on top of the input tokens of Anthropic
+	usage, _ = readUsage([]byte(`{"usage":{"prompt_tokens":2000,"completion_tokens":10,"prompt_tokens_details":{"cached_tokens":1536}}}`))
+	assert.Equal(t, tokenUsage{PromptTokens: 2000, CompletionTokens: 10, CachedTokens: 1536}, usage)
+	usage, _ = readUsage([]byte(`{"usage":{"input_tokens":20,"cache_creation_input_tokens":100,"cache_read_input_tokens":1800,"output_tokens":10}}`))
+	assert.Equal(t, tokenUsage{PromptTokens: 1920, CompletionTokens: 10, CachedTokens: 1800}, usage)
+
+	_, ok = readUsage([]byte(`{"error":{"message":"invalid"}}`))
+	assert.False(t, ok)
+}
+
+func TestStreamUsage(t *testing.T) {
+	var openAI streamUsage
+	for _, line := range strings.Split(openAIStream, "\n") {
+		openAI.addLine(line)
+	}
+	assert.True(t, openAI.report.ok)
+	assert.Equal(t, tokenUsage{PromptTokens: 10, CompletionTokens: 15}, openAI.report.usage)
+
+	var anthropic streamUsage
+	anthropic.add(`{"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":25,"output_tokens":1}}}`)
+	anthropic.add(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`)
+	anthropic.add(`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":15}}`)
+	assert.True(t, anthropic.report.ok)
+	assert.Equal(t, tokenUsage{PromptTokens: 25, CompletionTokens: 15}, anthropic.report.usage)
+}
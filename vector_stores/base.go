@@ -5,3 +5,22 @@ type VectorStoreInterface interface {
 	Add(embedding []float64, options map[string]interface{}) string
 	Search(embedding []float64, topN int, includeDistances bool, options map[string]interface{}) ([]string, []float64)
 }
+
+// DocumentStoreInterface is a vector store keeping a document with each embedding, so what an
+// embedding stands for is available to every process using the store.
+type DocumentStoreInterface interface {
+	VectorStoreInterface
+	// AddDocument stores embedding along with document, the options are used as in Add
+	AddDocument(embedding []float64, document string, options map[string]interface{}) string
+	// SearchDocuments returns the topN entries closest to embedding which match options, closest first
+	SearchDocuments(embedding []float64, topN int, options map[string]interface{}) []SearchResult
+	// DeleteDocument removes the entry id which was added with options
+	DeleteDocument(id string, options map[string]interface{}) bool
+}
+
+// SearchResult is an entry found by SearchDocuments.
+type SearchResult struct {
+	ID       string
+	Distance float64
+	Document string
+}
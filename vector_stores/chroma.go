@@ -0,0 +1,348 @@
+package vector_stores
+
+import (
+	"bifrost/utils"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	chromago "github.com/amikos-tech/chroma-go"
+	openapi "github.com/amikos-tech/chroma-go/swagger"
+	"github.com/amikos-tech/chroma-go/types"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// namespaceMetadataKey is the collection metadata holding the namespace the collection was created for.
+const namespaceMetadataKey = "bifrost:namespace"
+
+// ChromaConfig configures the Chroma vector store.
+type ChromaConfig struct {
+	// BaseUrl is the Chroma server, e.g. http://localhost:8000
+	BaseUrl string
+	// CollectionPrefix prefixes the name of every collection created by the store
+	CollectionPrefix string
+	// NamespaceKeys are the options which pick the collection of an embedding, the other
+	// options are stored as the metadata of the embedding
+	NamespaceKeys []string
+	// Metric is the distance of the collections created by the store
+	Metric DistanceMetric
+	// Timeout bounds each call to Chroma
+	Timeout time.Duration
+}
+
+// DefaultChromaConfig is used for the zero fields of the Chroma config.
+var DefaultChromaConfig = ChromaConfig{
+	BaseUrl:          "http://localhost:8000",
+	CollectionPrefix: "bifrost",
+	NamespaceKeys:    []string{"tenant", "model"},
+	Metric:           Cosine,
+	Timeout:          5 * time.Second,
+}
+
+// ChromaVectorStore implements DocumentStoreInterface on a Chroma server, with a collection per
+// namespace so the entries survive restarts and are shared between replicas.
+type ChromaVectorStore struct {
+	client      *chromago.Client
+	config      ChromaConfig
+	mu          sync.Mutex
+	collections map[string]*chromago.Collection
+}
+
+// precomputedEmbeddings is the embedding function of the collections, the store always sends
+// the embeddings so Chroma never has to compute one.
+type precomputedEmbeddings struct{}
+
+func (pe precomputedEmbeddings) EmbedDocuments(_ context.Context, texts []string) ([]*types.Embedding, error) {
+	if len(texts) > 0 {
+		return nil, errors.New("the Chroma vector store only accepts precomputed embeddings")
+	}
+	return nil, nil
+}
+
+func (pe precomputedEmbeddings) EmbedQuery(_ context.Context, _ string) (*types.Embedding, error) {
+	return nil, errors.New("the Chroma vector store only accepts precomputed embeddings")
+}
+
+func (pe precomputedEmbeddings) EmbedRecords(_ context.Context, _ []*types.Record, _ bool) error {
+	return errors.New("the Chroma vector store only accepts precomputed embeddings")
+}
+
+// NewChromaVectorStore connects to Chroma and loads the collections previously created by the store.
+func NewChromaVectorStore(ctx context.Context, config ChromaConfig) (*ChromaVectorStore, error) {
+	if config.BaseUrl == "" {
+		config.BaseUrl = DefaultChromaConfig.BaseUrl
+	}
+	if config.CollectionPrefix == "" {
+		config.CollectionPrefix = DefaultChromaConfig.CollectionPrefix
+	}
+	if config.NamespaceKeys == nil {
+		config.NamespaceKeys = DefaultChromaConfig.NamespaceKeys
+	}
+	if config.Metric == "" {
+		config.Metric = DefaultChromaConfig.Metric
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultChromaConfig.Timeout
+	}
+	client, err := chromago.NewClient(strings.TrimSuffix(config.BaseUrl, "/"))
+	if err != nil {
+		return nil, err
+	}
+	cs := &ChromaVectorStore{
+		client:      client,
+		config:      config,
+		collections: make(map[string]*chromago.Collection),
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+	collections, err := client.ListCollections(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing Chroma collections: %w", err)
+	}
+	for _, collection := range collections {
+		if strings.HasPrefix(collection.Name, config.CollectionPrefix+"-") {
+			cs.collections[collection.Name] = chromago.NewCollection(client.ApiClient, collection.ID, collection.Name,
+				&collection.Metadata, precomputedEmbeddings{}, collection.Tenant, collection.Database)
+		}
+	}
+	return cs, nil
+}
+
+// Add stores embedding in the collection of its namespace, the other options are stored as its
+// metadata. It returns an empty ID when the embedding could not be stored.
+func (cs *ChromaVectorStore) Add(embedding []float64, options map[string]interface{}) string {
+	return cs.add(embedding, nil, options)
+}
+
+// AddDocument stores embedding and document in the collection of its namespace, as Add does.
+func (cs *ChromaVectorStore) AddDocument(embedding []float64, document string, options map[string]interface{}) string {
+	return cs.add(embedding, []string{document}, options)
+}
+
+func (cs *ChromaVectorStore) add(embedding []float64, documents []string, options map[string]interface{}) string {
+	namespace, metadata := cs.splitOptions(options)
+	ctx, cancel := context.WithTimeout(context.Background(), cs.config.Timeout)
+	defer cancel()
+	collection, err := cs.getCollection(ctx, namespace, true)
+	if err != nil {
+		fmt.Printf("Error getting Chroma collection: %v\n", err)
+		return ""
+	}
+	id := utils.GetQueryIndex(nil)
+	var metadatas []map[string]interface{}
+	if len(metadata) > 0 {
+		metadatas = []map[string]interface{}{metadata}
+	}
+	// Collection.Add insists on documents along with metadatas, call the API directly instead
+	_, _, err = collection.ApiClient.DefaultApi.Add(ctx, collection.ID).AddEmbedding(openapi.AddEmbedding{
+		Embeddings: []openapi.EmbeddingsInner{types.NewEmbeddingFromFloat32(toFloat32(embedding)).ToAPI()},
+		Metadatas:  metadatas,
+		Documents:  documents,
+		Ids:        []string{id},
+	}).Execute()
+	if err != nil {
+		fmt.Printf("Error adding embedding to Chroma: %v\n", err)
+		return ""
+	}
+	return id
+}
+
+// Search returns the IDs of the topN entries of the namespace closest to embedding, whose
+// metadata has all the other values of options.
+func (cs *ChromaVectorStore) Search(embedding []float64, topN int, includeDistances bool, options map[string]interface{}) ([]string, []float64) {
+	result := cs.query(embedding, topN, options, types.IDistances)
+	if result == nil || len(result.Ids) == 0 {
+		return nil, nil
+	}
+	ids := result.Ids[0]
+	if !includeDistances {
+		return ids, nil
+	}
+	var distances []float64
+	if len(result.Distances) > 0 {
+		for _, distance := range result.Distances[0] {
+			distances = append(distances, float64(distance))
+		}
+	}
+	return ids, distances
+}
+
+// SearchDocuments returns the topN entries of the namespace closest to embedding along with
+// their documents, as Search does.
+func (cs *ChromaVectorStore) SearchDocuments(embedding []float64, topN int, options map[string]interface{}) []SearchResult {
+	result := cs.query(embedding, topN, options, types.IDistances, types.IDocuments)
+	if result == nil || len(result.Ids) == 0 || len(result.Distances) == 0 {
+		return nil
+	}
+	results := make([]SearchResult, 0, len(result.Ids[0]))
+	for i, id := range result.Ids[0] {
+		if i >= len(result.Distances[0]) {
+			break
+		}
+		searchResult := SearchResult{ID: id, Distance: float64(result.Distances[0][i])}
+		if len(result.Documents) > 0 && i < len(result.Documents[0]) {
+			searchResult.Document = result.Documents[0][i]
+		}
+		results = append(results, searchResult)
+	}
+	return results
+}
+
+// query searches the collection of the namespace of options, nil when it has no collection
+// or the query failed.
+func (cs *ChromaVectorStore) query(embedding []float64, topN int, options map[string]interface{}, include ...types.QueryEnum) *chromago.QueryResults {
+	namespace, filter := cs.splitOptions(options)
+	ctx, cancel := context.WithTimeout(context.Background(), cs.config.Timeout)
+	defer cancel()
+	collection, err := cs.getCollection(ctx, namespace, false)
+	if err != nil || collection == nil {
+		return nil
+	}
+	result, err := collection.QueryWithOptions(ctx,
+		types.WithQueryEmbedding(types.NewEmbeddingFromFloat32(toFloat32(embedding))),
+		types.WithNResults(int32(topN)),
+		types.WithWhereMap(whereFilter(filter)),
+		types.WithInclude(include...),
+	)
+	if err != nil {
+		fmt.Printf("Error searching Chroma: %v\n", err)
+		return nil
+	}
+	return result
+}
+
+// Delete removes the entry with id from the collections known to the store.
+func (cs *ChromaVectorStore) Delete(id string) bool {
+	cs.mu.Lock()
+	collections := make([]*chromago.Collection, 0, len(cs.collections))
+	for _, collection := range cs.collections {
+		collections = append(collections, collection)
+	}
+	cs.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cs.config.Timeout)
+	defer cancel()
+	deleted := false
+	for _, collection := range collections {
+		ids, err := collection.Delete(ctx, []string{id}, nil, nil)
+		if err != nil {
+			fmt.Printf("Error deleting embedding from Chroma: %v\n", err)
+			continue
+		}
+		deleted = deleted || len(ids) > 0
+	}
+	return deleted
+}
+
+// DeleteDocument removes the entry id from the collection of the namespace of options.
+func (cs *ChromaVectorStore) DeleteDocument(id string, options map[string]interface{}) bool {
+	namespace, _ := cs.splitOptions(options)
+	ctx, cancel := context.WithTimeout(context.Background(), cs.config.Timeout)
+	defer cancel()
+	collection, err := cs.getCollection(ctx, namespace, false)
+	if err != nil || collection == nil {
+		return false
+	}
+	ids, err := collection.Delete(ctx, []string{id}, nil, nil)
+	if err != nil {
+		fmt.Printf("Error deleting embedding from Chroma: %v\n", err)
+		return false
+	}
+	return len(ids) > 0
+}
+
+// splitOptions separates the namespace options from the metadata options.
+func (cs *ChromaVectorStore) splitOptions(options map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	namespace := make(map[string]interface{})
+	metadata := make(map[string]interface{})
+	for key, value := range options {
+		if utils.AnyMatch(cs.config.NamespaceKeys, func(namespaceKey string) bool { return namespaceKey == key }) {
+			namespace[key] = value
+		} else {
+			metadata[key] = chromaMetadataValue(value)
+		}
+	}
+	return namespace, metadata
+}
+
+// collectionName derives a valid Chroma collection name from the namespace.
+func (cs *ChromaVectorStore) collectionName(namespace map[string]interface{}) (string, string) {
+	keys := make([]string, 0, len(namespace))
+	for key := range namespace {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s=%v", key, namespace[key])
+	}
+	description := strings.Join(parts, ",")
+	hash := sha256.Sum256([]byte(description))
+	return cs.config.CollectionPrefix + "-" + hex.EncodeToString(hash[:12]), description
+}
+
+// getCollection returns the collection of the namespace, creating it when create is set. A
+// collection created by another replica is picked up as well.
+func (cs *ChromaVectorStore) getCollection(ctx context.Context, namespace map[string]interface{}, create bool) (*chromago.Collection, error) {
+	name, description := cs.collectionName(namespace)
+	cs.mu.Lock()
+	collection, ok := cs.collections[name]
+	cs.mu.Unlock()
+	if ok {
+		return collection, nil
+	}
+	collection, err := cs.client.GetCollection(ctx, name, precomputedEmbeddings{})
+	if err != nil {
+		if !create {
+			return nil, nil
+		}
+		metadata := map[string]interface{}{namespaceMetadataKey: description}
+		collection, err = cs.client.CreateCollection(ctx, name, metadata, true, precomputedEmbeddings{}, types.DistanceFunction(cs.config.Metric))
+		if err != nil {
+			return nil, err
+		}
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.collections[name] = collection
+	return collection, nil
+}
+
+// whereFilter turns equality filters into a Chroma where clause.
+func whereFilter(filter map[string]interface{}) map[string]interface{} {
+	if len(filter) <= 1 {
+		return filter
+	}
+	keys := make([]string, 0, len(filter))
+	for key := range filter {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	clauses := make([]interface{}, len(keys))
+	for i, key := range keys {
+		clauses[i] = map[string]interface{}{key: map[string]interface{}{"$eq": filter[key]}}
+	}
+	return map[string]interface{}{"$and": clauses}
+}
+
+// chromaMetadataValue converts a value to one of the types Chroma metadata supports.
+func chromaMetadataValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, bool, int, int32, int64, float32, float64:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func toFloat32(embedding []float64) []float32 {
+	converted := make([]float32, len(embedding))
+	for i, value := range embedding {
+		converted[i] = float32(value)
+	}
+	return converted
+}
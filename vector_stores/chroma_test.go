@@ -0,0 +1,334 @@
+package vector_stores
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// fakeChroma mimics the parts of the Chroma v1 API used by the store.
+type fakeChroma struct {
+	mu          sync.Mutex
+	collections map[string]*fakeCollection
+	creations   int
+}
+
+type fakeCollection struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	Tenant    string                 `json:"tenant"`
+	Database  string                 `json:"database"`
+	ids       []string
+	vectors   [][]float64
+	metadatas []map[string]interface{}
+	documents []string
+}
+
+func newFakeChroma() *fakeChroma {
+	return &fakeChroma{collections: make(map[string]*fakeCollection)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (fc *fakeChroma) collectionById(id string) *fakeCollection {
+	for _, collection := range fc.collections {
+		if collection.ID == id {
+			return collection
+		}
+	}
+	return nil
+}
+
+func (fc *fakeChroma) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`"0.5.0"`))
+	})
+	mux.HandleFunc("GET /api/v1/tenants/{tenant}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"name": r.PathValue("tenant")})
+	})
+	mux.HandleFunc("GET /api/v1/databases/{database}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"id": "db", "name": r.PathValue("database"), "tenant": r.URL.Query().Get("tenant")})
+	})
+	mux.HandleFunc("GET /api/v1/pre-flight-checks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"max_batch_size": 100})
+	})
+	mux.HandleFunc("GET /api/v1/collections", func(w http.ResponseWriter, r *http.Request) {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		collections := make([]*fakeCollection, 0, len(fc.collections))
+		for _, collection := range fc.collections {
+			collections = append(collections, collection)
+		}
+		writeJSON(w, http.StatusOK, collections)
+	})
+	mux.HandleFunc("GET /api/v1/collections/{name}", func(w http.ResponseWriter, r *http.Request) {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		collection, ok := fc.collections[r.PathValue("name")]
+		if !ok {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "ValueError('Collection does not exist.')"})
+			return
+		}
+		writeJSON(w, http.StatusOK, collection)
+	})
+	mux.HandleFunc("POST /api/v1/collections", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Name     string                 `json:"name"`
+			Metadata map[string]interface{} `json:"metadata"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		collection, ok := fc.collections[request.Name]
+		if !ok {
+			fc.creations++
+			collection = &fakeCollection{ID: fmt.Sprintf("id-%d", fc.creations), Name: request.Name, Metadata: request.Metadata}
+			fc.collections[request.Name] = collection
+		}
+		writeJSON(w, http.StatusOK, collection)
+	})
+	mux.HandleFunc("POST /api/v1/collections/{id}/add", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Embeddings [][]float64              `json:"embeddings"`
+			Metadatas  []map[string]interface{} `json:"metadatas"`
+			Documents  []string                 `json:"documents"`
+			Ids        []string                 `json:"ids"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		collection := fc.collectionById(r.PathValue("id"))
+		for i, id := range request.Ids {
+			collection.ids = append(collection.ids, id)
+			collection.vectors = append(collection.vectors, request.Embeddings[i])
+			var metadata map[string]interface{}
+			if request.Metadatas != nil {
+				metadata = request.Metadatas[i]
+			}
+			collection.metadatas = append(collection.metadatas, metadata)
+			var document string
+			if request.Documents != nil {
+				document = request.Documents[i]
+			}
+			collection.documents = append(collection.documents, document)
+		}
+		writeJSON(w, http.StatusCreated, true)
+	})
+	mux.HandleFunc("POST /api/v1/collections/{id}/query", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Where           map[string]interface{} `json:"where"`
+			QueryEmbeddings [][]float64            `json:"query_embeddings"`
+			NResults        int                    `json:"n_results"`
+			Include         []string               `json:"include"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		collection := fc.collectionById(r.PathValue("id"))
+		metric := DistanceMetric(collection.Metadata["hnsw:space"].(string))
+		type match struct {
+			id       string
+			distance float64
+			document string
+		}
+		var matches []match
+		for i, vector := range collection.vectors {
+			if matchesWhere(collection.metadatas[i], request.Where) {
+				matches = append(matches, match{collection.ids[i], metric.Distance(request.QueryEmbeddings[0], vector), collection.documents[i]})
+			}
+		}
+		sort.Slice(matches, func(i, j int) bool { return matches[i].distance < matches[j].distance })
+		if len(matches) > request.NResults {
+			matches = matches[:request.NResults]
+		}
+		ids, distances, documents := []string{}, []float64{}, []string{}
+		for _, m := range matches {
+			ids = append(ids, m.id)
+			distances = append(distances, m.distance)
+			documents = append(documents, m.document)
+		}
+		result := map[string]interface{}{"ids": [][]string{ids}, "distances": [][]float64{distances}}
+		for _, include := range request.Include {
+			if include == "documents" {
+				result["documents"] = [][]string{documents}
+			}
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+	mux.HandleFunc("POST /api/v1/collections/{id}/delete", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Ids []string `json:"ids"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		collection := fc.collectionById(r.PathValue("id"))
+		deleted := []string{}
+		for i := len(collection.ids) - 1; i >= 0; i-- {
+			if collection.ids[i] == request.Ids[0] {
+				deleted = append(deleted, collection.ids[i])
+				collection.ids = append(collection.ids[:i], collection.ids[i+1:]...)
+				collection.vectors = append(collection.vectors[:i], collection.vectors[i+1:]...)
+				collection.metadatas = append(collection.metadatas[:i], collection.metadatas[i+1:]...)
+			}
+		}
+		writeJSON(w, http.StatusOK, deleted)
+	})
+	return mux
+}
+
+// matchesWhere evaluates the {key: value}, {key: {"$eq": value}} and {"$and": [...]} clauses.
+func matchesWhere(metadata, where map[string]interface{}) bool {
+	for key, condition := range where {
+		if key == "$and" {
+			for _, clause := range condition.([]interface{}) {
+				if !matchesWhere(metadata, clause.(map[string]interface{})) {
+					return false
+				}
+			}
+			continue
+		}
+		if operator, ok := condition.(map[string]interface{}); ok {
+			condition = operator["$eq"]
+		}
+		if metadata[key] != condition {
+			return false
+		}
+	}
+	return true
+}
+
+func newTestChromaStore(t *testing.T, fake *fakeChroma) *ChromaVectorStore {
+	t.Helper()
+	server := httptest.NewServer(fake.handler())
+	t.Cleanup(server.Close)
+	store, err := NewChromaVectorStore(context.Background(), ChromaConfig{BaseUrl: server.URL, Metric: L2})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	return store
+}
+
+func TestChromaVectorStoreAddSearch(t *testing.T) {
+	fake := newFakeChroma()
+	store := newTestChromaStore(t, fake)
+
+	scope := map[string]interface{}{"tenant": "a", "model": "gpt-4o", "route": "/v1/chat/completions"}
+	near := store.Add([]float64{1, 1}, scope)
+	far := store.Add([]float64{5, 5}, scope)
+	store.Add([]float64{1, 1}, map[string]interface{}{"tenant": "b", "model": "gpt-4o", "route": "/v1/chat/completions"})
+	if near == "" || far == "" {
+		t.Fatal("expected the embeddings to be added")
+	}
+	if len(fake.collections) != 2 {
+		t.Errorf("expected a collection per namespace, got %d", len(fake.collections))
+	}
+
+	ids, distances := store.Search([]float64{1, 2}, 5, true, scope)
+	if len(ids) != 2 || ids[0] != near || ids[1] != far {
+		t.Fatalf("expected [%s %s], got %v", near, far, ids)
+	}
+	if !almostEqual(distances[0], 1) || !almostEqual(distances[1], 25) {
+		t.Errorf("expected distances [1 25], got %v", distances)
+	}
+
+	// The non namespace options filter on the metadata
+	ids, _ = store.Search([]float64{1, 2}, 5, false, map[string]interface{}{"tenant": "a", "model": "gpt-4o", "route": "/v1/messages"})
+	if len(ids) != 0 {
+		t.Errorf("expected no ids, got %v", ids)
+	}
+
+	// Searching a namespace without a collection does not create one
+	ids, _ = store.Search([]float64{1, 2}, 5, false, map[string]interface{}{"tenant": "c", "model": "gpt-4o"})
+	if len(ids) != 0 || len(fake.collections) != 2 {
+		t.Errorf("expected no ids and no new collection, got %v", ids)
+	}
+}
+
+func TestChromaVectorStoreLoadsCollectionsOnStartup(t *testing.T) {
+	fake := newFakeChroma()
+	server := httptest.NewServer(fake.handler())
+	defer server.Close()
+	config := ChromaConfig{BaseUrl: server.URL}
+
+	store, err := NewChromaVectorStore(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	id := store.Add([]float64{1, 0}, map[string]interface{}{"tenant": "a", "model": "gpt-4o"})
+
+	restarted, err := NewChromaVectorStore(context.Background(), config)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if len(restarted.collections) != 1 {
+		t.Errorf("expected the existing collection to be loaded, got %d", len(restarted.collections))
+	}
+	ids, _ := restarted.Search([]float64{1, 0}, 1, false, map[string]interface{}{"tenant": "a", "model": "gpt-4o"})
+	if len(ids) != 1 || ids[0] != id {
+		t.Errorf("expected [%s], got %v", id, ids)
+	}
+	if fake.creations != 1 {
+		t.Errorf("expected 1 collection to be created, got %d", fake.creations)
+	}
+}
+
+func TestChromaVectorStoreDelete(t *testing.T) {
+	store := newTestChromaStore(t, newFakeChroma())
+	scope := map[string]interface{}{"tenant": "a", "model": "gpt-4o"}
+	id := store.Add([]float64{1, 0}, scope)
+
+	if !store.Delete(id) {
+		t.Error("expected the entry to be deleted")
+	}
+	if ids, _ := store.Search([]float64{1, 0}, 1, false, scope); len(ids) != 0 {
+		t.Errorf("expected no ids, got %v", ids)
+	}
+}
+
+func TestChromaVectorStoreDocuments(t *testing.T) {
+	fake := newFakeChroma()
+	store := newTestChromaStore(t, fake)
+	scope := map[string]interface{}{"tenant": "a", "model": "gpt-4o", "route": "/v1/chat/completions"}
+	id := store.AddDocument([]float64{1, 1}, "completion", scope)
+	store.Add([]float64{2, 2}, scope)
+
+	// Another replica sharing the Chroma server finds the document
+	results := newTestChromaStore(t, fake).SearchDocuments([]float64{1, 1}, 5, scope)
+	if len(results) != 2 || results[0] != (SearchResult{ID: id, Distance: 0, Document: "completion"}) || results[1].Document != "" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+
+	if store.DeleteDocument(id, map[string]interface{}{"tenant": "b", "model": "gpt-4o"}) {
+		t.Error("expected the entry not to be found in another namespace")
+	}
+	if !store.DeleteDocument(id, scope) {
+		t.Error("expected the entry to be deleted")
+	}
+	if results := store.SearchDocuments([]float64{1, 1}, 5, scope); len(results) != 1 {
+		t.Errorf("expected 1 result, got %+v", results)
+	}
+}
+
+func TestWhereFilter(t *testing.T) {
+	if filter := whereFilter(map[string]interface{}{"route": "/v1/messages"}); filter["route"] != "/v1/messages" {
+		t.Errorf("expected a plain equality filter, got %v", filter)
+	}
+	filter := whereFilter(map[string]interface{}{"route": "/v1/messages", "version": 1})
+	clauses, ok := filter["$and"].([]interface{})
+	if !ok || len(clauses) != 2 {
+		t.Errorf("expected an $and filter, got %v", filter)
+	}
+}
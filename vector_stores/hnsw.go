@@ -0,0 +1,489 @@
+package vector_stores
+
+import (
+	"bifrost/utils"
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+)
+
+// HNSWConfig configures the graph of the HNSW vector store.
+type HNSWConfig struct {
+	// M is the number of neighbors of a node on the upper layers, twice as many are kept on layer 0
+	M int
+	// EfConstruction is the size of the candidate list while inserting, higher builds a better graph
+	EfConstruction int
+	// EfSearch is the size of the candidate list while searching, higher trades latency for recall
+	EfSearch int
+	// Metric is how distances are measured
+	Metric DistanceMetric
+	// Seed seeds the level generator, so the same inserts build the same graph
+	Seed int64
+}
+
+// DefaultHNSWConfig is used for the zero fields of the HNSW config.
+var DefaultHNSWConfig = HNSWConfig{
+	M:              16,
+	EfConstruction: 200,
+	EfSearch:       64,
+	Metric:         Cosine,
+	Seed:           1,
+}
+
+// HNSWVectorStore implements DocumentStoreInterface with a Hierarchical Navigable Small World
+// graph, an approximate nearest neighbor index which scales to a large number of entries.
+// Deleted entries are tombstoned, they keep routing searches but are never returned. The graph
+// is rebuilt from the live entries once the tombstones outnumber them.
+type HNSWVectorStore struct {
+	config    HNSWConfig
+	levelMult float64
+
+	mu         sync.RWMutex
+	rng        *rand.Rand
+	nodes      []*hnswNode
+	ids        map[string]int
+	entryPoint int
+	maxLevel   int
+	deleted    int
+	// visited holds the visitedSet of the searches, so they do not allocate one each
+	visited sync.Pool
+}
+
+type hnswNode struct {
+	ID        string
+	Embedding []float64
+	Metadata  map[string]interface{}
+	Document  string
+	Level     int
+	// Neighbors are the indexes of the neighbor nodes on each level
+	Neighbors [][]int
+	Deleted   bool
+}
+
+// hnswSnapshot is the file format of Snapshot and Restore.
+type hnswSnapshot struct {
+	Config     HNSWConfig
+	Nodes      []*hnswNode
+	EntryPoint int
+	MaxLevel   int
+}
+
+func init() {
+	// Metadata values are stored as interface{}, register the types they have after normalization
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// NewHNSWVectorStore creates an empty HNSW vector store.
+func NewHNSWVectorStore(config HNSWConfig) *HNSWVectorStore {
+	if config.M <= 1 {
+		config.M = DefaultHNSWConfig.M
+	}
+	if config.EfConstruction <= 0 {
+		config.EfConstruction = DefaultHNSWConfig.EfConstruction
+	}
+	if config.EfSearch <= 0 {
+		config.EfSearch = DefaultHNSWConfig.EfSearch
+	}
+	if config.Metric == "" {
+		config.Metric = DefaultHNSWConfig.Metric
+	}
+	return &HNSWVectorStore{
+		config:     config,
+		levelMult:  1 / math.Log(float64(config.M)),
+		rng:        rand.New(rand.NewSource(config.Seed)),
+		ids:        make(map[string]int),
+		entryPoint: -1,
+	}
+}
+
+// Add inserts embedding in the graph with options as its metadata and returns the ID of the entry.
+func (hs *HNSWVectorStore) Add(embedding []float64, options map[string]interface{}) string {
+	return hs.AddDocument(embedding, "", options)
+}
+
+// AddDocument inserts embedding in the graph with document and options as its metadata, and
+// returns the ID of the entry.
+func (hs *HNSWVectorStore) AddDocument(embedding []float64, document string, options map[string]interface{}) string {
+	node := &hnswNode{
+		ID:        utils.GetQueryIndex(nil),
+		Embedding: hs.prepare(embedding),
+		Metadata:  normalizeMetadata(options),
+		Document:  document,
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.insert(node)
+	return node.ID
+}
+
+// Search returns the IDs of the topN live entries closest to embedding whose metadata has all
+// the values of options, closest first.
+func (hs *HNSWVectorStore) Search(embedding []float64, topN int, includeDistances bool, options map[string]interface{}) ([]string, []float64) {
+	return splitResults(hs.SearchDocuments(embedding, topN, options), includeDistances)
+}
+
+// SearchDocuments returns the topN live entries closest to embedding whose metadata has all the
+// values of options, closest first.
+func (hs *HNSWVectorStore) SearchDocuments(embedding []float64, topN int, options map[string]interface{}) []SearchResult {
+	query := hs.prepare(embedding)
+	filter := normalizeMetadata(options)
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	if hs.entryPoint < 0 || topN <= 0 || len(query) != len(hs.nodes[hs.entryPoint].Embedding) {
+		return nil
+	}
+	entryPoint := hs.entryPoint
+	for level := hs.maxLevel; level > 0; level-- {
+		entryPoint = hs.searchLayer(query, []int{entryPoint}, 1, level, nil)[0].node
+	}
+	accept := func(index int) bool {
+		node := hs.nodes[index]
+		return !node.Deleted && matchesFilter(node.Metadata, filter)
+	}
+	candidates := hs.searchLayer(query, []int{entryPoint}, max(hs.config.EfSearch, topN), 0, accept)
+	if len(candidates) > topN {
+		candidates = candidates[:topN]
+	}
+	results := make([]SearchResult, len(candidates))
+	for i, candidate := range candidates {
+		node := hs.nodes[candidate.node]
+		results[i] = SearchResult{ID: node.ID, Distance: candidate.distance, Document: node.Document}
+	}
+	return results
+}
+
+// Delete tombstones the entry with id, it reports whether a live entry was deleted.
+func (hs *HNSWVectorStore) Delete(id string) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	index, ok := hs.ids[id]
+	if !ok || hs.nodes[index].Deleted {
+		return false
+	}
+	hs.nodes[index].Deleted = true
+	hs.deleted++
+	if hs.deleted > len(hs.nodes)/2 {
+		hs.compact()
+	}
+	return true
+}
+
+// DeleteDocument tombstones the entry id, the options are not needed to find it.
+func (hs *HNSWVectorStore) DeleteDocument(id string, _ map[string]interface{}) bool {
+	return hs.Delete(id)
+}
+
+// Metadata returns the metadata stored with the live entry id.
+func (hs *HNSWVectorStore) Metadata(id string) (map[string]interface{}, bool) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	index, ok := hs.ids[id]
+	if !ok || hs.nodes[index].Deleted {
+		return nil, false
+	}
+	return hs.nodes[index].Metadata, true
+}
+
+// Len returns the number of live entries in the store.
+func (hs *HNSWVectorStore) Len() int {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	return len(hs.nodes) - hs.deleted
+}
+
+// Snapshot writes the graph to path, the file is replaced atomically.
+func (hs *HNSWVectorStore) Snapshot(path string) error {
+	var content bytes.Buffer
+	hs.mu.RLock()
+	err := gob.NewEncoder(&content).Encode(hnswSnapshot{
+		Config:     hs.config,
+		Nodes:      hs.nodes,
+		EntryPoint: hs.entryPoint,
+		MaxLevel:   hs.maxLevel,
+	})
+	hs.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content.Bytes())
+}
+
+// Restore replaces the graph of the store with the one of the snapshot at path.
+func (hs *HNSWVectorStore) Restore(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var snapshot hnswSnapshot
+	if err := gob.NewDecoder(file).Decode(&snapshot); err != nil {
+		return fmt.Errorf("invalid HNSW snapshot %s: %w", path, err)
+	}
+	if snapshot.Config.Metric != hs.config.Metric {
+		return fmt.Errorf("HNSW snapshot %s uses the %s metric, the store uses %s", path, snapshot.Config.Metric, hs.config.Metric)
+	}
+	ids := make(map[string]int, len(snapshot.Nodes))
+	deleted := 0
+	for index, node := range snapshot.Nodes {
+		ids[node.ID] = index
+		if node.Deleted {
+			deleted++
+		}
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.nodes = snapshot.Nodes
+	hs.ids = ids
+	hs.entryPoint = snapshot.EntryPoint
+	hs.maxLevel = snapshot.MaxLevel
+	hs.deleted = deleted
+	return nil
+}
+
+// prepare copies embedding, normalizing it for the cosine metric so distances are a dot product.
+func (hs *HNSWVectorStore) prepare(embedding []float64) []float64 {
+	prepared := append([]float64(nil), embedding...)
+	if hs.config.Metric != Cosine {
+		return prepared
+	}
+	norm := math.Sqrt(dot(prepared, prepared))
+	if norm == 0 {
+		return prepared
+	}
+	for i := range prepared {
+		prepared[i] /= norm
+	}
+	return prepared
+}
+
+func (hs *HNSWVectorStore) distance(a, b []float64) float64 {
+	if hs.config.Metric == Cosine {
+		return 1 - dot(a, b)
+	}
+	return hs.config.Metric.Distance(a, b)
+}
+
+func (hs *HNSWVectorStore) maxNeighbors(level int) int {
+	if level == 0 {
+		return 2 * hs.config.M
+	}
+	return hs.config.M
+}
+
+// insert adds node to the graph, hs.mu must be held by the caller.
+func (hs *HNSWVectorStore) insert(node *hnswNode) {
+	index := len(hs.nodes)
+	node.Level = int(-math.Log(1-hs.rng.Float64()) * hs.levelMult)
+	node.Neighbors = make([][]int, node.Level+1)
+	hs.nodes = append(hs.nodes, node)
+	hs.ids[node.ID] = index
+	if hs.entryPoint < 0 {
+		hs.entryPoint, hs.maxLevel = index, node.Level
+		return
+	}
+	if len(node.Embedding) != len(hs.nodes[hs.entryPoint].Embedding) {
+		// Nodes of another dimension can not be linked, they are stored but never returned
+		node.Deleted = true
+		hs.deleted++
+		return
+	}
+
+	entryPoints := []int{hs.entryPoint}
+	for level := hs.maxLevel; level > node.Level; level-- {
+		entryPoints = []int{hs.searchLayer(node.Embedding, entryPoints, 1, level, nil)[0].node}
+	}
+	for level := min(hs.maxLevel, node.Level); level >= 0; level-- {
+		candidates := hs.searchLayer(node.Embedding, entryPoints, hs.config.EfConstruction, level, nil)
+		neighbors := hs.selectNeighbors(candidates, hs.config.M)
+		node.Neighbors[level] = neighbors
+		for _, neighbor := range neighbors {
+			hs.link(neighbor, index, level)
+		}
+		entryPoints = entryPoints[:0]
+		for _, candidate := range candidates {
+			entryPoints = append(entryPoints, candidate.node)
+		}
+	}
+	if node.Level > hs.maxLevel {
+		hs.entryPoint, hs.maxLevel = index, node.Level
+	}
+}
+
+// compact rebuilds the graph from the live nodes so the deleted ones free their memory,
+// hs.mu must be held by the caller.
+func (hs *HNSWVectorStore) compact() {
+	nodes := hs.nodes
+	hs.nodes = make([]*hnswNode, 0, len(nodes)-hs.deleted)
+	hs.ids = make(map[string]int, len(nodes)-hs.deleted)
+	hs.entryPoint, hs.maxLevel, hs.deleted = -1, 0, 0
+	for _, node := range nodes {
+		if !node.Deleted {
+			hs.insert(&hnswNode{ID: node.ID, Embedding: node.Embedding, Metadata: node.Metadata, Document: node.Document})
+		}
+	}
+}
+
+// link adds target to the neighbors of index on level, pruning them when there are too many.
+func (hs *HNSWVectorStore) link(index, target, level int) {
+	node := hs.nodes[index]
+	node.Neighbors[level] = append(node.Neighbors[level], target)
+	if len(node.Neighbors[level]) <= hs.maxNeighbors(level) {
+		return
+	}
+	candidates := make([]hnswCandidate, len(node.Neighbors[level]))
+	for i, neighbor := range node.Neighbors[level] {
+		candidates[i] = hnswCandidate{node: neighbor, distance: hs.distance(node.Embedding, hs.nodes[neighbor].Embedding)}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+	node.Neighbors[level] = hs.selectNeighbors(candidates, hs.maxNeighbors(level))
+}
+
+// selectNeighbors picks up to m neighbors out of candidates sorted by distance, preferring
+// candidates which are not closer to an already selected neighbor than to the node, so the
+// graph keeps links in every direction. Pruned candidates fill up the remaining slots.
+func (hs *HNSWVectorStore) selectNeighbors(candidates []hnswCandidate, m int) []int {
+	selected := make([]int, 0, m)
+	var pruned []int
+	for _, candidate := range candidates {
+		if len(selected) >= m {
+			break
+		}
+		diverse := true
+		for _, neighbor := range selected {
+			if hs.distance(hs.nodes[candidate.node].Embedding, hs.nodes[neighbor].Embedding) < candidate.distance {
+				diverse = false
+				break
+			}
+		}
+		if diverse {
+			selected = append(selected, candidate.node)
+		} else {
+			pruned = append(pruned, candidate.node)
+		}
+	}
+	for _, node := range pruned {
+		if len(selected) >= m {
+			break
+		}
+		selected = append(selected, node)
+	}
+	return selected
+}
+
+// searchLayer returns up to ef nodes of level closest to query, closest first. When accept is
+// set only the accepted nodes are returned, the others are still expanded to walk the graph,
+// so the walk goes on until ef accepted nodes are found however selective accept is.
+func (hs *HNSWVectorStore) searchLayer(query []float64, entryPoints []int, ef, level int, accept func(int) bool) []hnswCandidate {
+	visited := hs.acquireVisited()
+	defer hs.visited.Put(visited)
+	candidates := &candidateHeap{}
+	results := &candidateHeap{farthestFirst: true}
+	for _, entryPoint := range entryPoints {
+		visited.visit(entryPoint)
+		candidate := hnswCandidate{node: entryPoint, distance: hs.distance(query, hs.nodes[entryPoint].Embedding)}
+		heap.Push(candidates, candidate)
+		if accept == nil || accept(entryPoint) {
+			heap.Push(results, candidate)
+		}
+	}
+	for candidates.Len() > 0 {
+		closest := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && closest.distance > results.items[0].distance {
+			break
+		}
+		for _, neighbor := range hs.nodes[closest.node].Neighbors[level] {
+			if !visited.visit(neighbor) {
+				continue
+			}
+			distance := hs.distance(query, hs.nodes[neighbor].Embedding)
+			if results.Len() >= ef && distance >= results.items[0].distance {
+				continue
+			}
+			heap.Push(candidates, hnswCandidate{node: neighbor, distance: distance})
+			if accept != nil && !accept(neighbor) {
+				continue
+			}
+			heap.Push(results, hnswCandidate{node: neighbor, distance: distance})
+			if results.Len() > ef {
+				heap.Pop(results)
+			}
+		}
+	}
+	sorted := make([]hnswCandidate, results.Len())
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(results).(hnswCandidate)
+	}
+	return sorted
+}
+
+// visitedSet marks the nodes visited by a search. It is cleared by moving to the next
+// generation, so reusing it costs nothing however many nodes the graph has.
+type visitedSet struct {
+	marks      []uint32
+	generation uint32
+}
+
+// acquireVisited returns an empty visitedSet covering every node of the graph.
+func (hs *HNSWVectorStore) acquireVisited() *visitedSet {
+	visited, _ := hs.visited.Get().(*visitedSet)
+	if visited == nil {
+		visited = &visitedSet{}
+	}
+	if len(visited.marks) < len(hs.nodes) {
+		visited.marks = append(visited.marks, make([]uint32, len(hs.nodes)-len(visited.marks))...)
+	}
+	visited.generation++
+	if visited.generation == 0 {
+		clear(visited.marks)
+		visited.generation = 1
+	}
+	return visited
+}
+
+// visit marks node as visited, it reports whether it was not visited yet.
+func (vs *visitedSet) visit(node int) bool {
+	if vs.marks[node] == vs.generation {
+		return false
+	}
+	vs.marks[node] = vs.generation
+	return true
+}
+
+type hnswCandidate struct {
+	node     int
+	distance float64
+}
+
+// candidateHeap is a min-heap of candidates by distance, or a max-heap when farthestFirst is set.
+type candidateHeap struct {
+	items         []hnswCandidate
+	farthestFirst bool
+}
+
+func (ch *candidateHeap) Len() int { return len(ch.items) }
+
+func (ch *candidateHeap) Less(i, j int) bool {
+	if ch.farthestFirst {
+		return ch.items[i].distance > ch.items[j].distance
+	}
+	return ch.items[i].distance < ch.items[j].distance
+}
+
+func (ch *candidateHeap) Swap(i, j int) { ch.items[i], ch.items[j] = ch.items[j], ch.items[i] }
+
+func (ch *candidateHeap) Push(x interface{}) { ch.items = append(ch.items, x.(hnswCandidate)) }
+
+func (ch *candidateHeap) Pop() interface{} {
+	last := ch.items[len(ch.items)-1]
+	ch.items = ch.items[:len(ch.items)-1]
+	return last
+}
@@ -0,0 +1,313 @@
+package vector_stores
+
+import (
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func randomEmbeddings(rng *rand.Rand, count, dimension int) [][]float64 {
+	embeddings := make([][]float64, count)
+	for i := range embeddings {
+		embeddings[i] = make([]float64, dimension)
+		for j := range embeddings[i] {
+			embeddings[i][j] = rng.NormFloat64()
+		}
+	}
+	return embeddings
+}
+
+// clusteredEmbeddings mimics text embeddings, which gather around topics instead of being
+// spread uniformly over every dimension.
+func clusteredEmbeddings(rng *rand.Rand, count, dimension, clusters int) [][]float64 {
+	centers := randomEmbeddings(rng, clusters, dimension)
+	embeddings := randomEmbeddings(rng, count, dimension)
+	for _, embedding := range embeddings {
+		center := centers[rng.Intn(clusters)]
+		for j := range embedding {
+			embedding[j] = center[j] + 0.6*embedding[j]
+		}
+	}
+	return embeddings
+}
+
+// recall returns the share of the exact results found by the approximate search.
+func recall(exact, approximate []string) float64 {
+	found := make(map[string]bool, len(approximate))
+	for _, id := range approximate {
+		found[id] = true
+	}
+	hits := 0
+	for _, id := range exact {
+		if found[id] {
+			hits++
+		}
+	}
+	return float64(hits) / float64(len(exact))
+}
+
+// buildStores adds the same embeddings to an exact and an HNSW store.
+func buildStores(embeddings [][]float64, config HNSWConfig) (*MemoryVectorStore, *HNSWVectorStore, map[string]string) {
+	exact := NewMemoryVectorStore(config.Metric)
+	approximate := NewHNSWVectorStore(config)
+	// The stores generate their own IDs, map the HNSW ones to the exact ones
+	ids := make(map[string]string, len(embeddings))
+	for i, embedding := range embeddings {
+		ids[approximate.Add(embedding, map[string]interface{}{"i": i})] = exact.Add(embedding, map[string]interface{}{"i": i})
+	}
+	return exact, approximate, ids
+}
+
+func averageRecall(exact *MemoryVectorStore, approximate *HNSWVectorStore, ids map[string]string, queries [][]float64, topN int) float64 {
+	var total float64
+	for _, query := range queries {
+		exactIds, _ := exact.Search(query, topN, false, nil)
+		approximateIds, _ := approximate.Search(query, topN, false, nil)
+		for i, id := range approximateIds {
+			approximateIds[i] = ids[id]
+		}
+		total += recall(exactIds, approximateIds)
+	}
+	return total / float64(len(queries))
+}
+
+func TestHNSWVectorStoreRecall(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	embeddings := randomEmbeddings(rng, 2000, 32)
+	queries := randomEmbeddings(rng, 50, 32)
+	for _, metric := range []DistanceMetric{Cosine, L2} {
+		exact, approximate, ids := buildStores(embeddings, HNSWConfig{Metric: metric})
+		if r := averageRecall(exact, approximate, ids, queries, 10); r < 0.9 {
+			t.Errorf("expected a %s recall@10 of at least 0.9, got %v", metric, r)
+		}
+	}
+}
+
+func TestHNSWVectorStoreDistances(t *testing.T) {
+	store := NewHNSWVectorStore(HNSWConfig{Metric: L2})
+	near := store.Add([]float64{1, 1}, nil)
+	far := store.Add([]float64{5, 5}, nil)
+	store.Add([]float64{10, 10}, nil)
+
+	ids, distances := store.Search([]float64{1, 2}, 2, true, nil)
+	if len(ids) != 2 || ids[0] != near || ids[1] != far {
+		t.Fatalf("expected [%s %s], got %v", near, far, ids)
+	}
+	if !almostEqual(distances[0], 1) || !almostEqual(distances[1], 25) {
+		t.Errorf("expected distances [1 25], got %v", distances)
+	}
+
+	cosine := NewHNSWVectorStore(HNSWConfig{})
+	cosine.Add([]float64{2, 0}, nil)
+	_, distances = cosine.Search([]float64{1, 1}, 1, true, nil)
+	if want := Cosine.Distance([]float64{2, 0}, []float64{1, 1}); len(distances) != 1 || !almostEqual(distances[0], want) {
+		t.Errorf("expected distance %v, got %v", want, distances)
+	}
+	if ids, _ := cosine.Search([]float64{1, 1, 1}, 1, true, nil); len(ids) != 0 {
+		t.Errorf("expected no match for another dimension, got %v", ids)
+	}
+}
+
+func TestHNSWVectorStoreMetadataFilter(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	store := NewHNSWVectorStore(HNSWConfig{})
+	for _, embedding := range randomEmbeddings(rng, 500, 8) {
+		store.Add(embedding, map[string]interface{}{"model": "claude"})
+	}
+	gpt := store.Add([]float64{1, 0, 0, 0, 0, 0, 0, 0}, map[string]interface{}{"model": "gpt-4o", "version": 1})
+
+	ids, _ := store.Search([]float64{0, 1, 0, 0, 0, 0, 0, 0}, 10, false, map[string]interface{}{"model": "gpt-4o", "version": 1})
+	if len(ids) != 1 || ids[0] != gpt {
+		t.Errorf("expected [%s], got %v", gpt, ids)
+	}
+	ids, _ = store.Search([]float64{1, 0, 0, 0, 0, 0, 0, 0}, 10, false, map[string]interface{}{"model": "gemini"})
+	if len(ids) != 0 {
+		t.Errorf("expected no match, got %v", ids)
+	}
+}
+
+func TestHNSWVectorStoreSelectiveFilter(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	exact := NewMemoryVectorStore(Cosine)
+	store := NewHNSWVectorStore(HNSWConfig{})
+	ids := make(map[string]string)
+	for i, embedding := range randomEmbeddings(rng, 2000, 16) {
+		// One entry out of fifty matches the filter
+		metadata := map[string]interface{}{"tenant": i % 50}
+		ids[store.Add(embedding, metadata)] = exact.Add(embedding, metadata)
+	}
+	filter := map[string]interface{}{"tenant": 0}
+	for _, query := range randomEmbeddings(rng, 10, 16) {
+		want, _ := exact.Search(query, 10, false, filter)
+		got, _ := store.Search(query, 10, false, filter)
+		for i, id := range got {
+			got[i] = ids[id]
+		}
+		if len(got) != 10 || recall(want, got) < 0.9 {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestHNSWVectorStoreDelete(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	store := NewHNSWVectorStore(HNSWConfig{})
+	var added []string
+	for _, embedding := range randomEmbeddings(rng, 200, 8) {
+		added = append(added, store.Add(embedding, nil))
+	}
+	query := randomEmbeddings(rng, 1, 8)[0]
+	before, _ := store.Search(query, 5, false, nil)
+	if !store.Delete(before[0]) {
+		t.Fatalf("expected %s to be deleted", before[0])
+	}
+	if store.Delete(before[0]) || store.Delete("missing") {
+		t.Error("expected deleting a deleted or missing entry to fail")
+	}
+	if store.Len() != len(added)-1 {
+		t.Errorf("expected %d entries, got %d", len(added)-1, store.Len())
+	}
+	after, _ := store.Search(query, 5, false, nil)
+	if len(after) != 5 || after[0] == before[0] || after[0] != before[1] {
+		t.Errorf("expected the deleted entry to be skipped, got %v before %v", after, before)
+	}
+	if _, ok := store.Metadata(before[0]); ok {
+		t.Error("expected no metadata for a deleted entry")
+	}
+}
+
+func TestHNSWVectorStoreCompaction(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	store := NewHNSWVectorStore(HNSWConfig{})
+	var added []string
+	for _, embedding := range randomEmbeddings(rng, 200, 8) {
+		added = append(added, store.Add(embedding, map[string]interface{}{"tenant": "a"}))
+	}
+	for _, id := range added[:101] {
+		store.Delete(id)
+	}
+	// The tombstones outnumbered the live entries, the graph only keeps the live ones
+	if len(store.nodes) != 99 || store.deleted != 0 || store.Len() != 99 {
+		t.Errorf("expected 99 nodes without tombstones, got %d with %d deleted", len(store.nodes), store.deleted)
+	}
+	if _, ok := store.Metadata(added[100]); ok {
+		t.Error("expected no metadata for a deleted entry")
+	}
+	exact := NewMemoryVectorStore(Cosine)
+	ids := make(map[string]string)
+	for _, id := range added[101:] {
+		node := store.nodes[store.ids[id]]
+		ids[id] = exact.Add(node.Embedding, node.Metadata)
+	}
+	if average := averageRecall(exact, store, ids, randomEmbeddings(rng, 20, 8), 5); average < 0.95 {
+		t.Errorf("expected the rebuilt graph to keep its recall, got %.2f", average)
+	}
+}
+
+func TestHNSWVectorStoreSnapshotRestore(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	store := NewHNSWVectorStore(HNSWConfig{})
+	for _, embedding := range randomEmbeddings(rng, 300, 16) {
+		store.Add(embedding, map[string]interface{}{"tenant": "a"})
+	}
+	deleted, _ := store.Search(randomEmbeddings(rng, 1, 16)[0], 1, false, nil)
+	store.Delete(deleted[0])
+	document := randomEmbeddings(rng, 1, 16)[0]
+	documentId := store.AddDocument(document, "completion", map[string]interface{}{"tenant": "b"})
+	path := filepath.Join(t.TempDir(), "hnsw.gob")
+	if err := store.Snapshot(path); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+
+	restored := NewHNSWVectorStore(HNSWConfig{})
+	if err := restored.Restore(path); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if restored.Len() != store.Len() {
+		t.Errorf("expected %d entries, got %d", store.Len(), restored.Len())
+	}
+	for _, query := range randomEmbeddings(rng, 10, 16) {
+		want, _ := store.Search(query, 5, false, map[string]interface{}{"tenant": "a"})
+		got, _ := restored.Search(query, 5, false, map[string]interface{}{"tenant": "a"})
+		if len(got) != len(want) || recall(want, got) != 1 {
+			t.Errorf("expected %v after restore, got %v", want, got)
+		}
+	}
+	if results := restored.SearchDocuments(document, 1, map[string]interface{}{"tenant": "b"}); len(results) != 1 ||
+		results[0].ID != documentId || results[0].Document != "completion" {
+		t.Errorf("expected %s with its document, got %+v", documentId, results)
+	}
+	// Inserts keep working on a restored graph
+	id := restored.Add([]float64{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nil)
+	if ids, _ := restored.Search([]float64{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 1, false, nil); len(ids) != 1 || ids[0] != id {
+		t.Errorf("expected [%s], got %v", id, ids)
+	}
+
+	if err := NewHNSWVectorStore(HNSWConfig{Metric: L2}).Restore(path); err == nil {
+		t.Error("expected restoring a snapshot of another metric to fail")
+	}
+}
+
+func TestHNSWVectorStoreConcurrency(t *testing.T) {
+	store := NewHNSWVectorStore(HNSWConfig{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(i)))
+			for _, embedding := range randomEmbeddings(rng, 50, 8) {
+				id := store.Add(embedding, nil)
+				store.Search(embedding, 3, true, nil)
+				if rng.Intn(4) == 0 {
+					store.Delete(id)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if ids, _ := store.Search([]float64{1, 0, 0, 0, 0, 0, 0, 0}, 1000, false, nil); len(ids) != store.Len() {
+		t.Errorf("expected the %d live entries, got %d", store.Len(), len(ids))
+	}
+}
+
+// benchmarkFixture is built once, inserting 10k embeddings takes a while.
+var benchmarkFixture struct {
+	once        sync.Once
+	exact       *MemoryVectorStore
+	approximate *HNSWVectorStore
+	ids         map[string]string
+	queries     [][]float64
+}
+
+// benchmarkSearch compares the latency and recall of the exact and HNSW searches, run with
+// go test -run ^$ -bench Search ./vector_stores
+func benchmarkSearch(b *testing.B, efSearch int, useExact bool) {
+	fixture := &benchmarkFixture
+	fixture.once.Do(func() {
+		rng := rand.New(rand.NewSource(1))
+		embeddings := clusteredEmbeddings(rng, 10100, 128, 100)
+		fixture.exact, fixture.approximate, fixture.ids = buildStores(embeddings[:10000], HNSWConfig{Metric: Cosine})
+		fixture.queries = embeddings[10000:]
+	})
+	fixture.approximate.config.EfSearch = efSearch
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		query := fixture.queries[i%len(fixture.queries)]
+		if useExact {
+			fixture.exact.Search(query, 10, true, nil)
+		} else {
+			fixture.approximate.Search(query, 10, true, nil)
+		}
+	}
+	b.StopTimer()
+	if !useExact {
+		b.ReportMetric(averageRecall(fixture.exact, fixture.approximate, fixture.ids, fixture.queries, 10), "recall@10")
+	}
+}
+
+func BenchmarkExactSearch(b *testing.B)     { benchmarkSearch(b, 0, true) }
+func BenchmarkHNSWSearchEf32(b *testing.B)  { benchmarkSearch(b, 32, false) }
+func BenchmarkHNSWSearchEf64(b *testing.B)  { benchmarkSearch(b, 64, false) }
+func BenchmarkHNSWSearchEf128(b *testing.B) { benchmarkSearch(b, 128, false) }
@@ -0,0 +1,266 @@
+package vector_stores
+
+import (
+	"bifrost/utils"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// DistanceMetric is how the distance between two embeddings is measured, lower is closer.
+// The values follow the Chroma conventions so thresholds carry over between stores.
+type DistanceMetric string
+
+const (
+	// Cosine is 1 - the cosine similarity of the embeddings
+	Cosine DistanceMetric = "cosine"
+	// DotProduct is 1 - the dot product of the embeddings
+	DotProduct DistanceMetric = "ip"
+	// L2 is the squared euclidean distance between the embeddings
+	L2 DistanceMetric = "l2"
+)
+
+// Distance returns the distance between a and b, both must have the same dimension.
+func (dm DistanceMetric) Distance(a, b []float64) float64 {
+	switch dm {
+	case DotProduct:
+		return 1 - dot(a, b)
+	case L2:
+		var sum float64
+		for i := range a {
+			diff := a[i] - b[i]
+			sum += diff * diff
+		}
+		return sum
+	default:
+		normA, normB := math.Sqrt(dot(a, a)), math.Sqrt(dot(b, b))
+		if normA == 0 || normB == 0 {
+			return 1
+		}
+		return 1 - dot(a, b)/(normA*normB)
+	}
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// MemoryVectorStore implements DocumentStoreInterface with an exact search over embeddings kept in memory.
+type MemoryVectorStore struct {
+	metric  DistanceMetric
+	mu      sync.RWMutex
+	entries map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	ID        string                 `json:"id"`
+	Embedding []float64              `json:"embedding"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Document  string                 `json:"document,omitempty"`
+}
+
+// memorySnapshot is the file format of Snapshot and Restore.
+type memorySnapshot struct {
+	Metric  DistanceMetric `json:"metric"`
+	Entries []*memoryEntry `json:"entries"`
+}
+
+// NewMemoryVectorStore creates an empty in-memory vector store measuring distances with metric.
+func NewMemoryVectorStore(metric DistanceMetric) *MemoryVectorStore {
+	return &MemoryVectorStore{
+		metric:  metric,
+		entries: make(map[string]*memoryEntry),
+	}
+}
+
+// Add stores embedding with options as its metadata and returns the ID of the entry.
+func (ms *MemoryVectorStore) Add(embedding []float64, options map[string]interface{}) string {
+	return ms.AddDocument(embedding, "", options)
+}
+
+// AddDocument stores embedding and document with options as its metadata and returns the ID of the entry.
+func (ms *MemoryVectorStore) AddDocument(embedding []float64, document string, options map[string]interface{}) string {
+	entry := &memoryEntry{
+		ID:        utils.GetQueryIndex(nil),
+		Embedding: append([]float64(nil), embedding...),
+		Metadata:  normalizeMetadata(options),
+		Document:  document,
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.entries[entry.ID] = entry
+	return entry.ID
+}
+
+// Search returns the IDs of the topN entries closest to embedding whose metadata has all the
+// values of options, closest first. Distances are only returned when includeDistances is set.
+func (ms *MemoryVectorStore) Search(embedding []float64, topN int, includeDistances bool, options map[string]interface{}) ([]string, []float64) {
+	return splitResults(ms.SearchDocuments(embedding, topN, options), includeDistances)
+}
+
+// SearchDocuments returns the topN entries closest to embedding whose metadata has all the
+// values of options, closest first.
+func (ms *MemoryVectorStore) SearchDocuments(embedding []float64, topN int, options map[string]interface{}) []SearchResult {
+	filter := normalizeMetadata(options)
+	var results []SearchResult
+	ms.mu.RLock()
+	for _, entry := range ms.entries {
+		if len(entry.Embedding) != len(embedding) || !matchesFilter(entry.Metadata, filter) {
+			continue
+		}
+		results = append(results, SearchResult{
+			ID:       entry.ID,
+			Distance: ms.metric.Distance(embedding, entry.Embedding),
+			Document: entry.Document,
+		})
+	}
+	ms.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Distance < results[j].Distance
+	})
+	if topN >= 0 && len(results) > topN {
+		results = results[:topN]
+	}
+	return results
+}
+
+// Delete removes the entry with id, it reports whether the entry existed.
+func (ms *MemoryVectorStore) Delete(id string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, ok := ms.entries[id]
+	delete(ms.entries, id)
+	return ok
+}
+
+// DeleteDocument removes the entry id, the options are not needed to find it.
+func (ms *MemoryVectorStore) DeleteDocument(id string, _ map[string]interface{}) bool {
+	return ms.Delete(id)
+}
+
+// Metadata returns the metadata stored with the entry id.
+func (ms *MemoryVectorStore) Metadata(id string) (map[string]interface{}, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	entry, ok := ms.entries[id]
+	if !ok {
+		return nil, false
+	}
+	return entry.Metadata, true
+}
+
+// Len returns the number of entries in the store.
+func (ms *MemoryVectorStore) Len() int {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return len(ms.entries)
+}
+
+// Snapshot writes all the entries to path. The file is replaced atomically so a crash never
+// leaves a partial snapshot behind.
+func (ms *MemoryVectorStore) Snapshot(path string) error {
+	ms.mu.RLock()
+	snapshot := memorySnapshot{Metric: ms.metric, Entries: make([]*memoryEntry, 0, len(ms.entries))}
+	for _, entry := range ms.entries {
+		snapshot.Entries = append(snapshot.Entries, entry)
+	}
+	content, err := json.Marshal(snapshot)
+	ms.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// Restore replaces the entries of the store with the ones of the snapshot at path.
+func (ms *MemoryVectorStore) Restore(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return fmt.Errorf("invalid vector store snapshot %s: %w", path, err)
+	}
+	if snapshot.Metric != ms.metric {
+		return fmt.Errorf("vector store snapshot %s uses the %s metric, the store uses %s", path, snapshot.Metric, ms.metric)
+	}
+	entries := make(map[string]*memoryEntry, len(snapshot.Entries))
+	for _, entry := range snapshot.Entries {
+		entries[entry.ID] = entry
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.entries = entries
+	return nil
+}
+
+// splitResults returns the IDs of results, and their distances when includeDistances is set.
+func splitResults(results []SearchResult, includeDistances bool) ([]string, []float64) {
+	ids := make([]string, len(results))
+	var distances []float64
+	if includeDistances {
+		distances = make([]float64, len(results))
+	}
+	for i, result := range results {
+		ids[i] = result.ID
+		if includeDistances {
+			distances[i] = result.Distance
+		}
+	}
+	return ids, distances
+}
+
+// normalizeMetadata gives metadata the types it has after a JSON round trip, so that filters
+// match the same way before and after a snapshot is restored.
+func normalizeMetadata(metadata map[string]interface{}) map[string]interface{} {
+	if len(metadata) == 0 {
+		return nil
+	}
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return metadata
+	}
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(content, &normalized); err != nil {
+		return metadata
+	}
+	return normalized
+}
+
+// matchesFilter reports whether metadata has all the values of filter.
+func matchesFilter(metadata, filter map[string]interface{}) bool {
+	for key, value := range filter {
+		stored, ok := metadata[key]
+		if !ok || !reflect.DeepEqual(stored, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
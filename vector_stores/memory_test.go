@@ -0,0 +1,123 @@
+package vector_stores
+
+import (
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestDistanceMetrics(t *testing.T) {
+	a, b := []float64{1, 0}, []float64{0, 1}
+	if d := Cosine.Distance(a, b); !almostEqual(d, 1) {
+		t.Errorf("expected cosine distance 1, got %v", d)
+	}
+	if d := Cosine.Distance(a, []float64{2, 0}); !almostEqual(d, 0) {
+		t.Errorf("expected cosine distance 0, got %v", d)
+	}
+	if d := DotProduct.Distance(a, []float64{0.5, 0}); !almostEqual(d, 0.5) {
+		t.Errorf("expected dot product distance 0.5, got %v", d)
+	}
+	if d := L2.Distance(a, b); !almostEqual(d, 2) {
+		t.Errorf("expected l2 distance 2, got %v", d)
+	}
+}
+
+func TestMemoryVectorStoreSearch(t *testing.T) {
+	store := NewMemoryVectorStore(L2)
+	near := store.Add([]float64{1, 1}, nil)
+	far := store.Add([]float64{5, 5}, nil)
+	store.Add([]float64{10, 10}, nil)
+
+	ids, distances := store.Search([]float64{1, 2}, 2, true, nil)
+	if len(ids) != 2 || ids[0] != near || ids[1] != far {
+		t.Fatalf("expected [%s %s], got %v", near, far, ids)
+	}
+	if !almostEqual(distances[0], 1) || !almostEqual(distances[1], 25) {
+		t.Errorf("expected distances [1 25], got %v", distances)
+	}
+
+	ids, distances = store.Search([]float64{1, 2}, 10, false, nil)
+	if len(ids) != 3 || distances != nil {
+		t.Errorf("expected 3 ids without distances, got %v %v", ids, distances)
+	}
+}
+
+func TestMemoryVectorStoreMetadataFilter(t *testing.T) {
+	store := NewMemoryVectorStore(Cosine)
+	gpt := store.Add([]float64{1, 0}, map[string]interface{}{"model": "gpt-4o", "tenant": "a", "version": 1})
+	store.Add([]float64{1, 0}, map[string]interface{}{"model": "claude", "tenant": "a", "version": 1})
+
+	ids, _ := store.Search([]float64{1, 0}, 10, false, map[string]interface{}{"model": "gpt-4o", "version": 1})
+	if len(ids) != 1 || ids[0] != gpt {
+		t.Errorf("expected [%s], got %v", gpt, ids)
+	}
+	ids, _ = store.Search([]float64{1, 0}, 10, false, map[string]interface{}{"tenant": "b"})
+	if len(ids) != 0 {
+		t.Errorf("expected no ids, got %v", ids)
+	}
+	metadata, ok := store.Metadata(gpt)
+	if !ok || metadata["model"] != "gpt-4o" {
+		t.Errorf("expected the stored metadata, got %v", metadata)
+	}
+}
+
+func TestMemoryVectorStoreDelete(t *testing.T) {
+	store := NewMemoryVectorStore(Cosine)
+	id := store.Add([]float64{1, 0}, nil)
+
+	if !store.Delete(id) {
+		t.Error("expected the entry to be deleted")
+	}
+	if store.Delete(id) {
+		t.Error("expected the entry to be already deleted")
+	}
+	if ids, _ := store.Search([]float64{1, 0}, 1, false, nil); len(ids) != 0 {
+		t.Errorf("expected no ids, got %v", ids)
+	}
+}
+
+func TestMemoryVectorStoreSnapshotRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vectors.json")
+	store := NewMemoryVectorStore(DotProduct)
+	id := store.AddDocument([]float64{0.6, 0.8}, "completion", map[string]interface{}{"model": "gpt-4o", "version": 2})
+	if err := store.Snapshot(path); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+
+	restored := NewMemoryVectorStore(DotProduct)
+	if err := restored.Restore(path); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	results := restored.SearchDocuments([]float64{0.6, 0.8}, 1, map[string]interface{}{"version": 2})
+	if restored.Len() != 1 || len(results) != 1 || results[0].ID != id || results[0].Document != "completion" {
+		t.Errorf("expected %s with its document, got %+v", id, results)
+	}
+
+	if err := NewMemoryVectorStore(L2).Restore(path); err == nil {
+		t.Error("expected an error restoring a snapshot of another metric")
+	}
+}
+
+func TestMemoryVectorStoreConcurrency(t *testing.T) {
+	store := NewMemoryVectorStore(Cosine)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				store.Add([]float64{float64(i), float64(j)}, nil)
+				store.Search([]float64{1, 1}, 5, true, nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if store.Len() != 1000 {
+		t.Errorf("expected 1000 entries, got %d", store.Len())
+	}
+}